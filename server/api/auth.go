@@ -1 +1,228 @@
 package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/types"
+	"github.com/ankylat/anky/server/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Authentication
+//
+// Requests carry a Bearer token in their Authorization header: either one of our access tokens,
+// valid as long as its session is active (see services.AuthService), or the access token of
+// their Privy session. The authenticate middleware resolves the token to the user and keeps the
+// user in the request context, then each route says who may call it:
+//
+//   - requireUser: any signed in user
+//   - requireSelf: the user of the {userId} path parameter
+//   - requireAdmin: admins only, like the lists of all the users and all the Ankys
+//
+// Admins pass requireSelf too. Handlers that get the user from the body, or work on a writing
+// session or an Anky, check its owner with authorizeUser. Browsers can't set headers on a
+// WebSocket, so the upgrade to /ws/writing can send the token as the access_token parameter.
+
+var (
+	errUnauthenticated = errors.New("missing or invalid authorization token")
+	errForbidden       = errors.New("not allowed to access another user's data")
+)
+
+type contextKey string
+
+const (
+	userContextKey    contextKey = "user"
+	sessionContextKey contextKey = "session"
+)
+
+// authenticate puts the user of the request's token in its context. Requests without a valid
+// token go on without a user, and the routes that need one turn them away.
+func (s *APIServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, session, err := s.resolveToken(r.Context(), token)
+		if err != nil {
+			log.Printf("Rejected the token of %s %s: %v", r.Method, r.URL.Path, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		if session != nil {
+			ctx = context.WithValue(ctx, sessionContextKey, session)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// resolveToken finds the user of one of our access tokens and its session, or else the user
+// of a Privy token, who has no session with us
+func (s *APIServer) resolveToken(ctx context.Context, token string) (*types.User, *types.Session, error) {
+	session, err := s.auth.Authenticate(ctx, token)
+	if err == nil {
+		user, err := s.store.GetUserByID(ctx, session.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, session, nil
+	}
+
+	if s.privy == nil {
+		return nil, nil, err
+	}
+	did, privyErr := s.privy.Verify(ctx, token)
+	if privyErr != nil {
+		return nil, nil, fmt.Errorf("invalid token (%v) and invalid Privy token (%v)", err, privyErr)
+	}
+	user, err := s.store.GetUserByPrivyDID(ctx, did)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no user linked to Privy user %s", did)
+	}
+	return user, nil, nil
+}
+
+// authUser is the user who sent the request, nil if it wasn't authenticated
+func authUser(r *http.Request) *types.User {
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+	return user
+}
+
+// authSession is the session of the request's access token, nil for Privy tokens
+func authSession(r *http.Request) *types.Session {
+	session, _ := r.Context().Value(sessionContextKey).(*types.Session)
+	return session
+}
+
+// authorizeUser makes sure the caller is the user, or an admin
+func authorizeUser(r *http.Request, userID uuid.UUID) error {
+	user := authUser(r)
+	if user == nil {
+		return errUnauthenticated
+	}
+	if user.ID != userID && user.Role != types.UserRoleAdmin {
+		return errForbidden
+	}
+	return nil
+}
+
+// writeAuthError answers with 401 or 403 depending on the error of authorizeUser
+func writeAuthError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errUnauthenticated) {
+		return WriteJSON(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+	}
+	return WriteJSON(w, http.StatusForbidden, ApiError{Error: err.Error()})
+}
+
+func requireUser(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if authUser(r) == nil {
+			return writeAuthError(w, errUnauthenticated)
+		}
+		return f(w, r)
+	}
+}
+
+func requireSelf(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		userID, err := utils.GetUserID(r)
+		if err != nil {
+			return fmt.Errorf("invalid user ID: %v", err)
+		}
+		if err := authorizeUser(r, userID); err != nil {
+			return writeAuthError(w, err)
+		}
+		return f(w, r)
+	}
+}
+
+func requireAdmin(f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user := authUser(r)
+		if user == nil {
+			return writeAuthError(w, errUnauthenticated)
+		}
+		if user.Role != types.UserRoleAdmin {
+			return WriteJSON(w, http.StatusForbidden, ApiError{Error: "admins only"})
+		}
+		return f(w, r)
+	}
+}
+
+// ******************** Sessions ********************
+
+// POST /auth/refresh
+// Trades the refresh token for a new access token and a new refresh token. Clients from before
+// sessions send the JWT they got at registration instead, once.
+func (s *APIServer) handleRefreshSession(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	if req.RefreshToken == "" {
+		return fmt.Errorf("refresh_token is required")
+	}
+
+	tokens, err := s.auth.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, services.ErrInvalidRefreshToken) && strings.Count(req.RefreshToken, ".") == 2 {
+		tokens, err = s.auth.ExchangeLegacyToken(r.Context(), req.RefreshToken, r.UserAgent())
+	}
+	switch {
+	case errors.Is(err, services.ErrInvalidRefreshToken), errors.Is(err, services.ErrRefreshTokenReused):
+		return WriteJSON(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+	case err != nil:
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+// POST /auth/logout
+// Ends the session of the access token, or every session of the user with {"all": true}
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		All bool `json:"all"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return fmt.Errorf("invalid request body: %v", err)
+		}
+	}
+
+	session := authSession(r)
+	switch {
+	case req.All:
+		if err := s.auth.LogoutEverywhere(r.Context(), authUser(r).ID); err != nil {
+			return err
+		}
+	case session != nil:
+		if err := s.auth.Logout(r.Context(), session.ID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("signed in with Privy, there is no session to end")
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{"message": "signed out"})
+}
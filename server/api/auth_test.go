@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestRouteAuthorization(t *testing.T) {
+	owner := &types.User{ID: uuid.New(), Role: types.UserRoleUser}
+	other := &types.User{ID: uuid.New(), Role: types.UserRoleUser}
+	admin := &types.User{ID: uuid.New(), Role: types.UserRoleAdmin}
+
+	ok := func(w http.ResponseWriter, r *http.Request) error {
+		return WriteJSON(w, http.StatusOK, map[string]string{"ok": "ok"})
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/me", makeHTTPHandleFunc(requireUser(ok)))
+	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(requireSelf(ok)))
+	router.HandleFunc("/users", makeHTTPHandleFunc(requireAdmin(ok)))
+
+	tests := []struct {
+		name   string
+		path   string
+		caller *types.User
+		want   int
+	}{
+		{"signed in user", "/me", other, http.StatusOK},
+		{"anonymous request", "/me", nil, http.StatusUnauthorized},
+		{"own user", "/users/" + owner.ID.String(), owner, http.StatusOK},
+		{"another user", "/users/" + owner.ID.String(), other, http.StatusForbidden},
+		{"admin on another user", "/users/" + owner.ID.String(), admin, http.StatusOK},
+		{"anonymous on a user", "/users/" + owner.ID.String(), nil, http.StatusUnauthorized},
+		{"invalid user ID", "/users/not-a-uuid", owner, http.StatusBadRequest},
+		{"list as a user", "/users", owner, http.StatusForbidden},
+		{"list as an admin", "/users", admin, http.StatusOK},
+		{"list anonymously", "/users", nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.caller != nil {
+				req = req.WithContext(context.WithValue(req.Context(), userContextKey, tt.caller))
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		upgrade bool
+		want    string
+	}{
+		{name: "authorization header", header: "Bearer abc", want: "abc"},
+		{name: "no token", want: ""},
+		{name: "other scheme", header: "Basic abc", want: ""},
+		{name: "query on a websocket", query: "?access_token=abc", upgrade: true, want: "abc"},
+		{name: "query on a plain request", query: "?access_token=abc", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ws/writing"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			if got := bearerToken(req); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
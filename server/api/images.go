@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// uploadFormOverhead is what the multipart form adds around the image
+const uploadFormOverhead = 1 << 20
+
+// POST /images
+// Uploads an image of the caller as a multipart form: the file in "image", what it is for in
+// "kind" (profile_picture or anky_art) and, for Anky art, the Anky in "anky_id".
+func (s *APIServer) handleUploadImage(w http.ResponseWriter, r *http.Request) error {
+	userID := authUser(r).ID
+
+	imageService, err := services.NewImageService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating image service: %v", err)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(imageService.Limits.MaxBytes+uploadFormOverhead))
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return WriteJSON(w, http.StatusRequestEntityTooLarge, ApiError{Error: services.ErrImageTooLarge.Error()})
+		}
+		return fmt.Errorf("no image uploaded: %v", err)
+	}
+	defer file.Close()
+
+	// One byte over the limit is enough to know the image is too large
+	data, err := io.ReadAll(io.LimitReader(file, int64(imageService.Limits.MaxBytes+1)))
+	if err != nil {
+		return fmt.Errorf("error reading image: %v", err)
+	}
+
+	var ankyID *uuid.UUID
+	if value := r.FormValue("anky_id"); value != "" {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid anky_id: %v", err)
+		}
+		ankyID = &id
+	}
+
+	upload, err := imageService.UploadImage(r.Context(), userID, r.FormValue("kind"), ankyID, data)
+	switch {
+	case errors.Is(err, services.ErrImageTooLarge):
+		return WriteJSON(w, http.StatusRequestEntityTooLarge, ApiError{Error: err.Error()})
+	case errors.Is(err, services.ErrUnsupportedImage):
+		return WriteJSON(w, http.StatusUnsupportedMediaType, ApiError{Error: err.Error()})
+	case err != nil:
+		log.Printf("Error uploading image of user %s: %v", userID, err)
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, upload)
+}
+
+// GET /images/{id}
+func (s *APIServer) handleGetImage(w http.ResponseWriter, r *http.Request) error {
+	uploadID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return fmt.Errorf("invalid image ID: %v", err)
+	}
+
+	imageService, err := services.NewImageService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating image service: %v", err)
+	}
+	upload, err := imageService.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: "image not found"})
+	}
+
+	return WriteJSON(w, http.StatusOK, upload)
+}
+
+// DELETE /images/{id}
+// Only the user who uploaded the image can delete it.
+func (s *APIServer) handleDeleteImage(w http.ResponseWriter, r *http.Request) error {
+	userID := authUser(r).ID
+	uploadID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return fmt.Errorf("invalid image ID: %v", err)
+	}
+
+	imageService, err := services.NewImageService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating image service: %v", err)
+	}
+	err = imageService.DeleteImage(r.Context(), userID, uploadID)
+	if errors.Is(err, services.ErrNotUploadOwner) {
+		return WriteJSON(w, http.StatusForbidden, ApiError{Error: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"message": "Image deleted successfully"})
+}
@@ -0,0 +1,448 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// Live writing sessions over /ws/writing
+//
+// The client opens a session with session_start, then streams what is typed in
+// keystroke_batch messages. Every batch is appended to the session's raw file and to its
+// writing_sessions row, so nothing is lost if the app crashes. The server enforces the
+// 8-second rule itself: when no keystrokes arrive for MaxPauseMs (plus some slack for the
+// network) the session is closed and the client receives session_ended. heartbeat keeps
+// the client informed of what the server has stored, and session_end closes the session
+// explicitly. Only the connection that sent session_start for a session can write to it, and
+// only the user of the session can send session_start for it.
+
+// defaultLiveSessionGrace is the slack on top of the 8 seconds for batching and network latency
+const defaultLiveSessionGrace = 2 * time.Second
+
+const (
+	sessionEndedByPause  = "pause"
+	sessionEndedByClient = "client_ended"
+)
+
+type sessionStartPayload struct {
+	SessionID         uuid.UUID `json:"session_id"`
+	UserID            uuid.UUID `json:"user_id"`
+	Prompt            string    `json:"prompt"`
+	StartingTimestamp int64     `json:"starting_timestamp"` // epoch milliseconds
+	IsOnboarding      bool      `json:"is_onboarding"`
+}
+
+type keystrokeBatchPayload struct {
+	SessionID  uuid.UUID         `json:"session_id"`
+	Keystrokes []types.Keystroke `json:"keystrokes"`
+}
+
+type sessionRefPayload struct {
+	SessionID uuid.UUID `json:"session_id"`
+}
+
+type liveSession struct {
+	mu             sync.Mutex
+	client         *Client
+	writingSession *types.WritingSession
+	rawSession     *types.RawWritingSession
+	silenceTimer   *time.Timer
+	ended          bool
+
+	// startedAt is when the server opened the live session, and writtenBefore how much had
+	// already been written when it did (a session resumed after a restart). They bound how
+	// long the client can claim to have written.
+	startedAt     time.Time
+	writtenBefore time.Duration
+}
+
+type liveSessionManager struct {
+	server                *APIServer
+	writingSessionService *services.WritingSessionService
+	grace                 time.Duration
+
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*liveSession
+}
+
+func newLiveSessionManager(server *APIServer) *liveSessionManager {
+	grace := defaultLiveSessionGrace
+	if graceStr := os.Getenv("LIVE_SESSION_GRACE_MS"); graceStr != "" {
+		if graceMs, err := strconv.Atoi(graceStr); err == nil && graceMs >= 0 {
+			grace = time.Duration(graceMs) * time.Millisecond
+		}
+	}
+
+	return &liveSessionManager{
+		server:                server,
+		writingSessionService: services.NewWritingSessionService(),
+		grace:                 grace,
+		sessions:              make(map[uuid.UUID]*liveSession),
+	}
+}
+
+func decodeWSPayload(msg WSMessage, v any) error {
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid %s payload: %v", msg.Type, err)
+	}
+	if err := json.Unmarshal(payloadBytes, v); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", msg.Type, err)
+	}
+	return nil
+}
+
+func (m *liveSessionManager) get(sessionID uuid.UUID) (*liveSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no live session with ID %s", sessionID)
+	}
+	return session, nil
+}
+
+// checkAttached makes sure the client is the one that opened (or re-attached to) the session
+// with session_start. Callers hold session.mu.
+func (s *liveSession) checkAttached(c *Client) error {
+	if s.client != c {
+		return fmt.Errorf("send session_start for session %s first", s.rawSession.SessionID)
+	}
+	return nil
+}
+
+// handleSessionStart opens a live session, or re-attaches the client to it if it's still running
+func (m *liveSessionManager) handleSessionStart(c *Client, msg WSMessage) (*WSMessage, error) {
+	ctx := context.Background()
+
+	var payload sessionStartPayload
+	if err := decodeWSPayload(msg, &payload); err != nil {
+		return nil, err
+	}
+	// Sessions are written by the user who opened the connection
+	if payload.UserID == uuid.Nil {
+		payload.UserID = c.user.ID
+	}
+	if payload.SessionID == uuid.Nil {
+		return nil, fmt.Errorf("session_start requires a session_id")
+	}
+	if payload.UserID != c.user.ID {
+		return nil, errForbidden
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[payload.SessionID]; ok {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+
+		if session.writingSession.UserID != payload.UserID {
+			return nil, fmt.Errorf("session %s belongs to another user", payload.SessionID)
+		}
+		session.client = c
+		log.Printf("Client re-attached to live session %s", payload.SessionID)
+		return session.startedMessage(true), nil
+	}
+
+	startingTimestamp := time.Now().UTC()
+	if payload.StartingTimestamp != 0 {
+		startingTimestamp = time.UnixMilli(payload.StartingTimestamp).UTC()
+	}
+
+	rawSession, err := m.writingSessionService.StartRawSession(&types.RawWritingSession{
+		UserID:            payload.UserID,
+		SessionID:         payload.SessionID,
+		Prompt:            payload.Prompt,
+		StartingTimestamp: startingTimestamp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error starting raw writing session: %v", err)
+	}
+	resumed := len(rawSession.Keystrokes) > 0
+
+	writingSession, err := m.server.store.GetWritingSessionById(ctx, payload.SessionID)
+	if err != nil {
+		writingSession, err = m.createWritingSession(ctx, payload, rawSession)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if writingSession.UserID != payload.UserID {
+		return nil, fmt.Errorf("session %s belongs to another user", payload.SessionID)
+	}
+	if writingSession.Status != "in_progress" {
+		return nil, fmt.Errorf("session %s has already ended", payload.SessionID)
+	}
+
+	session := &liveSession{
+		client:         c,
+		writingSession: writingSession,
+		rawSession:     rawSession,
+		startedAt:      time.Now(),
+		writtenBefore:  rawSession.WritingDuration(),
+	}
+	session.silenceTimer = time.AfterFunc(m.silenceTimeout(), func() {
+		m.endSession(payload.SessionID, sessionEndedByPause)
+	})
+	m.sessions[payload.SessionID] = session
+
+	log.Printf("Live session %s started for user %s (resumed: %t)", payload.SessionID, payload.UserID, resumed)
+	return session.startedMessage(resumed), nil
+}
+
+func (m *liveSessionManager) createWritingSession(ctx context.Context, payload sessionStartPayload, rawSession *types.RawWritingSession) (*types.WritingSession, error) {
+	userSessions, err := m.server.store.GetUserWritingSessions(ctx, payload.UserID, false, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user's last session: %v", err)
+	}
+
+	sessionIndex := 0
+	if len(userSessions) > 0 {
+		sessionIndex = userSessions[0].SessionIndexForUser + 1
+	}
+
+	writingSession := types.NewWritingSession(payload.SessionID, payload.UserID, payload.Prompt, sessionIndex, payload.IsOnboarding)
+	writingSession.StartingTimestamp = rawSession.StartingTimestamp
+	if err := m.server.store.CreateWritingSession(ctx, writingSession); err != nil {
+		return nil, fmt.Errorf("error creating writing session: %v", err)
+	}
+	return writingSession, nil
+}
+
+// handleKeystrokeBatch autosaves a batch of keystrokes. A pause longer than MaxPauseMs inside
+// the batch ends the session right there, and nothing typed after it is kept.
+func (m *liveSessionManager) handleKeystrokeBatch(c *Client, msg WSMessage) (*WSMessage, error) {
+	var payload keystrokeBatchPayload
+	if err := decodeWSPayload(msg, &payload); err != nil {
+		return nil, err
+	}
+
+	session, err := m.get(payload.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	session.mu.Lock()
+	if err := session.checkAttached(c); err != nil {
+		session.mu.Unlock()
+		return nil, err
+	}
+	if session.ended {
+		session.mu.Unlock()
+		return nil, fmt.Errorf("session %s has already ended", payload.SessionID)
+	}
+
+	accepted := payload.Keystrokes
+	endedByPause := false
+	for i, keystroke := range payload.Keystrokes {
+		if err := keystroke.Validate(); err != nil {
+			session.mu.Unlock()
+			return nil, fmt.Errorf("invalid keystroke %d: %v", i, err)
+		}
+		// The first keystroke's delay is the time it took to start writing, not a pause.
+		// It doesn't count in the verdict either, so waiting doesn't earn an Anky.
+		isFirstKeystroke := len(session.rawSession.Keystrokes) == 0 && i == 0
+		if !isFirstKeystroke && keystroke.DelayMs > types.MaxPauseMs {
+			accepted = payload.Keystrokes[:i]
+			endedByPause = true
+			break
+		}
+	}
+
+	if err := m.saveKeystrokes(session, accepted); err != nil {
+		session.mu.Unlock()
+		return nil, err
+	}
+	if !endedByPause {
+		session.silenceTimer.Reset(m.silenceTimeout())
+	}
+	response := &WSMessage{
+		Type: "keystrokes_saved",
+		Payload: map[string]interface{}{
+			"session_id":      payload.SessionID,
+			"keystroke_count": len(session.rawSession.Keystrokes),
+			"elapsed_ms":      session.rawSession.TotalDuration().Milliseconds(),
+		},
+	}
+	session.mu.Unlock()
+
+	if endedByPause {
+		m.endSession(payload.SessionID, sessionEndedByPause)
+		return nil, nil
+	}
+	return response, nil
+}
+
+// saveKeystrokes appends keystrokes to the raw file and the writing_sessions row. Callers hold session.mu.
+func (m *liveSessionManager) saveKeystrokes(session *liveSession, keystrokes []types.Keystroke) error {
+	if len(keystrokes) == 0 {
+		return nil
+	}
+
+	rawSession := session.rawSession
+	if err := m.writingSessionService.AppendKeystrokes(rawSession.UserID, rawSession.SessionID, keystrokes); err != nil {
+		return fmt.Errorf("error saving keystrokes: %v", err)
+	}
+	rawSession.Keystrokes = append(rawSession.Keystrokes, keystrokes...)
+
+	timeSpent := int(rawSession.WritingDuration().Seconds())
+	session.writingSession.Writing = rawSession.Text()
+	session.writingSession.WordsWritten = rawSession.WordCount()
+	session.writingSession.TimeSpent = &timeSpent
+	if err := m.server.store.UpdateWritingSession(context.Background(), session.writingSession); err != nil {
+		// The raw file is the source of truth, the row catches up on the next batch
+		log.Printf("Error autosaving writing session %s: %v", rawSession.SessionID, err)
+	}
+	return nil
+}
+
+func (m *liveSessionManager) handleHeartbeat(c *Client, msg WSMessage) (*WSMessage, error) {
+	var payload sessionRefPayload
+	if err := decodeWSPayload(msg, &payload); err != nil {
+		return nil, err
+	}
+
+	response := map[string]interface{}{
+		"server_time": time.Now().UnixMilli(),
+	}
+	if payload.SessionID != uuid.Nil {
+		session, err := m.get(payload.SessionID)
+		if err != nil {
+			return nil, err
+		}
+
+		session.mu.Lock()
+		if err := session.checkAttached(c); err != nil {
+			session.mu.Unlock()
+			return nil, err
+		}
+		response["session_id"] = payload.SessionID
+		response["keystroke_count"] = len(session.rawSession.Keystrokes)
+		response["elapsed_ms"] = session.rawSession.TotalDuration().Milliseconds()
+		session.mu.Unlock()
+	}
+
+	return &WSMessage{Type: "heartbeat", Payload: response}, nil
+}
+
+func (m *liveSessionManager) handleSessionEnd(c *Client, msg WSMessage) (*WSMessage, error) {
+	var payload sessionRefPayload
+	if err := decodeWSPayload(msg, &payload); err != nil {
+		return nil, err
+	}
+
+	session, err := m.get(payload.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	err = session.checkAttached(c)
+	session.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m.endSession(payload.SessionID, sessionEndedByClient)
+	return nil, nil
+}
+
+// endSession closes a live session: the verdict is computed from the stored keystrokes,
+// the writing session is saved, the Anky creation starts if it earned one, and the client
+// (if it is still connected) receives session_ended.
+func (m *liveSessionManager) endSession(sessionID uuid.UUID, reason string) {
+	ctx := context.Background()
+
+	m.mu.Lock()
+	session, ok := m.sessions[sessionID]
+	if ok {
+		delete(m.sessions, sessionID)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.ended {
+		return
+	}
+	session.ended = true
+	session.silenceTimer.Stop()
+
+	writingSession := session.writingSession
+	observed := session.writtenBefore + time.Since(session.startedAt) + m.grace
+	verdict := m.writingSessionService.ApplyLiveSession(writingSession, session.rawSession, observed)
+	endingTimestamp := session.rawSession.StartingTimestamp.Add(session.rawSession.Effective().TotalDuration())
+	writingSession.EndingTimestamp = &endingTimestamp
+
+	var quotaExceeded *services.QuotaExceededError
+	if writingSession.IsAnky {
+		if err := m.server.startAnkyCreation(ctx, writingSession); err != nil {
+			log.Printf("Error starting Anky creation for session %s: %v", sessionID, err)
+			errors.As(err, &quotaExceeded)
+		}
+	}
+	if err := m.server.store.UpdateWritingSession(ctx, writingSession); err != nil {
+		log.Printf("Error saving ended writing session %s: %v", sessionID, err)
+	}
+
+	log.Printf("Live session %s ended (%s): %+v", sessionID, reason, verdict)
+	if session.client != nil {
+		session.client.sendMessage(WSMessage{
+			Type: "session_ended",
+			Payload: map[string]interface{}{
+				"session_id":      sessionID,
+				"reason":          reason,
+				"verdict":         verdict,
+				"writing_session": writingSession,
+				// Set when the writing was an Anky but the user can't have another one today
+				"quota_exceeded": quotaExceeded,
+			},
+		})
+	}
+}
+
+// detachClient forgets a disconnected client. Its sessions keep running and end on silence
+// unless the client reconnects and sends session_start again.
+func (m *liveSessionManager) detachClient(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, session := range m.sessions {
+		session.mu.Lock()
+		if session.client == c {
+			session.client = nil
+		}
+		session.mu.Unlock()
+	}
+}
+
+func (m *liveSessionManager) silenceTimeout() time.Duration {
+	return time.Duration(types.MaxPauseMs)*time.Millisecond + m.grace
+}
+
+func (s *liveSession) startedMessage(resumed bool) *WSMessage {
+	return &WSMessage{
+		Type: "session_started",
+		Payload: map[string]interface{}{
+			"session_id":      s.rawSession.SessionID,
+			"resumed":         resumed,
+			"keystroke_count": len(s.rawSession.Keystrokes),
+			"elapsed_ms":      s.rawSession.TotalDuration().Milliseconds(),
+		},
+	}
+}
@@ -1,111 +1,20 @@
 package api
 
 import (
-	"context"
-	"encoding/base64"
-	"encoding/json"
-	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/ankylat/anky/server/types"
+	"github.com/gorilla/mux"
 	"golang.org/x/time/rate"
 )
 
-// PrivyAuth is a middleware function that authenticates requests using Privy
-func PrivyAuth(appID, appSecret string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Println("Starting PrivyAuth middleware")
-
-			// Check for the Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				log.Println("Missing authorization header")
-				WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Missing authorization header"})
-				return
-			}
-
-			log.Printf("Received Authorization header: %s", authHeader)
-
-			// Remove "Bearer " prefix if present
-			token := authHeader
-			if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-				token = authHeader[7:]
-				log.Println("Removed 'Bearer ' prefix from token")
-			}
-
-			// Create the Basic Auth header for Privy API
-			auth := base64.StdEncoding.EncodeToString([]byte(appID + ":" + appSecret))
-			log.Println("Created Basic Auth header")
-
-			// Create a new request to Privy API
-			req, err := http.NewRequest("GET", "https://auth.privy.io/api/v1/users/me", nil)
-			if err != nil {
-				log.Printf("Failed to create request: %v", err)
-				WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "Failed to create request"})
-				return
-			}
-			log.Println("Created new request to Privy API")
-
-			// Set the required headers for Privy API request
-			req.Header.Set("Authorization", "Basic "+auth)
-			req.Header.Set("privy-app-id", appID)
-			req.Header.Set("Authorization", "Bearer "+token)
-			log.Println("Set headers for Privy API request")
-
-			// Send the request to Privy API
-			client := &http.Client{}
-			log.Println("Sending request to Privy API")
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("Failed to send request: %v", err)
-				WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "Failed to send request"})
-				return
-			}
-			defer resp.Body.Close()
-			log.Printf("Received response from Privy API with status: %s", resp.Status)
-
-			// Check if the response status is OK
-			if resp.StatusCode != http.StatusOK {
-				log.Printf("Invalid token. Status code: %d", resp.StatusCode)
-				WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Invalid token"})
-				return
-			}
-
-			// Read and parse the response body
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Failed to read response: %v", err)
-				WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "Failed to read response"})
-				return
-			}
-			log.Printf("Response body: %s", string(body))
-
-			// Define a struct to hold the user information
-			var privyUser types.PrivyUser
-
-			// Unmarshal the JSON response into the privyUser struct
-			err = json.Unmarshal(body, &privyUser)
-			if err != nil {
-				log.Printf("Failed to parse response: %v", err)
-				WriteJSON(w, http.StatusInternalServerError, ApiError{Error: "Failed to parse response"})
-				return
-			}
-
-			// Store the privyUser in the request context
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, "privyUser", privyUser)
-			r = r.WithContext(ctx)
-			log.Printf("Set privyUser in context: %+v", privyUser)
-
-			log.Println("PrivyAuth middleware completed successfully")
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
 // Logger is a middleware function that logs request details
 func Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -135,16 +44,237 @@ func Logger(next http.Handler) http.Handler {
 	})
 }
 
-// RateLimiter is a middleware function that implements rate limiting
-func RateLimiter(next http.Handler) http.Handler {
-	// Create a new rate limiter that allows 1 request per second with a burst of 5
-	limiter := rate.NewLimiter(1, 5)
+// ******************** Rate limiting ********************
+
+// Requests are rate limited per caller: the signed in user, or else the client IP. Each group
+// of routes has its own policy, a token bucket refilled at PerMinute requests a minute holding
+// up to Burst requests. The policies can be changed with RATE_LIMIT_<GROUP>_PER_MINUTE and
+// RATE_LIMIT_<GROUP>_BURST, like RATE_LIMIT_LLM_PER_MINUTE. Behind a proxy, set
+// RATE_LIMIT_TRUST_PROXY so that the client IP is read from X-Forwarded-For.
+//
+// Registering an anonymous user is limited per hour and per IP (RATE_LIMIT_REGISTER_PER_HOUR),
+// every new user comes with a fresh daily quota of the anonymous tier.
+
+// RateLimitPolicy is the limit of a group of routes
+type RateLimitPolicy struct {
+	Name      string
+	PerMinute int
+	// PerHour is the rate of the policies slower than a request a minute, instead of PerMinute
+	PerHour int
+	Burst   int
+	// ByIP limits the client IP even when the caller is signed in
+	ByIP bool
+}
+
+// every is how many requests the bucket gets back a second
+func (p RateLimitPolicy) every() rate.Limit {
+	if p.PerHour > 0 {
+		return rate.Limit(float64(p.PerHour) / 3600)
+	}
+	return rate.Limit(float64(p.PerMinute) / 60)
+}
+
+// Route groups
+var (
+	// The routes that reach the LLM, each request costs us money
+	RateLimitLLM = RateLimitPolicy{Name: "llm", PerMinute: 6, Burst: 3}
+	// Everything else that changes something
+	RateLimitWrite = RateLimitPolicy{Name: "write", PerMinute: 60, Burst: 20}
+	RateLimitRead  = RateLimitPolicy{Name: "read", PerMinute: 300, Burst: 60}
+	// Creating users, each of them gets its own quota
+	RateLimitRegister = RateLimitPolicy{Name: "register", PerHour: 3, Burst: 5, ByIP: true}
+)
+
+// registerRoutes are the path templates of the RateLimitRegister group
+var registerRoutes = map[string]bool{
+	"/users/register-anon-user": true,
+}
+
+// llmRoutes are the path templates of the RateLimitLLM group
+var llmRoutes = map[string]bool{
+	"/anky/simple-prompt":              true,
+	"/anky/simple-prompt/stream":       true,
+	"/anky/messages-prompt":            true,
+	"/anky/onboarding/{userId}":        true,
+	"/anky/onboarding/{userId}/stream": true,
+}
+
+// unlimitedRoutes are called by other services, not by our users
+var unlimitedRoutes = map[string]bool{
+	"/webhooks/image-generated/{id}": true,
+}
+
+// idleLimiterTTL is how long the limiter of a caller is kept after its last request, at least
+// until its bucket is full again. A caller coming back later starts with a full bucket, as it
+// would have anyway.
+const idleLimiterTTL = 10 * time.Minute
+
+type callerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	// how long an empty bucket takes to fill up
+	refill time.Duration
+}
+
+// RateLimiter keeps a token bucket per policy and caller
+type RateLimiter struct {
+	policies   map[string]RateLimitPolicy
+	trustProxy bool
+	idleTTL    time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[string]*callerLimiter
+	lastSweep time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	policies := make(map[string]RateLimitPolicy)
+	for _, policy := range []RateLimitPolicy{RateLimitLLM, RateLimitWrite, RateLimitRead, RateLimitRegister} {
+		prefix := "RATE_LIMIT_" + strings.ToUpper(policy.Name)
+		if policy.PerHour > 0 {
+			policy.PerHour = envPositiveInt(prefix+"_PER_HOUR", policy.PerHour)
+		} else {
+			policy.PerMinute = envPositiveInt(prefix+"_PER_MINUTE", policy.PerMinute)
+		}
+		policy.Burst = envPositiveInt(prefix+"_BURST", policy.Burst)
+		policies[policy.Name] = policy
+	}
+	return &RateLimiter{
+		policies:   policies,
+		trustProxy: os.Getenv("RATE_LIMIT_TRUST_PROXY") == "true",
+		idleTTL:    idleLimiterTTL,
+		now:        time.Now,
+		limiters:   make(map[string]*callerLimiter),
+	}
+}
+
+func envPositiveInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Middleware limits the requests of the route group they belong to. It goes after
+// authenticate, to know the user.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if the request is allowed based on the rate limit
-		if !limiter.Allow() {
+		policy, ok := l.policyFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		caller := l.callerKey(r)
+		if policy.ByIP {
+			caller = "ip:" + l.clientIP(r)
+		}
+		allowed, remaining, retryAfter, reset := l.take(policy, caller)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(policy.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
 			WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: "Too many requests"})
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (l *RateLimiter) policyFor(r *http.Request) (RateLimitPolicy, bool) {
+	template := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			template = t
+		}
+	}
+	switch {
+	case unlimitedRoutes[template]:
+		return RateLimitPolicy{}, false
+	case llmRoutes[template]:
+		return l.policies[RateLimitLLM.Name], true
+	case registerRoutes[template]:
+		return l.policies[RateLimitRegister.Name], true
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return l.policies[RateLimitRead.Name], true
+	default:
+		return l.policies[RateLimitWrite.Name], true
+	}
+}
+
+// callerKey is the signed in user, or else the client IP
+func (l *RateLimiter) callerKey(r *http.Request) string {
+	if user := authUser(r); user != nil {
+		return "user:" + user.ID.String()
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		// The proxy appends the address it got the request from, the entries before it are
+		// whatever the client sent
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// take spends a request of the caller. It returns if the request is allowed, how many are left,
+// when the next one will be allowed, and when the bucket will be full again.
+func (l *RateLimiter) take(policy RateLimitPolicy, caller string) (allowed bool, remaining int, retryAfter, reset time.Duration) {
+	now := l.now()
+	every := policy.every()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	key := policy.Name + "|" + caller
+	entry, ok := l.limiters[key]
+	if !ok {
+		entry = &callerLimiter{
+			limiter: rate.NewLimiter(every, policy.Burst),
+			refill:  time.Duration(float64(policy.Burst) / float64(every) * float64(time.Second)),
+		}
+		l.limiters[key] = entry
+	}
+	entry.lastSeen = now
+
+	allowed = entry.limiter.AllowN(now, 1)
+	tokens := entry.limiter.TokensAt(now)
+	if tokens > 0 {
+		remaining = int(tokens)
+	}
+	reset = time.Duration((float64(policy.Burst) - tokens) / float64(every) * float64(time.Second))
+	if !allowed {
+		retryAfter = time.Duration((1 - tokens) / float64(every) * float64(time.Second))
+	}
+	return allowed, remaining, retryAfter, reset
+}
+
+// sweep forgets the callers idle for longer than idleTTL, at most once per idleTTL
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTTL {
+		return
+	}
+	l.lastSweep = now
+	for key, entry := range l.limiters {
+		if idle := now.Sub(entry.lastSeen); idle > l.idleTTL && idle > entry.refill {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
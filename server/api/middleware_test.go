@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func newTestRateLimiter() (*RateLimiter, *time.Time, http.Handler) {
+	limiter := NewRateLimiter()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	router.HandleFunc("/anky/simple-prompt", ok).Methods("POST")
+	router.HandleFunc("/ankys/{id}", ok).Methods("GET")
+	router.HandleFunc("/webhooks/image-generated/{id}", ok).Methods("POST")
+	router.HandleFunc("/users/register-anon-user", ok).Methods("POST")
+	return limiter, &now, router
+}
+
+func rateLimitedRequest(method, path string, user *types.User, ip string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":1234"
+	if user != nil {
+		req = req.WithContext(context.WithValue(req.Context(), userContextKey, user))
+	}
+	return req
+}
+
+func TestRateLimiterKeysByCaller(t *testing.T) {
+	_, now, router := newTestRateLimiter()
+	alice := &types.User{ID: uuid.New()}
+	bob := &types.User{ID: uuid.New()}
+
+	// Alice spends her LLM burst, from the same IP as Bob
+	for i := 0; i < RateLimitLLM.Burst; i++ {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, rateLimitedRequest("POST", "/anky/simple-prompt", alice, "10.0.0.1"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+		if remaining := rec.Header().Get("X-RateLimit-Remaining"); remaining != strconv.Itoa(RateLimitLLM.Burst-i-1) {
+			t.Errorf("request %d: expected %d remaining, got %s", i, RateLimitLLM.Burst-i-1, remaining)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, rateLimitedRequest("POST", "/anky/simple-prompt", alice, "10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	// 6 a minute, the next request is allowed in 10 seconds
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("expected Retry-After 10, got %q", retryAfter)
+	}
+	if limit := rec.Header().Get("X-RateLimit-Limit"); limit != strconv.Itoa(RateLimitLLM.Burst) {
+		t.Errorf("expected X-RateLimit-Limit %d, got %q", RateLimitLLM.Burst, limit)
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"another user on the same IP", rateLimitedRequest("POST", "/anky/simple-prompt", bob, "10.0.0.1"), http.StatusOK},
+		{"another route group", rateLimitedRequest("GET", "/ankys/"+uuid.NewString(), alice, "10.0.0.1"), http.StatusOK},
+		{"anonymous on the same IP", rateLimitedRequest("POST", "/anky/simple-prompt", nil, "10.0.0.1"), http.StatusOK},
+		{"webhook", rateLimitedRequest("POST", "/webhooks/image-generated/"+uuid.NewString(), nil, "10.0.0.1"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, tt.req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+
+	*now = now.Add(10 * time.Second)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, rateLimitedRequest("POST", "/anky/simple-prompt", alice, "10.0.0.1"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the bucket to refill, got %d", rec.Code)
+	}
+}
+
+func TestRateLimiterFallsBackToIP(t *testing.T) {
+	_, _, router := newTestRateLimiter()
+
+	for i := 0; i < RateLimitLLM.Burst; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), rateLimitedRequest("POST", "/anky/simple-prompt", nil, "10.0.0.1"))
+	}
+	for ip, want := range map[string]int{"10.0.0.1": http.StatusTooManyRequests, "10.0.0.2": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, rateLimitedRequest("POST", "/anky/simple-prompt", nil, ip))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", ip, want, rec.Code)
+		}
+	}
+}
+
+func TestRateLimiterEvictsIdleCallers(t *testing.T) {
+	limiter, now, router := newTestRateLimiter()
+
+	for i := 0; i < 5; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), rateLimitedRequest("GET", "/ankys/"+uuid.NewString(), nil, "10.0.0."+strconv.Itoa(i)))
+	}
+	if len(limiter.limiters) != 5 {
+		t.Fatalf("expected 5 limiters, got %d", len(limiter.limiters))
+	}
+
+	*now = now.Add(idleLimiterTTL + time.Second)
+	router.ServeHTTP(httptest.NewRecorder(), rateLimitedRequest("GET", "/ankys/"+uuid.NewString(), nil, "10.0.0.9"))
+	if len(limiter.limiters) != 1 {
+		t.Errorf("expected the idle limiters to be evicted, %d left", len(limiter.limiters))
+	}
+}
+
+func TestRateLimiterLimitsRegistrationsByIP(t *testing.T) {
+	limiter, now, router := newTestRateLimiter()
+
+	// Signing in doesn't give an IP more users to register
+	for i := 0; i < RateLimitRegister.Burst; i++ {
+		caller := &types.User{ID: uuid.New()}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, rateLimitedRequest("POST", "/users/register-anon-user", caller, "10.0.0.1"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("registration %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, rateLimitedRequest("POST", "/users/register-anon-user", &types.User{ID: uuid.New()}, "10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	// 3 an hour, the next registration is allowed in 20 minutes
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "1200" {
+		t.Errorf("expected Retry-After 1200, got %q", retryAfter)
+	}
+
+	// The bucket is kept while it refills, even once the IP went quiet
+	*now = now.Add(idleLimiterTTL + time.Minute)
+	router.ServeHTTP(httptest.NewRecorder(), rateLimitedRequest("GET", "/ankys/"+uuid.NewString(), nil, "10.0.0.9"))
+	if _, ok := limiter.limiters[RateLimitRegister.Name+"|ip:10.0.0.1"]; !ok {
+		t.Fatalf("expected the registration limiter of the IP to be kept")
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, rateLimitedRequest("POST", "/users/register-anon-user", nil, "10.0.0.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the IP to still be limited, got %d", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	limiter := NewRateLimiter()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+
+	if ip := limiter.clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("expected the remote address without a trusted proxy, got %s", ip)
+	}
+	limiter.trustProxy = true
+	if ip := limiter.clientIP(req); ip != "5.6.7.8" {
+		t.Errorf("expected the address the proxy saw, got %s", ip)
+	}
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Privy tokens
+//
+// The access tokens of Privy sessions are ES256 JWTs signed by Privy for our app. They are
+// verified here, without calling Privy: the signature against the app's verification keys,
+// the issuer, the audience (our app ID) and the expiry. The configuration:
+//
+//   - PRIVY_APP_ID: the app, Privy tokens are refused without it
+//   - PRIVY_VERIFICATION_KEY: the PEM verification key of the Privy dashboard. Without it the
+//     keys are fetched from PRIVY_JWKS_URL (the app's JWKS by default) and refreshed every
+//     PRIVY_JWKS_REFRESH_SECONDS (an hour by default), or sooner for a key we don't know yet.
+//   - PRIVY_ISSUER: privy.io by default
+
+const (
+	defaultPrivyIssuer = "privy.io"
+
+	// minJWKSRefreshInterval keeps tokens with made up key IDs from making us fetch the keys
+	// on every request
+	minJWKSRefreshInterval = time.Minute
+	// jwksFetchTimeout bounds a fetch of the keys, whoever is waiting for it
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// PrivyVerifier checks a Privy access token and returns the DID of its Privy user
+type PrivyVerifier interface {
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// NewPrivyVerifier builds the verifier of the Privy app in PRIVY_APP_ID, nil when Privy
+// isn't configured
+func NewPrivyVerifier() (PrivyVerifier, error) {
+	appID := os.Getenv("PRIVY_APP_ID")
+	if appID == "" {
+		return nil, nil
+	}
+	issuer := os.Getenv("PRIVY_ISSUER")
+	if issuer == "" {
+		issuer = defaultPrivyIssuer
+	}
+
+	if pemKey := os.Getenv("PRIVY_VERIFICATION_KEY"); pemKey != "" {
+		// .env files keep the key on one line
+		key, err := parseECPublicKeyPEM(strings.ReplaceAll(pemKey, `\n`, "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid PRIVY_VERIFICATION_KEY: %v", err)
+		}
+		return NewPrivyJWTVerifier(appID, issuer, staticKeySource{key: key}), nil
+	}
+
+	jwksURL := os.Getenv("PRIVY_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = "https://auth.privy.io/api/v1/apps/" + appID + "/jwks.json"
+	}
+	refresh := time.Hour
+	if seconds, err := strconv.Atoi(os.Getenv("PRIVY_JWKS_REFRESH_SECONDS")); err == nil && seconds > 0 {
+		refresh = time.Duration(seconds) * time.Second
+	}
+	keys := newJWKSCache(jwksURL, refresh, &http.Client{Timeout: 10 * time.Second})
+	return NewPrivyJWTVerifier(appID, issuer, keys), nil
+}
+
+// keySource gives the verification key of a key ID
+type keySource interface {
+	Key(ctx context.Context, kid string) (*ecdsa.PublicKey, error)
+}
+
+// PrivyJWTVerifier verifies Privy tokens locally
+type PrivyJWTVerifier struct {
+	appID  string
+	issuer string
+	keys   keySource
+}
+
+func NewPrivyJWTVerifier(appID, issuer string, keys keySource) *PrivyJWTVerifier {
+	return &PrivyJWTVerifier{appID: appID, issuer: issuer, keys: keys}
+}
+
+func (v *PrivyJWTVerifier) Verify(ctx context.Context, token string) (string, error) {
+	claims := new(jwt.RegisteredClaims)
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithAudience(v.appID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("the token has no Privy user")
+	}
+	return claims.Subject, nil
+}
+
+// ******************** Keys ********************
+
+// staticKeySource is the one key of the Privy dashboard, whatever the key ID
+type staticKeySource struct {
+	key *ecdsa.PublicKey
+}
+
+func (s staticKeySource) Key(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	return s.key, nil
+}
+
+// jwksCache keeps the keys of a JWKS and fetches them again once they are older than refresh,
+// or when a token names a key it doesn't have. A single fetch runs at a time, outside of the
+// lock, and the requests that need its keys wait for it as long as their context lets them.
+type jwksCache struct {
+	url        string
+	refresh    time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*ecdsa.PublicKey
+	fetchedAt time.Time
+	fetchErr  error
+	// closed when the running fetch is over, nil when no fetch runs
+	fetching chan struct{}
+}
+
+func newJWKSCache(url string, refresh time.Duration, client *http.Client) *jwksCache {
+	return &jwksCache{url: url, refresh: refresh, minRefresh: minJWKSRefreshInterval, client: client}
+}
+
+func (c *jwksCache) Key(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	c.mu.Lock()
+	stale := time.Since(c.fetchedAt) > c.refresh
+	_, known := c.keys[kid]
+	if stale || (!known && time.Since(c.fetchedAt) > c.minRefresh) {
+		done := c.fetching
+		if done == nil {
+			done = make(chan struct{})
+			c.fetching = done
+			go c.refreshKeys(done)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if c.keys == nil && c.fetchErr != nil {
+		return nil, c.fetchErr
+	}
+	// Tokens without a key ID are fine as long as there is only one key
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// refreshKeys fetches the keys and closes done. It doesn't belong to any request, so a request
+// that gives up doesn't cancel it for the others.
+func (c *jwksCache) refreshKeys(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	keys, err := c.fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetchedAt = time.Now()
+	c.fetchErr = err
+	switch {
+	case err == nil:
+		c.keys = keys
+	case c.keys != nil:
+		// Privy being down doesn't sign everyone out, the keys we have are still good
+		log.Printf("Error refreshing the Privy keys, keeping the cached ones: %v", err)
+	}
+	c.fetching = nil
+	close(done)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]*ecdsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching the keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("error decoding the keys: %v", err)
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping Privy key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in the JWKS")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x: %v", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y: %v", err)
+	}
+
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("the point is not on the curve")
+	}
+	return key, nil
+}
+
+func parseECPublicKeyPEM(data string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA key")
+	}
+	return key, nil
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testPrivyAppID = "test-app"
+
+// fakePrivyIssuer stands in for Privy: it signs tokens with a key it generated and serves
+// that key as a JWKS
+type fakePrivyIssuer struct {
+	t       *testing.T
+	key     *ecdsa.PrivateKey
+	kid     string
+	fetches atomic.Int32
+	down    atomic.Bool
+	// the JWKS is served once it is closed, when set
+	hold   chan struct{}
+	server *httptest.Server
+}
+
+func newFakePrivyIssuer(t *testing.T) *fakePrivyIssuer {
+	issuer := &fakePrivyIssuer{t: t}
+	issuer.rotate("key-1")
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer.fetches.Add(1)
+		if issuer.hold != nil {
+			<-issuer.hold
+		}
+		if issuer.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "EC",
+				"crv": "P-256",
+				"kid": issuer.kid,
+				"x":   base64.RawURLEncoding.EncodeToString(issuer.key.PublicKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(issuer.key.PublicKey.Y.FillBytes(make([]byte, 32))),
+			}},
+		})
+	}))
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// rotate replaces the signing key, like Privy does from time to time
+func (i *fakePrivyIssuer) rotate(kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+	i.key, i.kid = key, kid
+}
+
+func (i *fakePrivyIssuer) token(claims jwt.RegisteredClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = i.kid
+	signed, err := token.SignedString(i.key)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+	return signed
+}
+
+func validPrivyClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    defaultPrivyIssuer,
+		Audience:  jwt.ClaimStrings{testPrivyAppID},
+		Subject:   "did:privy:abc",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func (i *fakePrivyIssuer) verifier() (*PrivyJWTVerifier, *jwksCache) {
+	keys := newJWKSCache(i.server.URL, time.Hour, i.server.Client())
+	return NewPrivyJWTVerifier(testPrivyAppID, defaultPrivyIssuer, keys), keys
+}
+
+func TestPrivyJWTVerifier(t *testing.T) {
+	issuer := newFakePrivyIssuer(t)
+	verifier, _ := issuer.verifier()
+
+	otherIssuer := newFakePrivyIssuer(t)
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validPrivyClaims()).SignedString([]byte("secret"))
+
+	tests := []struct {
+		name    string
+		token   string
+		wantDID string
+	}{
+		{name: "valid token", token: issuer.token(validPrivyClaims()), wantDID: "did:privy:abc"},
+		{name: "another app", token: issuer.token(func() jwt.RegisteredClaims {
+			c := validPrivyClaims()
+			c.Audience = jwt.ClaimStrings{"other-app"}
+			return c
+		}())},
+		{name: "another issuer", token: issuer.token(func() jwt.RegisteredClaims {
+			c := validPrivyClaims()
+			c.Issuer = "evil.example"
+			return c
+		}())},
+		{name: "expired", token: issuer.token(func() jwt.RegisteredClaims {
+			c := validPrivyClaims()
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			return c
+		}())},
+		{name: "no expiry", token: issuer.token(func() jwt.RegisteredClaims {
+			c := validPrivyClaims()
+			c.ExpiresAt = nil
+			return c
+		}())},
+		{name: "signed by another key", token: otherIssuer.token(validPrivyClaims())},
+		{name: "not ES256", token: hmacToken},
+		{name: "not a token", token: "abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			did, err := verifier.Verify(context.Background(), tt.token)
+			if tt.wantDID == "" {
+				if err == nil {
+					t.Fatalf("expected the token to be refused, got %s", did)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if did != tt.wantDID {
+				t.Errorf("expected %s, got %s", tt.wantDID, did)
+			}
+		})
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	ctx := context.Background()
+	issuer := newFakePrivyIssuer(t)
+	verifier, keys := issuer.verifier()
+	keys.minRefresh = 0
+
+	for i := 0; i < 5; i++ {
+		if _, err := verifier.Verify(ctx, issuer.token(validPrivyClaims())); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if fetches := issuer.fetches.Load(); fetches != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d fetches", fetches)
+	}
+
+	// A new key is picked up with the first token that uses it
+	issuer.rotate("key-2")
+	if _, err := verifier.Verify(ctx, issuer.token(validPrivyClaims())); err != nil {
+		t.Fatalf("expected the rotated key to be fetched, got %v", err)
+	}
+
+	// The cached keys keep working while the JWKS can't be fetched
+	issuer.down.Store(true)
+	keys.fetchedAt = time.Now().Add(-2 * time.Hour)
+	if _, err := verifier.Verify(ctx, issuer.token(validPrivyClaims())); err != nil {
+		t.Fatalf("expected the cached key to be used, got %v", err)
+	}
+}
+
+func TestJWKSCacheFetchesOnceForConcurrentRequests(t *testing.T) {
+	issuer := newFakePrivyIssuer(t)
+	issuer.hold = make(chan struct{})
+	verifier, _ := issuer.verifier()
+	token := issuer.token(validPrivyClaims())
+
+	// A request that gives up doesn't wait for the keys, nor stops the fetch for the others
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := verifier.Verify(ctx, token); err == nil {
+		t.Fatalf("expected the request to give up on the keys")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(context.Background(), token)
+			errs <- err
+		}()
+	}
+	close(issuer.hold)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if fetches := issuer.fetches.Load(); fetches != 1 {
+		t.Errorf("expected a single fetch of the keys, got %d", fetches)
+	}
+}
+
+func TestPrivyVerificationKeyFromEnv(t *testing.T) {
+	issuer := newFakePrivyIssuer(t)
+	der, err := x509.MarshalPKIXPublicKey(&issuer.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	t.Setenv("PRIVY_APP_ID", testPrivyAppID)
+	t.Setenv("PRIVY_VERIFICATION_KEY", strings.ReplaceAll(pemKey, "\n", `\n`))
+	verifier, err := NewPrivyVerifier()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := verifier.Verify(context.Background(), issuer.token(validPrivyClaims())); err != nil {
+		t.Fatalf("expected the token to be verified with the dashboard key, got %v", err)
+	}
+	if issuer.fetches.Load() != 0 {
+		t.Errorf("expected no JWKS fetch with a verification key")
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ankylat/anky/server/services"
+)
+
+// Streamed prompts over /ws/writing
+//
+// The client sends a prompt message with a request_id of its choice. The tokens of the
+// response come back in prompt_token messages as the model writes them, followed by a
+// prompt_done message with the whole response, or prompt_error if the model failed. The prompts
+// share the rate limit of the LLM routes and the daily quota of the user. When either refuses
+// one, prompt_error says in retry_after how many seconds to wait.
+
+type promptPayload struct {
+	RequestID string `json:"request_id"`
+	Prompt    string `json:"prompt"`
+}
+
+func (s *APIServer) handlePromptStream(c *Client, msg WSMessage) (*WSMessage, error) {
+	var payload promptPayload
+	if err := decodeWSPayload(msg, &payload); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(payload.Prompt) == "" {
+		return nil, fmt.Errorf("prompt is empty")
+	}
+
+	policy := s.rateLimiter.policies[RateLimitLLM.Name]
+	if allowed, _, retryAfter, _ := s.rateLimiter.take(policy, "user:"+c.user.ID.String()); !allowed {
+		sendPromptRefused(c, payload.RequestID, "Too many requests", retryAfter)
+		return nil, nil
+	}
+
+	ankyService, err := services.NewAnkyService(s.store)
+	if err != nil {
+		return nil, fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	// Stop generating if the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := s.quotas.ReserveLLMCall(ctx, c.user); err != nil {
+		cancel()
+		var exceeded *services.QuotaExceededError
+		if errors.As(err, &exceeded) {
+			sendPromptRefused(c, payload.RequestID, exceeded.Error(), time.Until(exceeded.ResetsAt))
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	chunks, err := ankyService.SimplePromptStream(ctx, payload.Prompt)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	chunks = s.quotas.MeterStream(ctx, c.user.ID, payload.Prompt, chunks)
+
+	go func() {
+		defer cancel()
+
+		// Every token has to reach the client, so the stream waits for room in its buffer
+		var response strings.Builder
+		for chunk := range chunks {
+			if chunk.Err != nil {
+				log.Printf("Error streaming prompt %s: %v", payload.RequestID, chunk.Err)
+				c.sendMessageWait(ctx, WSMessage{
+					Type:    "prompt_error",
+					Payload: map[string]string{"request_id": payload.RequestID, "error": chunk.Err.Error()},
+				})
+				return
+			}
+			response.WriteString(chunk.Content)
+			if err := c.sendMessageWait(ctx, WSMessage{
+				Type:    "prompt_token",
+				Payload: map[string]string{"request_id": payload.RequestID, "content": chunk.Content},
+			}); err != nil {
+				return
+			}
+		}
+
+		c.sendMessageWait(ctx, WSMessage{
+			Type:    "prompt_done",
+			Payload: map[string]string{"request_id": payload.RequestID, "response": response.String()},
+		})
+	}()
+
+	return nil, nil
+}
+
+// sendPromptRefused tells the client that a prompt wasn't run, and when to try again
+func sendPromptRefused(c *Client, requestID string, reason string, retryAfter time.Duration) {
+	c.sendMessage(WSMessage{
+		Type: "prompt_error",
+		Payload: map[string]interface{}{
+			"request_id":  requestID,
+			"error":       reason,
+			"retry_after": ceilSeconds(retryAfter),
+		},
+	})
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+func TestPromptStreamIsRateLimited(t *testing.T) {
+	limiter, _, _ := newTestRateLimiter()
+	s := &APIServer{rateLimiter: limiter}
+	c := &Client{
+		user: &types.User{ID: uuid.New()},
+		send: make(chan []byte, 1),
+		done: make(chan struct{}),
+	}
+
+	// The prompts of the user already spent the LLM burst
+	for i := 0; i < RateLimitLLM.Burst; i++ {
+		limiter.take(RateLimitLLM, "user:"+c.user.ID.String())
+	}
+
+	response, err := s.handlePromptStream(c, WSMessage{
+		Type:    "prompt",
+		Payload: map[string]string{"request_id": "r1", "prompt": "what is alive in you?"},
+	})
+	if response != nil || err != nil {
+		t.Fatalf("expected the refusal to be sent as a prompt_error, got %v and %v", response, err)
+	}
+
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			RequestID  string `json:"request_id"`
+			RetryAfter int    `json:"retry_after"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(<-c.send, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "prompt_error" || msg.Payload.RequestID != "r1" {
+		t.Errorf("expected a prompt_error for r1, got %+v", msg)
+	}
+	// 6 a minute, the next prompt is allowed in 10 seconds
+	if msg.Payload.RetryAfter != 10 {
+		t.Errorf("expected to retry after 10 seconds, got %d", msg.Payload.RetryAfter)
+	}
+}
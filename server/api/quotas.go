@@ -0,0 +1,50 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/utils"
+)
+
+// quotaExceededResponse is the body of a 429 for a spent quota
+type quotaExceededResponse struct {
+	Error string `json:"error"`
+	*services.QuotaExceededError
+}
+
+// writeQuotaError answers 429 when err is a QuotaExceededError, and returns the other errors
+func writeQuotaError(w http.ResponseWriter, err error) error {
+	var exceeded *services.QuotaExceededError
+	if !errors.As(err, &exceeded) {
+		return err
+	}
+	return writeQuotaExceeded(w, exceeded)
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, exceeded *services.QuotaExceededError) error {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(exceeded.ResetsAt))))
+	return WriteJSON(w, http.StatusTooManyRequests, quotaExceededResponse{Error: exceeded.Error(), QuotaExceededError: exceeded})
+}
+
+// GET /users/{userId}/usage
+// Returns what the user spent today on the models, their limits and when they reset
+func (s *APIServer) handleGetUserUsage(w http.ResponseWriter, r *http.Request) error {
+	userID, err := utils.GetUserID(r)
+	if err != nil {
+		return err
+	}
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.quotas.Usage(r.Context(), user)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, report)
+}
@@ -3,12 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ankylat/anky/server/services"
@@ -41,9 +42,16 @@ func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 }
 
 type APIServer struct {
-	listenAddr string
-	store      *storage.PostgresStore
-	hub        *Hub
+	listenAddr   string
+	store        *storage.PostgresStore
+	hub          *Hub
+	liveSessions *liveSessionManager
+	ankyJobs     *services.AnkyJobQueue
+	privy        PrivyVerifier
+	auth         *services.AuthService
+	rateLimiter  *RateLimiter
+	quotas       *services.QuotaService
+	wallets      *services.WalletCustodyService
 }
 
 var upgrader = websocket.Upgrader{
@@ -69,7 +77,14 @@ type WSMessage struct {
 // Add WebSocket client structure
 type Client struct {
 	conn *websocket.Conn
+	user *types.User // who opened the connection
 	send chan []byte
+	done chan struct{} // closed when the connection goes away
+
+	// mu is held for reading while sending, so that send isn't closed under a sender
+	mu        sync.RWMutex
+	closed    bool
+	closeDone sync.Once
 }
 
 // Add WebSocket hub to manage connections
@@ -83,21 +98,65 @@ type Hub struct {
 func newHub() *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		broadcast:  make(chan []byte, 256),
+		register:   make(chan *Client, 16),
+		unregister: make(chan *Client, 16),
+	}
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				client.close()
+			}
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				client.sendBytes(message)
+			}
+		}
 	}
 }
 
 func NewAPIServer(listenAddr string, store *storage.PostgresStore) (*APIServer, error) {
-	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
-		hub:        newHub(),
-	}, nil
+	// Tokens signed with an empty key would be worthless
+	if _, err := utils.JWTSecret(); err != nil {
+		return nil, err
+	}
+	privy, err := NewPrivyVerifier()
+	if err != nil {
+		return nil, fmt.Errorf("error creating Privy verifier: %v", err)
+	}
+
+	server := &APIServer{
+		listenAddr:  listenAddr,
+		store:       store,
+		hub:         newHub(),
+		ankyJobs:    services.NewAnkyJobQueue(store),
+		privy:       privy,
+		auth:        services.NewAuthService(store),
+		rateLimiter: NewRateLimiter(),
+		quotas:      services.NewQuotaService(store),
+		wallets:     services.NewWalletCustodyService(store),
+	}
+	server.liveSessions = newLiveSessionManager(server)
+
+	go server.hub.run()
+
+	return server, nil
 }
 
 func (s *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	user := authUser(r)
+	if user == nil {
+		writeAuthError(w, errUnauthenticated)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading to WebSocket: %v", err)
@@ -106,7 +165,9 @@ func (s *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{
 		conn: conn,
+		user: user,
 		send: make(chan []byte, 256),
+		done: make(chan struct{}),
 	}
 	s.hub.register <- client
 
@@ -115,6 +176,70 @@ func (s *APIServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	go client.readPump(s.hub, s)
 }
 
+// sendMessage queues a message for the client. Messages for disconnected clients (or clients
+// too slow to keep up) are dropped, since sessions keep going without a connection.
+func (c *Client) sendMessage(msg WSMessage) {
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling %s message: %v", msg.Type, err)
+		return
+	}
+	c.sendBytes(messageBytes)
+}
+
+func (c *Client) sendBytes(message []byte) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- message:
+	default:
+		log.Println("WebSocket client send buffer is full, dropping message")
+	}
+}
+
+// sendMessageWait queues a message that must not be lost, like the tokens of a streamed
+// response. It waits for room in the buffer until the client goes away or ctx is done.
+func (c *Client) sendMessageWait(ctx context.Context, msg WSMessage) error {
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling %s message: %v", msg.Type, err)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return errClientGone
+	}
+	select {
+	case c.send <- messageBytes:
+		return nil
+	case <-c.done:
+		return errClientGone
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var errClientGone = errors.New("websocket client is gone")
+
+func (c *Client) close() {
+	// Wake up the senders waiting for room first, they hold mu until they return
+	c.closeDone.Do(func() { close(c.done) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
 func (c *Client) writePump(hub *Hub) {
 	defer func() {
 		c.conn.Close()
@@ -141,7 +266,7 @@ func (c *Client) writePump(hub *Hub) {
 	}
 }
 
-func (s *APIServer) handleWSMessage(msg WSMessage) (*WSMessage, error) {
+func (s *APIServer) handleWSMessage(c *Client, msg WSMessage) (*WSMessage, error) {
 	switch msg.Type {
 	case "writing":
 		// Handle writing message
@@ -149,6 +274,16 @@ func (s *APIServer) handleWSMessage(msg WSMessage) (*WSMessage, error) {
 			Type:    "writing_response",
 			Payload: msg.Payload,
 		}, nil
+	case "session_start":
+		return s.liveSessions.handleSessionStart(c, msg)
+	case "keystroke_batch":
+		return s.liveSessions.handleKeystrokeBatch(c, msg)
+	case "heartbeat":
+		return s.liveSessions.handleHeartbeat(c, msg)
+	case "session_end":
+		return s.liveSessions.handleSessionEnd(c, msg)
+	case "prompt":
+		return s.handlePromptStream(c, msg)
 	default:
 		return nil, fmt.Errorf("unknown message type: %s", msg.Type)
 	}
@@ -156,6 +291,7 @@ func (s *APIServer) handleWSMessage(msg WSMessage) (*WSMessage, error) {
 
 func (c *Client) readPump(hub *Hub, s *APIServer) {
 	defer func() {
+		s.liveSessions.detachClient(c)
 		hub.unregister <- c
 		c.conn.Close()
 	}()
@@ -177,62 +313,94 @@ func (c *Client) readPump(hub *Hub, s *APIServer) {
 		}
 
 		// Handle different message types
-		response, err := s.handleWSMessage(wsMessage)
+		response, err := s.handleWSMessage(c, wsMessage)
 		if err != nil {
 			log.Printf("Error handling message: %v", err)
-			errorResponse := WSMessage{
+			c.sendMessage(WSMessage{
 				Type: "error",
 				Payload: map[string]string{
 					"error": err.Error(),
 				},
-			}
-			responseBytes, _ := json.Marshal(errorResponse)
-			c.send <- responseBytes
+			})
 			continue
 		}
 
 		// Send response back to client
-		responseBytes, _ := json.Marshal(response)
-		c.send <- responseBytes
+		if response != nil {
+			c.sendMessage(*response)
+		}
 	}
 }
 
 func (s *APIServer) Run() error {
 	router := mux.NewRouter()
+	router.Use(s.authenticate, s.rateLimiter.Middleware)
 
 	router.HandleFunc("/", makeHTTPHandleFunc(s.handleHelloWorld))
+	// Session routes
+	router.HandleFunc("/auth/refresh", makeHTTPHandleFunc(s.handleRefreshSession)).Methods("POST")
+	router.HandleFunc("/auth/logout", makeHTTPHandleFunc(requireUser(s.handleLogout))).Methods("POST")
 	// User routes
 	router.HandleFunc("/users/register-anon-user", makeHTTPHandleFunc(s.handleRegisterAnonymousUser)).Methods("POST")
-	router.HandleFunc("/users", makeHTTPHandleFunc(s.handleGetUsers)).Methods("GET")
-	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(s.handleGetUserByID)).Methods("GET")
-	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(s.handleUpdateUser)).Methods("PUT")
-	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(s.handleDeleteUser)).Methods("DELETE")
-	router.HandleFunc("/users/create-profile/{userId}", makeHTTPHandleFunc(s.handleCreateUserProfile)).Methods("POST")
+	router.HandleFunc("/users", makeHTTPHandleFunc(requireAdmin(s.handleGetUsers))).Methods("GET")
+	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(requireSelf(s.handleGetUserByID))).Methods("GET")
+	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(requireSelf(s.handleUpdateUser))).Methods("PUT")
+	router.HandleFunc("/users/{userId}", makeHTTPHandleFunc(requireSelf(s.handleDeleteUser))).Methods("DELETE")
+	router.HandleFunc("/users/create-profile/{userId}", makeHTTPHandleFunc(requireSelf(s.handleCreateUserProfile))).Methods("POST")
+
+	// Wallet routes
+	router.HandleFunc("/users/{userId}/wallet/export", makeHTTPHandleFunc(requireSelf(s.handleExportWallet))).Methods("POST")
+	router.HandleFunc("/users/{userId}/wallet/import", makeHTTPHandleFunc(requireSelf(s.handleImportWallet))).Methods("POST")
 
 	// Privy user routes
-	router.HandleFunc("/privy-users/${id}", makeHTTPHandleFunc(s.handleCreatePrivyUser)).Methods("POST")
+	router.HandleFunc("/privy-users/{userId}", makeHTTPHandleFunc(requireSelf(s.handleCreatePrivyUser))).Methods("POST")
 
 	// Writing session routes
-	router.HandleFunc("/writing-session-started", makeHTTPHandleFunc(s.handleWritingSessionStarted)).Methods("POST")
-	router.HandleFunc("/writing-session-ended", makeHTTPHandleFunc(s.handleWritingSessionEnded)).Methods("POST")
-	router.HandleFunc("/writing-sessions/{id}", makeHTTPHandleFunc(s.handleGetWritingSession)).Methods("GET")
-	router.HandleFunc("/users/{userId}/writing-sessions", makeHTTPHandleFunc(s.handleGetUserWritingSessions)).Methods("GET")
+	router.HandleFunc("/writing-session-started", makeHTTPHandleFunc(requireUser(s.handleWritingSessionStarted))).Methods("POST")
+	router.HandleFunc("/writing-session-ended", makeHTTPHandleFunc(requireUser(s.handleWritingSessionEnded))).Methods("POST")
+	router.HandleFunc("/writing-sessions/{id}", makeHTTPHandleFunc(requireUser(s.handleGetWritingSession))).Methods("GET")
+	router.HandleFunc("/writing-sessions/{id}/replay", makeHTTPHandleFunc(s.handleReplayWritingSession)).Methods("GET")
+	router.HandleFunc("/users/{userId}/writing-sessions", makeHTTPHandleFunc(requireSelf(s.handleGetUserWritingSessions))).Methods("GET")
 
 	// Anky routes
-	router.HandleFunc("/ankys", makeHTTPHandleFunc(s.handleGetAnkys)).Methods("GET")
+	router.HandleFunc("/ankys", makeHTTPHandleFunc(requireAdmin(s.handleGetAnkys))).Methods("GET")
 	router.HandleFunc("/ankys/{id}", makeHTTPHandleFunc(s.handleGetAnkyByID)).Methods("GET")
-	router.HandleFunc("/users/{userId}/ankys", makeHTTPHandleFunc(s.handleGetAnkysByUserID)).Methods("GET")
-	router.HandleFunc("/anky/onboarding/{userId}", makeHTTPHandleFunc(s.handleProcessUserOnboarding)).Methods("POST")
-	router.HandleFunc("/anky/edit-cast", makeHTTPHandleFunc(s.handleEditCast)).Methods("POST")
-	router.HandleFunc("/anky/simple-prompt", makeHTTPHandleFunc(s.handleSimplePrompt)).Methods("POST")
-	router.HandleFunc("/anky/messages-prompt", makeHTTPHandleFunc(s.handleMessagesPrompt)).Methods("POST")
-	router.HandleFunc("/anky/raw-writing-session", makeHTTPHandleFunc(s.handleRawWritingSession)).Methods("POST")
+	router.HandleFunc("/ankys/{id}/history", makeHTTPHandleFunc(requireUser(s.handleGetAnkyStatusHistory))).Methods("GET")
+	router.HandleFunc("/ankys/{id}/choose-image", makeHTTPHandleFunc(requireUser(s.handleChooseAnkyImage))).Methods("POST")
+	router.HandleFunc("/users/{userId}/ankys", makeHTTPHandleFunc(requireSelf(s.handleGetAnkysByUserID))).Methods("GET")
+	router.HandleFunc("/anky/onboarding/{userId}", makeHTTPHandleFunc(requireSelf(s.handleProcessUserOnboarding))).Methods("POST")
+	router.HandleFunc("/anky/onboarding/{userId}/stream", makeHTTPHandleFunc(requireSelf(s.handleProcessUserOnboardingStream))).Methods("POST")
+	router.HandleFunc("/anky/edit-cast", makeHTTPHandleFunc(requireUser(s.handleEditCast))).Methods("POST")
+	router.HandleFunc("/anky/simple-prompt", makeHTTPHandleFunc(requireUser(s.handleSimplePrompt))).Methods("POST")
+	router.HandleFunc("/anky/simple-prompt/stream", makeHTTPHandleFunc(requireUser(s.handleSimplePromptStream))).Methods("POST")
+	router.HandleFunc("/anky/messages-prompt", makeHTTPHandleFunc(requireUser(s.handleMessagesPrompt))).Methods("POST")
+	router.HandleFunc("/anky/raw-writing-session", makeHTTPHandleFunc(requireUser(s.handleRawWritingSession))).Methods("POST")
 
 	// newen routes
-	router.HandleFunc("/newen/transactions/{userId}", makeHTTPHandleFunc(s.handleGetUserTransactions)).Methods("GET")
+	router.HandleFunc("/newen/transactions/{userId}", makeHTTPHandleFunc(requireSelf(s.handleGetUserTransactions))).Methods("GET")
 
 	// Badge routes
-	router.HandleFunc("/users/{userId}/badges", makeHTTPHandleFunc(s.handleGetUserBadges)).Methods("GET")
+	router.HandleFunc("/users/{userId}/badges", makeHTTPHandleFunc(requireSelf(s.handleGetUserBadges))).Methods("GET")
+
+	// Usage routes
+	router.HandleFunc("/users/{userId}/usage", makeHTTPHandleFunc(requireSelf(s.handleGetUserUsage))).Methods("GET")
+
+	// Image routes
+	router.HandleFunc("/images", makeHTTPHandleFunc(requireUser(s.handleUploadImage))).Methods("POST")
+	router.HandleFunc("/images/{id}", makeHTTPHandleFunc(requireUser(s.handleGetImage))).Methods("GET")
+	router.HandleFunc("/images/{id}", makeHTTPHandleFunc(requireUser(s.handleDeleteImage))).Methods("DELETE")
+
+	// Files of the local blob store, when the images are kept on this server's disk
+	blobs, err := services.NewBlobStore(services.LoadBlobStoreConfig())
+	if err != nil {
+		return fmt.Errorf("error creating blob store: %v", err)
+	}
+	if local, ok := blobs.(*services.LocalBlobStore); ok {
+		router.PathPrefix("/blobs/").Handler(http.StripPrefix("/blobs", local.Handler()))
+	}
+
+	// Webhook routes
+	router.HandleFunc("/webhooks/image-generated/{id}", makeHTTPHandleFunc(s.handleImageGeneratedWebhook)).Methods("POST")
 
 	// WebSocket routes
 	router.HandleFunc("/ws/writing", s.handleWebSocket)
@@ -267,24 +435,26 @@ func (s *APIServer) handleRegisterAnonymousUser(w http.ResponseWriter, r *http.R
 
 	log.Printf("Created new user object with wallet address: %s", user.WalletAddress)
 
-	tokenString, err := utils.CreateJWT(user)
-	if err != nil {
-		log.Printf("Error creating JWT: %v", err)
-		return err
-	}
-	user.JWT = tokenString
-	log.Println("Generated JWT token for user")
-
 	if err := s.store.CreateUser(ctx, user); err != nil {
 		log.Printf("Error storing user in database: %v", err)
 		return err
 	}
 	log.Printf("Successfully stored user with ID %s in database", user.ID)
 
+	tokens, err := s.auth.StartSession(ctx, user.ID, r.UserAgent())
+	if err != nil {
+		log.Printf("Error starting session: %v", err)
+		return err
+	}
+	log.Println("Started session for user")
+
 	log.Println("Sending successful response")
 	return WriteJSON(w, http.StatusOK, map[string]interface{}{
-		"user": user,
-		"jwt":  tokenString,
+		"user":          user,
+		"jwt":           tokens.AccessToken, // the name older clients read the token from
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	})
 }
 
@@ -338,6 +508,19 @@ func (s *APIServer) handleUpdateUser(w http.ResponseWriter, r *http.Request) err
 	if err := json.NewDecoder(r.Body).Decode(updateUserRequest); err != nil {
 		return err
 	}
+	if updateUserRequest.User == nil {
+		return fmt.Errorf("user is required")
+	}
+	current, err := s.store.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	// The linked accounts set the quota tier and the role is for admins to give, nobody
+	// changes them by editing their user. The wallet isn't written here at all, it only
+	// changes through /wallet/import.
+	updateUserRequest.User.PrivyDID = current.PrivyDID
+	updateUserRequest.User.FID = current.FID
+	updateUserRequest.User.Role = current.Role
 	err = s.store.UpdateUser(ctx, id, updateUserRequest.User)
 	if err != nil {
 		return err
@@ -347,24 +530,11 @@ func (s *APIServer) handleUpdateUser(w http.ResponseWriter, r *http.Request) err
 
 // DELETE /users/{id}
 func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
-	// TODO ::::: IMPLEMENT JWT FOR VERIFICATION THAT THE USER IS THE OWNER OF THE ACCOUNT THAT IS BEING DELETED
 	ctx := r.Context()
 	id, err := utils.GetUserID(r)
 	if err != nil {
 		return err
 	}
-
-	// Get authenticated user ID from context
-	authenticatedUserID, ok := ctx.Value("userID").(uuid.UUID)
-	if !ok {
-		return fmt.Errorf("unauthorized: no user ID in context")
-	}
-
-	// Check if authenticated user matches requested user ID
-	if authenticatedUserID != id {
-		return fmt.Errorf("unauthorized: cannot delete other users")
-	}
-
 	return s.store.DeleteUser(ctx, id)
 }
 
@@ -428,49 +598,51 @@ func (s *APIServer) handleGetUserTransactions(w http.ResponseWriter, r *http.Req
 
 // ***************** PRIVY ROUTES *****************
 
+// POST /privy-users/{userId}
+// {"privy_access_token": "...", "privy_user": {"linked_accounts": [...]}}
+// Links the Privy user of the access token to the user, whose Privy tokens are accepted from
+// then on. A Privy user can only be linked to one user.
 func (s *APIServer) handleCreatePrivyUser(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
-	// 1. Verify authentication token from request header
 	userId, err := utils.GetUserID(r)
 	if err != nil {
 		return err
 	}
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return fmt.Errorf("no authorization header provided")
-	}
-
-	// Extract Bearer token
-	tokenParts := strings.Split(authHeader, " ")
-	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-		return fmt.Errorf("invalid authorization header format")
-	}
-	token := tokenParts[1]
-
-	// 2. Validate the token and get user claims
-	_, err = utils.ValidateJWT(token)
-	if err != nil {
-		return fmt.Errorf("invalid token: %v", err)
-	}
 
-	// 3. Decode the request body
 	newPrivyUserRequest := new(types.CreatePrivyUserRequest)
 	if err := json.NewDecoder(r.Body).Decode(newPrivyUserRequest); err != nil {
 		return fmt.Errorf("invalid request body: %v", err)
 	}
+	if newPrivyUserRequest.PrivyAccessToken == "" {
+		return fmt.Errorf("privy_access_token is required")
+	}
+	if s.privy == nil {
+		return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "Privy is not configured"})
+	}
+	did, err := s.privy.Verify(ctx, newPrivyUserRequest.PrivyAccessToken)
+	if err != nil {
+		return WriteJSON(w, http.StatusUnauthorized, ApiError{Error: fmt.Sprintf("invalid Privy token: %v", err)})
+	}
 
-	// 4. Create new PrivyUser with associated user ID
 	privyUser := &types.PrivyUser{
-		DID:            newPrivyUserRequest.PrivyUser.DID,
-		UserID:         userId, // Link to the authenticated user
-		CreatedAt:      time.Now().UTC(),
-		LinkedAccounts: newPrivyUserRequest.PrivyUser.LinkedAccounts,
+		DID:       did,
+		UserID:    userId, // Link to the authenticated user
+		CreatedAt: time.Now().UTC(),
+	}
+	if newPrivyUserRequest.PrivyUser != nil {
+		privyUser.LinkedAccounts = newPrivyUserRequest.PrivyUser.LinkedAccounts
 	}
 
-	// 5. Store the PrivyUser in database
-	if err := s.store.CreatePrivyUser(ctx, privyUser); err != nil {
-		return fmt.Errorf("failed to create privy user: %v", err)
+	if _, err := s.store.GetUserByID(ctx, userId); err != nil {
+		return fmt.Errorf("error getting user: %v", err)
+	}
+	linked, err := s.store.LinkUserPrivyDID(ctx, userId, did)
+	if err != nil {
+		return fmt.Errorf("failed to link privy user: %v", err)
+	}
+	if !linked {
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: "the Privy user is linked to another user"})
 	}
 
 	return WriteJSON(w, http.StatusCreated, privyUser)
@@ -501,20 +673,20 @@ func (s *APIServer) handleWritingSessionStarted(w http.ResponseWriter, r *http.R
 	}
 	fmt.Printf("Successfully parsed session ID to UUID: %s\n", sessionUUID)
 
-	// Handle anonymous users with a default UUID
+	// The session belongs to the caller, anonymous users are signed in with the JWT they
+	// got when they registered
 	fmt.Printf("Processing user ID: %s\n", newWritingSessionRequest.UserID)
-	var userUUID uuid.UUID
-	if newWritingSessionRequest.UserID == "anonymous" {
-		fmt.Println("Anonymous user detected, using default UUID")
-		// Use a specific UUID for anonymous users
-		userUUID = uuid.MustParse("00000000-0000-0000-0000-000000000000") // Anonymous user UUID
-	} else {
+	userUUID := authUser(r).ID
+	if newWritingSessionRequest.UserID != "" && newWritingSessionRequest.UserID != "anonymous" {
 		fmt.Println("Parsing non-anonymous user ID")
 		userUUID, err = uuid.Parse(newWritingSessionRequest.UserID)
 		if err != nil {
 			fmt.Printf("Failed to parse user ID: %v\n", err)
 			return fmt.Errorf("invalid user ID: %v", err)
 		}
+		if err := authorizeUser(r, userUUID); err != nil {
+			return writeAuthError(w, err)
+		}
 	}
 	fmt.Printf("Final user UUID: %s\n", userUUID)
 
@@ -570,14 +742,29 @@ func (s *APIServer) handleWritingSessionEnded(w http.ResponseWriter, r *http.Req
 		http.Error(w, fmt.Sprintf("Error getting writing session: %v", err), http.StatusInternalServerError)
 		return nil
 	}
+	if err := authorizeUser(r, writingSession.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
 
 	fmt.Println("Updating writing session fields...")
 	writingSession.EndingTimestamp = &newWritingSessionEndRequest.EndingTimestamp
-	writingSession.WordsWritten = newWritingSessionEndRequest.WordsWritten
 	writingSession.NewenEarned = newWritingSessionEndRequest.NewenEarned
-	writingSession.TimeSpent = &newWritingSessionEndRequest.TimeSpent
-	writingSession.IsAnky = newWritingSessionEndRequest.IsAnky
-	writingSession.Writing = newWritingSessionEndRequest.Text
+
+	// Trust the keystrokes over the values reported by the client whenever we have them.
+	// IsAnky, TimeSpent and Status all come from the server's verdict.
+	writingSessionService := services.NewWritingSessionService()
+	rawSession, err := writingSessionService.LoadRawSession(writingSession.UserID, writingSession.ID)
+	switch {
+	case err == nil:
+		fmt.Println("Using the values computed from the raw writing session")
+		writingSessionService.ApplyRawSession(writingSession, rawSession)
+	case errors.Is(err, services.ErrRawSessionNotFound):
+		fmt.Println("No raw writing session stored, falling back to the client report")
+		writingSessionService.ApplyClientReport(writingSession, newWritingSessionEndRequest.Text, newWritingSessionEndRequest.TimeSpent)
+	default:
+		http.Error(w, fmt.Sprintf("Error reading raw writing session: %v", err), http.StatusInternalServerError)
+		return nil
+	}
 
 	fmt.Printf("Parsed ParentAnkyID: %s\n", newWritingSessionEndRequest.ParentAnkyID)
 	if newWritingSessionEndRequest.ParentAnkyID != "" {
@@ -590,93 +777,94 @@ func (s *APIServer) handleWritingSessionEnded(w http.ResponseWriter, r *http.Req
 	}
 
 	writingSession.AnkyResponse = &newWritingSessionEndRequest.AnkyResponse
-	writingSession.Status = newWritingSessionEndRequest.Status
 
+	if newWritingSessionEndRequest.IsAnky && !writingSession.IsAnky {
+		fmt.Printf("Client claimed an Anky for session %s but the verdict is: %+v\n", writingSession.ID, writingSession.Verdict)
+	}
 	fmt.Printf("Writing session fields updated: %+v\n", writingSession)
 
+	var quotaExceeded *services.QuotaExceededError
 	if writingSession.IsAnky {
-		bgCtx := context.Background()
+		if err := s.startAnkyCreation(ctx, writingSession); err != nil && !errors.As(err, &quotaExceeded) {
+			return err
+		}
+	}
 
-		fmt.Println("Initiating Anky creation process...")
+	fmt.Printf("Saving writing session with updated status: %s\n", writingSession.Status)
+	if err := s.store.UpdateWritingSession(ctx, writingSession); err != nil {
+		fmt.Printf("Error updating writing session: %v\n", err)
+		return nil
+	}
 
-		// Validate UUIDs before creating Anky
-		if writingSession.ID == uuid.Nil {
-			return fmt.Errorf("writing session ID is nil")
-		}
-		if writingSession.UserID == uuid.Nil {
-			return fmt.Errorf("user ID is nil")
-		}
+	fmt.Println("Writing session successfully updated:")
+	fmt.Printf("%+v\n", writingSession)
 
-		anky := types.NewAnky(writingSession.ID, writingSession.Prompt, writingSession.UserID)
+	// The writing is saved, only its Anky won't be made
+	if quotaExceeded != nil {
+		return writeQuotaExceeded(w, quotaExceeded)
+	}
 
-		// Additional validation
-		if anky.ID == uuid.Nil {
-			return fmt.Errorf("generated anky ID is nil")
-		}
+	return WriteJSON(w, http.StatusOK, writingSession)
+}
 
-		log.Printf("Creating Anky - ID: %s, UserID: %s, WritingSessionID: %s",
-			anky.ID, anky.UserID, anky.WritingSessionID)
+// startAnkyCreation creates the Anky of a valid writing session and queues its generation.
+// The ID of the new Anky is set on the writing session, which the caller still has to save.
+// It returns a QuotaExceededError when the user can't have another image today.
+func (s *APIServer) startAnkyCreation(ctx context.Context, writingSession *types.WritingSession) error {
+	fmt.Println("Initiating Anky creation process...")
 
-		if err := s.store.CreateAnky(ctx, anky); err != nil {
-			log.Printf("Error creating initial anky record: %v", err)
-			return fmt.Errorf("failed to create anky record: %v", err)
-		}
-		fmt.Println("Initial Anky record created in database.")
+	// Validate UUIDs before creating Anky
+	if writingSession.ID == uuid.Nil {
+		return fmt.Errorf("writing session ID is nil")
+	}
+	if writingSession.UserID == uuid.Nil {
+		return fmt.Errorf("user ID is nil")
+	}
 
-		ankyService, err := services.NewAnkyService(s.store)
-		if err != nil {
-			log.Printf("Error creating anky service: %v", err)
-			return fmt.Errorf("failed to create anky service: %v", err)
-		}
-		fmt.Println("Anky service created successfully.")
-
-		// Create error channel with buffer
-		errChan := make(chan error, 1)
-		doneChan := make(chan bool, 1)
-
-		go func() {
-			defer close(errChan)
-			defer close(doneChan)
-
-			log.Printf("Starting ProcessAnkyCreation for Anky ID: %s", anky.ID)
-			if err := ankyService.ProcessAnkyCreation(bgCtx, anky, writingSession); err != nil {
-				log.Printf("Error processing Anky creation: %v", err)
-				anky.Status = "failed"
-				if updateErr := s.store.UpdateAnky(bgCtx, anky); updateErr != nil {
-					log.Printf("Error updating Anky status: %v", updateErr)
-				}
-				errChan <- err
-				return
-			}
-			log.Printf("Successfully completed ProcessAnkyCreation for Anky ID: %s", anky.ID)
-			doneChan <- true
-		}()
+	user, err := s.store.GetUserByID(ctx, writingSession.UserID)
+	if err != nil {
+		return fmt.Errorf("error getting the user of the writing session: %v", err)
+	}
+	if err := s.quotas.ReserveImageGeneration(ctx, user); err != nil {
+		return err
+	}
 
-		// Set a timeout for the goroutine
-		select {
-		case err := <-errChan:
-			if err != nil {
-				log.Printf("Received error from ProcessAnkyCreation: %v", err)
-				// Continue execution despite error, as this is async
-			}
-		case <-time.After(2 * time.Second): // Adjust timeout as needed
-			log.Println("ProcessAnkyCreation started successfully in background")
-		}
+	anky := types.NewAnky(writingSession.ID, writingSession.Prompt, writingSession.UserID)
 
-		writingSession.AnkyID = &anky.ID
-		fmt.Printf("Anky ID set in writing session: %s\n", anky.ID)
+	// Additional validation
+	if anky.ID == uuid.Nil {
+		return fmt.Errorf("generated anky ID is nil")
 	}
 
-	fmt.Printf("Saving writing session with updated status: %s\n", writingSession.Status)
+	log.Printf("Creating Anky - ID: %s, UserID: %s, WritingSessionID: %s",
+		anky.ID, anky.UserID, anky.WritingSessionID)
+
+	if err := s.store.CreateAnky(ctx, anky); err != nil {
+		log.Printf("Error creating initial anky record: %v", err)
+		return fmt.Errorf("failed to create anky record: %v", err)
+	}
+	fmt.Println("Initial Anky record created in database.")
+
+	writingSession.AnkyID = &anky.ID
+	fmt.Printf("Anky ID set in writing session: %s\n", anky.ID)
+
+	// The job workers load the writing session through its ID, so it must be saved first
 	if err := s.store.UpdateWritingSession(ctx, writingSession); err != nil {
-		fmt.Printf("Error updating writing session: %v\n", err)
-		return nil
+		return fmt.Errorf("failed to link anky to writing session: %v", err)
 	}
 
-	fmt.Println("Writing session successfully updated:")
-	fmt.Printf("%+v\n", writingSession)
+	if err := s.ankyJobs.Enqueue(ctx, anky); err != nil {
+		log.Printf("Error queueing anky creation: %v", err)
+		return fmt.Errorf("failed to queue anky creation: %v", err)
+	}
+	log.Printf("Anky %s queued for processing", anky.ID)
 
-	return WriteJSON(w, http.StatusOK, writingSession)
+	return nil
+}
+
+// StartAnkyWorkers starts the workers that process the queued Ankys until ctx is cancelled
+func (s *APIServer) StartAnkyWorkers(ctx context.Context) (*sync.WaitGroup, error) {
+	return s.ankyJobs.Start(ctx)
 }
 
 func (s *APIServer) handleGetWritingSession(w http.ResponseWriter, r *http.Request) error {
@@ -695,113 +883,159 @@ func (s *APIServer) handleGetWritingSession(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		return err
 	}
+	if err := authorizeUser(r, session.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
 
 	return WriteJSON(w, http.StatusOK, session)
 }
-func (s *APIServer) handleRawWritingSession(w http.ResponseWriter, r *http.Request) error {
-	log.Println("Starting handleRawWritingSession...")
-	log.Printf("Request method: %s", r.Method)
-	log.Printf("Request headers: %+v", r.Header)
 
-	// Read and decode JSON request
-	var requestData struct {
-		WritingString string `json:"writingString"`
+// GET /writing-sessions/{id}/replay?speed=4
+// Streams the keystrokes of a session back as Server-Sent Events, keeping their original timing.
+// Anyone can replay a session whose Anky was published, the others are for their writer only.
+func (s *APIServer) handleReplayWritingSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	sessionID, err := getSessionID(r)
+	if err != nil {
+		return err
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		log.Printf("Error decoding JSON request: %v", err)
-		return err
+	sessionUUID, err := uuid.Parse(sessionID)
+	if err != nil {
+		return fmt.Errorf("invalid session ID format: %v", err)
 	}
-	defer r.Body.Close()
 
-	log.Printf("Raw writing string: %s", requestData.WritingString)
+	speed := 1.0
+	if speedStr := r.URL.Query().Get("speed"); speedStr != "" {
+		parsedSpeed, err := strconv.ParseFloat(speedStr, 64)
+		if err != nil || parsedSpeed <= 0 || parsedSpeed > maxReplaySpeed {
+			return fmt.Errorf("invalid speed %q: must be a number between 0 and %d", speedStr, maxReplaySpeed)
+		}
+		speed = parsedSpeed
+	}
 
-	// Split the writing string into lines
-	lines := strings.Split(requestData.WritingString, "\n")
-	log.Printf("Number of lines split from writing string: %d", len(lines))
+	rawSession, err := services.NewWritingSessionService().FindRawSession(sessionUUID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeUser(r, rawSession.UserID); err != nil {
+		published, lookupErr := s.store.HasPublishedAnky(ctx, sessionUUID)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if !published {
+			return writeAuthError(w, err)
+		}
+	}
+	// The session is over after the first 8-second pause, so that's where the replay ends
+	session := rawSession.Effective()
 
-	if len(lines) < 4 {
-		log.Printf("Invalid format - insufficient lines. Got %d lines, expected at least 4", len(lines))
-		return fmt.Errorf("invalid writing session format: insufficient lines (got %d, need at least 4)", len(lines))
+	stream, err := newSSEStream(w)
+	if err != nil {
+		return err
 	}
 
-	// Extract metadata from first 4 lines
-	userId := strings.TrimSpace(lines[0])
-	sessionId := strings.TrimSpace(lines[1])
-	prompt := strings.TrimSpace(lines[2])
-	startingTimestamp := strings.TrimSpace(lines[3])
+	if err := stream.Send("session", map[string]interface{}{
+		"user_id":            session.UserID,
+		"session_id":         session.SessionID,
+		"prompt":             session.Prompt,
+		"starting_timestamp": session.StartingTimestamp.UnixMilli(),
+		"keystroke_count":    len(session.Keystrokes),
+		"speed":              speed,
+	}); err != nil {
+		return nil
+	}
 
-	log.Printf("Extracted metadata:")
-	log.Printf("- User ID (length: %d): '%s'", len(userId), userId)
-	log.Printf("- Session ID (length: %d): '%s'", len(sessionId), sessionId)
-	log.Printf("- Prompt (length: %d): '%s'", len(prompt), prompt)
-	log.Printf("- Starting Timestamp (length: %d): '%s'", len(startingTimestamp), startingTimestamp)
+	var elapsedMs int64
+	for i, keystroke := range session.Keystrokes {
+		delay := time.Duration(float64(keystroke.DelayMs)/speed) * time.Millisecond
+		select {
+		case <-ctx.Done():
+			log.Printf("Replay of session %s cancelled by the client", session.SessionID)
+			return nil
+		case <-time.After(delay):
+		}
 
-	// Get writing content (remaining lines)
-	writingContent := strings.Join(lines[4:], "\n")
-	log.Printf("Writing content length: %d bytes", len(writingContent))
-	log.Printf("First 100 chars of writing content: %s", writingContent[:min(100, len(writingContent))])
+		elapsedMs += keystroke.DelayMs
+		if err := stream.Send("keystroke", map[string]interface{}{
+			"index":      i,
+			"key":        keystroke.Key,
+			"delay_ms":   keystroke.DelayMs,
+			"elapsed_ms": elapsedMs,
+		}); err != nil {
+			return nil
+		}
+	}
 
-	// Create data directory structure if it doesn't exist
-	userDir := fmt.Sprintf("data/writing_sessions/%s", userId)
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		log.Printf("Error creating directory structure: %v", err)
-		return err
+	stream.Send("end", map[string]interface{}{
+		"text":    session.Text(),
+		"verdict": rawSession.Verdict(),
+	})
+	return nil
+}
+
+func (s *APIServer) handleRawWritingSession(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log.Println("Starting handleRawWritingSession...")
+
+	// Read and decode JSON request
+	var requestData struct {
+		WritingString string `json:"writingString"`
 	}
 
-	// Save individual writing session file
-	sessionFilePath := fmt.Sprintf("%s/%s.txt", userDir, sessionId)
-	if err := os.WriteFile(sessionFilePath, []byte(requestData.WritingString), 0644); err != nil {
-		log.Printf("Error writing session file: %v", err)
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		log.Printf("Error decoding JSON request: %v", err)
 		return err
 	}
+	defer r.Body.Close()
 
-	// Update all_writing_sessions.txt
-	allSessionsPath := fmt.Sprintf("%s/all_writing_sessions.txt", userDir)
-	f, err := os.OpenFile(allSessionsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// Only the writer can store their session
+	parsed, err := types.ParseRawWritingSession(requestData.WritingString)
 	if err != nil {
-		log.Printf("Error opening all_writing_sessions.txt: %v", err)
-		return err
+		return fmt.Errorf("invalid writing session: %v", err)
+	}
+	if err := authorizeUser(r, parsed.UserID); err != nil {
+		return writeAuthError(w, err)
 	}
-	defer f.Close()
 
-	// Add newline before new session ID if file is not empty
-	fileInfo, err := f.Stat()
+	// Parse, validate and store the keystrokes
+	writingSessionService := services.NewWritingSessionService()
+	rawSession, err := writingSessionService.SaveRawSession(requestData.WritingString)
 	if err != nil {
-		log.Printf("Error getting file info: %v", err)
-		return err
+		log.Printf("Error storing raw writing session: %v", err)
+		return fmt.Errorf("invalid writing session: %v", err)
 	}
 
-	if fileInfo.Size() > 0 {
-		if _, err := f.WriteString("\n"); err != nil {
-			log.Printf("Error writing newline: %v", err)
-			return err
-		}
-	}
+	writingContent := rawSession.Text()
+	log.Printf("Reconstructed writing session %s: %d keystrokes, %d words, %s total, longest pause %s",
+		rawSession.SessionID,
+		len(rawSession.Keystrokes),
+		rawSession.WordCount(),
+		rawSession.TotalDuration(),
+		rawSession.LongestPause(),
+	)
 
-	if _, err := f.WriteString(sessionId); err != nil {
-		log.Printf("Error writing session ID: %v", err)
-		return err
+	// Create writing session object for feedback, using the values computed from the keystrokes
+	writingSession := &types.WritingSession{
+		ID:                rawSession.SessionID,
+		UserID:            rawSession.UserID,
+		Prompt:            rawSession.Prompt,
+		StartingTimestamp: rawSession.StartingTimestamp,
 	}
+	writingSessionService.ApplyRawSession(writingSession, rawSession)
 
 	response := map[string]interface{}{
-		"userId":            userId,
-		"sessionId":         sessionId,
-		"prompt":            prompt,
-		"startingTimestamp": startingTimestamp,
+		"userId":            rawSession.UserID,
+		"sessionId":         rawSession.SessionID,
+		"prompt":            rawSession.Prompt,
+		"startingTimestamp": rawSession.StartingTimestamp.UnixMilli(),
 		"writingContent":    writingContent,
+		"timeSpent":         writingSession.TimeSpent,
+		"wordsWritten":      writingSession.WordsWritten,
+		"longestPauseMs":    rawSession.LongestPause().Milliseconds(),
+		"verdict":           writingSession.Verdict,
 	}
 
-	log.Println("Preparing to send response...")
-	log.Printf("Response object: %+v", response)
-
-	err = WriteJSON(w, http.StatusOK, response)
-	if err != nil {
-		log.Printf("Error writing JSON response: %v", err)
-		return err
-	}
-
-	log.Println("Successfully completed handleRawWritingSession")
 	// Get feedback from Anky about the writing session
 	ankyService, err := services.NewAnkyService(s.store)
 	if err != nil {
@@ -809,31 +1043,18 @@ func (s *APIServer) handleRawWritingSession(w http.ResponseWriter, r *http.Reque
 		return err
 	}
 
-	// Create writing session object for feedback
-	writingSession := &types.WritingSession{
-		ID:        uuid.MustParse(sessionId),
-		UserID:    userId,
-		Writing:   writingContent,
-		TimeSpent: int(time.Since(startingTimestamp).Seconds()),
-	}
-
-	feedback, err := ankyService.OnboardingConversation(ctx, userId, []*types.WritingSession{writingSession}, []string{})
+	feedback, err := ankyService.OnboardingConversation(ctx, rawSession.UserID, []*types.WritingSession{writingSession}, []string{})
 	if err != nil {
 		log.Printf("Error getting Anky feedback: %v", err)
 		return err
 	}
 
 	// Update response with feedback
-	response["ankyFeedback"] = feedback
-
-	// Send updated response
-	err = WriteJSON(w, http.StatusOK, response)
-	if err != nil {
-		log.Printf("Error writing JSON response with feedback: %v", err)
-		return err
-	}
+	response["ankyFeedback"] = feedback.ResponseToUser
+	response["prompt_version"] = feedback.PromptVersion
 
-	return nil
+	log.Println("Successfully completed handleRawWritingSession")
+	return WriteJSON(w, http.StatusOK, response)
 }
 
 func (s *APIServer) handleGetUserWritingSessions(w http.ResponseWriter, r *http.Request) error {
@@ -876,8 +1097,11 @@ func (s *APIServer) handleGetUserWritingSessions(w http.ResponseWriter, r *http.
 	return WriteJSON(w, http.StatusOK, userSessions)
 }
 
+// maxReplaySpeed caps how fast a session can be replayed
+const maxReplaySpeed = 64
+
 func getSessionID(r *http.Request) (string, error) {
-	sessionID := mux.Vars(r)["sessionId"]
+	sessionID := mux.Vars(r)["id"]
 	if sessionID == "" {
 		return "", fmt.Errorf("no session ID provided")
 	}
@@ -898,26 +1122,10 @@ func (s *APIServer) handleProcessUserOnboarding(w http.ResponseWriter, r *http.R
 	}
 	fmt.Printf("User ID obtained: %s\n", userID)
 
-	// Parse request body
-	fmt.Println("Decoding request body...")
-	var onboardingRequest struct {
-		UserWritings    []*types.WritingSession `json:"user_writings"`
-		AnkyReflections []string                `json:"anky_responses"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&onboardingRequest); err != nil {
-		fmt.Printf("Error decoding request body: %v\n", err)
-		return fmt.Errorf("error decoding request body: %v", err)
-	}
-	fmt.Printf("Decoded request body: %+v\n", onboardingRequest)
-
-	// Validate the lengths
-	fmt.Println("Validating lengths of user writings and anky reflections...")
-	if len(onboardingRequest.UserWritings) != len(onboardingRequest.AnkyReflections)+1 {
-		fmt.Println("Invalid number of writings and reflections")
-		return fmt.Errorf("invalid number of writings and reflections")
+	onboardingRequest, err := decodeOnboardingRequest(r)
+	if err != nil {
+		return err
 	}
-	fmt.Println("Validation successful")
 
 	fmt.Println("Creating Anky service...")
 	ankyService, err := services.NewAnkyService(s.store)
@@ -927,20 +1135,102 @@ func (s *APIServer) handleProcessUserOnboarding(w http.ResponseWriter, r *http.R
 	}
 	fmt.Println("Anky service created successfully")
 
+	if err := s.quotas.ReserveLLMCall(ctx, authUser(r)); err != nil {
+		return writeQuotaError(w, err)
+	}
+
 	fmt.Println("Processing onboarding conversation...")
 	response, err := ankyService.OnboardingConversation(ctx, userID, onboardingRequest.UserWritings, onboardingRequest.AnkyReflections)
 	if err != nil {
 		fmt.Printf("Error processing onboarding conversation: %v\n", err)
 		return fmt.Errorf("error processing onboarding conversation: %v", err)
 	}
-	fmt.Printf("Onboarding conversation processed successfully, response: %s\n", response)
+	s.quotas.RecordTokens(ctx, authUser(r).ID, onboardingRequest.text(), response.ResponseToUser)
+	fmt.Printf("Onboarding conversation processed successfully, response: %s\n", response.ResponseToUser)
 
 	fmt.Println("Sending response...")
 	return WriteJSON(w, http.StatusOK, map[string]string{
-		"reflection": response,
+		"reflection":     response.ResponseToUser,
+		"prompt_version": response.PromptVersion,
 	})
 }
 
+type onboardingRequest struct {
+	UserWritings    []*types.WritingSession `json:"user_writings"`
+	AnkyReflections []string                `json:"anky_responses"`
+}
+
+// text is what the user sends to the model, for the quotas
+func (o *onboardingRequest) text() string {
+	var text strings.Builder
+	for _, session := range o.UserWritings {
+		text.WriteString(session.Writing)
+	}
+	for _, reflection := range o.AnkyReflections {
+		text.WriteString(reflection)
+	}
+	return text.String()
+}
+
+func decodeOnboardingRequest(r *http.Request) (*onboardingRequest, error) {
+	// Parse request body
+	fmt.Println("Decoding request body...")
+	var request onboardingRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		fmt.Printf("Error decoding request body: %v\n", err)
+		return nil, fmt.Errorf("error decoding request body: %v", err)
+	}
+	fmt.Printf("Decoded request body: %+v\n", request)
+
+	// Validate the lengths
+	fmt.Println("Validating lengths of user writings and anky reflections...")
+	if len(request.UserWritings) != len(request.AnkyReflections)+1 {
+		fmt.Println("Invalid number of writings and reflections")
+		return nil, fmt.Errorf("invalid number of writings and reflections")
+	}
+	fmt.Println("Validation successful")
+
+	return &request, nil
+}
+
+// POST /anky/onboarding/{userId}/stream
+// Same as /anky/onboarding/{userId}, but Anky's reflection is streamed as Server-Sent Events
+// while the model writes it
+func (s *APIServer) handleProcessUserOnboardingStream(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	userID, err := utils.GetUserID(r)
+	if err != nil {
+		return err
+	}
+
+	onboardingRequest, err := decodeOnboardingRequest(r)
+	if err != nil {
+		return err
+	}
+
+	ankyService, err := services.NewAnkyService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	if err := s.quotas.ReserveLLMCall(ctx, authUser(r)); err != nil {
+		return writeQuotaError(w, err)
+	}
+
+	chunks, err := ankyService.OnboardingConversationStream(ctx, userID, onboardingRequest.UserWritings, onboardingRequest.AnkyReflections)
+	if err != nil {
+		return fmt.Errorf("error processing onboarding conversation: %v", err)
+	}
+	chunks = s.quotas.MeterStream(ctx, authUser(r).ID, onboardingRequest.text(), chunks)
+
+	stream, err := newSSEStream(w)
+	if err != nil {
+		return err
+	}
+	return stream.SendLLMResponse(chunks, "reflection")
+}
+
 func (s *APIServer) handleGetAnkys(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
@@ -978,6 +1268,76 @@ func (s *APIServer) handleGetAnkyByID(w http.ResponseWriter, r *http.Request) er
 	return WriteJSON(w, http.StatusOK, anky)
 }
 
+// GET /ankys/{id}/history
+// Returns every status transition of the Anky, with the error and attempt that caused it,
+// to see where and why its generation stalled
+func (s *APIServer) handleGetAnkyStatusHistory(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	ankyID, err := utils.GetAnkyID(r)
+	if err != nil {
+		return err
+	}
+
+	anky, err := s.store.GetAnkyByID(ctx, ankyID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeUser(r, anky.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	history, err := s.store.GetAnkyStatusHistory(ctx, ankyID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"anky_id": anky.ID,
+		"status":  anky.Status,
+		"history": history,
+	})
+}
+
+// POST /ankys/{id}/choose-image
+// Makes one of the image candidates the image of the Anky, by its index in image_candidates.
+// Once the time to choose is over the image is chosen automatically and this fails.
+func (s *APIServer) handleChooseAnkyImage(w http.ResponseWriter, r *http.Request) error {
+	ankyID, err := utils.GetAnkyID(r)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Index *int `json:"index"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	if body.Index == nil {
+		return fmt.Errorf("index is required")
+	}
+
+	owned, err := s.store.GetAnkyByID(r.Context(), ankyID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeUser(r, owned.UserID); err != nil {
+		return writeAuthError(w, err)
+	}
+
+	ankyService, err := services.NewAnkyService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	anky, err := ankyService.ChooseAnkyImage(r.Context(), ankyID, *body.Index)
+	if err != nil {
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+	}
+
+	return WriteJSON(w, http.StatusOK, anky)
+}
+
 func (s *APIServer) handleGetAnkysByUserID(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
@@ -1048,16 +1408,55 @@ func (s *APIServer) handleSimplePrompt(w http.ResponseWriter, r *http.Request) e
 		return fmt.Errorf("error creating anky service: %v", err)
 	}
 
+	if err := s.quotas.ReserveLLMCall(ctx, authUser(r)); err != nil {
+		return writeQuotaError(w, err)
+	}
+
 	response, err := ankyService.SimplePrompt(ctx, singlePromptRequest.Prompt)
 	if err != nil {
 		return fmt.Errorf("error processing simple prompt: %v", err)
 	}
+	s.quotas.RecordTokens(ctx, authUser(r).ID, singlePromptRequest.Prompt, response)
 
 	return WriteJSON(w, http.StatusOK, map[string]string{
 		"response": response,
 	})
 }
 
+// POST /anky/simple-prompt/stream
+// Same as /anky/simple-prompt, but the response is streamed as Server-Sent Events
+func (s *APIServer) handleSimplePromptStream(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	var singlePromptRequest struct {
+		Prompt string `json:"prompt"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&singlePromptRequest); err != nil {
+		return fmt.Errorf("error decoding request body: %v", err)
+	}
+
+	ankyService, err := services.NewAnkyService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	if err := s.quotas.ReserveLLMCall(ctx, authUser(r)); err != nil {
+		return writeQuotaError(w, err)
+	}
+
+	chunks, err := ankyService.SimplePromptStream(ctx, singlePromptRequest.Prompt)
+	if err != nil {
+		return fmt.Errorf("error processing simple prompt: %v", err)
+	}
+	chunks = s.quotas.MeterStream(ctx, authUser(r).ID, singlePromptRequest.Prompt, chunks)
+
+	stream, err := newSSEStream(w)
+	if err != nil {
+		return err
+	}
+	return stream.SendLLMResponse(chunks, "response")
+}
+
 func (s *APIServer) handleMessagesPrompt(w http.ResponseWriter, r *http.Request) error {
 	var messagesPromptRequest struct {
 		Messages []string `json:"messages"`
@@ -1073,10 +1472,15 @@ func (s *APIServer) handleMessagesPrompt(w http.ResponseWriter, r *http.Request)
 		return fmt.Errorf("error creating anky service: %v", err)
 	}
 
-	response, err := ankyService.MessagesPromptRequest(messagesPromptRequest.Messages)
+	if err := s.quotas.ReserveLLMCall(r.Context(), authUser(r)); err != nil {
+		return writeQuotaError(w, err)
+	}
+
+	response, err := ankyService.MessagesPromptRequest(r.Context(), messagesPromptRequest.Messages)
 	if err != nil {
 		return fmt.Errorf("error processing messages prompt: %v", err)
 	}
+	s.quotas.RecordTokens(r.Context(), authUser(r).ID, strings.Join(messagesPromptRequest.Messages, "\n"), response)
 
 	return WriteJSON(w, http.StatusOK, map[string]string{
 		"response": response,
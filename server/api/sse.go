@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ankylat/anky/server/services"
+)
+
+// sseStream writes Server-Sent Events to a client
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEStream(w http.ResponseWriter) (*sseStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported by this connection")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let nginx buffer the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &sseStream{w: w, flusher: flusher}, nil
+}
+
+// Send writes one event with its payload encoded as JSON
+func (s *sseStream) Send(event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %v", event, err)
+	}
+
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// SendLLMResponse forwards a streamed model response: a token event for every chunk, then
+// a done event with the whole text under the given key, or an error event if the stream failed.
+func (s *sseStream) SendLLMResponse(chunks <-chan services.LLMChunk, key string) error {
+	var text strings.Builder
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return s.Send("error", map[string]string{"error": chunk.Err.Error()})
+		}
+		text.WriteString(chunk.Content)
+		if err := s.Send("token", map[string]string{"content": chunk.Content}); err != nil {
+			return err
+		}
+	}
+	return s.Send("done", map[string]string{key: text.String()})
+}
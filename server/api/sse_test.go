@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type sseEvent struct {
+	Name string
+	Data map[string]any
+}
+
+// readSSEEvents reads the events of a stream until it ends
+func readSSEEvents(t *testing.T, body io.Reader) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var event sseEvent
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.Name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data); err != nil {
+				t.Fatalf("invalid data for event %q: %v", event.Name, err)
+			}
+		case line == "":
+			events = append(events, event)
+			event = sseEvent{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("error reading the stream: %v", err)
+	}
+	return events
+}
+
+func TestSSEStreamsLLMResponse(t *testing.T) {
+	llm := services.NewLLMServiceWithProvider(services.NewFakeLLMProvider(), "fake")
+	server := httptest.NewServer(makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		chunks, err := llm.SendSimpleRequest(r.Context(), r.URL.Query().Get("prompt"))
+		if err != nil {
+			return err
+		}
+		stream, err := newSSEStream(w)
+		if err != nil {
+			return err
+		}
+		return stream.SendLLMResponse(chunks, "response")
+	}))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?prompt=what+is+alive+in+you")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", contentType)
+	}
+
+	events := readSSEEvents(t, res.Body)
+	if len(events) < 2 {
+		t.Fatalf("expected tokens and a done event, got %v", events)
+	}
+	var tokens strings.Builder
+	for _, event := range events[:len(events)-1] {
+		if event.Name != "token" {
+			t.Fatalf("expected token events before the end, got %q", event.Name)
+		}
+		tokens.WriteString(event.Data["content"].(string))
+	}
+
+	done := events[len(events)-1]
+	if done.Name != "done" {
+		t.Fatalf("expected the stream to end with done, got %q", done.Name)
+	}
+	if done.Data["response"] != tokens.String() {
+		t.Errorf("expected the done event to hold the streamed text %q, got %q", tokens.String(), done.Data["response"])
+	}
+	if !strings.HasSuffix(tokens.String(), "to: what is alive in you") {
+		t.Errorf("expected the fake reply to the prompt, got %q", tokens.String())
+	}
+}
+
+func TestSSEStreamsLLMError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	stream, err := newSSEStream(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := make(chan services.LLMChunk, 2)
+	chunks <- services.LLMChunk{Content: "half "}
+	chunks <- services.LLMChunk{Err: errors.New("the model went away")}
+	close(chunks)
+	if err := stream.SendLLMResponse(chunks, "response"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := readSSEEvents(t, rec.Body)
+	if len(events) != 2 || events[0].Name != "token" || events[1].Name != "error" {
+		t.Fatalf("expected a token and an error event, got %v", events)
+	}
+	if events[1].Data["error"] != "the model went away" {
+		t.Errorf("expected the error of the model, got %v", events[1].Data)
+	}
+}
+
+// A session written over 1.5 seconds that keeps going after an 8-second pause, which the replay leaves out
+func writeReplayFixture(t *testing.T, userID, sessionID uuid.UUID) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("WRITING_SESSIONS_DIR", dir)
+
+	lines := []string{
+		userID.String(),
+		sessionID.String(),
+		"what is alive in you?",
+		fmt.Sprint(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()),
+		"h 0", "i 300", "  200", "y 400", "o 250", "Backspace 150", "u 200",
+		"x 9000",
+	}
+	if err := os.MkdirAll(filepath.Join(dir, userID.String()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, userID.String(), sessionID.String()+".txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayWritingSession(t *testing.T) {
+	writer := &types.User{ID: uuid.New(), Role: types.UserRoleUser}
+	sessionID := uuid.New()
+	writeReplayFixture(t, writer.ID, sessionID)
+
+	s := &APIServer{}
+	router := mux.NewRouter()
+	router.HandleFunc("/writing-sessions/{id}/replay", makeHTTPHandleFunc(s.handleReplayWritingSession))
+
+	tests := []struct {
+		name   string
+		caller *types.User
+		speed  string
+		want   int
+	}{
+		{"writer", writer, "64", http.StatusOK},
+		{"too fast", writer, "1000", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/writing-sessions/"+sessionID.String()+"/replay?speed="+tt.speed, nil)
+			req = req.WithContext(context.WithValue(req.Context(), userContextKey, tt.caller))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			events := readSSEEvents(t, rec.Body)
+			if len(events) != 9 {
+				t.Fatalf("expected a session, 7 keystrokes and an end event, got %d events", len(events))
+			}
+			if events[0].Name != "session" || events[0].Data["keystroke_count"] != float64(7) || events[0].Data["speed"] != float64(64) {
+				t.Errorf("unexpected session event %v", events[0])
+			}
+			last := events[7]
+			if last.Name != "keystroke" || last.Data["key"] != "u" || last.Data["elapsed_ms"] != float64(1500) {
+				t.Errorf("unexpected last keystroke %v", last)
+			}
+			end := events[8]
+			if end.Name != "end" || end.Data["text"] != "hi yu" {
+				t.Errorf("unexpected end event %v", end)
+			}
+		})
+	}
+}
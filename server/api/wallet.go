@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/types"
+	"github.com/ankylat/anky/server/utils"
+)
+
+// Custodial wallets
+//
+// The mnemonic is never part of a user's JSON. The wallet routes are for the user only, admins
+// included, and re-authenticate the caller with the refresh token of their session on top of
+// the access token (see services.WalletCustodyService). Requests signed with a Privy token
+// have no session with us to re-authenticate with.
+
+var errWalletSelfOnly = errors.New("only the user can export or replace their wallet")
+
+// reauthenticateWallet checks that the caller is the user of the path and that they hold the
+// refresh token of their session. It answers the request itself and returns nil when they don't.
+func (s *APIServer) reauthenticateWallet(w http.ResponseWriter, r *http.Request, refreshToken string) (*types.User, *services.WalletRequestOrigin, error) {
+	userID, err := utils.GetUserID(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	user := authUser(r)
+	if user.ID != userID {
+		return nil, nil, WriteJSON(w, http.StatusForbidden, ApiError{Error: errWalletSelfOnly.Error()})
+	}
+	session := authSession(r)
+	if session == nil {
+		return nil, nil, WriteJSON(w, http.StatusForbidden, ApiError{Error: "signed in with Privy, sign in with a session to re-authenticate"})
+	}
+
+	origin := &services.WalletRequestOrigin{
+		SessionID: &session.ID,
+		IPAddress: s.rateLimiter.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := s.auth.Reauthenticate(r.Context(), session.ID, refreshToken); err != nil {
+		if !errors.Is(err, services.ErrReauthFailed) && !errors.Is(err, services.ErrRefreshTokenReused) {
+			return nil, nil, err
+		}
+		s.wallets.RecordReauthFailure(r.Context(), user, *origin)
+		return nil, nil, WriteJSON(w, http.StatusUnauthorized, ApiError{Error: err.Error()})
+	}
+	return user, origin, nil
+}
+
+// POST /users/{userId}/wallet/export
+// {"refresh_token": "..."}
+// Returns the mnemonic of the custodial wallet. Exports are audited and limited to one per cooldown.
+func (s *APIServer) handleExportWallet(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+
+	user, origin, err := s.reauthenticateWallet(w, r, req.RefreshToken)
+	if user == nil {
+		return err
+	}
+
+	export, err := s.wallets.Export(r.Context(), user, *origin)
+	var cooldown *services.WalletExportCooldownError
+	switch {
+	case errors.As(err, &cooldown):
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(cooldown.RetryAt))))
+		return WriteJSON(w, http.StatusTooManyRequests, ApiError{Error: err.Error()})
+	case errors.Is(err, services.ErrNoCustodialWallet):
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+	case err != nil:
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return WriteJSON(w, http.StatusOK, export)
+}
+
+// POST /users/{userId}/wallet/import
+// {"refresh_token": "...", "mnemonic": "...", "discard_current_wallet": false}
+// Replaces the custodial wallet with the first account of the user's own mnemonic
+func (s *APIServer) handleImportWallet(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		RefreshToken         string `json:"refresh_token"`
+		Mnemonic             string `json:"mnemonic"`
+		DiscardCurrentWallet bool   `json:"discard_current_wallet"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+
+	user, origin, err := s.reauthenticateWallet(w, r, req.RefreshToken)
+	if user == nil {
+		return err
+	}
+
+	address, err := s.wallets.Import(r.Context(), user, req.Mnemonic, req.DiscardCurrentWallet, *origin)
+	switch {
+	case errors.Is(err, services.ErrWalletNotExported), errors.Is(err, services.ErrWalletChanged):
+		return WriteJSON(w, http.StatusConflict, ApiError{Error: err.Error()})
+	case err != nil:
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, map[string]string{
+		"wallet_address":  address,
+		"derivation_path": types.DerivationPath(0),
+	})
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/gorilla/mux"
+)
+
+// maxWebhookBodySize is more than enough for the status of an image job
+const maxWebhookBodySize = 64 << 10
+
+// imageWebhookPayload is what the image backend sends when an image job is done. Without a
+// status the job is taken as completed.
+type imageWebhookPayload struct {
+	Status string `json:"status"`
+}
+
+// POST /webhooks/image-generated/{id}
+// Called by the image backend when the image job {id} is done, so that the Anky waiting for it
+// carries on without polling. The body is signed with IMAGE_WEBHOOK_SECRET: the
+// X-Webhook-Signature header is the hex HMAC-SHA256 of the body, optionally prefixed by sha256=.
+func (s *APIServer) handleImageGeneratedWebhook(w http.ResponseWriter, r *http.Request) error {
+	secret := os.Getenv("IMAGE_WEBHOOK_SECRET")
+	if secret == "" {
+		return WriteJSON(w, http.StatusServiceUnavailable, ApiError{Error: "the image webhook is not configured"})
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize))
+	if err != nil {
+		return fmt.Errorf("error reading body: %v", err)
+	}
+	if !validWebhookSignature(secret, body, r.Header.Get("X-Webhook-Signature")) {
+		return WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "invalid signature"})
+	}
+
+	var payload imageWebhookPayload
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %v", err)
+		}
+	}
+	if payload.Status == "" {
+		payload.Status = services.ImageStatusCompleted
+	}
+
+	ankyService, err := services.NewAnkyService(s.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	imageID := mux.Vars(r)["id"]
+	anky, err := ankyService.HandleImageGenerated(r.Context(), imageID, payload.Status)
+	if err != nil {
+		log.Printf("Error handling image webhook for %s: %v", imageID, err)
+		return WriteJSON(w, http.StatusNotFound, ApiError{Error: err.Error()})
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"anky_id": anky.ID,
+		"status":  anky.Status,
+	})
+}
+
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	signature = strings.TrimPrefix(signature, "sha256=")
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
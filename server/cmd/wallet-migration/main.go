@@ -0,0 +1,88 @@
+// Command wallet-migration finds the custodial wallets created with the legacy derivation and
+// moves them to their standard BIP-44 address (see services.WalletMigrator).
+//
+// Run it from the server directory, with the environment of the server and ETH_RPC_URL:
+//
+//	go run ./cmd/wallet-migration                 # only records what it finds
+//	go run ./cmd/wallet-migration -apply          # switches the wallets without funds
+//	go run ./cmd/wallet-migration -tokens 0xabc,0xdef
+//
+// The users flagged needs_sweep keep their legacy address until their funds are moved, then
+// running it again switches them.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ankylat/anky/server/services"
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/joho/godotenv"
+)
+
+const pageSize = 100
+
+func main() {
+	apply := flag.Bool("apply", false, "switch the wallets without funds at their legacy address")
+	rpcURL := flag.String("rpc", os.Getenv("ETH_RPC_URL"), "Ethereum JSON-RPC endpoint")
+	tokens := flag.String("tokens", os.Getenv("WALLET_MIGRATION_TOKENS"), "comma separated ERC-20 contracts to check")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("Warning: Error loading .env file: %v", err)
+	}
+	if *rpcURL == "" {
+		log.Fatal("ETH_RPC_URL or -rpc is required to check the balances")
+	}
+
+	store, err := storage.NewPostgresStore()
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	var tokenList []string
+	for _, token := range strings.Split(*tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokenList = append(tokenList, token)
+		}
+	}
+	migrator := services.NewWalletMigrator(store, services.NewRPCBalanceChecker(*rpcURL), tokenList, *apply)
+
+	ctx := context.Background()
+	counts := make(map[string]int)
+	for offset := 0; ; offset += pageSize {
+		users, err := store.GetUsers(ctx, pageSize, offset)
+		if err != nil {
+			log.Fatalf("Failed to get users: %v", err)
+		}
+		for _, user := range users {
+			migration, err := migrator.MigrateUser(ctx, user)
+			switch {
+			case errors.Is(err, services.ErrUnknownWalletAddress):
+				log.Printf("User %s: %v (%s)", user.ID, err, user.WalletAddress)
+				counts["unknown"]++
+			case err != nil:
+				log.Printf("User %s: %v", user.ID, err)
+				counts["failed"]++
+			case migration == nil:
+				counts["standard"]++
+			default:
+				log.Printf("User %s: %s -> %s, %s", user.ID, migration.LegacyAddress, migration.StandardAddress, migration.Status)
+				if migration.Status == types.WalletMigrationNeedsSweep {
+					log.Printf("User %s has funds at the legacy address: %s wei, tokens %v", user.ID, migration.LegacyBalance, migration.TokenBalances)
+				}
+				counts[migration.Status]++
+			}
+		}
+		if len(users) < pageSize {
+			break
+		}
+	}
+
+	log.Printf("Done: %v", counts)
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/ankylat/anky/server/api"
+	"github.com/ankylat/anky/server/services"
 	"github.com/ankylat/anky/server/storage"
 	"github.com/joho/godotenv"
 )
 
+// workersShutdownTimeout is how long the shutdown waits for the running jobs to stop
+const workersShutdownTimeout = 30 * time.Second
+
 func main() {
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
@@ -34,6 +40,16 @@ func main() {
 		log.Fatalf("Failed to create API server: %v", err)
 	}
 
+	// Start the workers that generate the Ankys, resuming the ones left unfinished
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	workers, err := server.StartAnkyWorkers(workersCtx)
+	if err != nil {
+		log.Fatalf("Failed to start anky workers: %v", err)
+	}
+
+	// Move the seed phrases encrypted with an older master key to the newest one
+	services.NewSeedPhraseRotator(store).Start(workersCtx)
+
 	// Create channel for graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -53,6 +69,17 @@ func main() {
 		log.Fatalf("Server error: %v", err)
 	case <-stop:
 		log.Println("Shutting down server gracefully...")
-		// Add cleanup code here if needed
+		// Stop claiming jobs, interrupted jobs go back to the queue
+		stopWorkers()
+		workersDone := make(chan struct{})
+		go func() {
+			workers.Wait()
+			close(workersDone)
+		}()
+		select {
+		case <-workersDone:
+		case <-time.After(workersShutdownTimeout):
+			log.Printf("Anky workers still running after %s, their jobs will be picked up when their lease expires", workersShutdownTimeout)
+		}
 	}
 }
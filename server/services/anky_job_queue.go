@@ -0,0 +1,296 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// AnkyJobQueue runs the Anky processing jobs stored in the anky_jobs table.
+//
+// Workers claim jobs with a lease that they keep extending while the job runs. If a worker
+// dies, its lease expires and another worker picks the job up again. Failed jobs are retried
+// with exponential backoff until they run out of attempts, then they are dead-lettered and
+// their Anky is marked as failed. Every run resumes the Anky from the last status it reached.
+type AnkyJobQueue struct {
+	store        ankyJobStore
+	runner       ankyJobRunner
+	workers      int
+	maxAttempts  int
+	lease        time.Duration
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	pollInterval time.Duration
+	workerPrefix string
+	now          func() time.Time
+}
+
+// ankyJobStore is the part of the storage the queue needs
+type ankyJobStore interface {
+	EnqueueAnkyJob(ctx context.Context, ankyID uuid.UUID, maxAttempts int) error
+	GetUnfinishedAnkys(ctx context.Context) ([]*types.Anky, error)
+	ClaimAnkyJob(ctx context.Context, workerID string, lease time.Duration) (*types.AnkyJob, error)
+	ExtendAnkyJobLease(ctx context.Context, jobID uuid.UUID, workerID string, lease time.Duration) (bool, error)
+	CompleteAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error
+	RetryAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time, lastError string) error
+	DeadLetterAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, lastError string) error
+	ReleaseAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error
+	SnoozeAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) error
+}
+
+// ankyJobRunner does the work of a job
+type ankyJobRunner interface {
+	Process(ctx context.Context, job *types.AnkyJob) error
+	// RecordFailure writes a failed attempt to the status history of the Anky
+	RecordFailure(ctx context.Context, job *types.AnkyJob, jobErr error, giveUp bool) error
+}
+
+func NewAnkyJobQueue(store *storage.PostgresStore) *AnkyJobQueue {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "anky"
+	}
+
+	return &AnkyJobQueue{
+		store:        store,
+		runner:       &ankyProcessor{store: store},
+		workers:      envInt("ANKY_WORKERS", 2),
+		maxAttempts:  envInt("ANKY_JOB_MAX_ATTEMPTS", 5),
+		lease:        time.Duration(envInt("ANKY_JOB_LEASE_SECONDS", 300)) * time.Second,
+		baseBackoff:  time.Duration(envInt("ANKY_JOB_BACKOFF_SECONDS", 30)) * time.Second,
+		maxBackoff:   time.Hour,
+		pollInterval: 2 * time.Second,
+		workerPrefix: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		now:          time.Now,
+	}
+}
+
+// Enqueue queues the processing of an Anky
+func (q *AnkyJobQueue) Enqueue(ctx context.Context, anky *types.Anky) error {
+	return q.store.EnqueueAnkyJob(ctx, anky.ID, q.maxAttempts)
+}
+
+// Start resumes the Ankys left unfinished by a previous run and starts the workers.
+// The workers stop when ctx is cancelled, and the returned WaitGroup is done once they all returned.
+func (q *AnkyJobQueue) Start(ctx context.Context) (*sync.WaitGroup, error) {
+	if err := q.ResumeUnfinished(ctx); err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		workerID := fmt.Sprintf("%s-%d", q.workerPrefix, i)
+		go func() {
+			defer wg.Done()
+			q.runWorker(ctx, workerID)
+		}()
+	}
+
+	log.Printf("Anky job queue started with %d workers", q.workers)
+	return &wg, nil
+}
+
+// ResumeUnfinished queues a job for every Anky that stopped before reaching a final status
+// and has no job waiting for it, like the ones that were processing when the server went down.
+func (q *AnkyJobQueue) ResumeUnfinished(ctx context.Context) error {
+	ankys, err := q.store.GetUnfinishedAnkys(ctx)
+	if err != nil {
+		return fmt.Errorf("error looking for unfinished ankys: %v", err)
+	}
+
+	for _, anky := range ankys {
+		if err := q.Enqueue(ctx, anky); err != nil {
+			return err
+		}
+	}
+	if len(ankys) > 0 {
+		log.Printf("Resuming %d unfinished ankys", len(ankys))
+	}
+	return nil
+}
+
+func (q *AnkyJobQueue) runWorker(ctx context.Context, workerID string) {
+	for {
+		job, err := q.store.ClaimAnkyJob(ctx, workerID, q.lease)
+		if err != nil {
+			log.Printf("Worker %s: error claiming anky job: %v", workerID, err)
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.pollInterval):
+			}
+			continue
+		}
+
+		q.runJob(ctx, workerID, job)
+	}
+}
+
+func (q *AnkyJobQueue) runJob(ctx context.Context, workerID string, job *types.AnkyJob) {
+	log.Printf("Worker %s: running job %s for anky %s (attempt %d/%d)", workerID, job.ID, job.AnkyID, job.Attempts, job.MaxAttempts)
+
+	// A job can come back with too many attempts when its previous workers kept dying mid-run
+	if job.Attempts > job.MaxAttempts {
+		q.fail(ctx, workerID, job, fmt.Errorf("lease expired on the last attempt"))
+		return
+	}
+
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go q.keepLease(jobCtx, cancel, workerID, job)
+
+	if err := q.runner.Process(jobCtx, job); err != nil {
+		// Another worker runs the job now, what this run did is none of our business anymore
+		if errors.Is(context.Cause(jobCtx), errLeaseLost) {
+			log.Printf("Worker %s: job %s stopped, %v", workerID, job.ID, errLeaseLost)
+			return
+		}
+		// The Anky waits for the image webhook, that doesn't count as an attempt either
+		var waiting *WaitingForImageError
+		if errors.As(err, &waiting) {
+			log.Printf("Worker %s: job %s for anky %s is %v", workerID, job.ID, job.AnkyID, err)
+			if err := q.store.SnoozeAnkyJob(ctx, job.ID, workerID, waiting.Until); err != nil {
+				log.Printf("Worker %s: error putting job %s aside: %v", workerID, job.ID, err)
+			}
+			return
+		}
+		// Hand the job back if we are shutting down, the interruption doesn't count as an attempt
+		if ctx.Err() != nil {
+			log.Printf("Worker %s: job %s interrupted by shutdown", workerID, job.ID)
+			q.release(workerID, job)
+			return
+		}
+		q.fail(ctx, workerID, job, err)
+		return
+	}
+
+	if err := q.store.CompleteAnkyJob(ctx, job.ID, workerID); err != nil {
+		log.Printf("Worker %s: error completing job %s: %v", workerID, job.ID, err)
+	}
+	log.Printf("Worker %s: job %s for anky %s succeeded", workerID, job.ID, job.AnkyID)
+}
+
+// fail schedules a retry with exponential backoff, or dead-letters the job if it ran out of attempts.
+// Either way the failure is recorded in the status history of the Anky.
+func (q *AnkyJobQueue) fail(ctx context.Context, workerID string, job *types.AnkyJob, jobErr error) {
+	log.Printf("Worker %s: job %s for anky %s failed: %v", workerID, job.ID, job.AnkyID, jobErr)
+
+	giveUp := job.Attempts >= job.MaxAttempts
+	if giveUp {
+		if err := q.store.DeadLetterAnkyJob(ctx, job.ID, workerID, jobErr.Error()); err != nil {
+			log.Printf("Worker %s: error dead-lettering job %s: %v", workerID, job.ID, err)
+		}
+	} else {
+		runAfter := q.now().Add(q.backoff(job.Attempts))
+		if err := q.store.RetryAnkyJob(ctx, job.ID, workerID, runAfter, jobErr.Error()); err != nil {
+			log.Printf("Worker %s: error scheduling retry of job %s: %v", workerID, job.ID, err)
+		}
+	}
+
+	if err := q.runner.RecordFailure(ctx, job, jobErr, giveUp); err != nil {
+		log.Printf("Worker %s: error recording failure of anky %s: %v", workerID, job.AnkyID, err)
+	}
+}
+
+// release puts the job back in the queue. It runs after ctx was cancelled, so it gets its own deadline.
+func (q *AnkyJobQueue) release(workerID string, job *types.AnkyJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := q.store.ReleaseAnkyJob(ctx, job.ID, workerID); err != nil {
+		log.Printf("Worker %s: error releasing job %s, it will be picked up when its lease expires: %v", workerID, job.ID, err)
+	}
+}
+
+// backoff is baseBackoff * 2^(attempt-1), capped at maxBackoff
+func (q *AnkyJobQueue) backoff(attempt int) time.Duration {
+	backoff := float64(q.baseBackoff) * math.Pow(2, float64(attempt-1))
+	if backoff > float64(q.maxBackoff) {
+		return q.maxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// errLeaseLost stops a job whose lease expired before it could be extended
+var errLeaseLost = errors.New("the lease of the job was lost to another worker")
+
+// keepLease extends the lease of a running job until ctx is done. If the lease was lost, the
+// job is cancelled so that the same Anky isn't processed by two workers.
+func (q *AnkyJobQueue) keepLease(ctx context.Context, cancel context.CancelCauseFunc, workerID string, job *types.AnkyJob) {
+	ticker := time.NewTicker(q.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := q.store.ExtendAnkyJobLease(ctx, job.ID, workerID, q.lease)
+			if err != nil {
+				log.Printf("Worker %s: error extending lease of job %s: %v", workerID, job.ID, err)
+				continue
+			}
+			if !held {
+				cancel(errLeaseLost)
+				return
+			}
+		}
+	}
+}
+
+// ankyProcessor runs the jobs with the AnkyService
+type ankyProcessor struct {
+	store *storage.PostgresStore
+}
+
+func (p *ankyProcessor) Process(ctx context.Context, job *types.AnkyJob) error {
+	anky, err := p.store.GetAnkyByID(ctx, job.AnkyID)
+	if err != nil {
+		return fmt.Errorf("error loading anky: %v", err)
+	}
+
+	writingSession, err := p.store.GetWritingSessionById(ctx, anky.WritingSessionID)
+	if err != nil {
+		return fmt.Errorf("error loading writing session: %v", err)
+	}
+
+	ankyService, err := NewAnkyService(p.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+
+	return ankyService.ProcessAnkyCreation(ctx, anky, writingSession, job.Attempts)
+}
+
+func (p *ankyProcessor) RecordFailure(ctx context.Context, job *types.AnkyJob, jobErr error, giveUp bool) error {
+	anky, err := p.store.GetAnkyByID(ctx, job.AnkyID)
+	if err != nil {
+		return fmt.Errorf("error loading anky: %v", err)
+	}
+	ankyService, err := NewAnkyService(p.store)
+	if err != nil {
+		return fmt.Errorf("error creating anky service: %v", err)
+	}
+	return ankyService.RecordAnkyFailure(ctx, anky, job.Attempts, jobErr, giveUp)
+}
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,279 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// memoryJobStore records what the queue does with its jobs
+type memoryJobStore struct {
+	mu        sync.Mutex
+	leaseHeld bool
+	calls     []string
+	runAfter  time.Time
+	lastError string
+}
+
+func (s *memoryJobStore) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *memoryJobStore) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *memoryJobStore) EnqueueAnkyJob(ctx context.Context, ankyID uuid.UUID, maxAttempts int) error {
+	s.record("enqueue")
+	return nil
+}
+
+func (s *memoryJobStore) GetUnfinishedAnkys(ctx context.Context) ([]*types.Anky, error) {
+	return nil, nil
+}
+
+func (s *memoryJobStore) ClaimAnkyJob(ctx context.Context, workerID string, lease time.Duration) (*types.AnkyJob, error) {
+	return nil, nil
+}
+
+func (s *memoryJobStore) ExtendAnkyJobLease(ctx context.Context, jobID uuid.UUID, workerID string, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaseHeld, nil
+}
+
+func (s *memoryJobStore) CompleteAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error {
+	s.record("complete")
+	return nil
+}
+
+func (s *memoryJobStore) RetryAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time, lastError string) error {
+	s.mu.Lock()
+	s.runAfter, s.lastError = runAfter, lastError
+	s.mu.Unlock()
+	s.record("retry")
+	return nil
+}
+
+func (s *memoryJobStore) DeadLetterAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, lastError string) error {
+	s.mu.Lock()
+	s.lastError = lastError
+	s.mu.Unlock()
+	s.record("dead-letter")
+	return nil
+}
+
+func (s *memoryJobStore) ReleaseAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error {
+	s.record("release")
+	return nil
+}
+
+func (s *memoryJobStore) SnoozeAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) error {
+	s.mu.Lock()
+	s.runAfter = runAfter
+	s.mu.Unlock()
+	s.record("snooze")
+	return nil
+}
+
+// fakeJobRunner fails every job with err, or runs process instead when it is set
+type fakeJobRunner struct {
+	err      error
+	process  func(ctx context.Context) error
+	ran      int
+	failures []bool
+}
+
+func (r *fakeJobRunner) Process(ctx context.Context, job *types.AnkyJob) error {
+	r.ran++
+	if r.process != nil {
+		return r.process(ctx)
+	}
+	return r.err
+}
+
+func (r *fakeJobRunner) RecordFailure(ctx context.Context, job *types.AnkyJob, jobErr error, giveUp bool) error {
+	r.failures = append(r.failures, giveUp)
+	return nil
+}
+
+func newTestJobQueue(runner *fakeJobRunner) (*AnkyJobQueue, *memoryJobStore, time.Time) {
+	store := &memoryJobStore{leaseHeld: true}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &AnkyJobQueue{
+		store:       store,
+		runner:      runner,
+		maxAttempts: 3,
+		lease:       time.Minute,
+		baseBackoff: 30 * time.Second,
+		maxBackoff:  time.Hour,
+		now:         func() time.Time { return now },
+	}, store, now
+}
+
+func newTestJob(attempts int) *types.AnkyJob {
+	return &types.AnkyJob{ID: uuid.New(), AnkyID: uuid.New(), Attempts: attempts, MaxAttempts: 3}
+}
+
+func equalCalls(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAnkyJobQueueRetriesWithBackoff(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		wantCalls    []string
+		wantRunAfter time.Duration
+		wantGiveUp   bool
+	}{
+		{"first attempt", 1, []string{"retry"}, 30 * time.Second, false},
+		{"second attempt", 2, []string{"retry"}, time.Minute, false},
+		{"last attempt", 3, []string{"dead-letter"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeJobRunner{err: errors.New("the image backend is down")}
+			queue, store, now := newTestJobQueue(runner)
+			queue.runJob(context.Background(), "worker-0", newTestJob(tt.attempts))
+
+			if calls := store.recorded(); !equalCalls(calls, tt.wantCalls) {
+				t.Fatalf("expected calls %v, got %v", tt.wantCalls, calls)
+			}
+			if store.lastError != "the image backend is down" {
+				t.Errorf("expected the error of the job to be kept, got %q", store.lastError)
+			}
+			if tt.wantRunAfter > 0 && !store.runAfter.Equal(now.Add(tt.wantRunAfter)) {
+				t.Errorf("expected a retry at %s, got %s", now.Add(tt.wantRunAfter), store.runAfter)
+			}
+			if len(runner.failures) != 1 || runner.failures[0] != tt.wantGiveUp {
+				t.Errorf("expected one failure recorded with giveUp %t, got %v", tt.wantGiveUp, runner.failures)
+			}
+		})
+	}
+}
+
+func TestAnkyJobQueueDeadLettersJobsPastTheirAttempts(t *testing.T) {
+	runner := &fakeJobRunner{}
+	queue, store, _ := newTestJobQueue(runner)
+
+	// Its previous workers died on every attempt
+	queue.runJob(context.Background(), "worker-0", newTestJob(4))
+
+	if runner.ran != 0 {
+		t.Errorf("expected the job not to run, it ran %d times", runner.ran)
+	}
+	if calls := store.recorded(); !equalCalls(calls, []string{"dead-letter"}) {
+		t.Errorf("expected the job to be dead-lettered, got %v", calls)
+	}
+	if len(runner.failures) != 1 || !runner.failures[0] {
+		t.Errorf("expected the Anky to be marked as failed, got %v", runner.failures)
+	}
+}
+
+func TestAnkyJobQueueSnoozesJobsWaitingForTheImage(t *testing.T) {
+	until := time.Date(2024, 1, 1, 0, 10, 0, 0, time.UTC)
+	runner := &fakeJobRunner{err: &WaitingForImageError{Until: until}}
+	queue, store, _ := newTestJobQueue(runner)
+
+	// Even on its last attempt, waiting isn't a failure
+	queue.runJob(context.Background(), "worker-0", newTestJob(3))
+
+	if calls := store.recorded(); !equalCalls(calls, []string{"snooze"}) {
+		t.Fatalf("expected the job to be snoozed, got %v", calls)
+	}
+	if !store.runAfter.Equal(until) {
+		t.Errorf("expected the job to run again at %s, got %s", until, store.runAfter)
+	}
+	if len(runner.failures) != 0 {
+		t.Errorf("expected no failure recorded, got %v", runner.failures)
+	}
+}
+
+func TestAnkyJobQueueCompletesSucceededJobs(t *testing.T) {
+	runner := &fakeJobRunner{}
+	queue, store, _ := newTestJobQueue(runner)
+	queue.runJob(context.Background(), "worker-0", newTestJob(1))
+
+	if calls := store.recorded(); !equalCalls(calls, []string{"complete"}) {
+		t.Errorf("expected the job to be completed, got %v", calls)
+	}
+}
+
+func TestAnkyJobQueueReleasesJobsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &fakeJobRunner{process: func(jobCtx context.Context) error {
+		cancel()
+		<-jobCtx.Done()
+		return jobCtx.Err()
+	}}
+	queue, store, _ := newTestJobQueue(runner)
+	queue.runJob(ctx, "worker-0", newTestJob(3))
+
+	if calls := store.recorded(); !equalCalls(calls, []string{"release"}) {
+		t.Errorf("expected the job to be handed back, got %v", calls)
+	}
+	if len(runner.failures) != 0 {
+		t.Errorf("expected no failure recorded, got %v", runner.failures)
+	}
+}
+
+func TestAnkyJobQueueStopsJobsThatLostTheirLease(t *testing.T) {
+	runner := &fakeJobRunner{process: func(jobCtx context.Context) error {
+		select {
+		case <-jobCtx.Done():
+			return jobCtx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}}
+	queue, store, _ := newTestJobQueue(runner)
+	queue.lease = 30 * time.Millisecond
+	store.leaseHeld = false
+
+	queue.runJob(context.Background(), "worker-0", newTestJob(1))
+
+	if calls := store.recorded(); len(calls) != 0 {
+		t.Errorf("expected the job to be left to the other worker, got %v", calls)
+	}
+	if len(runner.failures) != 0 {
+		t.Errorf("expected no failure recorded, got %v", runner.failures)
+	}
+}
+
+func TestAnkyJobQueueBackoff(t *testing.T) {
+	queue, _, _ := newTestJobQueue(&fakeJobRunner{})
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := queue.backoff(tt.attempt); got != tt.want {
+			t.Errorf("attempt %d: expected %s, got %s", tt.attempt, tt.want, got)
+		}
+	}
+}
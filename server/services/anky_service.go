@@ -1,19 +1,16 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/ankylat/anky/server/storage"
 	"github.com/ankylat/anky/server/types"
 	"github.com/google/uuid"
-	"golang.org/x/exp/rand"
 )
 
 // Interfaces in Go serve several important purposes:
@@ -32,128 +29,247 @@ import (
 type AnkyServiceInterface interface {
 	ProcessAnkyCreation(anky *types.Anky, writingSession *types.WritingSession) error
 	GenerateAnkyReflection(session *types.WritingSession) (map[string]string, error)
-	GenerateImageWithMidjourney(prompt string) (string, error)
-	PollImageStatus(id string) (string, error)
-	CheckImageStatus(id string) (string, error)
-	FetchImageDetails(id string) (*ImageDetails, error)
+	GenerateAnkyFromPrompt(prompt string) (string, error)
 	PublishToFarcaster(session *types.WritingSession) (*types.Cast, error)
 	OnboardingConversation(sessions []*types.WritingSession, ankyReflections []*types.AnkyOnboardingResponse) (string, error)
 }
 
 type AnkyService struct {
-	store        *storage.PostgresStore
-	imageHandler *ImageService
-	farcaster    *FarcasterService
+	store       *storage.PostgresStore
+	blobs       BlobStore
+	images      ImageGenerator
+	imageConfig ImageGeneratorConfig
+	imageScorer ImageScorer
+	// How long the writer has to choose the image before the scorer does
+	imageChoiceTimeout time.Duration
+	pinner             Pinner
+	farcaster          *FarcasterService
+	prompts            *PromptRegistry
 }
 
 func NewAnkyService(store *storage.PostgresStore) (*AnkyService, error) {
-	imageHandler, err := NewImageService()
+	blobs, err := NewBlobStore(LoadBlobStoreConfig())
 	if err != nil {
-		return nil, fmt.Errorf("failed to create image handler: %v", err)
+		return nil, fmt.Errorf("failed to initialize blob store: %v", err)
 	}
 
-	return &AnkyService{
-		store:        store,
-		imageHandler: imageHandler,
-		farcaster:    NewFarcasterService(),
-	}, nil
-}
-
-func (s *AnkyService) ProcessAnkyCreation(ctx context.Context, anky *types.Anky, writingSession *types.WritingSession) error {
+	imageConfig := LoadImageGeneratorConfig()
+	images, err := NewImageGenerator(imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image generator: %v", err)
+	}
 
-	anky.Status = "starting_processing"
-	s.store.UpdateAnky(ctx, anky)
+	imageScorer, err := NewImageScorer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image scorer: %v", err)
+	}
 
-	// 1. Generate Anky's reflection on the writing
-	reflection, err := s.GenerateAnkyReflection(writingSession)
+	pinner, err := NewPinner()
 	if err != nil {
-		// TODO: handle processing error
-		// s.handleAnkyProcessingError(anky, "reflection_failed", err)
-		return err
+		return nil, fmt.Errorf("failed to create IPFS pinner: %v", err)
 	}
 
-	anky.Status = "reflection_completed"
-	s.store.UpdateAnky(ctx, anky)
-	anky.ImagePrompt = reflection["imageprompt"]
+	return &AnkyService{
+		store:              store,
+		blobs:              blobs,
+		images:             images,
+		imageConfig:        imageConfig,
+		imageScorer:        imageScorer,
+		imageChoiceTimeout: time.Duration(envInt("IMAGE_CHOICE_TIMEOUT_SECONDS", 600)) * time.Second,
+		pinner:             pinner,
+		farcaster:          NewFarcasterService(),
+		prompts:            NewPromptRegistry(store),
+	}, nil
+}
 
-	anky.FollowUpPrompt = reflection["prompt"]
+// transitionAnky moves the Anky to the next status and saves it, recording the transition in its history
+func (s *AnkyService) transitionAnky(ctx context.Context, anky *types.Anky, next types.AnkyStatus, attempt int) error {
+	previous := anky.Status
+	if err := anky.TransitionTo(next); err != nil {
+		return err
+	}
 
-	anky.Status = "going_to_generate_image"
-	s.store.UpdateAnky(ctx, anky)
+	transition := types.NewAnkyStatusTransition(anky.ID, previous, next, attempt, nil)
+	if err := s.store.TransitionAnky(ctx, anky, transition); err != nil {
+		anky.Status = previous
+		return fmt.Errorf("error saving anky status %s: %v", next, err)
+	}
+	return nil
+}
 
-	imageID, err := generateImageWithMidjourney("https://s.mj.run/YLJMlMJbo70 " + anky.ImagePrompt)
+// RecordAnkyFailure records a failed processing attempt in the history of the Anky. If the
+// job gave up on it, the Anky moves to failed, otherwise it stays where it was to be retried.
+func (s *AnkyService) RecordAnkyFailure(ctx context.Context, anky *types.Anky, attempt int, cause error, giveUp bool) error {
+	if !giveUp {
+		return s.store.CreateAnkyStatusTransition(ctx, types.NewAnkyStatusTransition(anky.ID, anky.Status, anky.Status, attempt, cause))
+	}
 
-	if err != nil {
-		log.Printf("Error generating image: %v", err)
+	previous := anky.Status
+	if err := anky.TransitionTo(types.AnkyStatusFailed); err != nil {
 		return err
 	}
-	log.Printf("Image generation response: %s", imageID)
+	return s.store.TransitionAnky(ctx, anky, types.NewAnkyStatusTransition(anky.ID, previous, types.AnkyStatusFailed, attempt, cause))
+}
 
-	anky.Status = "generating_image"
-	s.store.UpdateAnky(ctx, anky)
+// ProcessAnkyCreation generates the Anky of a writing session. Each status of the lifecycle is
+// a checkpoint: when the processing is attempted again, the steps whose status was already
+// reached are skipped.
+func (s *AnkyService) ProcessAnkyCreation(ctx context.Context, anky *types.Anky, writingSession *types.WritingSession, attempt int) error {
+	log.Printf("Processing Anky %s from status %s (attempt %d)", anky.ID, anky.Status, attempt)
 
-	status, err := pollImageStatus(imageID)
-	if err != nil {
-		log.Printf("Error polling image status: %v", err)
-		return err
-	}
-	log.Printf("Image generation status: %s", status)
+	// 1. Generate Anky's reflection on the writing
+	if !anky.Status.Reached(types.AnkyStatusReflectionCompleted) {
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusStartingProcessing, attempt); err != nil {
+			return err
+		}
 
-	anky.Status = "image_generated"
-	s.store.UpdateAnky(ctx, anky)
+		reflection, err := s.GenerateAnkyReflection(ctx, writingSession)
+		if err != nil {
+			return err
+		}
 
-	// Fetch the image details from the API
-	imageDetails, err := fetchImageDetails(imageID)
-	if err != nil {
-		log.Printf("Error fetching image details: %v", err)
-		return err
+		anky.ImagePrompt = reflection["imageprompt"]
+		anky.FollowUpPrompt = reflection["prompt"]
+		anky.PromptVersion = reflection["prompt_version"]
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusReflectionCompleted, attempt); err != nil {
+			return err
+		}
 	}
 
-	// TODO :::: choose the image with a better strategy
-	if len(imageDetails.UpscaledURLs) == 0 {
-		log.Printf("No upscaled images available")
-		return fmt.Errorf("no upscaled images available")
-	}
+	// 2. Ask for the image
+	// An Anky waiting for an image whose generation ID was lost has to ask for it again
+	if !anky.Status.Reached(types.AnkyStatusGeneratingImage) ||
+		(anky.Status == types.AnkyStatusGeneratingImage && anky.ImageGenerationID == "") {
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusGoingToGenerateImage, attempt); err != nil {
+			return err
+		}
+
+		imageID, err := s.images.Submit(ctx, anky.ImagePrompt)
+		if err != nil {
+			log.Printf("Error generating image: %v", err)
+			return err
+		}
+		log.Printf("Image generation response: %s", imageID)
 
-	randomIndex := rand.Intn(len(imageDetails.UpscaledURLs))
-	chosenImageURL := imageDetails.UpscaledURLs[randomIndex]
+		anky.ImageGenerationID = imageID
+		requestedAt := time.Now().UTC()
+		anky.ImageRequestedAt = &requestedAt
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusGeneratingImage, attempt); err != nil {
+			return err
+		}
+	}
 
-	anky.Status = "uploading_image"
-	s.store.UpdateAnky(ctx, anky)
+	// 3. Wait for the image to be ready
+	if !anky.Status.Reached(types.AnkyStatusImageGenerated) {
+		status, err := s.waitForAnkyImage(ctx, anky)
+		if errors.Is(err, ErrImageTimedOut) {
+			log.Printf("Image %s of anky %s timed out", anky.ImageGenerationID, anky.ID)
+			return s.timeOutAnkyImage(ctx, anky, attempt)
+		}
+		if err != nil {
+			log.Printf("Image status of anky %s: %v", anky.ID, err)
+			return err
+		}
+		log.Printf("Image generation status: %s", status)
 
-	// Upload the generated image to Cloudinary
-	imageHandler, err := NewImageService()
-	if err != nil {
-		log.Printf("Error creating ImageHandler: %v", err)
-		return err
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusImageGenerated, attempt); err != nil {
+			return err
+		}
 	}
 
-	uploadResult, err := uploadImageToCloudinary(imageHandler, chosenImageURL, writingSession.ID.String())
-	if err != nil {
-		log.Printf("Error uploading image to Cloudinary: %v", err)
-		return err
+	// 4. Choose one of the generated images, the writer has until ImageChooseBy to do it
+	if !anky.Status.Reached(types.AnkyStatusImageUploaded) && anky.ChosenImageURL == "" {
+		if len(anky.ImageCandidates) == 0 {
+			imageDetails, err := s.images.Fetch(ctx, anky.ImageGenerationID)
+			if err != nil {
+				log.Printf("Error fetching image details: %v", err)
+				return err
+			}
+
+			anky.ImageCandidates = imageDetails.UpscaledURLs
+			if len(anky.ImageCandidates) == 0 && imageDetails.URL != "" {
+				anky.ImageCandidates = []string{imageDetails.URL}
+			}
+			if len(anky.ImageCandidates) == 0 {
+				return fmt.Errorf("the image backend returned no image")
+			}
+			chooseBy := time.Now().UTC().Add(s.imageChoiceTimeout)
+			anky.ImageChooseBy = &chooseBy
+
+			// Ankys that were already uploading before there were candidates just keep going
+			if anky.Status.Reached(types.AnkyStatusUploadingImage) {
+				err = s.store.UpdateAnky(ctx, anky)
+			} else {
+				err = s.transitionAnky(ctx, anky, types.AnkyStatusChoosingImage, attempt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := s.autoChooseAnkyImage(ctx, anky); err != nil {
+			return err
+		}
 	}
-	anky.ImageURL = uploadResult.SecureURL
 
-	log.Printf("Image uploaded to Cloudinary successfully. Public ID: %s, URL: %s", uploadResult.PublicID, uploadResult.SecureURL)
+	// 5. Keep the chosen image and the alternates, and pin the image and the writing on IPFS
+	if !anky.Status.Reached(types.AnkyStatusImageUploaded) {
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusUploadingImage, attempt); err != nil {
+			return err
+		}
+
+		imageURL, image, err := storeImage(ctx, s.blobs, anky.ChosenImageURL, ankyImageKey(writingSession.ID.String()))
+		if err != nil {
+			log.Printf("Error storing image: %v", err)
+			return err
+		}
+		anky.ImageURL = imageURL
+		log.Printf("Image of anky %s stored at %s", anky.ID, imageURL)
 
-	anky.Status = "image_uploaded"
-	s.store.UpdateAnky(ctx, anky)
+		if anky.ImageIPFSHash, err = pinContent(ctx, s.pinner, image); err != nil {
+			return err
+		}
+		if err := s.pinWriting(ctx, anky, writingSession); err != nil {
+			return err
+		}
 
-	// 5. Mark as complete
-	anky.Status = "casting_to_farcaster"
-	s.store.UpdateAnky(ctx, anky)
+		// A missing alternate is not worth failing the Anky for
+		anky.ImageAlternates = []string{}
+		for i, candidate := range anky.ImageCandidates {
+			if candidate == anky.ChosenImageURL {
+				continue
+			}
+			alternate, _, err := storeImage(ctx, s.blobs, candidate, ankyImageKey(fmt.Sprintf("%s-%d", writingSession.ID, i)))
+			if err != nil {
+				log.Printf("Error storing alternate image %d of anky %s: %v", i, anky.ID, err)
+				continue
+			}
+			anky.ImageAlternates = append(anky.ImageAlternates, alternate)
+		}
 
-	castResponse, err := publishToFarcaster(writingSession)
-	if err != nil {
-		log.Printf("Error publishing to Farcaster: %v", err)
-		return err
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusImageUploaded, attempt); err != nil {
+			return err
+		}
 	}
 
-	anky.CastHash = castResponse.Hash
+	// 6. Cast it. The session ID is the idempotency key of the cast, so casting again after
+	// a crash doesn't publish it twice.
+	if !anky.Status.Reached(types.AnkyStatusCompleted) {
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusCastingToFarcaster, attempt); err != nil {
+			return err
+		}
+
+		castResponse, err := publishToFarcaster(ctx, writingSession)
+		if err != nil {
+			log.Printf("Error publishing to Farcaster: %v", err)
+			return err
+		}
 
-	anky.Status = "completed"
-	s.store.UpdateAnky(ctx, anky)
+		anky.CastHash = castResponse.Hash
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusCompleted, attempt); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -192,12 +308,15 @@ func (s *AnkyService) CreateUserProfile(ctx context.Context, userID uuid.UUID) (
 	}
 
 	// Update the Anky in our database to store the FID
-	// This creates the link between the user's writing and their Farcaster identity
-	err = s.store.UpdateAnky(ctx, &types.Anky{
-		ID:     lastAnky.ID,
-		FID:    newFid,
-		Status: "fid_linked",
-	})
+	// This creates the link between the user's writing and their Farcaster identity.
+	// Only a completed Anky moves to fid_linked, the others keep going through their processing
+	// and only get their fid set, without touching the status a worker may be moving forward.
+	lastAnky.FID = newFid
+	if lastAnky.Status.CanTransitionTo(types.AnkyStatusFidLinked) {
+		err = s.transitionAnky(ctx, lastAnky, types.AnkyStatusFidLinked, 0)
+	} else {
+		err = s.store.SetAnkyFID(ctx, lastAnky.ID, newFid)
+	}
 	if err != nil {
 		log.Printf("Error updating Anky with new FID: %v", err)
 		return "", fmt.Errorf("failed to link FID to Anky: %v", err)
@@ -220,29 +339,37 @@ func (s *AnkyService) LinkAnkyWithFid(ctx context.Context, ankyID uuid.UUID, fid
 	return nil
 }
 
-func (s *AnkyService) GenerateAnkyReflection(session *types.WritingSession) (map[string]string, error) {
+// AnkyReflectionOutput is what the model returns when it reflects on a writing session
+type AnkyReflectionOutput struct {
+	Prompt      string `json:"prompt" llm:"required" desc:"a direct, penetrating question that encourages deeper self-exploration"`
+	ImagePrompt string `json:"imageprompt" llm:"required" desc:"a vivid, symbolic description for image generation that captures the essence of the writing"`
+}
+
+func (s *AnkyService) GenerateAnkyReflection(ctx context.Context, session *types.WritingSession) (map[string]string, error) {
 	log.Printf("Starting LLM processing for session ID: %s", session.ID)
 
-	llmService := NewLLMService()
+	llmService := NewLLMServiceFor(LLMPurposeReflection)
+
+	timeSpent := 0
+	if session.TimeSpent != nil {
+		timeSpent = *session.TimeSpent
+	}
+	systemPrompt, err := s.prompts.Render(ctx, PromptReflection, session.UserID, PromptVars{
+		AttemptCount:    session.SessionIndexForUser + 1,
+		DurationSeconds: timeSpent,
+		WordsWritten:    session.WordsWritten,
+		Language:        s.writerLanguageName(ctx, session.UserID, session.Writing),
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Prepare the chat request
 	chatRequest := types.ChatRequest{
 		Messages: []types.Message{
 			{
-				Role: "system",
-				Content: `You are an AI guide for deep self-exploration. Your role is to analyze the user's stream of consciousness writing and generate two prompts:
-
-				1. A thought-provoking question that guides them deeper into self-reflection
-				2. A vivid, symbolic description for image generation that captures the essence of their writing
-
-				Generate a JSON object with the following structure:
-				
-				{
-					"prompt": "A direct, penetrating question that encourages deeper self-exploration",
-					"imageprompt": "A vivid, symbolic description for image generation that captures the essence of the user's writing"
-				}
-				
-				Keep responses clear and direct. Avoid spiritual jargon. Use precise language that guides the user toward genuine self-understanding. Strictly adhere to this JSON format in your response.`,
+				Role:    "system",
+				Content: systemPrompt.Text,
 			},
 			{
 				Role:    "user",
@@ -253,56 +380,60 @@ func (s *AnkyService) GenerateAnkyReflection(session *types.WritingSession) (map
 
 	// Send the chat request to the LLM service
 	log.Printf("Sending chat request to LLM service")
-	responseChan, err := llmService.SendChatRequest(chatRequest, true)
-	if err != nil {
-		log.Printf("Error sending chat request: %v", err)
-		return nil, err
-	}
-
-	// Collect the response
-	log.Printf("Collecting response from LLM service")
-	var fullResponse string
-	for partialResponse := range responseChan {
-		fullResponse += partialResponse
-		log.Printf("Received partial response: %s", partialResponse)
-	}
-
-	// Parse the JSON response
-	log.Printf("Parsing JSON response from LLM")
-	var llmOutput struct {
-		Prompt      string `json:"prompt"`
-		ImagePrompt string `json:"imageprompt"`
-	}
-	err = json.Unmarshal([]byte(fullResponse), &llmOutput)
-	if err != nil {
-		log.Printf("Error parsing LLM response: %v", err)
+	var llmOutput AnkyReflectionOutput
+	if err := llmService.SendStructuredRequest(ctx, chatRequest, &llmOutput); err != nil {
+		log.Printf("Error getting the reflection from the LLM: %v", err)
 		return nil, err
 	}
 	log.Printf("Parsed LLM output: %+v", llmOutput)
 
 	return map[string]string{
-		"prompt":      llmOutput.Prompt,
-		"imageprompt": llmOutput.ImagePrompt,
+		"prompt":         llmOutput.Prompt,
+		"imageprompt":    llmOutput.ImagePrompt,
+		"prompt_version": systemPrompt.Version,
 	}, nil
 }
 
+// writerLanguageName is the name of the language to answer the writer in, to use in the
+// prompts. It is empty when neither the writing nor the user tell which language it is.
+func (s *AnkyService) writerLanguageName(ctx context.Context, userID uuid.UUID, writing string) string {
+	var user *types.User
+	if s.store != nil {
+		var err error
+		user, err = s.store.GetUserByID(ctx, userID)
+		if err != nil {
+			// The writing alone usually says enough
+			log.Printf("Error loading user %s to pick their language: %v", userID, err)
+		}
+	}
+
+	code := WriterLanguage(DetectLanguage(writing), user)
+	if code == "" {
+		return ""
+	}
+	return LanguageName(code)
+}
+
 func (s *AnkyService) SimplePrompt(ctx context.Context, prompt string) (string, error) {
-	llmService := NewLLMService()
-	responseChan, err := llmService.SendSimpleRequest(prompt)
+	responseChan, err := s.SimplePromptStream(ctx, prompt)
 	if err != nil {
-		return "", fmt.Errorf("error sending simple request: %v", err)
+		return "", err
 	}
+	return CollectLLMResponse(responseChan)
+}
 
-	var fullResponse string
-	for partialResponse := range responseChan {
-		fullResponse += partialResponse
+// SimplePromptStream streams the response to a prompt as the model writes it
+func (s *AnkyService) SimplePromptStream(ctx context.Context, prompt string) (<-chan LLMChunk, error) {
+	llmService := NewLLMServiceFor(LLMPurposeSimple)
+	responseChan, err := llmService.SendSimpleRequest(ctx, prompt)
+	if err != nil {
+		return nil, fmt.Errorf("error sending simple request: %v", err)
 	}
-
-	return fullResponse, nil
+	return responseChan, nil
 }
 
-func (s *AnkyService) MessagesPromptRequest(messages []string) (string, error) {
-	llmService := NewLLMService()
+func (s *AnkyService) MessagesPromptRequest(ctx context.Context, messages []string) (string, error) {
+	llmService := NewLLMServiceFor(LLMPurposeSimple)
 
 	// Convert string messages to Message structs
 	chatMessages := make([]types.Message, len(messages))
@@ -317,156 +448,179 @@ func (s *AnkyService) MessagesPromptRequest(messages []string) (string, error) {
 		Messages: chatMessages,
 	}
 
-	responseChan, err := llmService.SendChatRequest(chatRequest, false)
+	responseChan, err := llmService.SendChatRequest(ctx, chatRequest, false)
 	if err != nil {
 		return "", fmt.Errorf("error sending chat request: %v", err)
 	}
 
-	var fullResponse string
-	for partialResponse := range responseChan {
-		fullResponse += partialResponse
-	}
-
-	return fullResponse, nil
+	return CollectLLMResponse(responseChan)
 }
 
-func generateImageWithMidjourney(prompt string) (string, error) {
-	data := map[string]interface{}{
-		"prompt": prompt,
+// pinWriting pins the raw file of the writing session of the Anky. Sessions that were only
+// reported by the client have no raw file, so there is nothing to pin for them.
+func (s *AnkyService) pinWriting(ctx context.Context, anky *types.Anky, writingSession *types.WritingSession) error {
+	raw, err := NewWritingSessionService().RawSessionFile(writingSession.UserID, writingSession.ID)
+	if errors.Is(err, ErrRawSessionNotFound) {
+		log.Printf("Writing session %s has no raw file to pin", writingSession.ID)
+		return nil
 	}
-
-	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return "", fmt.Errorf("error marshaling data: %v", err)
+		return err
 	}
 
-	req, err := http.NewRequest("POST", "http://localhost:8055/items/images/", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
-	}
+	anky.WritingIPFSHash, err = pinContent(ctx, s.pinner, raw)
+	return err
+}
 
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("IMAGINE_API_TOKEN"))
-	req.Header.Set("Content-Type", "application/json")
+// ankyImageKey is where the images of Ankys are kept in the blob store
+func ankyImageKey(name string) string {
+	return "ankys/" + name
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+// WaitingForImageError tells the job queue to put the job aside until Until. The image webhook,
+// or the writer choosing the image, runs the job again earlier.
+type WaitingForImageError struct {
+	Until time.Time
+}
+
+func (e *WaitingForImageError) Error() string {
+	return fmt.Sprintf("waiting for the image until %s", e.Until.Format(time.RFC3339))
+}
+
+// waitForAnkyImage waits for the image job of the Anky, until IMAGE_MAX_WAIT_SECONDS after it
+// was asked for. When the backend calls the webhook, the image is only checked once per run.
+func (s *AnkyService) waitForAnkyImage(ctx context.Context, anky *types.Anky) (string, error) {
+	requestedAt := anky.LastUpdatedAt
+	if anky.ImageRequestedAt != nil {
+		requestedAt = *anky.ImageRequestedAt
 	}
-	defer resp.Body.Close()
+	deadline := requestedAt.Add(s.imageConfig.MaxWait)
 
-	var responseData struct {
-		Data struct {
-			ID string `json:"id"`
-		} `json:"data"`
+	if !s.imageConfig.Callbacks {
+		return waitForImage(ctx, s.images, anky.ImageGenerationID, deadline, s.imageConfig.PollInterval, s.imageConfig.MaxPollInterval)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&responseData)
+	status, err := s.images.Status(ctx, anky.ImageGenerationID)
 	if err != nil {
-		return "", fmt.Errorf("error decoding response: %v", err)
+		return "", fmt.Errorf("error checking image status: %v", err)
+	}
+	switch {
+	case status == ImageStatusCompleted:
+		return status, nil
+	case status == ImageStatusFailed:
+		return status, fmt.Errorf("image generation failed")
+	case time.Now().After(deadline):
+		return status, ErrImageTimedOut
+	default:
+		return status, &WaitingForImageError{Until: deadline}
 	}
-
-	return responseData.Data.ID, nil
 }
 
-func pollImageStatus(id string) (string, error) {
-	fmt.Println("Starting pollImageStatus for id:", id)
-	for {
-		fmt.Println("Checking image status for id:", id)
-		status, err := checkImageStatus(id)
-		if err != nil {
-			fmt.Println("Error checking image status:", err)
-			return "", err
-		}
-
-		fmt.Println("Current status for id", id, ":", status)
-
-		if status == "completed" {
-			fmt.Println("Image generation completed for id:", id)
-			return status, nil
-		}
-
-		if status == "failed" {
-			fmt.Println("Image generation failed for id:", id)
-			return status, fmt.Errorf("image generation failed")
-		}
-
-		fmt.Println("Waiting 5 seconds before next status check for id:", id)
-		time.Sleep(5 * time.Second)
+// timeOutAnkyImage gives up on the image job of the Anky. A new image is asked for when the
+// job is retried, unless the webhook says the first one finally got ready before that.
+func (s *AnkyService) timeOutAnkyImage(ctx context.Context, anky *types.Anky, attempt int) error {
+	previous := anky.Status
+	if err := anky.TransitionTo(types.AnkyStatusImageTimedOut); err != nil {
+		return err
+	}
+	transition := types.NewAnkyStatusTransition(anky.ID, previous, types.AnkyStatusImageTimedOut, attempt, ErrImageTimedOut)
+	if err := s.store.TransitionAnky(ctx, anky, transition); err != nil {
+		anky.Status = previous
+		return fmt.Errorf("error saving anky status %s: %v", types.AnkyStatusImageTimedOut, err)
 	}
+	return ErrImageTimedOut
 }
 
-func checkImageStatus(id string) (string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:8055/items/images/%s", id), nil)
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+// autoChooseAnkyImage waits for the writer to choose the image of the Anky, and chooses the
+// best candidate for them once the time to do it is over
+func (s *AnkyService) autoChooseAnkyImage(ctx context.Context, anky *types.Anky) error {
+	if anky.ImageChooseBy != nil && time.Now().Before(*anky.ImageChooseBy) {
+		return &WaitingForImageError{Until: *anky.ImageChooseBy}
 	}
 
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("IMAGINE_API_TOKEN"))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	index, err := chooseImage(ctx, s.imageScorer, anky.ImageCandidates)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	var responseData struct {
-		Data struct {
-			Status string `json:"status"`
-			URL    string `json:"url"`
-		} `json:"data"`
+	if anky.Status != types.AnkyStatusChoosingImage {
+		anky.ChosenImageURL, anky.ImageChosenBy = anky.ImageCandidates[index], types.ImageChosenByAuto
+		return nil
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&responseData)
+	chosen, err := s.store.ChooseAnkyImage(ctx, anky.ID, anky.ImageCandidates[index], types.ImageChosenByAuto)
 	if err != nil {
-		return "", fmt.Errorf("error decoding response: %v", err)
+		return err
 	}
-
-	return responseData.Data.Status, nil
+	if !chosen {
+		// The writer chose right before us
+		current, err := s.store.GetAnkyByID(ctx, anky.ID)
+		if err != nil {
+			return fmt.Errorf("error loading anky: %v", err)
+		}
+		anky.ChosenImageURL, anky.ImageChosenBy = current.ChosenImageURL, current.ImageChosenBy
+		return nil
+	}
+	anky.ChosenImageURL, anky.ImageChosenBy = anky.ImageCandidates[index], types.ImageChosenByAuto
+	log.Printf("Chose image %d of anky %s", index, anky.ID)
+	return nil
 }
 
-func fetchImageDetails(id string) (*ImageDetails, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:8055/items/images/%s", id), nil)
+// ChooseAnkyImage makes the candidate at index the image of the Anky, and runs its job to
+// carry on without waiting for the time to choose to be over
+func (s *AnkyService) ChooseAnkyImage(ctx context.Context, ankyID uuid.UUID, index int) (*types.Anky, error) {
+	anky, err := s.store.GetAnkyByID(ctx, ankyID)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+		return nil, err
+	}
+	if anky.Status != types.AnkyStatusChoosingImage {
+		return nil, fmt.Errorf("anky %s is not waiting for its image to be chosen, it is %s", ankyID, anky.Status)
+	}
+	if index < 0 || index >= len(anky.ImageCandidates) {
+		return nil, fmt.Errorf("there is no image candidate %d, there are %d", index, len(anky.ImageCandidates))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("IMAGINE_API_TOKEN"))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	chosen, err := s.store.ChooseAnkyImage(ctx, ankyID, anky.ImageCandidates[index], types.ImageChosenByUser)
 	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+		return nil, err
+	}
+	if !chosen {
+		return nil, fmt.Errorf("the image of anky %s was already chosen", ankyID)
 	}
-	defer resp.Body.Close()
+	anky.ChosenImageURL, anky.ImageChosenBy = anky.ImageCandidates[index], types.ImageChosenByUser
 
-	var responseData struct {
-		Data ImageDetails `json:"data"`
+	if err := s.store.WakeAnkyJob(ctx, ankyID); err != nil {
+		return nil, fmt.Errorf("error waking the job of anky %s: %v", ankyID, err)
 	}
+	return anky, nil
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&responseData)
+// HandleImageGenerated is called by the image webhook. A completed image moves the Anky that
+// waits for it to image_generated, and either way its job runs again to carry on.
+func (s *AnkyService) HandleImageGenerated(ctx context.Context, imageGenerationID string, status string) (*types.Anky, error) {
+	anky, err := s.store.GetAnkyByImageGenerationID(ctx, imageGenerationID)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding response: %v", err)
+		return nil, fmt.Errorf("no anky is waiting for image %s", imageGenerationID)
 	}
 
-	return &responseData.Data, nil
-}
+	if status == ImageStatusCompleted &&
+		(anky.Status == types.AnkyStatusGeneratingImage || anky.Status == types.AnkyStatusImageTimedOut) {
+		if err := s.transitionAnky(ctx, anky, types.AnkyStatusImageGenerated, 0); err != nil {
+			return nil, err
+		}
+	}
 
-type ImageDetails struct {
-	Status       string   `json:"status"`
-	URL          string   `json:"url"`
-	UpscaledURLs []string `json:"upscaled_urls"`
+	if err := s.store.WakeAnkyJob(ctx, anky.ID); err != nil {
+		return nil, fmt.Errorf("error waking the job of anky %s: %v", anky.ID, err)
+	}
+	return anky, nil
 }
 
-func (s *AnkyService) GenerateAnkyFromPrompt(prompt string) (string, error) {
+func (s *AnkyService) GenerateAnkyFromPrompt(ctx context.Context, prompt string) (string, error) {
 	log.Println("Starting GenerateAnkyFromPrompt service")
 
-	// Generate image using Midjourney
-	log.Println("Generating image with Midjourney")
-	imageID, err := generateImageWithMidjourney("https://s.mj.run/YLJMlMJbo70 " + prompt)
+	log.Println("Generating image")
+	imageID, err := s.images.Submit(ctx, prompt)
 	if err != nil {
 		log.Printf("Failed to generate image: %v", err)
 		return "", fmt.Errorf("failed to generate image: %v", err)
@@ -475,42 +629,37 @@ func (s *AnkyService) GenerateAnkyFromPrompt(prompt string) (string, error) {
 
 	// Poll for image completion
 	log.Println("Polling for image completion")
-	status, err := pollImageStatus(imageID)
+	deadline := time.Now().Add(s.imageConfig.MaxWait)
+	status, err := waitForImage(ctx, s.images, imageID, deadline, s.imageConfig.PollInterval, s.imageConfig.MaxPollInterval)
 	if err != nil {
 		log.Printf("Error polling image status: %v", err)
 		return "", fmt.Errorf("error polling image status: %v", err)
 	}
 	log.Printf("Image status: %s", status)
 
-	if status != "completed" {
+	if status != ImageStatusCompleted {
 		log.Println("Image generation failed")
 		return "", fmt.Errorf("image generation failed")
 	}
 
 	// Fetch final image details
 	log.Println("Fetching image details")
-	imageDetails, err := fetchImageDetails(imageID)
+	imageDetails, err := s.images.Fetch(ctx, imageID)
 	if err != nil {
 		log.Printf("Error fetching image details: %v", err)
 		return "", fmt.Errorf("error fetching image details: %v", err)
 	}
 	log.Printf("Retrieved image URL: %s", imageDetails.URL)
 
-	// Upload to Cloudinary
-	log.Println("Uploading to Cloudinary")
-	imageHandler, err := NewImageService()
-	if err != nil {
-		log.Printf("Error creating ImageHandler: %v", err)
-		return "", fmt.Errorf("error creating ImageHandler: %v", err)
-	}
-	uploadResult, err := uploadImageToCloudinary(imageHandler, imageDetails.URL, uuid.New().String())
+	log.Println("Storing image")
+	imageURL, _, err := storeImage(ctx, s.blobs, imageDetails.URL, ankyImageKey(uuid.New().String()))
 	if err != nil {
-		log.Printf("Error uploading to Cloudinary: %v", err)
-		return "", fmt.Errorf("error uploading to Cloudinary: %v", err)
+		log.Printf("Error storing image: %v", err)
+		return "", fmt.Errorf("error storing image: %v", err)
 	}
-	log.Printf("Successfully uploaded to Cloudinary. URL: %s", uploadResult.SecureURL)
+	log.Printf("Successfully stored image. URL: %s", imageURL)
 
-	return uploadResult.SecureURL, nil
+	return imageURL, nil
 }
 
 func (s *AnkyService) EditCast(ctx context.Context, text string, userFid int) (string, error) {
@@ -518,49 +667,130 @@ func (s *AnkyService) EditCast(ctx context.Context, text string, userFid int) (s
 	return "", nil
 }
 
-func (s *AnkyService) OnboardingConversation(ctx context.Context, userId uuid.UUID, sessions []*types.WritingSession, ankyReflections []string) (string, error) {
+// OnboardingReflectionOutput is Anky's reply to a writing session of the onboarding
+type OnboardingReflectionOutput struct {
+	Reasoning      string `json:"reasoning" desc:"what stands out in their writing and their progress, for yourself"`
+	ResponseToUser string `json:"response_to_user" llm:"required,max=88" desc:"the single sentence the user will read"`
+}
+
+func (s *AnkyService) OnboardingConversation(ctx context.Context, userId uuid.UUID, sessions []*types.WritingSession, ankyReflections []string) (*types.AnkyOnboardingResponse, error) {
 	log.Printf("Starting onboarding conversation for attempt #%d", len(sessions))
 
-	llmService := NewLLMService()
+	llmService := NewLLMServiceFor(LLMPurposeOnboarding)
+	chatRequest, promptVersion, err := s.onboardingChatRequest(ctx, userId, sessions, ankyReflections)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Sending reflective conversation request %v", chatRequest)
+	var output OnboardingReflectionOutput
+	if err := llmService.SendStructuredRequest(ctx, chatRequest, &output); err != nil {
+		log.Printf("Error getting the onboarding reflection: %v", err)
+		return nil, err
+	}
+
+	response := newOnboardingResponse(userId, sessions, output.Reasoning, output.ResponseToUser, llmService.Model(), promptVersion)
+	if err := s.store.CreateOnboardingResponse(ctx, response); err != nil {
+		log.Printf("Error saving onboarding response: %v", err)
+	}
+	return response, nil
+}
+
+// OnboardingConversationStream streams Anky's reflection on the onboarding sessions as the
+// model writes it. The reflection comes as plain text, so it can be shown while it is typed,
+// and it is saved once the stream is complete.
+func (s *AnkyService) OnboardingConversationStream(ctx context.Context, userId uuid.UUID, sessions []*types.WritingSession, ankyReflections []string) (<-chan LLMChunk, error) {
+	log.Printf("Starting onboarding conversation stream for attempt #%d", len(sessions))
+
+	llmService := NewLLMServiceFor(LLMPurposeOnboarding)
+	chatRequest, promptVersion, err := s.onboardingChatRequest(ctx, userId, sessions, ankyReflections)
+	if err != nil {
+		return nil, err
+	}
+
+	responseChan, err := llmService.SendChatRequest(ctx, chatRequest, false)
+	if err != nil {
+		log.Printf("Error sending chat request: %v", err)
+		return nil, err
+	}
+
+	forwarded := make(chan LLMChunk)
+	go func() {
+		defer close(forwarded)
+
+		var text strings.Builder
+		for chunk := range responseChan {
+			select {
+			case forwarded <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			if chunk.Err != nil {
+				return
+			}
+			text.WriteString(chunk.Content)
+		}
+
+		response := newOnboardingResponse(userId, sessions, "", strings.TrimSpace(text.String()), llmService.Model(), promptVersion)
+		if err := s.store.CreateOnboardingResponse(context.Background(), response); err != nil {
+			log.Printf("Error saving onboarding response: %v", err)
+		}
+	}()
 
-	systemPrompt := `You are Anky, a wise guide inspired by Ramana Maharshi's practice of self-inquiry. Your role is to help users with their journey of daily stream-of-consciousness writing.
+	return forwarded, nil
+}
 
-Context:
-- Users are asked to write continuously for 8 minutes
-- The interface shows only a prompt and text area
-- The session ends if they pause for more than 8 seconds
-- This user has made ${sessions.length} previous attempts
+func newOnboardingResponse(userId uuid.UUID, sessions []*types.WritingSession, reasoning string, responseToUser string, model string, promptVersion string) *types.AnkyOnboardingResponse {
+	response := &types.AnkyOnboardingResponse{
+		ID:             uuid.New(),
+		UserID:         userId,
+		CreatedAt:      time.Now().UTC(),
+		Reasoning:      reasoning,
+		ResponseToUser: responseToUser,
+		AiModelUsed:    model,
+		PromptVersion:  promptVersion,
+	}
+	if len(sessions) > 0 {
+		response.RepliedToWritingSessionID = sessions[len(sessions)-1].ID
+	}
+	return response
+}
 
-Your Task:
-Provide a single-sentence response that:
-1. References specific words, themes or ideas from their writing to show deep understanding
-2. Acknowledges their progress based on writing duration:
-   - Under 1 minute: Validate their first steps
-   - 1-4 minutes: Recognize their growing momentum  
-   - 4-7 minutes: Celebrate their deeper exploration
-   - 7+ minutes: Honor their full expression
-3. Offers encouragement that builds naturally from their own words and themes
+func (s *AnkyService) onboardingChatRequest(ctx context.Context, userId uuid.UUID, sessions []*types.WritingSession, ankyReflections []string) (types.ChatRequest, string, error) {
+	vars := PromptVars{AttemptCount: len(sessions)}
+	if len(sessions) > 0 {
+		last := sessions[len(sessions)-1]
+		if last.TimeSpent != nil {
+			vars.DurationSeconds = *last.TimeSpent
+		}
+		vars.WordsWritten = last.WordsWritten
+	}
 
-Key Guidelines:
-- Make them feel truly seen and understood
-- Inspire them to continue their writing practice
-- Keep focus on their unique perspective and voice
-- Maintain a warm, supportive tone
-- Craft a response that resonates with their specific experience
+	// Every session of the onboarding counts to tell the language, the first ones are short
+	writings := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		writings = append(writings, session.Writing)
+	}
+	vars.Language = s.writerLanguageName(ctx, userId, strings.Join(writings, "\n"))
 
-Remember: Your response will be the only feedback they see after their writing session. Make it meaningful and motivating. Make it short and concise, less than 88 characters.`
+	systemPrompt, err := s.prompts.Render(ctx, PromptOnboarding, userId, vars)
+	if err != nil {
+		return types.ChatRequest{}, "", err
+	}
 
 	// Build conversation history with progression context
 	messages := []types.Message{
 		{
 			Role:    "system",
-			Content: systemPrompt,
+			Content: systemPrompt.Text,
 		},
 	}
-
 	// Add session context with progression markers
 	for i := 0; i < len(sessions); i++ {
-		timeSpent := sessions[i].TimeSpent
+		timeSpent := 0
+		if sessions[i].TimeSpent != nil {
+			timeSpent = *sessions[i].TimeSpent
+		}
 		wordsWritten := sessions[i].WordsWritten
 
 		attemptContext := fmt.Sprintf(`Writing Duration: %d seconds
@@ -586,23 +816,9 @@ Their words:
 		}
 	}
 
-	chatRequest := types.ChatRequest{
+	return types.ChatRequest{
 		Messages: messages,
-	}
-
-	log.Printf("Sending reflective conversation request %v", chatRequest)
-	responseChan, err := llmService.SendChatRequest(chatRequest, false)
-	if err != nil {
-		log.Printf("Error sending chat request: %v", err)
-		return "", err
-	}
-
-	var fullResponse string
-	for partialResponse := range responseChan {
-		fullResponse += partialResponse
-	}
-
-	return fullResponse, nil
+	}, systemPrompt.Version, nil
 }
 
 func getOnboardingStage(duration int) string {
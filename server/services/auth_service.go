@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/ankylat/anky/server/utils"
+	"github.com/google/uuid"
+)
+
+// Sessions
+//
+// Signing in opens a session and gives the client a pair of tokens: a short-lived access token
+// (ACCESS_TOKEN_TTL_SECONDS, 15 minutes by default) to call the API with, and a refresh token
+// (REFRESH_TOKEN_TTL_SECONDS, 30 days by default) to get the next pair with. Each refresh
+// replaces the refresh token, and a refresh token used a second time means someone else has a
+// copy of it, so the whole session is revoked. Ending the session invalidates its access tokens
+// right away.
+//
+// The users registered before sessions existed hold a JWT without expiry, which we kept in
+// users.jwt. It can be exchanged for a session once, then it stops working.
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("the refresh token was already used, the session is revoked")
+	ErrSessionInactive     = errors.New("the session has ended")
+	ErrReauthFailed        = errors.New("re-authentication failed, send the current refresh token of the session")
+)
+
+// TokenPair is what a client gets when it signs in or refreshes its tokens
+type TokenPair struct {
+	SessionID    uuid.UUID `json:"session_id"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"` // seconds until the access token expires
+}
+
+// sessionStore is the part of the storage the sessions need
+type sessionStore interface {
+	GetUserByID(ctx context.Context, userID uuid.UUID) (*types.User, error)
+	RetireUserLegacyJWT(ctx context.Context, userID uuid.UUID, jwt string) (bool, error)
+	CreateSession(ctx context.Context, session *types.Session) error
+	GetSessionByID(ctx context.Context, sessionID uuid.UUID) (*types.Session, error)
+	RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash string, newHash string, expiresAt time.Time) (bool, error)
+	EndSession(ctx context.Context, sessionID uuid.UUID, status string) error
+	EndUserSessions(ctx context.Context, userID uuid.UUID) error
+}
+
+type AuthService struct {
+	store      sessionStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewAuthService(store *storage.PostgresStore) *AuthService {
+	return &AuthService{
+		store:      store,
+		accessTTL:  time.Duration(envInt("ACCESS_TOKEN_TTL_SECONDS", 15*60)) * time.Second,
+		refreshTTL: time.Duration(envInt("REFRESH_TOKEN_TTL_SECONDS", 30*24*60*60)) * time.Second,
+	}
+}
+
+// StartSession signs the user in
+func (s *AuthService) StartSession(ctx context.Context, userID uuid.UUID, userAgent string) (*TokenPair, error) {
+	sessionID := uuid.New()
+	refreshToken, hash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := &types.Session{
+		ID:               sessionID,
+		UserID:           userID,
+		RefreshTokenHash: hash,
+		StartTime:        now,
+		LastActivity:     now,
+		ExpiresAt:        now.Add(s.refreshTTL),
+		Status:           types.SessionStatusActive,
+		UserAgent:        userAgent,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := s.store.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return s.tokenPair(userID, sessionID, refreshToken)
+}
+
+// Refresh trades a refresh token for a new pair of tokens
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	sessionID, hash, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	session, err := s.store.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if !session.IsActive(time.Now()) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if session.PreviousRefreshTokenHash != "" && hashesEqual(hash, session.PreviousRefreshTokenHash) {
+		log.Printf("Refresh token of session %s used twice, revoking the session", session.ID)
+		if err := s.store.EndSession(ctx, session.ID, types.SessionStatusRevoked); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if !hashesEqual(hash, session.RefreshTokenHash) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	next, nextHash, err := newRefreshToken(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Of two requests with the same token, only the first one gets new tokens
+	rotated, err := s.store.RotateSessionRefreshToken(ctx, session.ID, hash, nextHash, time.Now().UTC().Add(s.refreshTTL))
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		return nil, ErrInvalidRefreshToken
+	}
+	return s.tokenPair(session.UserID, session.ID, next)
+}
+
+// ExchangeLegacyToken opens a session for the holder of a JWT of the first versions of the API,
+// and retires the JWT
+func (s *AuthService) ExchangeLegacyToken(ctx context.Context, token string, userAgent string) (*TokenPair, error) {
+	userID, err := utils.ValidateLegacyJWT(token)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if user.JWT == "" || subtle.ConstantTimeCompare([]byte(user.JWT), []byte(token)) != 1 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Only one exchange of the token gets a session
+	retired, err := s.store.RetireUserLegacyJWT(ctx, user.ID, token)
+	if err != nil {
+		return nil, fmt.Errorf("error retiring the legacy token: %v", err)
+	}
+	if !retired {
+		return nil, ErrInvalidRefreshToken
+	}
+	return s.StartSession(ctx, user.ID, userAgent)
+}
+
+// Authenticate checks an access token and that its session is still active, and returns the
+// session
+func (s *AuthService) Authenticate(ctx context.Context, accessToken string) (*types.Session, error) {
+	claims, err := utils.ValidateAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session in the token: %v", err)
+	}
+	session, err := s.store.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !session.IsActive(time.Now()) {
+		return nil, ErrSessionInactive
+	}
+	if session.UserID.String() != claims.Subject {
+		return nil, fmt.Errorf("the token and its session have different users")
+	}
+	return session, nil
+}
+
+// Reauthenticate checks that the caller also holds the current refresh token of their session,
+// for what an access token alone isn't enough for, like showing the mnemonic of the wallet. The
+// refresh token stays valid, but an already used one revokes the session like in Refresh.
+func (s *AuthService) Reauthenticate(ctx context.Context, sessionID uuid.UUID, refreshToken string) error {
+	tokenSessionID, hash, err := parseRefreshToken(refreshToken)
+	if err != nil || tokenSessionID != sessionID {
+		return ErrReauthFailed
+	}
+	session, err := s.store.GetSessionByID(ctx, sessionID)
+	if err != nil || !session.IsActive(time.Now()) {
+		return ErrReauthFailed
+	}
+
+	if session.PreviousRefreshTokenHash != "" && hashesEqual(hash, session.PreviousRefreshTokenHash) {
+		log.Printf("Refresh token of session %s used again to re-authenticate, revoking the session", session.ID)
+		if err := s.store.EndSession(ctx, session.ID, types.SessionStatusRevoked); err != nil {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+	if !hashesEqual(hash, session.RefreshTokenHash) {
+		return ErrReauthFailed
+	}
+	return nil
+}
+
+// Logout ends a session
+func (s *AuthService) Logout(ctx context.Context, sessionID uuid.UUID) error {
+	return s.store.EndSession(ctx, sessionID, types.SessionStatusEnded)
+}
+
+// LogoutEverywhere ends all the sessions of a user
+func (s *AuthService) LogoutEverywhere(ctx context.Context, userID uuid.UUID) error {
+	return s.store.EndUserSessions(ctx, userID)
+}
+
+func (s *AuthService) tokenPair(userID, sessionID uuid.UUID, refreshToken string) (*TokenPair, error) {
+	accessToken, err := utils.CreateAccessToken(userID, sessionID, s.accessTTL)
+	if err != nil {
+		return nil, fmt.Errorf("error creating access token: %v", err)
+	}
+	return &TokenPair{
+		SessionID:    sessionID,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.accessTTL.Seconds()),
+	}, nil
+}
+
+// ******************** Refresh tokens ********************
+
+// A refresh token is the session ID and 32 random bytes, only the sha256 of the whole token is
+// stored
+
+func newRefreshToken(sessionID uuid.UUID) (token string, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", fmt.Errorf("error generating refresh token: %v", err)
+	}
+	token = sessionID.String() + "." + base64.RawURLEncoding.EncodeToString(secret)
+	return token, hashRefreshToken(token), nil
+}
+
+func parseRefreshToken(token string) (uuid.UUID, string, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, "", errors.New("malformed refresh token")
+	}
+	sessionID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("invalid session in the refresh token: %v", err)
+	}
+	if decoded, err := base64.RawURLEncoding.DecodeString(secret); err != nil || len(decoded) != 32 {
+		return uuid.Nil, "", errors.New("malformed refresh token")
+	}
+	return sessionID, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashesEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
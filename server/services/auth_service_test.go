@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/ankylat/anky/server/utils"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// memorySessionStore keeps the users and sessions of the tests in memory
+type memorySessionStore struct {
+	mu       sync.Mutex
+	users    map[uuid.UUID]*types.User
+	sessions map[uuid.UUID]*types.Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{users: map[uuid.UUID]*types.User{}, sessions: map[uuid.UUID]*types.Session{}}
+}
+
+func (m *memorySessionStore) GetUserByID(ctx context.Context, userID uuid.UUID) (*types.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, errors.New("no user")
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (m *memorySessionStore) RetireUserLegacyJWT(ctx context.Context, userID uuid.UUID, jwt string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok || user.JWT == "" || user.JWT != jwt {
+		return false, nil
+	}
+	user.JWT = ""
+	return true, nil
+}
+
+func (m *memorySessionStore) CreateSession(ctx context.Context, session *types.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copied := *session
+	m.sessions[session.ID] = &copied
+	return nil
+}
+
+func (m *memorySessionStore) GetSessionByID(ctx context.Context, sessionID uuid.UUID) (*types.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return nil, errors.New("no session")
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (m *memorySessionStore) RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash string, newHash string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[sessionID]
+	if !ok || session.RefreshTokenHash != oldHash || !session.IsActive(time.Now()) {
+		return false, nil
+	}
+	session.PreviousRefreshTokenHash, session.RefreshTokenHash, session.ExpiresAt = oldHash, newHash, expiresAt
+	return true, nil
+}
+
+func (m *memorySessionStore) EndSession(ctx context.Context, sessionID uuid.UUID, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[sessionID]; ok && session.Status == types.SessionStatusActive {
+		session.Status = status
+	}
+	return nil
+}
+
+func (m *memorySessionStore) EndUserSessions(ctx context.Context, userID uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.Status == types.SessionStatusActive {
+			session.Status = types.SessionStatusEnded
+		}
+	}
+	return nil
+}
+
+func newTestAuthService(t *testing.T) (*AuthService, *memorySessionStore) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	store := newMemorySessionStore()
+	return &AuthService{store: store, accessTTL: time.Minute, refreshTTL: time.Hour}, store
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	ctx := context.Background()
+	auth, store := newTestAuthService(t)
+	userID := uuid.New()
+
+	first, err := auth.StartSession(ctx, userID, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, first.AccessToken); err != nil {
+		t.Fatalf("expected the access token to be valid, got %v", err)
+	}
+
+	second, err := auth.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatalf("expected a new refresh token")
+	}
+	if second.SessionID != first.SessionID {
+		t.Errorf("expected the same session, got %s and %s", first.SessionID, second.SessionID)
+	}
+
+	// Using the first refresh token again revokes the session, and all its tokens
+	if _, err := auth.Refresh(ctx, first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected %v, got %v", ErrRefreshTokenReused, err)
+	}
+	if status := store.sessions[first.SessionID].Status; status != types.SessionStatusRevoked {
+		t.Errorf("expected the session to be revoked, got %s", status)
+	}
+	if _, err := auth.Refresh(ctx, second.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected the latest refresh token to stop working, got %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, second.AccessToken); !errors.Is(err, ErrSessionInactive) {
+		t.Errorf("expected the access token to stop working, got %v", err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	auth, _ := newTestAuthService(t)
+	userID := uuid.New()
+
+	phone, _ := auth.StartSession(ctx, userID, "phone")
+	laptop, _ := auth.StartSession(ctx, userID, "laptop")
+	tablet, _ := auth.StartSession(ctx, userID, "tablet")
+
+	if err := auth.Logout(ctx, phone.SessionID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, phone.AccessToken); !errors.Is(err, ErrSessionInactive) {
+		t.Errorf("expected the signed out session to be refused, got %v", err)
+	}
+	if _, err := auth.Authenticate(ctx, laptop.AccessToken); err != nil {
+		t.Errorf("expected the other sessions to keep working, got %v", err)
+	}
+
+	if err := auth.LogoutEverywhere(ctx, userID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tokens := range []*TokenPair{laptop, tablet} {
+		if _, err := auth.Refresh(ctx, tokens.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("expected every session to be ended, got %v", err)
+		}
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	ctx := context.Background()
+	auth, store := newTestAuthService(t)
+	userID := uuid.New()
+
+	first, _ := auth.StartSession(ctx, userID, "phone")
+	other, _ := auth.StartSession(ctx, userID, "laptop")
+
+	if err := auth.Reauthenticate(ctx, first.SessionID, first.RefreshToken); err != nil {
+		t.Fatalf("expected the current refresh token to re-authenticate, got %v", err)
+	}
+	// It stays usable
+	second, err := auth.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("expected the refresh token to still work, got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"another session's token", other.RefreshToken},
+		{"malformed", "not-a-token"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		if err := auth.Reauthenticate(ctx, second.SessionID, tt.token); !errors.Is(err, ErrReauthFailed) {
+			t.Errorf("%s: expected %v, got %v", tt.name, ErrReauthFailed, err)
+		}
+	}
+
+	// The replaced token means it leaked
+	if err := auth.Reauthenticate(ctx, second.SessionID, first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected %v, got %v", ErrRefreshTokenReused, err)
+	}
+	if status := store.sessions[first.SessionID].Status; status != types.SessionStatusRevoked {
+		t.Errorf("expected the session to be revoked, got %s", status)
+	}
+}
+
+func TestAuthenticateRefusesBadTokens(t *testing.T) {
+	ctx := context.Background()
+	auth, _ := newTestAuthService(t)
+	tokens, err := auth.StartSession(ctx, uuid.New(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+		signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	claims := func(change func(*utils.AccessClaims)) *utils.AccessClaims {
+		c, err := utils.ValidateAccessToken(tokens.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(c)
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", sign(jwt.SigningMethodHS256, []byte("test-secret"), claims(func(c *utils.AccessClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		}))},
+		{"no expiry", sign(jwt.SigningMethodHS256, []byte("test-secret"), claims(func(c *utils.AccessClaims) {
+			c.ExpiresAt = nil
+		}))},
+		{"another user", sign(jwt.SigningMethodHS256, []byte("test-secret"), claims(func(c *utils.AccessClaims) {
+			c.Subject = uuid.New().String()
+		}))},
+		{"another secret", sign(jwt.SigningMethodHS256, []byte("other-secret"), claims(func(*utils.AccessClaims) {}))},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(func(*utils.AccessClaims) {}))},
+		{"legacy token", sign(jwt.SigningMethodHS256, []byte("test-secret"), jwt.MapClaims{"userID": uuid.New().String()})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := auth.Authenticate(ctx, tt.token); err == nil {
+				t.Errorf("expected the token to be refused")
+			}
+		})
+	}
+
+	t.Run("missing secret", func(t *testing.T) {
+		t.Setenv("JWT_SECRET", "")
+		if _, err := auth.Authenticate(ctx, tokens.AccessToken); !errors.Is(err, utils.ErrMissingJWTSecret) {
+			t.Errorf("expected %v, got %v", utils.ErrMissingJWTSecret, err)
+		}
+	})
+}
+
+func TestExchangeLegacyToken(t *testing.T) {
+	ctx := context.Background()
+	auth, store := newTestAuthService(t)
+
+	user := &types.User{ID: uuid.New()}
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userID": user.ID.String()}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.JWT = legacy
+	store.users[user.ID] = user
+
+	tokens, err := auth.ExchangeLegacyToken(ctx, legacy, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session, err := auth.Authenticate(ctx, tokens.AccessToken); err != nil || session.UserID != user.ID {
+		t.Fatalf("expected a session of the user, got %v", err)
+	}
+	if store.users[user.ID].JWT != "" {
+		t.Errorf("expected the legacy token to be retired")
+	}
+	if _, err := auth.ExchangeLegacyToken(ctx, legacy, "test"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expected the legacy token to be exchanged only once, got %v", err)
+	}
+}
+
+func TestExchangeLegacyTokenConcurrently(t *testing.T) {
+	ctx := context.Background()
+	auth, store := newTestAuthService(t)
+
+	user := &types.User{ID: uuid.New()}
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"userID": user.ID.String()}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.JWT = legacy
+	store.users[user.ID] = user
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := auth.ExchangeLegacyToken(ctx, legacy, "test")
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	exchanged := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			exchanged++
+		case !errors.Is(err, ErrInvalidRefreshToken):
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if exchanged != 1 {
+		t.Errorf("expected a single session for the legacy token, got %d", exchanged)
+	}
+}
+
+func TestParseRefreshToken(t *testing.T) {
+	sessionID := uuid.New()
+	token, hash, err := newRefreshToken(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotID, gotHash, err := parseRefreshToken(token)
+	if err != nil || gotID != sessionID || gotHash != hash {
+		t.Fatalf("expected %s and %s, got %s, %s and %v", sessionID, hash, gotID, gotHash, err)
+	}
+
+	for _, bad := range []string{"", "abc", sessionID.String(), sessionID.String() + ".short", "not-a-uuid." + token[37:]} {
+		if _, _, err := parseRefreshToken(bad); err == nil {
+			t.Errorf("expected %q to be refused", bad)
+		}
+	}
+}
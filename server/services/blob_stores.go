@@ -0,0 +1,501 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+)
+
+// Object storage
+//
+// The images are kept in a BlobStore chosen with BLOB_STORE:
+//
+//   - cloudinary: Cloudinary, configured with CLOUDINARY_URL and the CLOUDINARY_UPLOAD_PRESET preset
+//   - local: files under BLOB_LOCAL_DIR, served by the API under /blobs/
+//   - s3: a bucket of S3 or of any S3-compatible server like MinIO, see LoadBlobStoreConfig
+//
+// Without BLOB_STORE, Cloudinary is used when CLOUDINARY_URL is set and the local disk otherwise,
+// so that development runs without any account. BLOB_PUBLIC_BASE_URL overrides the base of the
+// public URLs of the local and S3 stores, like the URL of a CDN in front of them.
+
+// ErrBlobNotFound is returned by Get for a key that was never stored, or was deleted
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps files under keys, like ankys/<session ID>
+type BlobStore interface {
+	// Put stores the data under key, replacing what was there, and returns its public URL
+	Put(ctx context.Context, key string, data []byte, contentType string) (string, error)
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// PublicURL is where clients can download the file stored under key
+	PublicURL(key string) string
+}
+
+// BlobStoreConfig says where the files are kept
+type BlobStoreConfig struct {
+	Backend       string // cloudinary, local or s3
+	PublicBaseURL string
+
+	CloudinaryURL    string
+	CloudinaryPreset string
+
+	LocalDir string
+
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+}
+
+// LoadBlobStoreConfig reads the configuration from the BLOB_*, CLOUDINARY_* and S3_* variables
+func LoadBlobStoreConfig() BlobStoreConfig {
+	config := BlobStoreConfig{
+		Backend:       strings.ToLower(os.Getenv("BLOB_STORE")),
+		PublicBaseURL: os.Getenv("BLOB_PUBLIC_BASE_URL"),
+
+		CloudinaryURL:    os.Getenv("CLOUDINARY_URL"),
+		CloudinaryPreset: os.Getenv("CLOUDINARY_UPLOAD_PRESET"),
+
+		LocalDir: os.Getenv("BLOB_LOCAL_DIR"),
+
+		S3Endpoint:        os.Getenv("S3_ENDPOINT"),
+		S3Region:          os.Getenv("S3_REGION"),
+		S3Bucket:          os.Getenv("S3_BUCKET"),
+		S3AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+	}
+
+	if config.Backend == "" {
+		config.Backend = "local"
+		if config.CloudinaryURL != "" {
+			config.Backend = "cloudinary"
+		}
+	}
+	if config.CloudinaryPreset == "" {
+		config.CloudinaryPreset = "anky_mobile"
+	}
+	if config.LocalDir == "" {
+		config.LocalDir = "data/blobs"
+	}
+	if config.S3Endpoint == "" {
+		config.S3Endpoint = "https://s3.amazonaws.com"
+	}
+	if config.S3Region == "" {
+		config.S3Region = "us-east-1"
+	}
+	return config
+}
+
+// NewBlobStore builds the store described by the configuration
+func NewBlobStore(config BlobStoreConfig) (BlobStore, error) {
+	switch config.Backend {
+	case "cloudinary":
+		return NewCloudinaryBlobStore(config.CloudinaryURL, config.CloudinaryPreset)
+	case "local":
+		baseURL := config.PublicBaseURL
+		if baseURL == "" {
+			baseURL = "http://localhost:8888/blobs"
+		}
+		return NewLocalBlobStore(config.LocalDir, baseURL)
+	case "s3":
+		if config.S3Bucket == "" || config.S3AccessKeyID == "" || config.S3SecretAccessKey == "" {
+			return nil, fmt.Errorf("the s3 blob store needs S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+		}
+		return NewS3BlobStore(config.S3Endpoint, config.S3Region, config.S3Bucket,
+			config.S3AccessKeyID, config.S3SecretAccessKey, config.PublicBaseURL, &http.Client{Timeout: time.Minute})
+	default:
+		return nil, fmt.Errorf("unknown blob store: %s", config.Backend)
+	}
+}
+
+// storeImage keeps a copy of a generated image, which can be a data URL, and returns its
+// public URL and its bytes
+func storeImage(ctx context.Context, blobs BlobStore, imageURL, key string) (string, []byte, error) {
+	data, err := downloadImage(ctx, imageURL)
+	if err != nil {
+		return "", nil, err
+	}
+	publicURL, err := blobs.Put(ctx, key, data, http.DetectContentType(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("error storing image: %v", err)
+	}
+	return publicURL, data, nil
+}
+
+// validBlobKey keeps keys to plain relative paths, so that none can escape the local directory
+func validBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
+
+// ******************** Cloudinary ********************
+
+// CloudinaryBlobStore keeps the files as Cloudinary assets, whose public ID is the key
+type CloudinaryBlobStore struct {
+	cld    *cloudinary.Cloudinary
+	preset string
+	client *http.Client
+}
+
+func NewCloudinaryBlobStore(cloudinaryURL, preset string) (*CloudinaryBlobStore, error) {
+	cld, err := cloudinary.NewFromURL(cloudinaryURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Cloudinary: %v", err)
+	}
+	cld.Config.URL.Secure = true
+	return &CloudinaryBlobStore{cld: cld, preset: preset, client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+func (s *CloudinaryBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	result, err := s.cld.Upload.Upload(ctx, bytes.NewReader(data), uploader.UploadParams{
+		PublicID:     key,
+		UploadPreset: s.preset,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error uploading to Cloudinary: %v", err)
+	}
+	if result.Error.Message != "" {
+		return "", fmt.Errorf("error uploading to Cloudinary: %s", result.Error.Message)
+	}
+	return result.SecureURL, nil
+}
+
+func (s *CloudinaryBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.PublicURL(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	return doBlobRequest(s.client, req)
+}
+
+func (s *CloudinaryBlobStore) Delete(ctx context.Context, key string) error {
+	if _, err := s.cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: key}); err != nil {
+		return fmt.Errorf("error deleting from Cloudinary: %v", err)
+	}
+	return nil
+}
+
+func (s *CloudinaryBlobStore) PublicURL(key string) string {
+	asset, err := s.cld.Image(key)
+	if err != nil {
+		return ""
+	}
+	publicURL, err := asset.String()
+	if err != nil {
+		return ""
+	}
+	return publicURL
+}
+
+// ******************** Local disk ********************
+
+// LocalBlobStore keeps the files in a directory, for development and single-server deployments
+type LocalBlobStore struct {
+	dir     string
+	baseURL string
+}
+
+func NewLocalBlobStore(dir, baseURL string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory: %v", err)
+	}
+	return &LocalBlobStore{dir: dir, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first, so that readers never see half a file
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("error creating blob directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating blob file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("error writing blob file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("error writing blob file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("error writing blob file: %v", err)
+	}
+	return s.PublicURL(key), nil
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting blob file: %v", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) PublicURL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// Handler serves the stored files, to be mounted under /blobs/. Directories are not listed.
+func (s *LocalBlobStore) Handler() http.Handler {
+	files := http.FileServer(http.Dir(s.dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") || validBlobKey(strings.TrimPrefix(r.URL.Path, "/")) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// ******************** S3 ********************
+
+// S3BlobStore keeps the files in a bucket of S3 or of an S3-compatible server. The bucket is
+// addressed in the path (https://endpoint/bucket/key), which every S3-compatible server
+// supports, and requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint        string
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	publicBaseURL   string
+	client          *http.Client
+}
+
+func NewS3BlobStore(endpoint, region, bucket, accessKeyID, secretAccessKey, publicBaseURL string, client *http.Client) (*S3BlobStore, error) {
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	if publicBaseURL == "" {
+		publicBaseURL = endpoint + "/" + bucket
+	}
+	return &S3BlobStore{
+		endpoint:        endpoint,
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		publicBaseURL:   strings.TrimRight(publicBaseURL, "/"),
+		client:          client,
+	}, nil
+}
+
+func (s *S3BlobStore) objectURL(key string) string {
+	return s.endpoint + "/" + s.bucket + "/" + escapeS3Key(key)
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	signS3Request(req, data, s.accessKeyID, s.secretAccessKey, s.region, time.Now())
+
+	if _, err := doBlobRequest(s.client, req); err != nil {
+		return "", err
+	}
+	return s.PublicURL(key), nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectURL(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	signS3Request(req, nil, s.accessKeyID, s.secretAccessKey, s.region, time.Now())
+	return doBlobRequest(s.client, req)
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	signS3Request(req, nil, s.accessKeyID, s.secretAccessKey, s.region, time.Now())
+	_, err = doBlobRequest(s.client, req)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *S3BlobStore) PublicURL(key string) string {
+	return s.publicBaseURL + "/" + escapeS3Key(key)
+}
+
+// escapeS3Key escapes every segment of the key but keeps its slashes
+func escapeS3Key(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3Escape is the URI encoding of Signature Version 4: everything but unreserved characters
+func s3Escape(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signS3Request adds the Authorization header of AWS Signature Version 4 to the request,
+// signing the host, the x-amz-* headers and the other headers already set on it
+func signS3Request(req *http.Request, payload []byte, accessKeyID, secretAccessKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// Canonical headers: lowercase names, sorted, with the host
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Canonical query: sorted and escaped
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// doBlobRequest sends a request to a blob store and returns the body of its response
+func doBlobRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -251,7 +252,7 @@ func (s *FarcasterService) makeRequest(method, url string, payload interface{})
 	return result, nil
 }
 
-func publishToFarcaster(session *types.WritingSession) (*types.Cast, error) {
+func publishToFarcaster(ctx context.Context, session *types.WritingSession) (*types.Cast, error) {
 	log.Printf("Publishing to Farcaster for session ID: %s", session.ID)
 	fmt.Println("Publishing to Farcaster for session ID:", session.ID)
 
@@ -286,7 +287,7 @@ func publishToFarcaster(session *types.WritingSession) (*types.Cast, error) {
 	fmt.Println("Idem:", idem)
 	fmt.Println("Cast Text:", castText)
 
-	castResponse, err := neynarService.WriteCast(apiKey, signerUUID, castText, channelID, idem.String(), session.ID.String())
+	castResponse, err := neynarService.WriteCast(ctx, apiKey, signerUUID, castText, channelID, idem.String(), session.ID.String())
 	if err != nil {
 		log.Printf("Error publishing to Farcaster: %v", err)
 		fmt.Println("Error publishing to Farcaster:", err)
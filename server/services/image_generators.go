@@ -0,0 +1,522 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Image generation
+//
+// The image of an Anky comes from an ImageGenerator chosen with IMAGE_GENERATOR:
+//
+//   - imagine (default): the imagine-API proxy in front of Midjourney, at IMAGE_GENERATOR_BASE_URL
+//   - comfyui: a ComfyUI server, or any HTTP backend with the same /prompt and /history API.
+//     IMAGE_GENERATOR_WORKFLOW is the workflow JSON to run, where "{{prompt}}" is replaced by the prompt.
+//   - placeholder: renders a deterministic PNG locally, for tests and offline development
+//
+// IMAGE_GENERATOR_API_KEY authenticates the requests (IMAGINE_API_TOKEN is still read for the
+// proxy), and IMAGE_STYLE_REFERENCE is put in front of every prompt, like the --sref URL of
+// the deployment's Midjourney style. The imagine backend defaults to the style of Anky.
+//
+// The status of an image job is polled every IMAGE_POLL_INTERVAL_SECONDS at first, backing off
+// up to IMAGE_POLL_MAX_INTERVAL_SECONDS, and the job is given up on after IMAGE_MAX_WAIT_SECONDS.
+// With IMAGE_GENERATOR_CALLBACKS=true the backend calls POST /webhooks/image-generated/{id}
+// when the image is ready instead, and nothing is polled in the meantime.
+
+const (
+	ImageStatusPending   = "pending"
+	ImageStatusCompleted = "completed"
+	ImageStatusFailed    = "failed"
+)
+
+// ImageGenerator is a backend that turns prompts into images. Generation is asynchronous:
+// Submit starts a job, Status tells when it is done and Fetch returns its images.
+type ImageGenerator interface {
+	// Submit starts generating the images of a prompt and returns the ID of the job on the backend
+	Submit(ctx context.Context, prompt string) (string, error)
+	// Status returns ImageStatusPending, ImageStatusCompleted or ImageStatusFailed
+	Status(ctx context.Context, id string) (string, error)
+	// Fetch returns the images of a completed job
+	Fetch(ctx context.Context, id string) (*ImageDetails, error)
+}
+
+// ImageDetails are the results of an image job. URL is the main image, and UpscaledURLs the
+// variations to choose from.
+type ImageDetails struct {
+	Status       string   `json:"status"`
+	URL          string   `json:"url"`
+	UpscaledURLs []string `json:"upscaled_urls"`
+}
+
+// defaultImagineStyleReference is the Midjourney style of the Ankys
+const defaultImagineStyleReference = "https://s.mj.run/YLJMlMJbo70"
+
+// ImageGeneratorConfig says which backend generates the images
+type ImageGeneratorConfig struct {
+	Backend        string // imagine, comfyui or placeholder
+	BaseURL        string
+	APIKey         string
+	StyleReference string
+	WorkflowFile   string
+
+	// Callbacks means the backend calls the image webhook, so the jobs don't poll it
+	Callbacks       bool
+	MaxWait         time.Duration
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+}
+
+// LoadImageGeneratorConfig reads the configuration from the IMAGE_GENERATOR* variables
+func LoadImageGeneratorConfig() ImageGeneratorConfig {
+	config := ImageGeneratorConfig{
+		Backend:        strings.ToLower(os.Getenv("IMAGE_GENERATOR")),
+		BaseURL:        os.Getenv("IMAGE_GENERATOR_BASE_URL"),
+		APIKey:         os.Getenv("IMAGE_GENERATOR_API_KEY"),
+		StyleReference: os.Getenv("IMAGE_STYLE_REFERENCE"),
+		WorkflowFile:   os.Getenv("IMAGE_GENERATOR_WORKFLOW"),
+
+		Callbacks:       os.Getenv("IMAGE_GENERATOR_CALLBACKS") == "true",
+		MaxWait:         time.Duration(envInt("IMAGE_MAX_WAIT_SECONDS", 600)) * time.Second,
+		PollInterval:    time.Duration(envInt("IMAGE_POLL_INTERVAL_SECONDS", 5)) * time.Second,
+		MaxPollInterval: time.Duration(envInt("IMAGE_POLL_MAX_INTERVAL_SECONDS", 60)) * time.Second,
+	}
+
+	switch config.Backend {
+	case "", "imagine":
+		config.Backend = "imagine"
+		if config.BaseURL == "" {
+			config.BaseURL = "http://localhost:8055"
+		}
+		if config.APIKey == "" {
+			config.APIKey = os.Getenv("IMAGINE_API_TOKEN")
+		}
+		if config.StyleReference == "" {
+			config.StyleReference = defaultImagineStyleReference
+		}
+	case "comfyui", "http":
+		config.Backend = "comfyui"
+		if config.BaseURL == "" {
+			config.BaseURL = "http://localhost:8188"
+		}
+	}
+	return config
+}
+
+// NewImageGenerator builds the generator described by the configuration
+func NewImageGenerator(config ImageGeneratorConfig) (ImageGenerator, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	switch config.Backend {
+	case "imagine":
+		return NewImagineAPIGenerator(config.BaseURL, config.APIKey, config.StyleReference, client), nil
+	case "comfyui":
+		workflow := ""
+		if config.WorkflowFile != "" {
+			content, err := os.ReadFile(config.WorkflowFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading image workflow: %v", err)
+			}
+			workflow = string(content)
+		}
+		return NewComfyUIGenerator(config.BaseURL, config.APIKey, config.StyleReference, workflow, client), nil
+	case "placeholder":
+		return NewPlaceholderImageGenerator(), nil
+	default:
+		return nil, fmt.Errorf("unknown image generator: %s", config.Backend)
+	}
+}
+
+// ErrImageTimedOut is returned when an image job is still not done after the maximum wait
+var ErrImageTimedOut = errors.New("image generation timed out")
+
+// waitForImage polls the status of an image job until it is done, the deadline passes or ctx
+// is cancelled. The interval between checks doubles up to maxInterval, with some jitter so
+// that the jobs started together don't all hit the backend at the same time.
+func waitForImage(ctx context.Context, generator ImageGenerator, id string, deadline time.Time, interval, maxInterval time.Duration) (string, error) {
+	for {
+		status, err := generator.Status(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("error checking image status: %v", err)
+		}
+
+		switch status {
+		case ImageStatusCompleted:
+			return status, nil
+		case ImageStatusFailed:
+			return status, fmt.Errorf("image generation failed")
+		}
+
+		wait := jitter(interval)
+		if remaining := time.Until(deadline); remaining <= 0 {
+			return status, ErrImageTimedOut
+		} else if wait > remaining {
+			wait = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// jitter spreads d by 20% either way
+func jitter(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (0.8 + 0.4*rand.Float64()))
+}
+
+// withStyleReference puts the style reference of the deployment in front of the prompt
+func withStyleReference(styleReference, prompt string) string {
+	if styleReference == "" {
+		return prompt
+	}
+	return styleReference + " " + prompt
+}
+
+// doImageRequest sends a JSON request to an image backend and decodes its JSON response into out
+func doImageRequest(ctx context.Context, client *http.Client, method, url, apiKey string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("error marshaling data: %v", err)
+		}
+		reader = bytes.NewBuffer(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
+
+// ******************** Imagine API ********************
+
+// ImagineAPIGenerator talks to the imagine-API proxy, which runs the prompts on Midjourney
+// and stores them as items/images
+type ImagineAPIGenerator struct {
+	baseURL        string
+	apiKey         string
+	styleReference string
+	client         *http.Client
+}
+
+func NewImagineAPIGenerator(baseURL, apiKey, styleReference string, client *http.Client) *ImagineAPIGenerator {
+	return &ImagineAPIGenerator{
+		baseURL:        strings.TrimRight(baseURL, "/"),
+		apiKey:         apiKey,
+		styleReference: styleReference,
+		client:         client,
+	}
+}
+
+func (g *ImagineAPIGenerator) Submit(ctx context.Context, prompt string) (string, error) {
+	var response struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{"prompt": withStyleReference(g.styleReference, prompt)}
+	if err := doImageRequest(ctx, g.client, "POST", g.baseURL+"/items/images/", g.apiKey, body, &response); err != nil {
+		return "", err
+	}
+	if response.Data.ID == "" {
+		return "", fmt.Errorf("the image proxy returned no job ID")
+	}
+	return response.Data.ID, nil
+}
+
+func (g *ImagineAPIGenerator) Status(ctx context.Context, id string) (string, error) {
+	details, err := g.Fetch(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return details.Status, nil
+}
+
+func (g *ImagineAPIGenerator) Fetch(ctx context.Context, id string) (*ImageDetails, error) {
+	var response struct {
+		Data ImageDetails `json:"data"`
+	}
+	if err := doImageRequest(ctx, g.client, "GET", g.baseURL+"/items/images/"+url.PathEscape(id), g.apiKey, nil, &response); err != nil {
+		return nil, err
+	}
+
+	// The proxy also reports in-progress and other intermediate statuses
+	switch response.Data.Status {
+	case ImageStatusCompleted, ImageStatusFailed:
+	default:
+		response.Data.Status = ImageStatusPending
+	}
+	return &response.Data, nil
+}
+
+// ******************** ComfyUI ********************
+
+// ComfyUIGenerator runs a workflow on a ComfyUI server: POST /prompt queues it, and
+// GET /history/{id} tells when it is done and which images it produced. Without a workflow,
+// the prompt is sent as is, for backends that only need the text.
+type ComfyUIGenerator struct {
+	baseURL        string
+	apiKey         string
+	styleReference string
+	workflow       string
+	client         *http.Client
+}
+
+func NewComfyUIGenerator(baseURL, apiKey, styleReference, workflow string, client *http.Client) *ComfyUIGenerator {
+	return &ComfyUIGenerator{
+		baseURL:        strings.TrimRight(baseURL, "/"),
+		apiKey:         apiKey,
+		styleReference: styleReference,
+		workflow:       workflow,
+		client:         client,
+	}
+}
+
+func (g *ComfyUIGenerator) Submit(ctx context.Context, prompt string) (string, error) {
+	prompt = withStyleReference(g.styleReference, prompt)
+
+	var body interface{} = map[string]string{"prompt": prompt}
+	if g.workflow != "" {
+		// The prompt goes inside a JSON string of the workflow, so it is escaped like one
+		escaped, err := json.Marshal(prompt)
+		if err != nil {
+			return "", fmt.Errorf("error escaping prompt: %v", err)
+		}
+		workflow := strings.ReplaceAll(g.workflow, "{{prompt}}", string(escaped[1:len(escaped)-1]))
+
+		var graph map[string]interface{}
+		if err := json.Unmarshal([]byte(workflow), &graph); err != nil {
+			return "", fmt.Errorf("invalid image workflow: %v", err)
+		}
+		body = map[string]interface{}{"prompt": graph}
+	}
+
+	var response struct {
+		PromptID string `json:"prompt_id"`
+	}
+	if err := doImageRequest(ctx, g.client, "POST", g.baseURL+"/prompt", g.apiKey, body, &response); err != nil {
+		return "", err
+	}
+	if response.PromptID == "" {
+		return "", fmt.Errorf("the image backend returned no prompt ID")
+	}
+	return response.PromptID, nil
+}
+
+// comfyUIHistory is the entry of a prompt in the /history/{id} response
+type comfyUIHistory struct {
+	Status struct {
+		StatusStr string `json:"status_str"`
+		Completed bool   `json:"completed"`
+	} `json:"status"`
+	Outputs map[string]struct {
+		Images []struct {
+			Filename  string `json:"filename"`
+			Subfolder string `json:"subfolder"`
+			Type      string `json:"type"`
+		} `json:"images"`
+	} `json:"outputs"`
+}
+
+func (g *ComfyUIGenerator) history(ctx context.Context, id string) (*comfyUIHistory, error) {
+	var response map[string]*comfyUIHistory
+	if err := doImageRequest(ctx, g.client, "GET", g.baseURL+"/history/"+url.PathEscape(id), g.apiKey, nil, &response); err != nil {
+		return nil, err
+	}
+	// A prompt still in the queue has no history yet
+	return response[id], nil
+}
+
+func (g *ComfyUIGenerator) Status(ctx context.Context, id string) (string, error) {
+	history, err := g.history(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return comfyUIStatus(history), nil
+}
+
+func comfyUIStatus(history *comfyUIHistory) string {
+	switch {
+	case history == nil:
+		return ImageStatusPending
+	case history.Status.StatusStr == "error":
+		return ImageStatusFailed
+	case history.Status.Completed:
+		return ImageStatusCompleted
+	default:
+		return ImageStatusPending
+	}
+}
+
+func (g *ComfyUIGenerator) Fetch(ctx context.Context, id string) (*ImageDetails, error) {
+	history, err := g.history(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &ImageDetails{Status: comfyUIStatus(history)}
+	if history == nil {
+		return details, nil
+	}
+	for _, output := range history.Outputs {
+		for _, img := range output.Images {
+			query := url.Values{}
+			query.Set("filename", img.Filename)
+			query.Set("subfolder", img.Subfolder)
+			query.Set("type", img.Type)
+			details.UpscaledURLs = append(details.UpscaledURLs, g.baseURL+"/view?"+query.Encode())
+		}
+	}
+	if len(details.UpscaledURLs) > 0 {
+		details.URL = details.UpscaledURLs[0]
+	}
+	return details, nil
+}
+
+// ******************** Placeholder ********************
+
+// placeholderImageCount is how many variations the placeholder generator renders for a prompt
+const placeholderImageCount = 4
+
+const placeholderImageSize = 256
+
+// PlaceholderImageGenerator renders images locally, without any backend. The same prompt
+// always gets the same images, returned as data URLs.
+type PlaceholderImageGenerator struct{}
+
+func NewPlaceholderImageGenerator() *PlaceholderImageGenerator {
+	return &PlaceholderImageGenerator{}
+}
+
+// Submit doesn't need to remember the prompt: the job ID is its hash, which is all the images are made of
+func (g *PlaceholderImageGenerator) Submit(ctx context.Context, prompt string) (string, error) {
+	hash := sha256.Sum256([]byte(prompt))
+	return "placeholder-" + hex.EncodeToString(hash[:8]), nil
+}
+
+func (g *PlaceholderImageGenerator) Status(ctx context.Context, id string) (string, error) {
+	return ImageStatusCompleted, nil
+}
+
+func (g *PlaceholderImageGenerator) Fetch(ctx context.Context, id string) (*ImageDetails, error) {
+	details := &ImageDetails{Status: ImageStatusCompleted}
+	for i := 0; i < placeholderImageCount; i++ {
+		data, err := renderPlaceholderImage(fmt.Sprintf("%s-%d", id, i))
+		if err != nil {
+			return nil, err
+		}
+		details.UpscaledURLs = append(details.UpscaledURLs, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(data))
+	}
+	details.URL = details.UpscaledURLs[0]
+	return details, nil
+}
+
+// renderPlaceholderImage paints a gradient between two colors taken from the seed, with a
+// disc in a place also taken from the seed
+func renderPlaceholderImage(seed string) ([]byte, error) {
+	hash := sha256.Sum256([]byte(seed))
+	from := color.RGBA{hash[0], hash[1], hash[2], 255}
+	to := color.RGBA{hash[3], hash[4], hash[5], 255}
+	disc := color.RGBA{hash[6], hash[7], hash[8], 255}
+	centerX := int(hash[9]) * placeholderImageSize / 256
+	centerY := int(hash[10]) * placeholderImageSize / 256
+	radius := placeholderImageSize/8 + int(hash[11])*placeholderImageSize/1024
+
+	img := image.NewRGBA(image.Rect(0, 0, placeholderImageSize, placeholderImageSize))
+	for y := 0; y < placeholderImageSize; y++ {
+		for x := 0; x < placeholderImageSize; x++ {
+			dx, dy := x-centerX, y-centerY
+			if dx*dx+dy*dy <= radius*radius {
+				img.SetRGBA(x, y, disc)
+				continue
+			}
+			t := float64(x+y) / float64(2*placeholderImageSize)
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(float64(from.R)*(1-t) + float64(to.R)*t),
+				G: uint8(float64(from.G)*(1-t) + float64(to.G)*t),
+				B: uint8(float64(from.B)*(1-t) + float64(to.B)*t),
+				A: 255,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("error encoding placeholder image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// imageDownloadClient fetches the generated images, which are bigger than the API responses
+// of the backends, so it waits a bit longer for them
+var imageDownloadClient = &http.Client{Timeout: 60 * time.Second}
+
+// downloadImage returns the bytes of an image URL, which can also be a data URL like the
+// ones of the placeholder generator
+func downloadImage(ctx context.Context, imageURL string) ([]byte, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		comma := strings.IndexByte(imageURL, ',')
+		if comma < 0 || !strings.HasSuffix(imageURL[:comma], ";base64") {
+			return nil, fmt.Errorf("unsupported data URL")
+		}
+		return base64.StdEncoding.DecodeString(imageURL[comma+1:])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	resp, err := imageDownloadClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading image: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
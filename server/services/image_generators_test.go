@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadImageGeneratorConfigStyleReference(t *testing.T) {
+	tests := []struct {
+		name      string
+		backend   string
+		reference string
+		want      string
+	}{
+		{"imagine without a reference", "imagine", "", defaultImagineStyleReference},
+		{"default backend", "", "", defaultImagineStyleReference},
+		{"imagine with its own reference", "imagine", "https://s.mj.run/other", "https://s.mj.run/other"},
+		{"comfyui without a reference", "comfyui", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IMAGE_GENERATOR", tt.backend)
+			t.Setenv("IMAGE_STYLE_REFERENCE", tt.reference)
+			if got := LoadImageGeneratorConfig().StyleReference; got != tt.want {
+				t.Errorf("expected style reference %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPlaceholderImageGenerator(t *testing.T) {
+	ctx := context.Background()
+	generator := NewPlaceholderImageGenerator()
+
+	first, err := generator.Submit(ctx, "a blue creature writing at dawn")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, _ := generator.Submit(ctx, "a blue creature writing at dawn")
+	other, _ := generator.Submit(ctx, "a purple creature")
+	if first != second || first == other {
+		t.Fatalf("expected the job ID to depend only on the prompt, got %s, %s and %s", first, second, other)
+	}
+
+	details, err := generator.Fetch(ctx, first)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if details.Status != ImageStatusCompleted || len(details.UpscaledURLs) != placeholderImageCount {
+		t.Fatalf("expected %d completed images, got %+v", placeholderImageCount, details)
+	}
+
+	again, _ := generator.Fetch(ctx, first)
+	for i, imageURL := range details.UpscaledURLs {
+		if again.UpscaledURLs[i] != imageURL {
+			t.Errorf("image %d: expected the same image for the same job", i)
+		}
+		data, err := downloadImage(ctx, imageURL)
+		if err != nil {
+			t.Fatalf("image %d: unexpected error: %v", i, err)
+		}
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("image %d: expected a PNG, got %v", i, err)
+		}
+	}
+}
+
+func TestComfyUIGenerator(t *testing.T) {
+	var queued map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/prompt":
+			json.NewDecoder(r.Body).Decode(&queued)
+			w.Write([]byte(`{"prompt_id": "abc"}`))
+		case "/history/abc":
+			w.Write([]byte(`{"abc": {"status": {"status_str": "success", "completed": true},
+				"outputs": {"9": {"images": [{"filename": "anky.png", "subfolder": "", "type": "output"}]}}}}`))
+		case "/history/queued":
+			w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	workflow := `{"6": {"inputs": {"text": "{{prompt}}"}}}`
+	generator := NewComfyUIGenerator(server.URL, "", "--sref style", workflow, server.Client())
+	ctx := context.Background()
+
+	id, err := generator.Submit(ctx, `a "quoted" prompt`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "abc" {
+		t.Fatalf("expected prompt ID abc, got %s", id)
+	}
+	text := queued["prompt"].(map[string]interface{})["6"].(map[string]interface{})["inputs"].(map[string]interface{})["text"]
+	if text != `--sref style a "quoted" prompt` {
+		t.Errorf("expected the prompt in the workflow, got %v", text)
+	}
+
+	if status, _ := generator.Status(ctx, "queued"); status != ImageStatusPending {
+		t.Errorf("expected a queued prompt to be pending, got %s", status)
+	}
+	details, err := generator.Fetch(ctx, "abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if details.Status != ImageStatusCompleted || !strings.Contains(details.URL, "/view?filename=anky.png") {
+		t.Errorf("expected the completed image, got %+v", details)
+	}
+}
+
+// scriptedImageGenerator answers the status checks with its statuses in order, then keeps
+// answering the last one
+type scriptedImageGenerator struct {
+	PlaceholderImageGenerator
+	statuses []string
+	checks   int
+}
+
+func (g *scriptedImageGenerator) Status(ctx context.Context, id string) (string, error) {
+	status := g.statuses[min(g.checks, len(g.statuses)-1)]
+	g.checks++
+	return status, nil
+}
+
+func TestWaitForImage(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []string
+		maxWait    time.Duration
+		wantErr    error
+		wantFailed bool
+		wantChecks int
+	}{
+		{name: "completed right away", statuses: []string{ImageStatusCompleted}, maxWait: time.Second, wantChecks: 1},
+		{name: "completed after a few checks", statuses: []string{"pending", "in-progress", ImageStatusCompleted}, maxWait: time.Second, wantChecks: 3},
+		{name: "failed", statuses: []string{"pending", ImageStatusFailed}, maxWait: time.Second, wantFailed: true, wantChecks: 2},
+		{name: "still pending after the max wait", statuses: []string{"pending"}, maxWait: 50 * time.Millisecond, wantErr: ErrImageTimedOut},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generator := &scriptedImageGenerator{statuses: tt.statuses}
+			deadline := time.Now().Add(tt.maxWait)
+			_, err := waitForImage(context.Background(), generator, "job", deadline, time.Millisecond, 10*time.Millisecond)
+
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+			case tt.wantFailed:
+				if err == nil || errors.Is(err, ErrImageTimedOut) {
+					t.Fatalf("expected the generation to fail, got %v", err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantChecks != 0 && generator.checks != tt.wantChecks {
+				t.Errorf("expected %d checks, got %d", tt.wantChecks, generator.checks)
+			}
+			if time.Now().After(deadline.Add(100 * time.Millisecond)) {
+				t.Errorf("expected to stop at the deadline")
+			}
+		})
+	}
+}
+
+func TestWaitForImageStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	generator := &scriptedImageGenerator{statuses: []string{"pending"}}
+	_, err := waitForImage(ctx, generator, "job", time.Now().Add(time.Hour), time.Hour, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to stop with the context, got %v", err)
+	}
+}
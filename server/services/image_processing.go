@@ -0,0 +1,276 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"sync"
+)
+
+// Uploaded images are decoded and encoded again before they are stored. That drops every
+// piece of metadata the file came with (EXIF with its GPS position, camera and date, XMP,
+// PNG text chunks), once the EXIF orientation is applied to the pixels so that the photo
+// still shows the right way up.
+//
+// A decoded image takes 4 bytes a pixel, and turning it upright copies it, so the pixels of
+// an upload are capped and only IMAGE_PROCESSING_CONCURRENCY uploads (2 by default) are
+// processed at once. The others wait for their turn.
+
+var (
+	ErrUnsupportedImage = errors.New("unsupported image type, use JPEG, PNG or GIF")
+	ErrImageTooLarge    = errors.New("image is too large")
+)
+
+// uploadFormats are the types we accept, by their sniffed content type
+var uploadFormats = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// ImageLimits bound what can be uploaded
+type ImageLimits struct {
+	MaxBytes      int
+	MaxDimension  int // of the width and of the height, in pixels
+	MaxPixels     int // width times height
+	ThumbnailSize int // of the longest side of the thumbnail, in pixels
+}
+
+// processedImage is an upload ready to be stored
+type processedImage struct {
+	Data          []byte
+	Thumbnail     []byte
+	ContentType   string
+	Extension     string
+	Width, Height int
+}
+
+// processImage checks an uploaded image against the limits, strips its metadata and makes
+// its thumbnail. JPEG photos stay JPEG, the other images become PNG (a GIF keeps its first
+// frame only).
+func processImage(data []byte, limits ImageLimits) (*processedImage, error) {
+	if len(data) > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrImageTooLarge, len(data), limits.MaxBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if !uploadFormats[contentType] {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedImage, contentType)
+	}
+
+	// Check the size before decoding, a small file can hold a huge image
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+	if config.Width > limits.MaxDimension || config.Height > limits.MaxDimension {
+		return nil, fmt.Errorf("%w: %dx%d, the limit is %d pixels a side", ErrImageTooLarge, config.Width, config.Height, limits.MaxDimension)
+	}
+	if int64(config.Width)*int64(config.Height) > int64(limits.MaxPixels) {
+		return nil, fmt.Errorf("%w: %dx%d, the limit is %d pixels", ErrImageTooLarge, config.Width, config.Height, limits.MaxPixels)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	img := orientImage(decoded, orientation)
+	thumbnail := resizeToFit(img, limits.ThumbnailSize)
+
+	processed := &processedImage{Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	if contentType == "image/jpeg" {
+		processed.ContentType, processed.Extension = "image/jpeg", ".jpg"
+		processed.Data, err = encodeJPEG(img)
+		if err == nil {
+			processed.Thumbnail, err = encodeJPEG(thumbnail)
+		}
+	} else {
+		processed.ContentType, processed.Extension = "image/png", ".png"
+		processed.Data, err = encodePNG(img)
+		if err == nil {
+			processed.Thumbnail, err = encodePNG(thumbnail)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding image: %v", err)
+	}
+	return processed, nil
+}
+
+var (
+	imageSlotsOnce sync.Once
+	imageSlots     chan struct{}
+)
+
+// acquireImageSlot waits until the upload can be processed, and returns the function that
+// hands its slot back
+func acquireImageSlot(ctx context.Context) (func(), error) {
+	imageSlotsOnce.Do(func() {
+		imageSlots = make(chan struct{}, envInt("IMAGE_PROCESSING_CONCURRENCY", 2))
+	})
+	select {
+	case imageSlots <- struct{}{}:
+		return func() { <-imageSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	return buf.Bytes(), err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG file, from 1 (as stored) to 8,
+// and 1 when there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		if marker == 0xDA || marker == 0xD9 { // the image data starts, no more metadata
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		segment := data[offset+4 : min(offset+2+length, len(data))]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF header
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientImage turns the stored pixels the way the EXIF orientation says they are shown
+func orientImage(src image.Image, orientation int) *image.RGBA {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if orientation <= 1 || orientation > 8 {
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+
+	dw, dh := w, h
+	if orientation >= 5 { // the orientations that swap the sides
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a quarter turn clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a quarter turn counterclockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// resizeToFit scales the image down so that its longest side is size, averaging the pixels
+// each thumbnail pixel covers. Smaller images are kept as they are.
+func resizeToFit(src *image.RGBA, size int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, max(1, h*size/w)
+	if h > w {
+		dw, dh = max(1, w*size/h), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			pixel := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				pixel[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
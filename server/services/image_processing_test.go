@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+var testImageLimits = ImageLimits{MaxBytes: 1 << 20, MaxDimension: 1000, MaxPixels: 500_000, ThumbnailSize: 256}
+
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 100, 255})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(width, height)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testJPEGWithExif is a JPEG with an EXIF segment holding the orientation and a camera make
+func testJPEGWithExif(t *testing.T, width, height int, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(width, height), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Little endian TIFF header and an IFD of two entries: the orientation and the make
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x02\x00")
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	binary.LittleEndian.PutUint16(entry[0:], 0x010F)
+	binary.LittleEndian.PutUint16(entry[2:], 2) // ASCII
+	binary.LittleEndian.PutUint32(entry[4:], 4)
+	copy(entry[8:], "Cam\x00")
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0) // no next IFD
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	// Right after the start of image marker
+	return append(append(append([]byte{}, encoded[:2]...), app1...), encoded[2:]...)
+}
+
+func TestProcessImage(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            []byte
+		wantErr         error
+		wantContentType string
+		wantSize        [2]int
+		wantThumbnail   [2]int
+	}{
+		{
+			name:            "png with a thumbnail",
+			data:            testPNG(t, 600, 300),
+			wantContentType: "image/png",
+			wantSize:        [2]int{600, 300},
+			wantThumbnail:   [2]int{256, 128},
+		},
+		{
+			name:            "small image is its own thumbnail",
+			data:            testPNG(t, 100, 40),
+			wantContentType: "image/png",
+			wantSize:        [2]int{100, 40},
+			wantThumbnail:   [2]int{100, 40},
+		},
+		{
+			name:            "jpeg turned upright by its orientation",
+			data:            testJPEGWithExif(t, 400, 200, 6),
+			wantContentType: "image/jpeg",
+			wantSize:        [2]int{200, 400},
+			wantThumbnail:   [2]int{128, 256},
+		},
+		{
+			name:            "jpeg as stored",
+			data:            testJPEGWithExif(t, 400, 200, 1),
+			wantContentType: "image/jpeg",
+			wantSize:        [2]int{400, 200},
+			wantThumbnail:   [2]int{256, 128},
+		},
+		{name: "not an image", data: []byte("just some text, not a picture"), wantErr: ErrUnsupportedImage},
+		{name: "file too large", data: make([]byte, testImageLimits.MaxBytes+1), wantErr: ErrImageTooLarge},
+		{name: "image too large", data: testPNG(t, 1001, 10), wantErr: ErrImageTooLarge},
+		{name: "too many pixels", data: testPNG(t, 1000, 600), wantErr: ErrImageTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			processed, err := processImage(tt.data, testImageLimits)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if processed.ContentType != tt.wantContentType {
+				t.Errorf("expected %s, got %s", tt.wantContentType, processed.ContentType)
+			}
+			if bytes.Contains(processed.Data, []byte("Exif")) || bytes.Contains(processed.Data, []byte("Cam\x00")) {
+				t.Errorf("expected the metadata to be stripped")
+			}
+			for _, img := range []struct {
+				data []byte
+				want [2]int
+			}{{processed.Data, tt.wantSize}, {processed.Thumbnail, tt.wantThumbnail}} {
+				config, _, err := imageDecodeConfig(img.data)
+				if err != nil {
+					t.Fatalf("unexpected error decoding the result: %v", err)
+				}
+				if config != img.want {
+					t.Errorf("expected %v, got %v", img.want, config)
+				}
+			}
+		})
+	}
+}
+
+func imageDecodeConfig(data []byte) ([2]int, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	return [2]int{config.Width, config.Height}, format, err
+}
+
+func TestOrientImage(t *testing.T) {
+	// A 2x1 image, red then blue
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		want        [][]color.RGBA // rows
+	}{
+		{1, [][]color.RGBA{{red, blue}}},
+		{2, [][]color.RGBA{{blue, red}}},
+		{3, [][]color.RGBA{{blue, red}}},
+		{4, [][]color.RGBA{{red, blue}}},
+		{5, [][]color.RGBA{{red}, {blue}}},
+		{6, [][]color.RGBA{{red}, {blue}}},
+		{7, [][]color.RGBA{{blue}, {red}}},
+		{8, [][]color.RGBA{{blue}, {red}}},
+	}
+
+	for _, tt := range tests {
+		got := orientImage(src, tt.orientation)
+		for y, row := range tt.want {
+			for x, want := range row {
+				if c := got.RGBAAt(x, y); c != want {
+					t.Errorf("orientation %d: expected %v at %d,%d, got %v", tt.orientation, want, x, y, c)
+				}
+			}
+		}
+	}
+}
+
+func TestAcquireImageSlot(t *testing.T) {
+	t.Setenv("IMAGE_PROCESSING_CONCURRENCY", "2")
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := acquireImageSlot(context.Background())
+		if err != nil {
+			t.Fatalf("slot %d: unexpected error: %v", i, err)
+		}
+		releases = append(releases, release)
+	}
+
+	// Every slot is taken, the next upload waits
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireImageSlot(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected to wait for a slot, got %v", err)
+	}
+
+	releases[0]()
+	release, err := acquireImageSlot(context.Background())
+	if err != nil {
+		t.Fatalf("expected the released slot, got %v", err)
+	}
+	release()
+	releases[1]()
+}
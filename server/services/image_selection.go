@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// Image selection
+//
+// The image backend gives a few candidates for the image of an Anky. The writer has
+// IMAGE_CHOICE_TIMEOUT_SECONDS to pick one with POST /ankys/{id}/choose-image, then an
+// ImageScorer picks the best one for them. IMAGE_SCORER chooses the scorer:
+//
+//   - perceptual (default): a local heuristic of sharpness, contrast, colorfulness and exposure
+//   - first: the first candidate, like the backend ordered them
+//
+// The candidates that were not chosen stay on the Anky as alternates.
+
+// ImageScorer rates an image, the candidate with the highest score is chosen
+type ImageScorer interface {
+	Score(ctx context.Context, data []byte) (float64, error)
+}
+
+// NewImageScorer builds the scorer named by IMAGE_SCORER
+func NewImageScorer() (ImageScorer, error) {
+	switch name := strings.ToLower(os.Getenv("IMAGE_SCORER")); name {
+	case "", "perceptual":
+		return PerceptualImageScorer{}, nil
+	case "first":
+		return FirstImageScorer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown image scorer: %s", name)
+	}
+}
+
+// chooseImage scores every candidate and returns the index of the best one. Candidates that
+// can't be downloaded or scored are skipped.
+func chooseImage(ctx context.Context, scorer ImageScorer, candidates []string) (int, error) {
+	best, bestScore := -1, math.Inf(-1)
+	for i, candidate := range candidates {
+		data, err := downloadImage(ctx, candidate)
+		if err != nil {
+			log.Printf("Skipping image candidate %d: %v", i, err)
+			continue
+		}
+		score, err := scorer.Score(ctx, data)
+		if err != nil {
+			log.Printf("Skipping image candidate %d: %v", i, err)
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	if best < 0 {
+		return 0, fmt.Errorf("none of the %d image candidates could be scored", len(candidates))
+	}
+	return best, nil
+}
+
+// ******************** First ********************
+
+// FirstImageScorer prefers the candidates in the order they came in
+type FirstImageScorer struct{}
+
+func (FirstImageScorer) Score(ctx context.Context, data []byte) (float64, error) {
+	return 0, nil
+}
+
+// ******************** Perceptual ********************
+
+// perceptualSampleSize is the side of the grid the image is sampled on, enough to tell
+// a blurry or washed out image from a good one without looking at every pixel
+const perceptualSampleSize = 128
+
+// PerceptualImageScorer rates how good an image looks without any model: sharp, contrasted
+// and colorful images score higher, images with large burnt or blocked areas score lower.
+type PerceptualImageScorer struct{}
+
+func (PerceptualImageScorer) Score(ctx context.Context, data []byte) (float64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("error decoding image: %v", err)
+	}
+	return perceptualScore(img), nil
+}
+
+func perceptualScore(img image.Image) float64 {
+	bounds := img.Bounds()
+	width, height := min(bounds.Dx(), perceptualSampleSize), min(bounds.Dy(), perceptualSampleSize)
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	// Sample the luminance and the color opponents of the image on a grid, values in [0, 1]
+	luma := make([][]float64, height)
+	var sumRG, sumYB, sumRG2, sumYB2 float64
+	var clipped int
+	for y := 0; y < height; y++ {
+		luma[y] = make([]float64, width)
+		for x := 0; x < width; x++ {
+			r16, g16, b16, _ := img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height).RGBA()
+			r, g, b := float64(r16)/0xffff, float64(g16)/0xffff, float64(b16)/0xffff
+
+			l := 0.299*r + 0.587*g + 0.114*b
+			luma[y][x] = l
+			if l < 0.02 || l > 0.98 {
+				clipped++
+			}
+
+			rg, yb := r-g, 0.5*(r+g)-b
+			sumRG += rg
+			sumYB += yb
+			sumRG2 += rg * rg
+			sumYB2 += yb * yb
+		}
+	}
+	n := float64(width * height)
+
+	// Contrast: standard deviation of the luminance
+	var sum, sum2 float64
+	for _, row := range luma {
+		for _, l := range row {
+			sum += l
+			sum2 += l * l
+		}
+	}
+	contrast := math.Sqrt(math.Max(sum2/n-(sum/n)*(sum/n), 0))
+
+	// Sharpness: variance of the Laplacian of the luminance
+	var lapSum, lapSum2 float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			lap := luma[y-1][x] + luma[y+1][x] + luma[y][x-1] + luma[y][x+1] - 4*luma[y][x]
+			lapSum += lap
+			lapSum2 += lap * lap
+		}
+	}
+	inner := float64((width - 2) * (height - 2))
+	sharpness := math.Sqrt(math.Max(lapSum2/inner-(lapSum/inner)*(lapSum/inner), 0))
+
+	// Colorfulness, after Hasler and Süsstrunk
+	meanRG, meanYB := sumRG/n, sumYB/n
+	stdRG := math.Sqrt(math.Max(sumRG2/n-meanRG*meanRG, 0))
+	stdYB := math.Sqrt(math.Max(sumYB2/n-meanYB*meanYB, 0))
+	colorfulness := math.Hypot(stdRG, stdYB) + 0.3*math.Hypot(meanRG, meanYB)
+
+	// Exposure: the share of pixels that are nearly black or white
+	clippedShare := float64(clipped) / n
+
+	return 2*sharpness + contrast + colorfulness - clippedShare
+}
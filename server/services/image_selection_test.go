@@ -0,0 +1,63 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// testImageURL paints an image with paint and returns it as a data URL
+func testImageURL(t *testing.T, paint func(x, y int) color.Color) string {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, paint(x, y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestChooseImage(t *testing.T) {
+	flatGray := testImageURL(t, func(x, y int) color.Color { return color.Gray{128} })
+	black := testImageURL(t, func(x, y int) color.Color { return color.Black })
+	detailed := testImageURL(t, func(x, y int) color.Color {
+		if (x/4+y/4)%2 == 0 {
+			return color.RGBA{200, 40, 60, 255}
+		}
+		return color.RGBA{30, 120, 210, 255}
+	})
+
+	tests := []struct {
+		name       string
+		scorer     ImageScorer
+		candidates []string
+		want       int
+		wantErr    bool
+	}{
+		{"detailed image over flat ones", PerceptualImageScorer{}, []string{flatGray, black, detailed}, 2, false},
+		{"flat image over a black one", PerceptualImageScorer{}, []string{black, flatGray}, 1, false},
+		{"broken candidates are skipped", PerceptualImageScorer{}, []string{"data:image/png;base64,bm90IGFuIGltYWdl", flatGray}, 1, false},
+		{"first scorer keeps the order", FirstImageScorer{}, []string{flatGray, detailed}, 0, false},
+		{"nothing to score", PerceptualImageScorer{}, []string{"data:image/png;base64,bm90IGFuIGltYWdl"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chooseImage(context.Background(), tt.scorer, tt.candidates)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("expected candidate %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -2,140 +2,174 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"os"
+	"time"
 
-	"github.com/cloudinary/cloudinary-go/v2"
-	"github.com/cloudinary/cloudinary-go/v2/api"
-	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
-	"github.com/gin-gonic/gin"
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
 )
 
+// Image uploads
+//
+// Users upload their profile picture and their own art for an Anky through /images. The
+// images are cleaned up (see processImage) and kept in the blob store with a thumbnail, and
+// every upload is recorded so that its owner can delete it. The limits come from:
+//
+//   - IMAGE_UPLOAD_MAX_BYTES: size of the uploaded file, 10MB by default
+//   - IMAGE_UPLOAD_MAX_DIMENSION: width and height, 6000 pixels by default
+//   - IMAGE_UPLOAD_MAX_PIXELS: width times height, 24 million pixels by default
+//   - IMAGE_THUMBNAIL_SIZE: longest side of the thumbnails, 256 pixels by default
+
+// ErrNotUploadOwner is returned when someone else than its owner deletes an upload
+var ErrNotUploadOwner = errors.New("the image belongs to another user")
+
+// ImageService keeps the images the users upload
 type ImageService struct {
-	Cld *cloudinary.Cloudinary
-	Ctx context.Context
+	store  *storage.PostgresStore
+	Blobs  BlobStore
+	Limits ImageLimits
 }
 
-func NewImageService() (*ImageService, error) {
-	cld, err := cloudinary.NewFromURL(os.Getenv("CLOUDINARY_URL"))
+func NewImageService(store *storage.PostgresStore) (*ImageService, error) {
+	blobs, err := NewBlobStore(LoadBlobStoreConfig())
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize Cloudinary: %v", err)
+		return nil, fmt.Errorf("failed to initialize blob store: %v", err)
 	}
-	cld.Config.URL.Secure = true
-	ctx := context.Background()
-	return &ImageService{Cld: cld, Ctx: ctx}, nil
+	return &ImageService{
+		store:  store,
+		Blobs:  blobs,
+		Limits: LoadImageLimits(),
+	}, nil
 }
 
-func (s *ImageService) UploadImage(c *gin.Context) {
-	file, header, err := c.Request.FormFile("image")
-	if err != nil {
-		log.Printf("Error getting file: %v", err)
-		fmt.Println("Error getting file:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
-		return
+// LoadImageLimits reads the upload limits from the environment
+func LoadImageLimits() ImageLimits {
+	return ImageLimits{
+		MaxBytes:      envInt("IMAGE_UPLOAD_MAX_BYTES", 10<<20),
+		MaxDimension:  envInt("IMAGE_UPLOAD_MAX_DIMENSION", 6000),
+		MaxPixels:     envInt("IMAGE_UPLOAD_MAX_PIXELS", 24_000_000),
+		ThumbnailSize: envInt("IMAGE_THUMBNAIL_SIZE", 256),
 	}
-	defer file.Close()
+}
 
-	uploadParams := uploader.UploadParams{
-		PublicID:       header.Filename,
-		UniqueFilename: api.Bool(true),
-		Overwrite:      api.Bool(false),
-		UploadPreset:   "anky_mobile",
+// UploadImage stores an image of the user. A profile picture becomes the picture of the user
+// right away, Anky art can name the Anky it was made for, which must be one of theirs.
+func (s *ImageService) UploadImage(ctx context.Context, userID uuid.UUID, kind string, ankyID *uuid.UUID, data []byte) (*types.Upload, error) {
+	if !types.ValidUploadKind(kind) {
+		return nil, fmt.Errorf("unknown image kind: %s", kind)
+	}
+	if ankyID != nil {
+		if kind != types.UploadKindAnkyArt {
+			return nil, fmt.Errorf("only anky_art images can be attached to an Anky")
+		}
+		anky, err := s.store.GetAnkyByID(ctx, *ankyID)
+		if err != nil || anky.UserID != userID {
+			return nil, fmt.Errorf("anky %s not found", ankyID)
+		}
 	}
 
-	resp, err := s.Cld.Upload.Upload(s.Ctx, file, uploadParams)
+	release, err := acquireImageSlot(ctx)
 	if err != nil {
-		log.Printf("Error uploading file: %v", err)
-		fmt.Println("Error uploading file:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload image"})
-		return
+		return nil, err
+	}
+	processed, err := processImage(data, s.Limits)
+	release()
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Println("Image uploaded successfully")
-	fmt.Println("Public ID:", resp.PublicID)
-	fmt.Println("URL:", resp.SecureURL)
-
-	c.JSON(http.StatusOK, gin.H{
-		"message":   "Image uploaded successfully",
-		"public_id": resp.PublicID,
-		"url":       resp.SecureURL,
-	})
-}
-
-func (s *ImageService) DeleteImage(c *gin.Context) {
-	publicID := c.Param("publicID")
-	if publicID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Public ID is required"})
-		return
+	upload := &types.Upload{
+		ID:          uuid.New(),
+		UserID:      userID,
+		Kind:        kind,
+		AnkyID:      ankyID,
+		ContentType: processed.ContentType,
+		SizeBytes:   len(processed.Data),
+		Width:       processed.Width,
+		Height:      processed.Height,
+		CreatedAt:   time.Now().UTC(),
 	}
+	upload.BlobKey = fmt.Sprintf("uploads/%s/%s%s", userID, upload.ID, processed.Extension)
+	upload.ThumbnailKey = fmt.Sprintf("uploads/%s/%s_thumb%s", userID, upload.ID, processed.Extension)
 
-	_, err := s.Cld.Upload.Destroy(s.Ctx, uploader.DestroyParams{PublicID: publicID})
+	upload.URL, err = s.Blobs.Put(ctx, upload.BlobKey, processed.Data, processed.ContentType)
 	if err != nil {
-		log.Printf("Error deleting image: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
-		return
+		return nil, fmt.Errorf("error storing image: %v", err)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Image deleted successfully"})
-}
-
-func (s *ImageService) GetImage(c *gin.Context) {
-	publicID := c.Param("publicID")
-	if publicID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Public ID is required"})
-		return
+	upload.ThumbnailURL, err = s.Blobs.Put(ctx, upload.ThumbnailKey, processed.Thumbnail, processed.ContentType)
+	if err != nil {
+		s.deleteBlobs(ctx, upload)
+		return nil, fmt.Errorf("error storing thumbnail: %v", err)
 	}
 
-	asset, err := s.Cld.Image(publicID)
-	if err != nil {
-		log.Printf("Error getting image URL: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image URL"})
-		return
+	if err := s.store.CreateUpload(ctx, upload); err != nil {
+		s.deleteBlobs(ctx, upload)
+		return nil, err
 	}
 
-	url, err := asset.String()
-	if err != nil {
-		log.Printf("Error getting image URL: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get image URL"})
-		return
+	if kind == types.UploadKindProfilePicture {
+		if err := s.setProfilePicture(ctx, userID, upload.URL); err != nil {
+			return nil, err
+		}
 	}
+	return upload, nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"url": url})
+func (s *ImageService) GetUpload(ctx context.Context, uploadID uuid.UUID) (*types.Upload, error) {
+	return s.store.GetUploadByID(ctx, uploadID)
 }
 
-func uploadImageToCloudinary(imageHandler *ImageService, imageURL, sessionID string) (*uploader.UploadResult, error) {
-	resp, err := http.Get(imageURL)
+// DeleteImage removes an upload and its files. Deleting the current profile picture of the
+// user leaves them without one.
+func (s *ImageService) DeleteImage(ctx context.Context, userID uuid.UUID, uploadID uuid.UUID) error {
+	upload, err := s.store.GetUploadByID(ctx, uploadID)
 	if err != nil {
-		return nil, fmt.Errorf("error downloading image: %v", err)
+		return fmt.Errorf("image %s not found", uploadID)
 	}
-	defer resp.Body.Close()
-
-	tempFile, err := os.CreateTemp("", fmt.Sprintf("%s.png", sessionID))
-	if err != nil {
-		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	if upload.UserID != userID {
+		return ErrNotUploadOwner
 	}
-	defer os.Remove(tempFile.Name())
 
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error saving downloaded image: %v", err)
+	if err := s.store.DeleteUpload(ctx, uploadID); err != nil {
+		return err
 	}
-
-	_, err = tempFile.Seek(0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("error rewinding temporary file: %v", err)
+	s.deleteBlobs(ctx, upload)
+
+	if upload.Kind == types.UploadKindProfilePicture {
+		user, err := s.store.GetUserByID(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("error getting user: %v", err)
+		}
+		if user.Settings != nil && user.Settings.ProfilePicture == upload.URL {
+			return s.setProfilePicture(ctx, userID, "")
+		}
 	}
+	return nil
+}
 
-	uploadResult, err := imageHandler.Cld.Upload.Upload(imageHandler.Ctx, tempFile, uploader.UploadParams{
-		PublicID:     sessionID,
-		UploadPreset: "anky_mobile",
-	})
+func (s *ImageService) setProfilePicture(ctx context.Context, userID uuid.UUID, url string) error {
+	user, err := s.store.GetUserByID(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("error uploading image to Cloudinary: %v", err)
+		return fmt.Errorf("error getting user: %v", err)
+	}
+	if user.Settings == nil {
+		user.Settings = &types.UserSettings{}
 	}
+	user.Settings.ProfilePicture = url
+	if err := s.store.UpdateUser(ctx, userID, user); err != nil {
+		return fmt.Errorf("error updating profile picture: %v", err)
+	}
+	return nil
+}
 
-	return uploadResult, nil
+// deleteBlobs removes the files of an upload, what is already gone is fine
+func (s *ImageService) deleteBlobs(ctx context.Context, upload *types.Upload) {
+	for _, key := range []string{upload.BlobKey, upload.ThumbnailKey} {
+		if err := s.Blobs.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			log.Printf("Error deleting blob %s of upload %s: %v", key, upload.ID, err)
+		}
+	}
 }
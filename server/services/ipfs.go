@@ -0,0 +1,243 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// IPFS
+//
+// The image and the raw session file of every Anky are content-addressed: their CID is
+// computed here, the same way `ipfs add --cid-version=1` computes it, and stored on the Anky.
+// A Pinner then makes sure the content is available on IPFS under that CID. IPFS_PINNER
+// chooses it:
+//
+//   - none (default): only computes the CIDs, for development and tests
+//   - kubo: adds and pins the files on the Kubo node whose RPC API is at IPFS_API_URL
+
+// Pinner makes content available on IPFS under its CID
+type Pinner interface {
+	Pin(ctx context.Context, cid string, data []byte) error
+}
+
+// NewPinner builds the pinner named by IPFS_PINNER
+func NewPinner() (Pinner, error) {
+	switch name := strings.ToLower(os.Getenv("IPFS_PINNER")); name {
+	case "", "none":
+		return NoopPinner{}, nil
+	case "kubo":
+		apiURL := os.Getenv("IPFS_API_URL")
+		if apiURL == "" {
+			apiURL = "http://127.0.0.1:5001"
+		}
+		return NewKuboPinner(apiURL, &http.Client{Timeout: 2 * time.Minute}), nil
+	default:
+		return nil, fmt.Errorf("unknown IPFS pinner: %s", name)
+	}
+}
+
+// pinContent computes the CID of the data and pins it
+func pinContent(ctx context.Context, pinner Pinner, data []byte) (string, error) {
+	cid := ComputeCID(data)
+	if err := pinner.Pin(ctx, cid, data); err != nil {
+		return "", fmt.Errorf("error pinning %s: %v", cid, err)
+	}
+	return cid, nil
+}
+
+// ******************** CID ********************
+
+const (
+	multicodecRaw    = 0x55
+	multicodecDagPB  = 0x70
+	multihashSHA256  = 0x12
+	unixfsChunkSize  = 256 * 1024
+	unixfsMaxLinks   = 174
+	unixfsTypeFile   = 2
+	cidVersion1      = 1
+	multibaseBase32  = 'b'
+	protobufVarint   = 0
+	protobufBytes    = 2
+	unixfsFieldType  = 1
+	unixfsFieldSize  = 3
+	unixfsFieldBlock = 4
+	dagPBFieldData   = 1
+	dagPBFieldLinks  = 2
+	dagPBLinkHash    = 1
+	dagPBLinkName    = 2
+	dagPBLinkTsize   = 3
+)
+
+var cidBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ComputeCID returns the CIDv1 of a file as added by `ipfs add --cid-version=1`: the file is
+// cut in chunks of 256KiB stored as raw blocks, linked by a balanced tree of UnixFS nodes when
+// there is more than one. A file of a single chunk is just that raw block.
+func ComputeCID(data []byte) string {
+	var leaves []dagNode
+	for offset := 0; offset == 0 || offset < len(data); offset += unixfsChunkSize {
+		chunk := data[offset:min(offset+unixfsChunkSize, len(data))]
+		leaves = append(leaves, dagNode{cid: cidBytes(multicodecRaw, chunk), fileSize: uint64(len(chunk)), treeSize: uint64(len(chunk))})
+	}
+
+	root, next := leaves[0], 1
+	for depth := 1; next < len(leaves); depth++ {
+		root, next = fillUnixFSNode(leaves, next, depth, []dagNode{root})
+	}
+	return string(multibaseBase32) + strings.ToLower(cidBase32.EncodeToString(root.cid))
+}
+
+// dagNode is a block of the file's DAG, as seen by the node that links to it
+type dagNode struct {
+	cid      []byte
+	fileSize uint64 // bytes of the file under this node
+	treeSize uint64 // bytes of all the blocks under this node, itself included
+}
+
+// fillUnixFSNode builds a node of the given depth with the children it starts with, adding
+// leaves from next (or subtrees of them, under depth 1) until it is full or there are no more.
+// It returns the node and the next leaf left to add.
+func fillUnixFSNode(leaves []dagNode, next int, depth int, children []dagNode) (dagNode, int) {
+	for len(children) < unixfsMaxLinks && next < len(leaves) {
+		if depth == 1 {
+			children = append(children, leaves[next])
+			next++
+			continue
+		}
+		var child dagNode
+		child, next = fillUnixFSNode(leaves, next, depth-1, nil)
+		children = append(children, child)
+	}
+	return unixfsFileNode(children), next
+}
+
+// unixfsFileNode encodes the dag-pb node of a UnixFS file made of the children
+func unixfsFileNode(children []dagNode) dagNode {
+	var fileSize uint64
+	var unixfs []byte
+	unixfs = appendProtobufVarint(unixfs, unixfsFieldType, unixfsTypeFile)
+	for _, child := range children {
+		fileSize += child.fileSize
+	}
+	unixfs = appendProtobufVarint(unixfs, unixfsFieldSize, fileSize)
+	for _, child := range children {
+		unixfs = appendProtobufVarint(unixfs, unixfsFieldBlock, child.fileSize)
+	}
+
+	// dag-pb puts the links before the data
+	var node []byte
+	var treeSize uint64
+	for _, child := range children {
+		var link []byte
+		link = appendProtobufBytes(link, dagPBLinkHash, child.cid)
+		link = appendProtobufBytes(link, dagPBLinkName, nil)
+		link = appendProtobufVarint(link, dagPBLinkTsize, child.treeSize)
+		node = appendProtobufBytes(node, dagPBFieldLinks, link)
+		treeSize += child.treeSize
+	}
+	node = appendProtobufBytes(node, dagPBFieldData, unixfs)
+
+	return dagNode{
+		cid:      cidBytes(multicodecDagPB, node),
+		fileSize: fileSize,
+		treeSize: treeSize + uint64(len(node)),
+	}
+}
+
+// cidBytes is the binary CIDv1 of a block: version, codec and the sha2-256 multihash
+func cidBytes(codec uint64, block []byte) []byte {
+	digest := sha256.Sum256(block)
+	cid := binary.AppendUvarint(nil, cidVersion1)
+	cid = binary.AppendUvarint(cid, codec)
+	cid = binary.AppendUvarint(cid, multihashSHA256)
+	cid = binary.AppendUvarint(cid, uint64(len(digest)))
+	return append(cid, digest[:]...)
+}
+
+func appendProtobufVarint(b []byte, field int, value uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protobufVarint))
+	return binary.AppendUvarint(b, value)
+}
+
+func appendProtobufBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|protobufBytes))
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// ******************** None ********************
+
+// NoopPinner pins nothing, the CIDs are still computed and stored
+type NoopPinner struct{}
+
+func (NoopPinner) Pin(ctx context.Context, cid string, data []byte) error {
+	return nil
+}
+
+// ******************** Kubo ********************
+
+// KuboPinner adds the content to a Kubo node with the same options ComputeCID follows, and
+// checks that the node came to the same CID
+type KuboPinner struct {
+	apiURL string
+	client *http.Client
+}
+
+func NewKuboPinner(apiURL string, client *http.Client) *KuboPinner {
+	return &KuboPinner{apiURL: strings.TrimRight(apiURL, "/"), client: client}
+}
+
+func (p *KuboPinner) Pin(ctx context.Context, cid string, data []byte) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", cid)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	url := p.apiURL + "/api/v0/add?cid-version=1&raw-leaves=true&chunker=size-262144&pin=true&quiet=true"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, &body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	if added.Hash != cid {
+		return fmt.Errorf("the IPFS node added the content as %s instead of %s", added.Hash, cid)
+	}
+	return nil
+}
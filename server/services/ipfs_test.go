@@ -0,0 +1,129 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestComputeCID(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty file", nil, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{"single chunk", []byte("hello world"), "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ComputeCID(tt.data); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// kuboTestFile is deterministic content to compare ComputeCID with the CIDs of
+// ipfs add --cid-version=1 --raw-leaves
+func kuboTestFile(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte((i*7 + i>>12) % 251)
+	}
+	return data
+}
+
+func TestComputeCIDMatchesKubo(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want string
+	}{
+		{"13 chunks under the root", 3<<20 + 1234, "bafybeidtmum3mbuw6wh3pfalzevjj3zppfijbdjzenys7f36ffms22vtcy"},
+		{"175 chunks in two levels", 175*unixfsChunkSize + 1, "bafybeiembkko4ydivyeouobgvdmvpa2aoxq2soe5evtsd5dbmaa4zzqvra"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ComputeCID(kuboTestFile(tt.size)); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestComputeCIDOfChunkedFiles(t *testing.T) {
+	oneChunk := bytes.Repeat([]byte("a"), unixfsChunkSize)
+	twoChunks := bytes.Repeat([]byte("a"), unixfsChunkSize+1)
+	deep := bytes.Repeat([]byte("a"), unixfsChunkSize*(unixfsMaxLinks+1))
+
+	// A file of exactly one chunk is still a raw block, a bigger one is a dag-pb node
+	if cid := ComputeCID(oneChunk); !strings.HasPrefix(cid, "bafkrei") {
+		t.Errorf("expected a raw CID, got %s", cid)
+	}
+	for _, data := range [][]byte{twoChunks, deep} {
+		cid := ComputeCID(data)
+		if !strings.HasPrefix(cid, "bafybei") {
+			t.Errorf("expected a dag-pb CID, got %s", cid)
+		}
+		if again := ComputeCID(data); again != cid {
+			t.Errorf("expected the same CID for the same content, got %s and %s", cid, again)
+		}
+	}
+	if ComputeCID(twoChunks) == ComputeCID(append(twoChunks, 'b')) {
+		t.Errorf("expected different content to get a different CID")
+	}
+
+	// The root of a file of more than 174 chunks links to two subtrees
+	root, next := fillUnixFSNode(chunkLeaves(unixfsMaxLinks+1), 1, 2, []dagNode{{fileSize: unixfsChunkSize}})
+	if next != unixfsMaxLinks+1 || root.fileSize != unixfsChunkSize*(unixfsMaxLinks+1) {
+		t.Errorf("expected every chunk under the root, got %d chunks and %d bytes", next, root.fileSize)
+	}
+}
+
+func chunkLeaves(n int) []dagNode {
+	leaves := make([]dagNode, n)
+	for i := range leaves {
+		leaves[i] = dagNode{cid: cidBytes(multicodecRaw, []byte{byte(i)}), fileSize: unixfsChunkSize, treeSize: unixfsChunkSize}
+	}
+	return leaves
+}
+
+func TestKuboPinner(t *testing.T) {
+	data := []byte("hello world")
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"same CID", ComputeCID(data), false},
+		{"different CID", "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v0/add" || r.URL.Query().Get("cid-version") != "1" || r.URL.Query().Get("pin") != "true" {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprintf(w, `{"Name": "file", "Hash": %q, "Size": "11"}`, tt.hash)
+			}))
+			defer server.Close()
+
+			cid, err := pinContent(context.Background(), NewKuboPinner(server.URL, server.Client()), data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if err == nil && cid != ComputeCID(data) {
+				t.Errorf("expected %s, got %s", ComputeCID(data), cid)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package services
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+// Language detection
+//
+// Writings are stream of consciousness, so they are long, informal and full of the small
+// words every language uses all the time. That is enough to tell the languages apart without
+// any model: scripts like Cyrillic or Hangul give the language away, and among the languages
+// written with the Latin alphabet the one whose stopwords show up the most wins.
+
+// minDetectionConfidence is the confidence under which the user's settings are trusted instead
+const minDetectionConfidence = 0.6
+
+// minStopwordHits is how many stopwords a Latin text needs before its language is guessed
+const minStopwordHits = 3
+
+// DetectedLanguage is the language of a text as an ISO 639-1 code, with how sure the guess is
+type DetectedLanguage struct {
+	Code       string
+	Confidence float64
+}
+
+var languageNames = map[string]string{
+	"en": "English",
+	"es": "Spanish",
+	"pt": "Portuguese",
+	"fr": "French",
+	"de": "German",
+	"it": "Italian",
+	"nl": "Dutch",
+	"ru": "Russian",
+	"uk": "Ukrainian",
+	"el": "Greek",
+	"ar": "Arabic",
+	"he": "Hebrew",
+	"hi": "Hindi",
+	"th": "Thai",
+	"zh": "Chinese",
+	"ja": "Japanese",
+	"ko": "Korean",
+}
+
+var scriptLanguages = []struct {
+	table *unicode.RangeTable
+	code  string
+}{
+	{unicode.Hangul, "ko"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Han, "zh"},
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+	{unicode.Thai, "th"},
+}
+
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "i", "you", "my", "me", "this", "was", "with", "for", "not", "what", "but", "have", "just", "be", "so", "am"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "las", "es", "por", "para", "con", "no", "una", "un", "yo", "mi", "me", "pero", "lo", "como", "más", "esto", "estoy"},
+	"pt": {"o", "a", "de", "que", "e", "em", "os", "as", "é", "um", "uma", "para", "com", "não", "eu", "meu", "minha", "mas", "isso", "estou", "você", "mais", "como", "muito"},
+	"fr": {"le", "la", "les", "de", "et", "est", "que", "je", "un", "une", "pas", "en", "dans", "pour", "ce", "qui", "mon", "ma", "mais", "sur", "avec", "suis", "tout", "moi"},
+	"de": {"der", "die", "das", "und", "ist", "ich", "nicht", "zu", "ein", "eine", "es", "mit", "den", "auf", "für", "mein", "aber", "auch", "sich", "was", "wie", "bin", "dass", "so"},
+	"it": {"il", "la", "di", "che", "e", "è", "un", "una", "non", "per", "con", "io", "mi", "mio", "ma", "sono", "lo", "gli", "come", "questo", "anche", "più", "del", "della"},
+	"nl": {"de", "het", "een", "en", "is", "ik", "niet", "van", "dat", "te", "in", "op", "mijn", "maar", "met", "voor", "ook", "wat", "zijn", "je", "dit", "er", "nog", "ben"},
+}
+
+var stopwordLanguages = func() map[string][]string {
+	index := map[string][]string{}
+	for code, words := range stopwords {
+		for _, word := range words {
+			index[word] = append(index[word], code)
+		}
+	}
+	return index
+}()
+
+// DetectLanguage guesses the language of a text. The code is empty when the text doesn't say enough.
+func DetectLanguage(text string) DetectedLanguage {
+	if detected, ok := detectScript(text); ok {
+		return detected
+	}
+	return detectLatinLanguage(text)
+}
+
+// detectScript recognizes the languages that have their own script
+func detectScript(text string) (DetectedLanguage, bool) {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range scriptLanguages {
+			if unicode.Is(script.table, r) {
+				counts[script.code]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return DetectedLanguage{}, false
+	}
+
+	// Japanese mixes kana with Han characters, any kana makes it Japanese
+	if counts["ja"] > 0 {
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+
+	best, bestCount := "", 0
+	for code, count := range counts {
+		if count > bestCount {
+			best, bestCount = code, count
+		}
+	}
+	confidence := float64(bestCount) / float64(letters)
+	if best == "" || confidence < 0.5 {
+		return DetectedLanguage{}, false
+	}
+
+	// Cyrillic is shared, і and ї are only used in Ukrainian
+	if best == "ru" && strings.ContainsAny(strings.ToLower(text), "іїє") {
+		best = "uk"
+	}
+	return DetectedLanguage{Code: best, Confidence: confidence}, true
+}
+
+// detectLatinLanguage scores the languages by the stopwords found in the text
+func detectLatinLanguage(text string) DetectedLanguage {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+
+	scores := map[string]float64{}
+	hits := 0
+	for _, word := range words {
+		codes, ok := stopwordLanguages[word]
+		if !ok {
+			continue
+		}
+		hits++
+		// A word shared by several languages counts for each of them a bit
+		for _, code := range codes {
+			scores[code] += 1 / float64(len(codes))
+		}
+	}
+	if hits < minStopwordHits {
+		return DetectedLanguage{}
+	}
+
+	best, bestScore := "", 0.0
+	total := 0.0
+	for code, score := range scores {
+		total += score
+		if score > bestScore || (score == bestScore && code < best) {
+			best, bestScore = code, score
+		}
+	}
+	return DetectedLanguage{Code: best, Confidence: bestScore / total}
+}
+
+// WriterLanguage decides the language to answer a writer in: the one of their writing when
+// it is clear, otherwise the language of their settings, otherwise the locale of their device
+func WriterLanguage(detected DetectedLanguage, user *types.User) string {
+	if detected.Code != "" && detected.Confidence >= minDetectionConfidence {
+		return detected.Code
+	}
+	if user != nil {
+		if user.Settings != nil && user.Settings.Language != "" {
+			return normalizeLanguageCode(user.Settings.Language)
+		}
+		for _, language := range user.Languages {
+			if language != "" {
+				return normalizeLanguageCode(language)
+			}
+		}
+	}
+	return detected.Code
+}
+
+// normalizeLanguageCode turns locales like es-AR or pt_BR into their language code
+func normalizeLanguageCode(language string) string {
+	code := strings.ToLower(strings.TrimSpace(language))
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	return code
+}
+
+// LanguageName is the English name of a language code, to use in prompts
+func LanguageName(code string) string {
+	if name, ok := languageNames[code]; ok {
+		return name
+	}
+	return code
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"english", "I am not sure what I want to write, but this is what is in my mind and it was a long day", "en"},
+		{"spanish", "No sé qué escribir pero estoy aquí y la verdad es que me siento bien con lo que hago por la mañana", "es"},
+		{"portuguese", "Eu não sei o que escrever mas estou aqui e isso é muito bom para mim, você sabe como é", "pt"},
+		{"french", "Je ne sais pas quoi écrire mais je suis là et tout est calme dans ma tête pour le moment", "fr"},
+		{"german", "Ich weiß nicht, was ich schreiben soll, aber das ist mein Tag und ich bin müde und es ist so", "de"},
+		{"russian", "Я не знаю, что написать, но я здесь и пишу", "ru"},
+		{"ukrainian", "Я не знаю, що написати, але я тут і пишу їм", "uk"},
+		{"japanese", "今日はとても疲れたけど、書き続けています", "ja"},
+		{"chinese", "我今天很累但是我还在写", "zh"},
+		{"korean", "오늘은 정말 피곤하지만 계속 쓰고 있어요", "ko"},
+		{"too short to tell", "hello world", ""},
+		{"no letters", "1234 !!! ...", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectLanguage(tt.text).Code; got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWriterLanguage(t *testing.T) {
+	spanishSettings := &types.User{Settings: &types.UserSettings{Language: "es-AR"}}
+	portugueseLocale := &types.User{Languages: []string{"", "pt_BR"}}
+
+	tests := []struct {
+		name     string
+		detected DetectedLanguage
+		user     *types.User
+		want     string
+	}{
+		{"clear detection wins over the settings", DetectedLanguage{Code: "fr", Confidence: 0.9}, spanishSettings, "fr"},
+		{"unclear detection falls back to the settings", DetectedLanguage{Code: "fr", Confidence: 0.4}, spanishSettings, "es"},
+		{"then to the device locale", DetectedLanguage{}, portugueseLocale, "pt"},
+		{"unclear detection without a user", DetectedLanguage{Code: "it", Confidence: 0.4}, nil, "it"},
+		{"nothing known", DetectedLanguage{}, &types.User{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WriterLanguage(tt.detected, tt.user); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+// LLMChunk is a piece of a streamed model response. A chunk with Err set is the last one.
+type LLMChunk struct {
+	Content string
+	Err     error
+}
+
+// LLMProvider is a backend that can run prompts on a language model. Responses are streamed:
+// the channel gets the tokens as the model produces them and is closed when it is done.
+type LLMProvider interface {
+	// Chat sends a conversation and streams the reply of the model. With jsonFormat the
+	// model is asked to reply with a JSON object.
+	Chat(ctx context.Context, model string, messages []types.Message, jsonFormat bool) (<-chan LLMChunk, error)
+	// Generate streams the completion of a single prompt
+	Generate(ctx context.Context, model string, prompt string) (<-chan LLMChunk, error)
+}
+
+// CollectLLMResponse waits for the end of a stream and returns the whole response
+func CollectLLMResponse(chunks <-chan LLMChunk) (string, error) {
+	var response strings.Builder
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			return response.String(), chunk.Err
+		}
+		response.WriteString(chunk.Content)
+	}
+	return response.String(), nil
+}
+
+// llmLineParser reads one line of a streamed response. It returns the content it carries,
+// whether it is the last line, or an error sent by the provider.
+type llmLineParser func(line []byte) (content string, done bool, err error)
+
+// streamLines sends body to url and streams the response line by line through parse
+func streamLines(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}, parse llmLineParser) (<-chan LLMChunk, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	chunks := make(chan LLMChunk)
+	go func() {
+		defer resp.Body.Close()
+		defer close(chunks)
+
+		send := func(chunk LLMChunk) bool {
+			select {
+			case chunks <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			content, done, err := parse(line)
+			if err != nil {
+				send(LLMChunk{Err: err})
+				return
+			}
+			if content != "" && !send(LLMChunk{Content: content}) {
+				return
+			}
+			if done {
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			send(LLMChunk{Err: fmt.Errorf("error reading stream: %v", err)})
+			return
+		}
+		// The stream ended without its last line, the provider went away
+		send(LLMChunk{Err: fmt.Errorf("stream ended unexpectedly")})
+	}()
+
+	return chunks, nil
+}
+
+// ******************** Ollama ********************
+
+// OllamaProvider talks to an Ollama server through /api/chat and /api/generate
+type OllamaProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewOllamaProvider(baseURL string, apiKey string, client *http.Client) *OllamaProvider {
+	return &OllamaProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  client,
+	}
+}
+
+func (p *OllamaProvider) headers() map[string]string {
+	if p.apiKey == "" {
+		return nil
+	}
+	return map[string]string{"Authorization": "Bearer " + p.apiKey}
+}
+
+// ollamaStreamLine is a line of Ollama's NDJSON stream, for both /api/chat and /api/generate
+type ollamaStreamLine struct {
+	Message  types.Message `json:"message"`
+	Response string        `json:"response"`
+	Done     bool          `json:"done"`
+	Error    string        `json:"error"`
+}
+
+func parseOllamaLine(line []byte) (string, bool, error) {
+	var streamLine ollamaStreamLine
+	if err := json.Unmarshal(line, &streamLine); err != nil {
+		return "", false, fmt.Errorf("error unmarshaling stream response: %v", err)
+	}
+	if streamLine.Error != "" {
+		return "", true, fmt.Errorf("ollama error: %s", streamLine.Error)
+	}
+	return streamLine.Message.Content + streamLine.Response, streamLine.Done, nil
+}
+
+func (p *OllamaProvider) Chat(ctx context.Context, model string, messages []types.Message, jsonFormat bool) (<-chan LLMChunk, error) {
+	llmRequest := types.LLMRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   true,
+	}
+	if jsonFormat {
+		llmRequest.Format = "json"
+	}
+
+	chunks, err := streamLines(ctx, p.client, p.baseURL+"/api/chat", p.headers(), llmRequest, parseOllamaLine)
+	if err != nil {
+		return nil, fmt.Errorf("ollama chat request failed: %v", err)
+	}
+	return chunks, nil
+}
+
+func (p *OllamaProvider) Generate(ctx context.Context, model string, prompt string) (<-chan LLMChunk, error) {
+	llmRequest := types.LLMRequest{
+		Model:  model,
+		Prompt: prompt,
+		Stream: true,
+	}
+
+	chunks, err := streamLines(ctx, p.client, p.baseURL+"/api/generate", p.headers(), llmRequest, parseOllamaLine)
+	if err != nil {
+		return nil, fmt.Errorf("ollama generate request failed: %v", err)
+	}
+	return chunks, nil
+}
+
+// ******************** OpenAI-compatible ********************
+
+// OpenAICompatibleProvider talks to any server implementing /v1/chat/completions
+// (OpenAI, vLLM, llama.cpp, LM Studio, OpenRouter...)
+type OpenAICompatibleProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewOpenAICompatibleProvider(baseURL string, apiKey string, client *http.Client) *OpenAICompatibleProvider {
+	return &OpenAICompatibleProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  client,
+	}
+}
+
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []types.Message       `json:"messages"`
+	Stream         bool                  `json:"stream"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// openAIStreamLine is the payload of a "data:" line of a streamed chat completion
+type openAIStreamLine struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func parseOpenAILine(line []byte) (string, bool, error) {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		// Comments and other SSE fields
+		return "", false, nil
+	}
+	data = bytes.TrimSpace(data)
+	if string(data) == "[DONE]" {
+		return "", true, nil
+	}
+
+	var streamLine openAIStreamLine
+	if err := json.Unmarshal(data, &streamLine); err != nil {
+		return "", false, fmt.Errorf("error unmarshaling stream response: %v", err)
+	}
+	if streamLine.Error != nil {
+		return "", true, fmt.Errorf("chat completion error: %s", streamLine.Error.Message)
+	}
+	if len(streamLine.Choices) == 0 {
+		return "", false, nil
+	}
+	return streamLine.Choices[0].Delta.Content, false, nil
+}
+
+func (p *OpenAICompatibleProvider) Chat(ctx context.Context, model string, messages []types.Message, jsonFormat bool) (<-chan LLMChunk, error) {
+	chatRequest := openAIChatRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   true,
+	}
+	if jsonFormat {
+		chatRequest.ResponseFormat = &openAIResponseFormat{Type: "json_object"}
+	}
+
+	headers := map[string]string{"Accept": "text/event-stream"}
+	if p.apiKey != "" {
+		headers["Authorization"] = "Bearer " + p.apiKey
+	}
+
+	chunks, err := streamLines(ctx, p.client, p.baseURL+"/v1/chat/completions", headers, chatRequest, parseOpenAILine)
+	if err != nil {
+		return nil, fmt.Errorf("chat completion request failed: %v", err)
+	}
+	return chunks, nil
+}
+
+func (p *OpenAICompatibleProvider) Generate(ctx context.Context, model string, prompt string) (<-chan LLMChunk, error) {
+	return p.Chat(ctx, model, []types.Message{{Role: "user", Content: prompt}}, false)
+}
+
+// ******************** Fake ********************
+
+// FakeLLMProvider answers without calling any model, for tests and local development.
+// The same input always gets the same answer. When JSON is asked for, it fills every key
+// quoted in the system prompt (like "prompt": ...) so the callers can parse the reply.
+type FakeLLMProvider struct{}
+
+func NewFakeLLMProvider() *FakeLLMProvider {
+	return &FakeLLMProvider{}
+}
+
+var jsonKeyPattern = regexp.MustCompile(`"([A-Za-z_][A-Za-z0-9_]*)"\s*:`)
+
+func (p *FakeLLMProvider) Chat(ctx context.Context, model string, messages []types.Message, jsonFormat bool) (<-chan LLMChunk, error) {
+	var systemPrompt string
+	for _, message := range messages {
+		if message.Role == "system" {
+			systemPrompt += message.Content
+		}
+	}
+
+	reply := fakeReply(model, messages)
+	if !jsonFormat {
+		return fakeStream(ctx, reply), nil
+	}
+
+	object := map[string]string{}
+	for _, match := range jsonKeyPattern.FindAllStringSubmatch(systemPrompt, -1) {
+		object[match[1]] = fmt.Sprintf("%s (%s)", reply, match[1])
+	}
+	if len(object) == 0 {
+		object["response"] = reply
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return fakeStream(ctx, string(data)), nil
+}
+
+func (p *FakeLLMProvider) Generate(ctx context.Context, model string, prompt string) (<-chan LLMChunk, error) {
+	return fakeStream(ctx, fakeReply(model, []types.Message{{Role: "user", Content: prompt}})), nil
+}
+
+// fakeStream sends the reply word by word, like a model would
+func fakeStream(ctx context.Context, reply string) <-chan LLMChunk {
+	chunks := make(chan LLMChunk)
+	go func() {
+		defer close(chunks)
+		for _, token := range strings.SplitAfter(reply, " ") {
+			select {
+			case chunks <- LLMChunk{Content: token}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return chunks
+}
+
+// fakeReply builds a deterministic reply from the first words of the last user message and a hash of the whole conversation
+func fakeReply(model string, messages []types.Message) string {
+	hash := sha256.New()
+	hash.Write([]byte(model))
+	var last string
+	for _, message := range messages {
+		hash.Write([]byte(message.Role))
+		hash.Write([]byte(message.Content))
+		if message.Role == "user" {
+			last = message.Content
+		}
+	}
+
+	words := strings.Fields(last)
+	if len(words) > 8 {
+		words = words[:8]
+	}
+	return fmt.Sprintf("fake reply %s to: %s", hex.EncodeToString(hash.Sum(nil))[:8], strings.Join(words, " "))
+}
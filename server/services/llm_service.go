@@ -1,163 +1,171 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/ankylat/anky/server/types"
 )
 
-type LLMService struct {
-	client *http.Client
-}
-
-func NewLLMService() *LLMService {
-	return &LLMService{
-		client: &http.Client{},
-	}
-}
+// LLMPurpose is what a prompt is used for. Each purpose can be routed to its own provider and model.
+type LLMPurpose string
 
-func (s *LLMService) SendSimpleRequest(prompt string) (<-chan string, error) {
-	fmt.Println("=== SendSimpleRequest START ===")
-	fmt.Println("Input prompt:", prompt)
+const (
+	LLMPurposeDefault    LLMPurpose = ""
+	LLMPurposeReflection LLMPurpose = "reflection"
+	LLMPurposeOnboarding LLMPurpose = "onboarding"
+	LLMPurposeSimple     LLMPurpose = "simple"
+)
 
-	llmRequest := types.LLMRequest{
-		Model:  "llama3.2",
-		Prompt: prompt,
-	}
-	fmt.Println("Created LLMRequest object:", llmRequest)
+// llmResponseHeaderTimeout bounds how long a provider can take to start answering. Once the
+// stream started it can last as long as the model keeps writing, until the caller's ctx is done.
+const llmResponseHeaderTimeout = 2 * time.Minute
+
+// llmHTTPClient is shared by the providers so that they reuse their connections
+var llmHTTPClient = func() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = llmResponseHeaderTimeout
+	return &http.Client{Transport: transport}
+}()
+
+// LLMConfig says which provider and model serve a purpose
+type LLMConfig struct {
+	Provider string // ollama, openai or fake
+	BaseURL  string
+	Model    string
+	APIKey   string
+}
 
-	jsonData, err := json.Marshal(llmRequest)
-	if err != nil {
-		fmt.Println("ERROR: Failed to marshal LLMRequest:", err)
-		return nil, err
+// LoadLLMConfig reads the configuration of a purpose from the environment. The LLM_PROVIDER,
+// LLM_BASE_URL, LLM_MODEL and LLM_API_KEY variables apply to every purpose, and can be
+// overridden for one of them with LLM_<PURPOSE>_PROVIDER, LLM_REFLECTION_MODEL, etc.
+func LoadLLMConfig(purpose LLMPurpose) LLMConfig {
+	get := func(name string) string {
+		if purpose != LLMPurposeDefault {
+			if value := os.Getenv("LLM_" + strings.ToUpper(string(purpose)) + "_" + name); value != "" {
+				return value
+			}
+		}
+		return os.Getenv("LLM_" + name)
 	}
-	fmt.Println("Successfully marshaled request to JSON:", string(jsonData))
 
-	req, err := http.NewRequest("POST", "http://localhost:11434/api/generate", bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println("ERROR: Failed to create HTTP request:", err)
-		return nil, err
+	config := LLMConfig{
+		Provider: strings.ToLower(get("PROVIDER")),
+		BaseURL:  get("BASE_URL"),
+		Model:    get("MODEL"),
+		APIKey:   get("API_KEY"),
 	}
-	req.Header.Set("Content-Type", "application/json")
-	fmt.Println("Created HTTP request with headers:", req.Header)
 
-	fmt.Println("Sending HTTP request...")
-	resp, err := s.client.Do(req)
-	if err != nil {
-		fmt.Println("ERROR: Failed to send HTTP request:", err)
-		return nil, fmt.Errorf("failed to send HTTP request: %v", err)
+	switch config.Provider {
+	case "", "ollama":
+		config.Provider = "ollama"
+		if config.BaseURL == "" {
+			config.BaseURL = "http://localhost:11434"
+		}
+		if config.Model == "" {
+			config.Model = "llama3.2"
+		}
+	case "openai":
+		if config.BaseURL == "" {
+			config.BaseURL = "https://api.openai.com"
+		}
+		if config.Model == "" {
+			config.Model = "gpt-4o-mini"
+		}
+	case "fake":
+		if config.Model == "" {
+			config.Model = "fake"
+		}
 	}
-	fmt.Println("Received response with status:", resp.Status)
+	return config
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("ERROR: Unexpected status code:", resp.StatusCode)
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+// NewLLMProvider builds the provider described by the configuration
+func NewLLMProvider(config LLMConfig) (LLMProvider, error) {
+	client := llmHTTPClient
+
+	switch config.Provider {
+	case "ollama":
+		return NewOllamaProvider(config.BaseURL, config.APIKey, client), nil
+	case "openai":
+		return NewOpenAICompatibleProvider(config.BaseURL, config.APIKey, client), nil
+	case "fake":
+		return NewFakeLLMProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider: %s", config.Provider)
 	}
+}
 
-	fmt.Println("Creating response channel...")
-	responseChan := make(chan string)
-
-	go func() {
-		fmt.Println("Starting goroutine to process response...")
-		defer func() {
-			fmt.Println("Closing response body and channel...")
-			resp.Body.Close()
-			close(responseChan)
-		}()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println("ERROR: Failed to read response body:", err)
-			return
-		}
-		fmt.Println("Successfully read response body:", string(body))
+type LLMService struct {
+	provider LLMProvider
+	model    string
+	err      error
+}
 
-		// Parse the JSON response to get just the "response" field
-		var llmResponse struct {
-			Response string `json:"response"`
-		}
-		if err := json.Unmarshal(body, &llmResponse); err != nil {
-			fmt.Println("ERROR: Failed to unmarshal response:", err)
-			return
-		}
+// NewLLMService returns the service configured by the LLM_* variables
+func NewLLMService() *LLMService {
+	return NewLLMServiceFor(LLMPurposeDefault)
+}
 
-		fmt.Println("Sending response through channel...")
-		responseChan <- llmResponse.Response
-		fmt.Println("Response sent through channel")
-	}()
+// NewLLMServiceFor returns the service configured for a purpose. A bad configuration is
+// reported by the first request, like an unreachable provider would be.
+func NewLLMServiceFor(purpose LLMPurpose) *LLMService {
+	config := LoadLLMConfig(purpose)
+	provider, err := NewLLMProvider(config)
+	if err != nil {
+		log.Printf("Error creating LLM provider for purpose %q: %v", purpose, err)
+	}
+	return &LLMService{
+		provider: provider,
+		model:    config.Model,
+		err:      err,
+	}
+}
 
-	fmt.Println("=== SendSimpleRequest END ===")
-	return responseChan, nil
+// NewLLMServiceWithProvider returns a service running every request on the given provider and model
+func NewLLMServiceWithProvider(provider LLMProvider, model string) *LLMService {
+	return &LLMService{
+		provider: provider,
+		model:    model,
+	}
 }
 
-func (s *LLMService) SendChatRequest(chatRequest types.ChatRequest, jsonFormatting bool) (<-chan string, error) {
-	fmt.Println("SendChatRequest called with:", chatRequest)
+// Model is the model that runs the requests of the service
+func (s *LLMService) Model() string {
+	return s.model
+}
 
-	llmRequest := types.LLMRequest{
-		Model:    "llama3.2",
-		Messages: chatRequest.Messages,
-		Stream:   false,
+// SendSimpleRequest streams the completion of a prompt. Errors happening once the stream
+// started come as the last chunk of the channel.
+func (s *LLMService) SendSimpleRequest(ctx context.Context, prompt string) (<-chan LLMChunk, error) {
+	if s.err != nil {
+		return nil, s.err
 	}
-	if jsonFormatting {
-		llmRequest.Format = "json"
-	}
-	fmt.Printf("Created LLMRequest: %+v\n", llmRequest)
 
-	jsonData, err := json.Marshal(llmRequest)
+	chunks, err := s.provider.Generate(ctx, s.model, prompt)
 	if err != nil {
-		fmt.Println("Error marshaling LLMRequest:", err)
+		fmt.Println("ERROR: Failed to send simple request:", err)
 		return nil, err
 	}
-	fmt.Println("Marshaled LLMRequest to JSON:", string(jsonData))
+	return chunks, nil
+}
 
-	req, err := http.NewRequest("POST", "http://localhost:11434/api/chat", bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println("Error creating HTTP request:", err)
-		return nil, err
+// SendChatRequest streams the reply to a conversation. Errors happening once the stream
+// started come as the last chunk of the channel.
+func (s *LLMService) SendChatRequest(ctx context.Context, chatRequest types.ChatRequest, jsonFormatting bool) (<-chan LLMChunk, error) {
+	if s.err != nil {
+		return nil, s.err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	fmt.Println("Created HTTP request:", req)
 
-	resp, err := s.client.Do(req)
+	chunks, err := s.provider.Chat(ctx, s.model, chatRequest.Messages, jsonFormatting)
 	if err != nil {
-		fmt.Println("Error sending HTTP request:", err)
+		fmt.Println("Error sending chat request:", err)
 		return nil, err
 	}
-	fmt.Println("Received HTTP response:", resp.Status)
-
-	responseChan := make(chan string)
-	fmt.Println("Created response channel")
-
-	go func() {
-		fmt.Println("Started goroutine to process response")
-		defer resp.Body.Close()
-		defer close(responseChan)
-		fmt.Println("Deferred response body close and channel close")
-
-		scanner := bufio.NewScanner(resp.Body)
-		for scanner.Scan() {
-			fmt.Println("Scanned new line from response body")
-			var streamResponse types.StreamResponse
-			if err := json.Unmarshal(scanner.Bytes(), &streamResponse); err != nil {
-				fmt.Println("Error unmarshaling stream response:", err)
-				continue
-			}
-			fmt.Printf("Unmarshaled stream response: %+v\n", streamResponse)
-			responseChan <- streamResponse.Message.Content
-			fmt.Println("Sent message content to response channel")
-		}
-
-		if err := scanner.Err(); err != nil {
-			fmt.Println("Error reading stream:", err)
-		}
-		fmt.Println("Finished processing response")
-	}()
-
-	fmt.Println("Returning response channel")
-	return responseChan, nil
+	return chunks, nil
 }
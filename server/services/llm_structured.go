@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+// Structured output
+//
+// A prompt that needs JSON back describes the reply as a Go struct. Its fields are read
+// through their json tag, and an llm tag adds the constraints the reply must satisfy:
+//
+//	type AnkyReflectionOutput struct {
+//		Prompt string `json:"prompt" llm:"required" desc:"A question that goes deeper"`
+//	}
+//
+// The supported constraints are required (the field can't be empty) and max=N (at most N
+// characters, or N items). A struct can also implement StructuredOutputValidator for
+// anything the tags can't express. When a reply doesn't parse or doesn't validate, the model
+// is asked again with the error, up to LLM_STRUCTURED_MAX_ATTEMPTS times.
+
+const defaultStructuredMaxAttempts = 3
+
+// StructuredOutputValidator is implemented by the outputs that need checks beyond their tags
+type StructuredOutputValidator interface {
+	Validate() error
+}
+
+// SendStructuredRequest sends the conversation and decodes the reply of the model into out,
+// which must be a pointer to a struct. Replies wrapped in code fences or prose are repaired
+// before being parsed, and invalid replies are sent back to the model with what is wrong.
+func (s *LLMService) SendStructuredRequest(ctx context.Context, chatRequest types.ChatRequest, out interface{}) error {
+	schema, err := describeStructuredOutput(out)
+	if err != nil {
+		return err
+	}
+
+	messages := append([]types.Message{}, chatRequest.Messages...)
+	messages = append(messages, types.Message{
+		Role:    "system",
+		Content: "Reply only with a JSON object of this form, without any other text:\n" + schema,
+	})
+
+	maxAttempts := structuredMaxAttempts()
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		chunks, err := s.SendChatRequest(ctx, types.ChatRequest{Messages: messages}, true)
+		if err != nil {
+			return err
+		}
+		response, err := CollectLLMResponse(chunks)
+		if err != nil {
+			return err
+		}
+
+		lastErr = decodeStructuredOutput(response, out)
+		if lastErr == nil {
+			return nil
+		}
+		log.Printf("Invalid structured output (attempt %d/%d): %v", attempt, maxAttempts, lastErr)
+
+		// Show the model its reply and what is wrong with it
+		messages = append(messages,
+			types.Message{Role: "assistant", Content: response},
+			types.Message{
+				Role:    "user",
+				Content: fmt.Sprintf("That reply is invalid: %v. Reply again with only a JSON object of this form:\n%s", lastErr, schema),
+			},
+		)
+	}
+
+	return fmt.Errorf("invalid structured output after %d attempts: %v", maxAttempts, lastErr)
+}
+
+func structuredMaxAttempts() int {
+	if attempts, err := strconv.Atoi(os.Getenv("LLM_STRUCTURED_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		return attempts
+	}
+	return defaultStructuredMaxAttempts
+}
+
+// decodeStructuredOutput repairs, parses and validates a reply
+func decodeStructuredOutput(response string, out interface{}) error {
+	repaired, err := extractJSONObject(response)
+	if err != nil {
+		return err
+	}
+
+	// Decode into a fresh value so that nothing is left over from a previous attempt
+	value := reflect.New(reflect.TypeOf(out).Elem())
+	if err := json.Unmarshal([]byte(repaired), value.Interface()); err != nil {
+		return fmt.Errorf("the JSON doesn't match the expected form: %v", err)
+	}
+	if err := validateStructuredOutput(value.Interface()); err != nil {
+		return err
+	}
+
+	reflect.ValueOf(out).Elem().Set(value.Elem())
+	return nil
+}
+
+// extractJSONObject finds the JSON object in a reply, dropping code fences and any prose around it
+func extractJSONObject(response string) (string, error) {
+	text := strings.TrimSpace(response)
+
+	if fenceStart := strings.Index(text, "```"); fenceStart >= 0 {
+		inside := text[fenceStart+3:]
+		// Drop the language of the fence, like ```json
+		if newline := strings.IndexByte(inside, '\n'); newline >= 0 && !strings.Contains(inside[:newline], "{") {
+			inside = inside[newline+1:]
+		}
+		if fenceEnd := strings.Index(inside, "```"); fenceEnd >= 0 {
+			inside = inside[:fenceEnd]
+		}
+		text = strings.TrimSpace(inside)
+	}
+
+	start := strings.IndexByte(text, '{')
+	if start < 0 {
+		return "", fmt.Errorf("the reply has no JSON object")
+	}
+
+	// Find the brace closing the first one, skipping the ones inside strings
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return text[start : i+1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("the JSON object in the reply is not closed")
+}
+
+// structuredField is a field of an output struct with its constraints
+type structuredField struct {
+	name        string
+	index       int
+	required    bool
+	max         int
+	description string
+}
+
+func structuredFields(t reflect.Type) []structuredField {
+	fields := make([]structuredField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		f := structuredField{name: name, index: i, description: field.Tag.Get("desc")}
+		for _, constraint := range strings.Split(field.Tag.Get("llm"), ",") {
+			switch {
+			case constraint == "required":
+				f.required = true
+			case strings.HasPrefix(constraint, "max="):
+				f.max, _ = strconv.Atoi(strings.TrimPrefix(constraint, "max="))
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func structType(out interface{}) (reflect.Type, error) {
+	t := reflect.TypeOf(out)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("structured output must be a pointer to a struct, got %T", out)
+	}
+	return t.Elem(), nil
+}
+
+// describeStructuredOutput writes the form of the expected JSON object for the prompt
+func describeStructuredOutput(out interface{}) (string, error) {
+	t, err := structType(out)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("{\n")
+	fields := structuredFields(t)
+	for i, f := range fields {
+		var notes []string
+		notes = append(notes, jsonTypeName(t.Field(f.index).Type))
+		if f.required {
+			notes = append(notes, "required")
+		}
+		if f.max > 0 {
+			notes = append(notes, fmt.Sprintf("at most %d characters", f.max))
+		}
+		if f.description != "" {
+			notes = append(notes, f.description)
+		}
+
+		fmt.Fprintf(&b, "  %q: %q", f.name, strings.Join(notes, ", "))
+		if i < len(fields)-1 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array of " + jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
+
+// validateStructuredOutput checks the constraints of the tags, then the Validate method if there is one
+func validateStructuredOutput(out interface{}) error {
+	t, err := structType(out)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(out).Elem()
+
+	for _, f := range structuredFields(t) {
+		fieldValue := v.Field(f.index)
+
+		if f.required {
+			empty := fieldValue.IsZero()
+			if fieldValue.Kind() == reflect.String {
+				empty = strings.TrimSpace(fieldValue.String()) == ""
+			}
+			if (fieldValue.Kind() == reflect.Slice || fieldValue.Kind() == reflect.Map) && fieldValue.Len() == 0 {
+				empty = true
+			}
+			if empty {
+				return fmt.Errorf("%q is missing or empty", f.name)
+			}
+		}
+
+		if f.max > 0 {
+			length := 0
+			switch fieldValue.Kind() {
+			case reflect.String:
+				length = utf8.RuneCountInString(fieldValue.String())
+			case reflect.Slice, reflect.Array, reflect.Map:
+				length = fieldValue.Len()
+			}
+			if length > f.max {
+				return fmt.Errorf("%q is %d long, it must be at most %d", f.name, length, f.max)
+			}
+		}
+	}
+
+	if validator, ok := out.(StructuredOutputValidator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+func TestExtractJSONObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+		wantErr  bool
+	}{
+		{"plain object", `{"a": "b"}`, `{"a": "b"}`, false},
+		{"surrounded by prose", `Sure! Here it is: {"a": "b"} Hope it helps.`, `{"a": "b"}`, false},
+		{"json code fence", "```json\n{\"a\": \"b\"}\n```", `{"a": "b"}`, false},
+		{"bare code fence", "```\n{\"a\": 1}\n```", `{"a": 1}`, false},
+		{"braces inside strings", `{"a": "a } and a {", "b": "\"}"}`, `{"a": "a } and a {", "b": "\"}"}`, false},
+		{"nested objects", `{"a": {"b": {}}} trailing`, `{"a": {"b": {}}}`, false},
+		{"no object", `I can't answer that`, "", true},
+		{"object not closed", `{"a": "b"`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractJSONObject(tt.response)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+type testOutput struct {
+	Title string   `json:"title" llm:"required,max=10"`
+	Tags  []string `json:"tags" llm:"max=2"`
+	Note  string   `json:"note"`
+}
+
+type testValidatedOutput struct {
+	Answer string `json:"answer"`
+}
+
+func (o *testValidatedOutput) Validate() error {
+	if o.Answer != "yes" && o.Answer != "no" {
+		return fmt.Errorf("answer must be yes or no")
+	}
+	return nil
+}
+
+func TestValidateStructuredOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     interface{}
+		wantErr string
+	}{
+		{"valid", &testOutput{Title: "hello", Tags: []string{"a"}}, ""},
+		{"optional fields empty", &testOutput{Title: "hello"}, ""},
+		{"required missing", &testOutput{}, `"title" is missing`},
+		{"required only spaces", &testOutput{Title: "   "}, `"title" is missing`},
+		{"string too long", &testOutput{Title: "much too long"}, `"title" is 13 long`},
+		{"max counts characters, not bytes", &testOutput{Title: "ñññññññññ"}, ""},
+		{"too many items", &testOutput{Title: "hello", Tags: []string{"a", "b", "c"}}, `"tags" is 3 long`},
+		{"custom validation passes", &testValidatedOutput{Answer: "yes"}, ""},
+		{"custom validation fails", &testValidatedOutput{Answer: "maybe"}, "yes or no"},
+		{"not a pointer to a struct", testOutput{}, "pointer to a struct"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateStructuredOutput(tt.out)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// scriptedProvider replies with its replies in order, and records the conversations it got
+type scriptedProvider struct {
+	replies       []string
+	conversations [][]types.Message
+}
+
+func (p *scriptedProvider) Chat(ctx context.Context, model string, messages []types.Message, jsonFormat bool) (<-chan LLMChunk, error) {
+	p.conversations = append(p.conversations, messages)
+	reply := p.replies[0]
+	if len(p.replies) > 1 {
+		p.replies = p.replies[1:]
+	}
+	return fakeStream(ctx, reply), nil
+}
+
+func (p *scriptedProvider) Generate(ctx context.Context, model string, prompt string) (<-chan LLMChunk, error) {
+	return p.Chat(ctx, model, []types.Message{{Role: "user", Content: prompt}}, false)
+}
+
+func TestSendStructuredRequest(t *testing.T) {
+	t.Setenv("LLM_STRUCTURED_MAX_ATTEMPTS", "3")
+	request := types.ChatRequest{Messages: []types.Message{{Role: "user", Content: "write a title"}}}
+
+	tests := []struct {
+		name         string
+		replies      []string
+		wantTitle    string
+		wantAttempts int
+		wantErr      bool
+	}{
+		{
+			name:         "valid on the first attempt",
+			replies:      []string{`{"title": "first"}`},
+			wantTitle:    "first",
+			wantAttempts: 1,
+		},
+		{
+			name:         "repaired without asking again",
+			replies:      []string{"```json\n{\"title\": \"fenced\"}\n```"},
+			wantTitle:    "fenced",
+			wantAttempts: 1,
+		},
+		{
+			name:         "asked again after an invalid reply",
+			replies:      []string{`no idea`, `{"title": "much too long"}`, `{"title": "third"}`},
+			wantTitle:    "third",
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up after the last attempt",
+			replies:      []string{`{"title": ""}`},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &scriptedProvider{replies: tt.replies}
+			service := NewLLMServiceWithProvider(provider, "test")
+
+			var out testOutput
+			err := service.SendStructuredRequest(context.Background(), request, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %t, got %v", tt.wantErr, err)
+			}
+			if out.Title != tt.wantTitle {
+				t.Errorf("expected title %q, got %q", tt.wantTitle, out.Title)
+			}
+			if len(provider.conversations) != tt.wantAttempts {
+				t.Fatalf("expected %d attempts, got %d", tt.wantAttempts, len(provider.conversations))
+			}
+
+			// A new attempt shows the model its previous reply and what was wrong with it
+			if tt.wantAttempts > 1 {
+				retry := provider.conversations[1]
+				last := retry[len(retry)-1]
+				if last.Role != "user" || !strings.Contains(last.Content, "That reply is invalid") {
+					t.Errorf("expected the retry to explain the error, got %+v", last)
+				}
+				if retry[len(retry)-2].Role != "assistant" {
+					t.Errorf("expected the retry to include the previous reply, got %+v", retry[len(retry)-2])
+				}
+			}
+		})
+	}
+}
+
+func TestSendStructuredRequestWithFakeProvider(t *testing.T) {
+	service := NewLLMServiceWithProvider(NewFakeLLMProvider(), "fake")
+	request := types.ChatRequest{Messages: []types.Message{
+		{Role: "system", Content: "Reflect on the writing"},
+		{Role: "user", Content: "today I woke up and wrote"},
+	}}
+
+	var first, second AnkyReflectionOutput
+	if err := service.SendStructuredRequest(context.Background(), request, &first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Prompt == "" || first.ImagePrompt == "" {
+		t.Fatalf("expected every required field to be filled, got %+v", first)
+	}
+
+	if err := service.SendStructuredRequest(context.Background(), request, &second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != second {
+		t.Errorf("expected the fake provider to be deterministic, got %+v and %+v", first, second)
+	}
+}
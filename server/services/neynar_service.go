@@ -195,7 +195,7 @@ func (s *NeynarService) FetchUserCasts(fid int) ([]Cast, error) {
 	return neynarResponse.Casts, nil
 }
 
-func (s *NeynarService) WriteCast(apiKey, signerUUID, text, channelID, idem, sessionId string) (*types.Cast, error) {
+func (s *NeynarService) WriteCast(ctx context.Context, apiKey, signerUUID, text, channelID, idem, sessionId string) (*types.Cast, error) {
 	log.Println("Starting WriteCast function")
 
 	url := "https://api.neynar.com/v2/farcaster/cast"
@@ -220,7 +220,7 @@ func (s *NeynarService) WriteCast(apiKey, signerUUID, text, channelID, idem, ses
 	}
 	log.Printf("Payload: %s", string(payloadBytes))
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		log.Printf("Error creating request: %v", err)
 		return nil, fmt.Errorf("error creating request: %v", err)
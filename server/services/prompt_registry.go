@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/google/uuid"
+)
+
+// Prompt registry
+//
+// The system prompts live in the prompts directory (PROMPTS_DIR), one folder per prompt and
+// one text/template file per version: prompts/onboarding/v1.tmpl. An optional weights.json
+// in the folder sets how many users each version gets, like {"v1": 80, "v2": 20}, and
+// versions missing from it weigh 100. Versions can also be added, reweighted or switched off
+// from the prompt_templates table, which wins over the files.
+//
+// Every user is assigned to a version by hashing their ID, so they keep getting the same one
+// as long as the versions don't change. The version ID (onboarding/v1) is stored with what
+// the prompt produced, to compare the versions.
+
+const (
+	PromptReflection = "reflection"
+	PromptOnboarding = "onboarding"
+)
+
+const defaultPromptWeight = 100
+
+// PromptVars are the variables available to the templates
+type PromptVars struct {
+	AttemptCount    int
+	DurationSeconds int
+	WordsWritten    int
+	Language        string
+}
+
+// RenderedPrompt is a prompt ready to be sent, with the version it came from
+type RenderedPrompt struct {
+	Text    string
+	Version string
+}
+
+type promptVersion struct {
+	version  string
+	template string
+	weight   int
+}
+
+type PromptRegistry struct {
+	dir   string
+	store *storage.PostgresStore
+}
+
+// NewPromptRegistry returns the registry reading the prompts directory and, when store is
+// not nil, the prompt_templates table
+func NewPromptRegistry(store *storage.PostgresStore) *PromptRegistry {
+	dir := os.Getenv("PROMPTS_DIR")
+	if dir == "" {
+		dir = "prompts"
+	}
+	return &PromptRegistry{dir: dir, store: store}
+}
+
+// Render picks the version of the prompt assigned to the user and executes it with vars
+func (r *PromptRegistry) Render(ctx context.Context, name string, userID uuid.UUID, vars PromptVars) (*RenderedPrompt, error) {
+	versions, err := r.versions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	chosen := assignPromptVersion(versions, name, userID)
+	if chosen == nil {
+		return nil, fmt.Errorf("prompt %s has no active version", name)
+	}
+
+	tmpl, err := template.New(name + "/" + chosen.version).Option("missingkey=error").Parse(chosen.template)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing prompt %s/%s: %v", name, chosen.version, err)
+	}
+
+	var text strings.Builder
+	if err := tmpl.Execute(&text, vars); err != nil {
+		return nil, fmt.Errorf("error rendering prompt %s/%s: %v", name, chosen.version, err)
+	}
+
+	return &RenderedPrompt{
+		Text:    strings.TrimSpace(text.String()),
+		Version: name + "/" + chosen.version,
+	}, nil
+}
+
+// versions loads the versions of a prompt from the files, then applies the database rows on top
+func (r *PromptRegistry) versions(ctx context.Context, name string) ([]*promptVersion, error) {
+	byVersion := map[string]*promptVersion{}
+
+	promptDir := filepath.Join(r.dir, name)
+	files, err := filepath.Glob(filepath.Join(promptDir, "*.tmpl"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing prompt files: %v", err)
+	}
+
+	weights := map[string]int{}
+	weightsFile, err := os.ReadFile(filepath.Join(promptDir, "weights.json"))
+	if err == nil {
+		if err := json.Unmarshal(weightsFile, &weights); err != nil {
+			return nil, fmt.Errorf("error reading weights of prompt %s: %v", name, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading weights of prompt %s: %v", name, err)
+	}
+
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading prompt file: %v", err)
+		}
+
+		version := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		weight, ok := weights[version]
+		if !ok {
+			weight = defaultPromptWeight
+		}
+		byVersion[version] = &promptVersion{version: version, template: string(content), weight: weight}
+	}
+
+	if r.store != nil {
+		templates, err := r.store.GetPromptTemplates(ctx, name)
+		if err != nil {
+			// The files are enough to keep going
+			log.Printf("Error loading prompt templates of %s from the database: %v", name, err)
+		}
+		for _, t := range templates {
+			if !t.Active {
+				delete(byVersion, t.Version)
+				continue
+			}
+			byVersion[t.Version] = &promptVersion{version: t.Version, template: t.Template, weight: t.Weight}
+		}
+	}
+
+	versions := make([]*promptVersion, 0, len(byVersion))
+	for _, v := range byVersion {
+		if v.weight > 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return promptVersionLess(versions[i].version, versions[j].version) })
+	return versions, nil
+}
+
+// promptVersionLess orders versions by their prefix, then by their number, so that v2 comes
+// before v10
+func promptVersionLess(a, b string) bool {
+	prefixA, numberA, okA := splitPromptVersion(a)
+	prefixB, numberB, okB := splitPromptVersion(b)
+	switch {
+	case prefixA != prefixB:
+		return prefixA < prefixB
+	case okA != okB:
+		return !okA
+	case numberA != numberB:
+		return numberA < numberB
+	}
+	return a < b
+}
+
+// splitPromptVersion splits v12 into v and 12
+func splitPromptVersion(version string) (string, int, bool) {
+	prefix := strings.TrimRight(version, "0123456789")
+	number, err := strconv.Atoi(version[len(prefix):])
+	if err != nil {
+		return version, 0, false
+	}
+	return prefix, number, true
+}
+
+// assignPromptVersion picks a version for the user according to the weights. The same user
+// always lands on the same version of a prompt, and different prompts are assigned independently.
+func assignPromptVersion(versions []*promptVersion, name string, userID uuid.UUID) *promptVersion {
+	total := 0
+	for _, v := range versions {
+		total += v.weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	hash.Write(userID[:])
+	point := int(hash.Sum64() % uint64(total))
+
+	for _, v := range versions {
+		if point < v.weight {
+			return v
+		}
+		point -= v.weight
+	}
+	return versions[len(versions)-1]
+}
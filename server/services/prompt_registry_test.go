@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAssignPromptVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		weights  map[string]int
+		wantOnly string // the only version that can be assigned, if any
+		wantNil  bool
+	}{
+		{name: "single version", weights: map[string]int{"v1": 100}, wantOnly: "v1"},
+		{name: "switched off version", weights: map[string]int{"v1": 0, "v2": 100}, wantOnly: "v2"},
+		{name: "shared versions", weights: map[string]int{"v1": 50, "v2": 50}},
+		{name: "no weight at all", weights: map[string]int{"v1": 0}, wantNil: true},
+		{name: "no version", weights: map[string]int{}, wantNil: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions []*promptVersion
+			for version, weight := range tt.weights {
+				versions = append(versions, &promptVersion{version: version, weight: weight})
+			}
+
+			for i := 0; i < 50; i++ {
+				userID := uuid.New()
+				chosen := assignPromptVersion(versions, "reflection", userID)
+				if tt.wantNil {
+					if chosen != nil {
+						t.Fatalf("expected no version, got %s", chosen.version)
+					}
+					continue
+				}
+				if chosen == nil {
+					t.Fatalf("expected a version, got none")
+				}
+				if tt.wantOnly != "" && chosen.version != tt.wantOnly {
+					t.Fatalf("expected %s, got %s", tt.wantOnly, chosen.version)
+				}
+				if again := assignPromptVersion(versions, "reflection", userID); again != chosen {
+					t.Fatalf("expected user %s to keep %s, got %s", userID, chosen.version, again.version)
+				}
+			}
+		})
+	}
+}
+
+func TestAssignPromptVersionFollowsWeights(t *testing.T) {
+	versions := []*promptVersion{{version: "v1", weight: 80}, {version: "v2", weight: 20}}
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[assignPromptVersion(versions, "onboarding", uuid.New()).version]++
+	}
+	if counts["v2"] < 1500 || counts["v2"] > 2500 {
+		t.Errorf("expected about 20%% of the users on v2, got %d out of 10000", counts["v2"])
+	}
+}
+
+func TestPromptVersionOrder(t *testing.T) {
+	versions := []string{"v10", "v2", "v1", "experiment", "v9", "v2b"}
+	sort.Slice(versions, func(i, j int) bool { return promptVersionLess(versions[i], versions[j]) })
+
+	want := []string{"experiment", "v1", "v2", "v9", "v10", "v2b"}
+	if strings.Join(versions, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, versions)
+	}
+}
+
+func TestPromptRegistryRender(t *testing.T) {
+	dir := t.TempDir()
+	promptDir := filepath.Join(dir, "greeting")
+	if err := os.MkdirAll(promptDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"v1.tmpl":      "Attempt {{.AttemptCount}}{{if .Language}}, in {{.Language}}{{end}}\n",
+		"v2.tmpl":      "unused",
+		"weights.json": `{"v2": 0}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(promptDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("PROMPTS_DIR", dir)
+	registry := NewPromptRegistry(nil)
+
+	tests := []struct {
+		vars PromptVars
+		want string
+	}{
+		{PromptVars{AttemptCount: 3}, "Attempt 3"},
+		{PromptVars{AttemptCount: 1, Language: "Spanish"}, "Attempt 1, in Spanish"},
+	}
+	for _, tt := range tests {
+		rendered, err := registry.Render(context.Background(), "greeting", uuid.New(), tt.vars)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rendered.Text != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, rendered.Text)
+		}
+		if rendered.Version != "greeting/v1" {
+			t.Errorf("expected version greeting/v1, got %s", rendered.Version)
+		}
+	}
+
+	if _, err := registry.Render(context.Background(), "missing", uuid.New(), PromptVars{}); err == nil {
+		t.Errorf("expected an error for a prompt without versions")
+	}
+}
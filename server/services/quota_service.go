@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// Quotas
+//
+// Every user gets a daily budget of LLM calls, tokens and Anky images, which depends on their
+// tier (see types.QuotaTier). The days are UTC days. The limits can be changed with
+// QUOTA_<TIER>_LLM_CALLS, QUOTA_<TIER>_TOKENS and QUOTA_<TIER>_IMAGES, like
+// QUOTA_ANONYMOUS_LLM_CALLS.
+//
+// A call is reserved before it is sent to the model, and refused once the calls or the tokens
+// of the day are spent. The tokens are only known once the response is complete, so they are
+// recorded afterwards: the call that crosses the token limit goes through, the next ones don't.
+// The providers don't all report token counts, they are estimated from the length of the text.
+
+var defaultQuotaLimits = map[string]types.QuotaLimits{
+	types.QuotaTierAnonymous: {LLMCalls: 30, Tokens: 30000, ImageGenerations: 2},
+	types.QuotaTierPrivy:     {LLMCalls: 150, Tokens: 200000, ImageGenerations: 8},
+	types.QuotaTierFarcaster: {LLMCalls: 300, Tokens: 400000, ImageGenerations: 16},
+}
+
+// What a quota limits
+const (
+	QuotaResourceLLMCalls         = "llm_calls"
+	QuotaResourceTokens           = "tokens"
+	QuotaResourceImageGenerations = "image_generations"
+)
+
+// QuotaExceededError is returned when the user spent their quota for the day
+type QuotaExceededError struct {
+	Tier     string    `json:"tier"`
+	Resource string    `json:"resource"`
+	Limit    int       `json:"limit"`
+	Used     int       `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("daily %s quota of the %s tier exceeded (%d of %d), it resets at %s",
+		strings.ReplaceAll(e.Resource, "_", " "), e.Tier, e.Used, e.Limit, e.ResetsAt.Format(time.RFC3339))
+}
+
+// UsageReport is what a user spent today, next to their limits
+type UsageReport struct {
+	Tier     string            `json:"tier"`
+	Usage    *types.DailyUsage `json:"usage"`
+	Limits   types.QuotaLimits `json:"limits"`
+	ResetsAt time.Time         `json:"resets_at"`
+}
+
+// usageStore is the part of the storage the quotas need
+type usageStore interface {
+	GetDailyUsage(ctx context.Context, userID uuid.UUID, day time.Time) (*types.DailyUsage, error)
+	AddDailyUsage(ctx context.Context, usage *types.DailyUsage) (*types.DailyUsage, error)
+}
+
+type QuotaService struct {
+	store  usageStore
+	limits map[string]types.QuotaLimits
+	now    func() time.Time
+}
+
+func NewQuotaService(store *storage.PostgresStore) *QuotaService {
+	limits := make(map[string]types.QuotaLimits)
+	for tier, defaults := range defaultQuotaLimits {
+		prefix := "QUOTA_" + strings.ToUpper(tier)
+		limits[tier] = types.QuotaLimits{
+			LLMCalls:         envInt(prefix+"_LLM_CALLS", defaults.LLMCalls),
+			Tokens:           envInt(prefix+"_TOKENS", defaults.Tokens),
+			ImageGenerations: envInt(prefix+"_IMAGES", defaults.ImageGenerations),
+		}
+	}
+	return &QuotaService{store: store, limits: limits, now: time.Now}
+}
+
+// today is the current UTC day and when it ends
+func (q *QuotaService) today() (time.Time, time.Time) {
+	now := q.now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return day, day.AddDate(0, 0, 1)
+}
+
+// ReserveLLMCall counts a call to the model, or returns a QuotaExceededError if the user can't
+// make any more today
+func (q *QuotaService) ReserveLLMCall(ctx context.Context, user *types.User) error {
+	tier := types.QuotaTier(user)
+	limits := q.limits[tier]
+	day, resetsAt := q.today()
+
+	usage, err := q.store.AddDailyUsage(ctx, &types.DailyUsage{UserID: user.ID, Day: day, LLMCalls: 1})
+	if err != nil {
+		return fmt.Errorf("error reserving LLM call: %v", err)
+	}
+
+	var exceeded *QuotaExceededError
+	switch tokens := usage.PromptTokens + usage.ResponseTokens; {
+	case usage.LLMCalls > limits.LLMCalls:
+		exceeded = &QuotaExceededError{Tier: tier, Resource: QuotaResourceLLMCalls, Limit: limits.LLMCalls, Used: usage.LLMCalls - 1, ResetsAt: resetsAt}
+	case tokens >= limits.Tokens:
+		exceeded = &QuotaExceededError{Tier: tier, Resource: QuotaResourceTokens, Limit: limits.Tokens, Used: tokens, ResetsAt: resetsAt}
+	default:
+		return nil
+	}
+
+	// The call won't be made
+	if _, err := q.store.AddDailyUsage(ctx, &types.DailyUsage{UserID: user.ID, Day: day, LLMCalls: -1}); err != nil {
+		log.Printf("Error giving back the LLM call of user %s: %v", user.ID, err)
+	}
+	return exceeded
+}
+
+// ReserveImageGeneration counts the generation of an Anky image, or returns a
+// QuotaExceededError if the user can't have any more today
+func (q *QuotaService) ReserveImageGeneration(ctx context.Context, user *types.User) error {
+	tier := types.QuotaTier(user)
+	limits := q.limits[tier]
+	day, resetsAt := q.today()
+
+	usage, err := q.store.AddDailyUsage(ctx, &types.DailyUsage{UserID: user.ID, Day: day, ImageGenerations: 1})
+	if err != nil {
+		return fmt.Errorf("error reserving image generation: %v", err)
+	}
+	if usage.ImageGenerations <= limits.ImageGenerations {
+		return nil
+	}
+
+	if _, err := q.store.AddDailyUsage(ctx, &types.DailyUsage{UserID: user.ID, Day: day, ImageGenerations: -1}); err != nil {
+		log.Printf("Error giving back the image generation of user %s: %v", user.ID, err)
+	}
+	return &QuotaExceededError{
+		Tier:     tier,
+		Resource: QuotaResourceImageGenerations,
+		Limit:    limits.ImageGenerations,
+		Used:     usage.ImageGenerations - 1,
+		ResetsAt: resetsAt,
+	}
+}
+
+// RecordTokens adds the tokens of a prompt and its response to the day of the user
+func (q *QuotaService) RecordTokens(ctx context.Context, userID uuid.UUID, prompt string, response string) {
+	day, _ := q.today()
+	usage := &types.DailyUsage{
+		UserID:         userID,
+		Day:            day,
+		PromptTokens:   EstimateTokens(prompt),
+		ResponseTokens: EstimateTokens(response),
+	}
+	if _, err := q.store.AddDailyUsage(ctx, usage); err != nil {
+		log.Printf("Error recording the tokens of user %s: %v", userID, err)
+	}
+}
+
+// MeterStream forwards a streamed response and records its tokens once it is complete
+func (q *QuotaService) MeterStream(ctx context.Context, userID uuid.UUID, prompt string, chunks <-chan LLMChunk) <-chan LLMChunk {
+	forwarded := make(chan LLMChunk)
+	go func() {
+		defer close(forwarded)
+
+		var response strings.Builder
+		// Whatever the model wrote was paid for, even if the client went away
+		defer func() { q.RecordTokens(context.Background(), userID, prompt, response.String()) }()
+
+		for chunk := range chunks {
+			response.WriteString(chunk.Content)
+			select {
+			case forwarded <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return forwarded
+}
+
+// Usage is what the user spent today
+func (q *QuotaService) Usage(ctx context.Context, user *types.User) (*UsageReport, error) {
+	tier := types.QuotaTier(user)
+	day, resetsAt := q.today()
+	usage, err := q.store.GetDailyUsage(ctx, user.ID, day)
+	if err != nil {
+		return nil, err
+	}
+	return &UsageReport{Tier: tier, Usage: usage, Limits: q.limits[tier], ResetsAt: resetsAt}, nil
+}
+
+// EstimateTokens guesses the number of tokens of a text, about four characters a token
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
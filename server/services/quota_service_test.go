@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// memoryUsageStore keeps the daily usage of the tests in memory
+type memoryUsageStore struct {
+	mu    sync.Mutex
+	usage map[string]*types.DailyUsage
+}
+
+func usageKey(userID uuid.UUID, day time.Time) string {
+	return userID.String() + day.Format("2006-01-02")
+}
+
+func (m *memoryUsageStore) GetDailyUsage(ctx context.Context, userID uuid.UUID, day time.Time) (*types.DailyUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if usage, ok := m.usage[usageKey(userID, day)]; ok {
+		copied := *usage
+		return &copied, nil
+	}
+	return &types.DailyUsage{UserID: userID, Day: day}, nil
+}
+
+func (m *memoryUsageStore) AddDailyUsage(ctx context.Context, delta *types.DailyUsage) (*types.DailyUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage, ok := m.usage[usageKey(delta.UserID, delta.Day)]
+	if !ok {
+		usage = &types.DailyUsage{UserID: delta.UserID, Day: delta.Day}
+		m.usage[usageKey(delta.UserID, delta.Day)] = usage
+	}
+	usage.LLMCalls += delta.LLMCalls
+	usage.PromptTokens += delta.PromptTokens
+	usage.ResponseTokens += delta.ResponseTokens
+	usage.ImageGenerations += delta.ImageGenerations
+	copied := *usage
+	return &copied, nil
+}
+
+func newTestQuotaService() (*QuotaService, *time.Time) {
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	return &QuotaService{
+		store: &memoryUsageStore{usage: map[string]*types.DailyUsage{}},
+		limits: map[string]types.QuotaLimits{
+			types.QuotaTierAnonymous: {LLMCalls: 2, Tokens: 100, ImageGenerations: 1},
+			types.QuotaTierPrivy:     {LLMCalls: 4, Tokens: 1000, ImageGenerations: 2},
+			types.QuotaTierFarcaster: {LLMCalls: 8, Tokens: 10000, ImageGenerations: 4},
+		},
+		now: func() time.Time { return now },
+	}, &now
+}
+
+func TestQuotaTier(t *testing.T) {
+	tests := []struct {
+		name string
+		user *types.User
+		want string
+	}{
+		{"anonymous", &types.User{}, types.QuotaTierAnonymous},
+		{"privy", &types.User{PrivyDID: "did:privy:abc"}, types.QuotaTierPrivy},
+		{"farcaster", &types.User{FID: 18350}, types.QuotaTierFarcaster},
+		{"privy and farcaster", &types.User{PrivyDID: "did:privy:abc", FID: 18350}, types.QuotaTierFarcaster},
+	}
+	for _, tt := range tests {
+		if got := types.QuotaTier(tt.user); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestReserveLLMCall(t *testing.T) {
+	ctx := context.Background()
+	quotas, now := newTestQuotaService()
+	anonymous := &types.User{ID: uuid.New()}
+	linked := &types.User{ID: uuid.New(), PrivyDID: "did:privy:abc"}
+
+	for i := 0; i < 2; i++ {
+		if err := quotas.ReserveLLMCall(ctx, anonymous); err != nil {
+			t.Fatalf("call %d: unexpected error: %v", i, err)
+		}
+	}
+	var exceeded *QuotaExceededError
+	if err := quotas.ReserveLLMCall(ctx, anonymous); !errors.As(err, &exceeded) {
+		t.Fatalf("expected the quota to be exceeded, got %v", err)
+	}
+	if exceeded.Resource != QuotaResourceLLMCalls || exceeded.Used != 2 || exceeded.Limit != 2 {
+		t.Errorf("unexpected error: %+v", exceeded)
+	}
+	if want := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC); !exceeded.ResetsAt.Equal(want) {
+		t.Errorf("expected the quota to reset at %s, got %s", want, exceeded.ResetsAt)
+	}
+
+	// The refused call isn't counted
+	report, err := quotas.Usage(ctx, anonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Usage.LLMCalls != 2 || report.Tier != types.QuotaTierAnonymous {
+		t.Errorf("expected 2 calls of the anonymous tier, got %+v", report)
+	}
+
+	// A linked user has more
+	for i := 0; i < 4; i++ {
+		if err := quotas.ReserveLLMCall(ctx, linked); err != nil {
+			t.Fatalf("linked call %d: unexpected error: %v", i, err)
+		}
+	}
+
+	// And the next day starts over
+	*now = now.Add(2 * time.Hour)
+	if err := quotas.ReserveLLMCall(ctx, anonymous); err != nil {
+		t.Errorf("expected the quota to reset, got %v", err)
+	}
+}
+
+func TestTokenQuota(t *testing.T) {
+	ctx := context.Background()
+	quotas, _ := newTestQuotaService()
+	user := &types.User{ID: uuid.New()}
+
+	if err := quotas.ReserveLLMCall(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	// The response that crosses the limit was already paid for
+	quotas.RecordTokens(ctx, user.ID, strings.Repeat("a", 200), strings.Repeat("b", 400))
+
+	var exceeded *QuotaExceededError
+	if err := quotas.ReserveLLMCall(ctx, user); !errors.As(err, &exceeded) || exceeded.Resource != QuotaResourceTokens {
+		t.Fatalf("expected the token quota to be exceeded, got %v", err)
+	}
+	if exceeded.Used != 150 {
+		t.Errorf("expected 150 tokens used, got %d", exceeded.Used)
+	}
+}
+
+func TestReserveImageGeneration(t *testing.T) {
+	ctx := context.Background()
+	quotas, _ := newTestQuotaService()
+	user := &types.User{ID: uuid.New(), FID: 18350}
+
+	for i := 0; i < 4; i++ {
+		if err := quotas.ReserveImageGeneration(ctx, user); err != nil {
+			t.Fatalf("image %d: unexpected error: %v", i, err)
+		}
+	}
+	var exceeded *QuotaExceededError
+	if err := quotas.ReserveImageGeneration(ctx, user); !errors.As(err, &exceeded) || exceeded.Resource != QuotaResourceImageGenerations {
+		t.Fatalf("expected the image quota to be exceeded, got %v", err)
+	}
+	if report, _ := quotas.Usage(ctx, user); report.Usage.ImageGenerations != 4 {
+		t.Errorf("expected 4 images, got %d", report.Usage.ImageGenerations)
+	}
+}
+
+func TestMeterStream(t *testing.T) {
+	quotas, _ := newTestQuotaService()
+	userID := uuid.New()
+
+	chunks := make(chan LLMChunk, 2)
+	chunks <- LLMChunk{Content: "12345678"}
+	chunks <- LLMChunk{Content: "1234"}
+	close(chunks)
+
+	response, err := CollectLLMResponse(quotas.MeterStream(context.Background(), userID, "1234", chunks))
+	if err != nil || response != "123456781234" {
+		t.Fatalf("expected the response to be forwarded, got %q and %v", response, err)
+	}
+
+	// The tokens are recorded once the stream is closed
+	deadline := time.Now().Add(time.Second)
+	for {
+		report, _ := quotas.Usage(context.Background(), &types.User{ID: userID})
+		if report.Usage.PromptTokens == 1 && report.Usage.ResponseTokens == 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 prompt token and 3 response tokens, got %+v", report.Usage)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
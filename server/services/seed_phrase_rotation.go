@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// Seed phrase rotation
+//
+// Once a new master key is configured (see types.EncryptString), the seed phrases encrypted with
+// the older ones are re-encrypted in the background, a batch at a time, while the server keeps
+// running. Every seed phrase is swapped only if it didn't change since it was read, so the
+// rotation never overwrites a wallet that was replaced meanwhile, and several servers can run it
+// at the same time. It runs when the server starts and then every
+// KEY_ROTATION_INTERVAL_MINUTES (60 by default, 0 to only run it at start). An older master key
+// can be removed once a run reports that no seed phrase is left on it.
+
+// seedPhraseStore is the part of the storage the rotation needs
+type seedPhraseStore interface {
+	GetSeedPhrasesAfter(ctx context.Context, after uuid.UUID, limit int) ([]*types.EncryptedSeedPhrase, error)
+	ReplaceUserSeedPhrase(ctx context.Context, userID uuid.UUID, old string, replacement string) (bool, error)
+}
+
+// RotationReport counts what a rotation run did
+type RotationReport struct {
+	Checked int
+	Rotated int
+	// Changed by something else while they were re-encrypted, the next run checks them again
+	Skipped int
+	Failed  int
+}
+
+type SeedPhraseRotator struct {
+	store     seedPhraseStore
+	keys      types.KeyProvider
+	batchSize int
+	// pause between two batches, to leave the database to the requests
+	pause    time.Duration
+	interval time.Duration
+}
+
+func NewSeedPhraseRotator(store *storage.PostgresStore) *SeedPhraseRotator {
+	return &SeedPhraseRotator{
+		store:     store,
+		keys:      types.DefaultKeyProvider(),
+		batchSize: envInt("KEY_ROTATION_BATCH_SIZE", 100),
+		pause:     time.Duration(envInt("KEY_ROTATION_BATCH_PAUSE_MS", 200)) * time.Millisecond,
+		interval:  time.Duration(envInt("KEY_ROTATION_INTERVAL_MINUTES", 60)) * time.Minute,
+	}
+}
+
+// Start runs the rotation in the background until ctx is cancelled
+func (r *SeedPhraseRotator) Start(ctx context.Context) {
+	go func() {
+		for {
+			report, err := r.RotateAll(ctx)
+			if err != nil {
+				log.Printf("Error rotating the seed phrases: %v", err)
+			} else if report.Rotated > 0 || report.Skipped > 0 || report.Failed > 0 {
+				log.Printf("Seed phrase rotation: %d checked, %d rotated, %d skipped, %d failed",
+					report.Checked, report.Rotated, report.Skipped, report.Failed)
+			}
+
+			if r.interval <= 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.interval):
+			}
+		}
+	}()
+}
+
+// RotateAll re-encrypts with the current master key every seed phrase that doesn't use it
+func (r *SeedPhraseRotator) RotateAll(ctx context.Context) (*RotationReport, error) {
+	report := &RotationReport{}
+	after := uuid.Nil
+	for {
+		seedPhrases, err := r.store.GetSeedPhrasesAfter(ctx, after, r.batchSize)
+		if err != nil {
+			return report, err
+		}
+
+		for _, seedPhrase := range seedPhrases {
+			report.Checked++
+			after = seedPhrase.UserID
+
+			outcome, err := r.rotate(ctx, seedPhrase)
+			switch {
+			case err != nil:
+				log.Printf("Error rotating the seed phrase of user %s: %v", seedPhrase.UserID, err)
+				report.Failed++
+			case outcome == rotationRotated:
+				report.Rotated++
+			case outcome == rotationSkipped:
+				report.Skipped++
+			}
+		}
+
+		if len(seedPhrases) < r.batchSize {
+			return report, nil
+		}
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-time.After(r.pause):
+		}
+	}
+}
+
+// What happened to a seed phrase
+const (
+	rotationUnchanged = iota
+	rotationRotated
+	rotationSkipped
+)
+
+func (r *SeedPhraseRotator) rotate(ctx context.Context, seedPhrase *types.EncryptedSeedPhrase) (int, error) {
+	reencrypted, changed, err := types.ReencryptString(r.keys, seedPhrase.SeedPhrase)
+	if err != nil {
+		return rotationUnchanged, err
+	}
+	if !changed {
+		return rotationUnchanged, nil
+	}
+
+	replaced, err := r.store.ReplaceUserSeedPhrase(ctx, seedPhrase.UserID, seedPhrase.SeedPhrase, reencrypted)
+	if err != nil {
+		return rotationUnchanged, fmt.Errorf("error saving the seed phrase: %v", err)
+	}
+	if !replaced {
+		return rotationSkipped, nil
+	}
+	return rotationRotated, nil
+}
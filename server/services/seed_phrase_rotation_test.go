@@ -0,0 +1,116 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// memorySeedPhraseStore keeps the seed phrases of the tests in memory
+type memorySeedPhraseStore struct {
+	seedPhrases map[uuid.UUID]string
+	// called before a seed phrase is replaced, to change it concurrently
+	beforeReplace func(userID uuid.UUID)
+}
+
+func (m *memorySeedPhraseStore) GetSeedPhrasesAfter(ctx context.Context, after uuid.UUID, limit int) ([]*types.EncryptedSeedPhrase, error) {
+	var ids []uuid.UUID
+	for id := range m.seedPhrases {
+		if strings.Compare(id.String(), after.String()) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	seedPhrases := make([]*types.EncryptedSeedPhrase, 0, len(ids))
+	for _, id := range ids {
+		seedPhrases = append(seedPhrases, &types.EncryptedSeedPhrase{UserID: id, SeedPhrase: m.seedPhrases[id]})
+	}
+	return seedPhrases, nil
+}
+
+func (m *memorySeedPhraseStore) ReplaceUserSeedPhrase(ctx context.Context, userID uuid.UUID, old string, replacement string) (bool, error) {
+	if m.beforeReplace != nil {
+		m.beforeReplace(userID)
+	}
+	if m.seedPhrases[userID] != old {
+		return false, nil
+	}
+	m.seedPhrases[userID] = replacement
+	return true, nil
+}
+
+func TestRotateAll(t *testing.T) {
+	ctx := context.Background()
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	}
+	t.Setenv("ENCRYPTION_KEY", "")
+	t.Setenv("ENCRYPTION_KEYS", "1:"+key(1))
+	keys := types.EnvKeyProvider{}
+
+	store := &memorySeedPhraseStore{seedPhrases: map[uuid.UUID]string{}}
+	for i := 0; i < 5; i++ {
+		encrypted, err := types.EncryptStringWith(keys, "seed "+uuid.NewString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.seedPhrases[uuid.New()] = encrypted
+	}
+	corrupted := uuid.New()
+	store.seedPhrases[corrupted] = "v1:bm90IGEgdmFsaWQgZW52ZWxvcGU="
+
+	plaintexts := map[uuid.UUID]string{}
+	for id, encrypted := range store.seedPhrases {
+		plaintexts[id], _ = types.DecryptStringWith(keys, encrypted)
+	}
+
+	// Key 2 is added, one seed phrase is replaced while the rotation runs
+	t.Setenv("ENCRYPTION_KEYS", "1:"+key(1)+",2:"+key(2))
+	var replaced uuid.UUID
+	store.beforeReplace = func(userID uuid.UUID) {
+		if replaced == uuid.Nil {
+			replaced = userID
+			store.seedPhrases[userID] = "replaced"
+		}
+	}
+
+	rotator := &SeedPhraseRotator{store: store, keys: keys, batchSize: 2}
+	report, err := rotator.RotateAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != (RotationReport{Checked: 6, Rotated: 4, Skipped: 1, Failed: 1}) {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	for id, encrypted := range store.seedPhrases {
+		if id == corrupted || id == replaced {
+			continue
+		}
+		if !strings.HasPrefix(encrypted, "v2:") {
+			t.Errorf("expected the seed phrase of %s on key 2, got %s", id, encrypted)
+		}
+		if decrypted, err := types.DecryptStringWith(keys, encrypted); err != nil || decrypted != plaintexts[id] {
+			t.Errorf("expected the seed phrase of %s to be kept, got %q and %v", id, decrypted, err)
+		}
+	}
+	if store.seedPhrases[replaced] != "replaced" {
+		t.Error("expected the concurrent change to be kept")
+	}
+
+	// Nothing left on key 1 for a second run
+	store.beforeReplace = nil
+	if report, _ := rotator.RotateAll(ctx); report.Rotated != 0 || report.Checked != 6 {
+		t.Errorf("expected nothing to rotate, got %+v", report)
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ankylat/anky/server/storage"
+	"github.com/ankylat/anky/server/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// Wallet export and import
+//
+// The mnemonic of a custodial wallet is only shown by an export: the user proves again who they
+// are (see AuthService.Reauthenticate), the export goes to the wallet audit log before the
+// mnemonic is returned, and the next export waits for WALLET_EXPORT_COOLDOWN_HOURS (24 by
+// default). Users can also bring their own mnemonic, whose first account replaces the custodial
+// wallet. A custodial wallet whose mnemonic was never exported is only replaced when the user
+// says to discard it, nobody could reach its funds afterwards.
+
+var (
+	ErrNoCustodialWallet = errors.New("the user has no custodial wallet")
+	ErrInvalidMnemonic   = errors.New("invalid mnemonic")
+	ErrWalletNotExported = errors.New("the mnemonic of the current wallet was never exported, export it first or set discard_current_wallet")
+	ErrWalletChanged     = errors.New("the wallet changed in the meantime, try again")
+)
+
+// WalletExportCooldownError is returned for an export too soon after the previous one
+type WalletExportCooldownError struct {
+	RetryAt time.Time
+}
+
+func (e *WalletExportCooldownError) Error() string {
+	return fmt.Sprintf("the mnemonic was exported recently, it can be exported again at %s", e.RetryAt.Format(time.RFC3339))
+}
+
+// WalletExport is what an export shows the user
+type WalletExport struct {
+	Mnemonic       string `json:"mnemonic"`
+	WalletAddress  string `json:"wallet_address"`
+	DerivationPath string `json:"derivation_path"`
+	// The address comes from the legacy derivation, other wallets won't show it for this
+	// mnemonic until it is migrated (see WalletMigrator)
+	LegacyDerivation bool `json:"legacy_derivation,omitempty"`
+}
+
+// WalletRequestOrigin is where a wallet request came from, for the audit log
+type WalletRequestOrigin struct {
+	SessionID *uuid.UUID
+	IPAddress string
+	UserAgent string
+}
+
+// walletCustodyStore is the part of the storage the exports and imports need
+type walletCustodyStore interface {
+	ReplaceUserWallet(ctx context.Context, userID uuid.UUID, oldSeedPhrase string, seedPhrase string, walletAddress string) (bool, error)
+	CreateWalletAuditEvent(ctx context.Context, event *types.WalletAuditEvent) error
+	GetLastWalletAuditEvent(ctx context.Context, userID uuid.UUID, action string) (*types.WalletAuditEvent, error)
+	RecordWalletExport(ctx context.Context, event *types.WalletAuditEvent, since time.Time) (*types.WalletAuditEvent, error)
+}
+
+type WalletCustodyService struct {
+	store          walletCustodyStore
+	exportCooldown time.Duration
+	now            func() time.Time
+}
+
+func NewWalletCustodyService(store *storage.PostgresStore) *WalletCustodyService {
+	return &WalletCustodyService{
+		store:          store,
+		exportCooldown: time.Duration(envInt("WALLET_EXPORT_COOLDOWN_HOURS", 24)) * time.Hour,
+		now:            time.Now,
+	}
+}
+
+// Export decrypts the mnemonic of the user's custodial wallet, once the export is in the audit log
+func (s *WalletCustodyService) Export(ctx context.Context, user *types.User, origin WalletRequestOrigin) (*WalletExport, error) {
+	if user.SeedPhrase == "" {
+		return nil, ErrNoCustodialWallet
+	}
+
+	mnemonic, err := types.DecryptString(user.SeedPhrase)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting the seed phrase: %v", err)
+	}
+	key, err := types.DeriveAccountKey(mnemonic, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is shown without a trace of it, and the cooldown is checked with the same write so
+	// that concurrent exports can't all get past it
+	last, err := s.store.RecordWalletExport(ctx, s.auditEvent(user, types.WalletAuditExport, origin), s.now().Add(-s.exportCooldown))
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		return nil, &WalletExportCooldownError{RetryAt: last.CreatedAt.Add(s.exportCooldown)}
+	}
+	return &WalletExport{
+		Mnemonic:         mnemonic,
+		WalletAddress:    user.WalletAddress,
+		DerivationPath:   types.DerivationPath(0),
+		LegacyDerivation: !strings.EqualFold(crypto.PubkeyToAddress(key.PublicKey).Hex(), user.WalletAddress),
+	}, nil
+}
+
+// Import replaces the user's custodial wallet with the first account of their mnemonic, and
+// returns its address
+func (s *WalletCustodyService) Import(ctx context.Context, user *types.User, mnemonic string, discardCurrent bool, origin WalletRequestOrigin) (string, error) {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	key, err := types.DeriveAccountKey(mnemonic, 0)
+	if err != nil {
+		return "", ErrInvalidMnemonic
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey).Hex()
+
+	if user.SeedPhrase != "" && !discardCurrent {
+		last, err := s.store.GetLastWalletAuditEvent(ctx, user.ID, types.WalletAuditExport)
+		if err != nil {
+			return "", err
+		}
+		if last == nil || !strings.EqualFold(last.WalletAddress, user.WalletAddress) {
+			return "", ErrWalletNotExported
+		}
+	}
+
+	encrypted, err := types.EncryptString(mnemonic)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting the seed phrase: %v", err)
+	}
+	replaced, err := s.store.ReplaceUserWallet(ctx, user.ID, user.SeedPhrase, encrypted, address)
+	if err != nil {
+		return "", err
+	}
+	if !replaced {
+		return "", ErrWalletChanged
+	}
+
+	event := s.auditEvent(user, types.WalletAuditImport, origin)
+	event.WalletAddress, event.PreviousWalletAddress = address, user.WalletAddress
+	if err := s.store.CreateWalletAuditEvent(ctx, event); err != nil {
+		log.Printf("Error recording the wallet import of user %s: %v", user.ID, err)
+	}
+	return address, nil
+}
+
+// RecordReauthFailure writes a failed re-authentication to the audit log
+func (s *WalletCustodyService) RecordReauthFailure(ctx context.Context, user *types.User, origin WalletRequestOrigin) {
+	if err := s.store.CreateWalletAuditEvent(ctx, s.auditEvent(user, types.WalletAuditReauthFailed, origin)); err != nil {
+		log.Printf("Error recording the failed re-authentication of user %s: %v", user.ID, err)
+	}
+}
+
+func (s *WalletCustodyService) auditEvent(user *types.User, action string, origin WalletRequestOrigin) *types.WalletAuditEvent {
+	return &types.WalletAuditEvent{
+		ID:            uuid.New(),
+		UserID:        user.ID,
+		Action:        action,
+		WalletAddress: user.WalletAddress,
+		SessionID:     origin.SessionID,
+		IPAddress:     origin.IPAddress,
+		UserAgent:     origin.UserAgent,
+		CreatedAt:     s.now().UTC(),
+	}
+}
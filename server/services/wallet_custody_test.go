@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// memoryWalletCustodyStore keeps the users' wallets and the audit log of the tests in memory
+type memoryWalletCustodyStore struct {
+	mu     sync.Mutex
+	users  map[uuid.UUID]*types.User
+	events []*types.WalletAuditEvent
+}
+
+func (m *memoryWalletCustodyStore) ReplaceUserWallet(ctx context.Context, userID uuid.UUID, oldSeedPhrase string, seedPhrase string, walletAddress string) (bool, error) {
+	user := m.users[userID]
+	if user.SeedPhrase != oldSeedPhrase {
+		return false, nil
+	}
+	user.SeedPhrase, user.WalletAddress = seedPhrase, walletAddress
+	return true, nil
+}
+
+func (m *memoryWalletCustodyStore) CreateWalletAuditEvent(ctx context.Context, event *types.WalletAuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryWalletCustodyStore) RecordWalletExport(ctx context.Context, event *types.WalletAuditEvent, since time.Time) (*types.WalletAuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.events) - 1; i >= 0; i-- {
+		last := m.events[i]
+		if last.UserID == event.UserID && last.Action == types.WalletAuditExport && last.CreatedAt.After(since) {
+			return last, nil
+		}
+	}
+	m.events = append(m.events, event)
+	return nil, nil
+}
+
+func (m *memoryWalletCustodyStore) GetLastWalletAuditEvent(ctx context.Context, userID uuid.UUID, action string) (*types.WalletAuditEvent, error) {
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if m.events[i].UserID == userID && m.events[i].Action == action {
+			return m.events[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func newTestWalletCustody(t *testing.T) (*WalletCustodyService, *memoryWalletCustodyStore, *types.User, *time.Time) {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", "")
+	t.Setenv("ENCRYPTION_KEYS", "1:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+
+	mnemonic, address, err := types.NewWalletService().CreateNewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := types.EncryptString(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &types.User{ID: uuid.New(), SeedPhrase: encrypted, WalletAddress: address}
+
+	stored := *user
+	store := &memoryWalletCustodyStore{users: map[uuid.UUID]*types.User{user.ID: &stored}}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &WalletCustodyService{store: store, exportCooldown: 24 * time.Hour, now: func() time.Time { return now }}, store, user, &now
+}
+
+func TestExportWallet(t *testing.T) {
+	ctx := context.Background()
+	wallets, store, user, now := newTestWalletCustody(t)
+	sessionID := uuid.New()
+	origin := WalletRequestOrigin{SessionID: &sessionID, IPAddress: "10.0.0.1", UserAgent: "test"}
+
+	export, err := wallets.Export(ctx, user, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.Fields(export.Mnemonic)) != 12 || export.WalletAddress != user.WalletAddress || export.LegacyDerivation {
+		t.Errorf("unexpected export: %+v", export)
+	}
+	if len(store.events) != 1 || store.events[0].Action != types.WalletAuditExport || *store.events[0].SessionID != sessionID {
+		t.Fatalf("expected the export to be audited, got %+v", store.events)
+	}
+
+	// Once per cooldown
+	*now = now.Add(time.Hour)
+	var cooldown *WalletExportCooldownError
+	if _, err := wallets.Export(ctx, user, origin); !errors.As(err, &cooldown) {
+		t.Fatalf("expected the cooldown, got %v", err)
+	}
+	if want := store.events[0].CreatedAt.Add(24 * time.Hour); !cooldown.RetryAt.Equal(want) {
+		t.Errorf("expected the next export at %s, got %s", want, cooldown.RetryAt)
+	}
+	if len(store.events) != 1 {
+		t.Errorf("expected the refused export not to be audited, got %d events", len(store.events))
+	}
+
+	*now = now.Add(24 * time.Hour)
+	if _, err := wallets.Export(ctx, user, origin); err != nil {
+		t.Errorf("expected the export after the cooldown, got %v", err)
+	}
+
+	if _, err := wallets.Export(ctx, &types.User{ID: uuid.New()}, origin); !errors.Is(err, ErrNoCustodialWallet) {
+		t.Errorf("expected ErrNoCustodialWallet, got %v", err)
+	}
+}
+
+func TestExportWalletConcurrently(t *testing.T) {
+	wallets, store, user, _ := newTestWalletCustody(t)
+
+	const exports = 8
+	errs := make(chan error, exports)
+	var wg sync.WaitGroup
+	for i := 0; i < exports; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := wallets.Export(context.Background(), user, WalletRequestOrigin{IPAddress: "10.0.0.1"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	exported := 0
+	for err := range errs {
+		var cooldown *WalletExportCooldownError
+		switch {
+		case err == nil:
+			exported++
+		case !errors.As(err, &cooldown):
+			t.Errorf("expected the cooldown, got %v", err)
+		}
+	}
+	if exported != 1 || len(store.events) != 1 {
+		t.Errorf("expected a single export within the cooldown, got %d exports and %d events", exported, len(store.events))
+	}
+}
+
+func TestImportWallet(t *testing.T) {
+	ctx := context.Background()
+	wallets, store, user, _ := newTestWalletCustody(t)
+	previous := user.WalletAddress
+	mnemonic := " Test test test test test test test test test test test JUNK "
+
+	if _, err := wallets.Import(ctx, user, "test test test", false, WalletRequestOrigin{}); !errors.Is(err, ErrInvalidMnemonic) {
+		t.Errorf("expected ErrInvalidMnemonic, got %v", err)
+	}
+	// The custodial mnemonic would be lost
+	if _, err := wallets.Import(ctx, user, mnemonic, false, WalletRequestOrigin{}); !errors.Is(err, ErrWalletNotExported) {
+		t.Fatalf("expected ErrWalletNotExported, got %v", err)
+	}
+
+	if _, err := wallets.Export(ctx, user, WalletRequestOrigin{}); err != nil {
+		t.Fatal(err)
+	}
+	address, err := wallets.Import(ctx, user, mnemonic, false, WalletRequestOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266" || store.users[user.ID].WalletAddress != address {
+		t.Errorf("expected the first account of the mnemonic, got %s", address)
+	}
+	decrypted, _ := types.DecryptString(store.users[user.ID].SeedPhrase)
+	if decrypted != "test test test test test test test test test test test junk" {
+		t.Errorf("expected the normalized mnemonic to be stored, got %q", decrypted)
+	}
+	last := store.events[len(store.events)-1]
+	if last.Action != types.WalletAuditImport || last.WalletAddress != address || last.PreviousWalletAddress != previous {
+		t.Errorf("expected the import to be audited, got %+v", last)
+	}
+
+	// The user we read is stale now
+	if _, err := wallets.Import(ctx, user, mnemonic, true, WalletRequestOrigin{}); !errors.Is(err, ErrWalletChanged) {
+		t.Errorf("expected ErrWalletChanged, got %v", err)
+	}
+}
+
+func TestImportWalletDiscardingCurrent(t *testing.T) {
+	wallets, store, user, _ := newTestWalletCustody(t)
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+	address, err := wallets.Import(context.Background(), user, mnemonic, true, WalletRequestOrigin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address != "0x9858EfFD232B4033E47d90003D41EC34EcaEda94" || store.users[user.ID].WalletAddress != address {
+		t.Errorf("expected the wallet to be replaced, got %s", address)
+	}
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// Wallet migration
+//
+// The first custodial wallets got a non-standard address (see types.LegacyPrivateKeyFromMnemonic),
+// which the users can't find when they import their mnemonic in another wallet. The migration
+// finds them, records both of their addresses, and checks what is left at the legacy one:
+// users with funds there are flagged to have them moved first, the others are switched to the
+// standard address. It only records what it finds unless it is told to apply the switch.
+
+// ErrUnknownWalletAddress is returned for a wallet address derived neither way from the mnemonic
+var ErrUnknownWalletAddress = errors.New("the wallet address doesn't come from the mnemonic")
+
+// BalanceChecker reads balances on chain
+type BalanceChecker interface {
+	Balance(ctx context.Context, address string) (*big.Int, error)
+	TokenBalance(ctx context.Context, token string, address string) (*big.Int, error)
+}
+
+// walletMigrationStore is the part of the storage the migration needs
+type walletMigrationStore interface {
+	SaveWalletMigration(ctx context.Context, migration *types.WalletMigration) error
+	UpdateUserWalletAddress(ctx context.Context, userID uuid.UUID, walletAddress string) error
+}
+
+type WalletMigrator struct {
+	store    walletMigrationStore
+	balances BalanceChecker
+	// ERC-20 contracts whose balances count as funds
+	tokens []string
+	// Without apply, the migrations are only recorded as pending
+	apply bool
+}
+
+func NewWalletMigrator(store walletMigrationStore, balances BalanceChecker, tokens []string, apply bool) *WalletMigrator {
+	return &WalletMigrator{store: store, balances: balances, tokens: tokens, apply: apply}
+}
+
+// MigrateUser checks the wallet of a user. It returns nil for wallets that already have their
+// standard address.
+func (m *WalletMigrator) MigrateUser(ctx context.Context, user *types.User) (*types.WalletMigration, error) {
+	if user.SeedPhrase == "" {
+		return nil, nil
+	}
+	mnemonic, err := types.DecryptString(user.SeedPhrase)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting the seed phrase: %v", err)
+	}
+
+	standardKey, err := types.DeriveAccountKey(mnemonic, 0)
+	if err != nil {
+		return nil, err
+	}
+	standard := crypto.PubkeyToAddress(standardKey.PublicKey).Hex()
+	if strings.EqualFold(user.WalletAddress, standard) {
+		return nil, nil
+	}
+
+	legacyKey, err := types.LegacyPrivateKeyFromMnemonic(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+	legacy := crypto.PubkeyToAddress(legacyKey.PublicKey).Hex()
+	if !strings.EqualFold(user.WalletAddress, legacy) {
+		return nil, ErrUnknownWalletAddress
+	}
+
+	migration := &types.WalletMigration{
+		UserID:          user.ID,
+		LegacyAddress:   legacy,
+		StandardAddress: standard,
+		TokenBalances:   map[string]string{},
+		Status:          types.WalletMigrationPending,
+		CheckedAt:       time.Now().UTC(),
+	}
+
+	if migration.LegacyBalance, err = m.balances.Balance(ctx, legacy); err != nil {
+		return nil, fmt.Errorf("error reading the balance of %s: %v", legacy, err)
+	}
+	funded := migration.LegacyBalance.Sign() > 0
+	for _, token := range m.tokens {
+		balance, err := m.balances.TokenBalance(ctx, token, legacy)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the %s balance of %s: %v", token, legacy, err)
+		}
+		if balance.Sign() > 0 {
+			migration.TokenBalances[token] = balance.String()
+			funded = true
+		}
+	}
+
+	switch {
+	case funded:
+		migration.Status = types.WalletMigrationNeedsSweep
+	case m.apply:
+		if err := m.store.UpdateUserWalletAddress(ctx, user.ID, standard); err != nil {
+			return nil, err
+		}
+		migratedAt := time.Now().UTC()
+		migration.Status = types.WalletMigrationMigrated
+		migration.MigratedAt = &migratedAt
+	}
+
+	if err := m.store.SaveWalletMigration(ctx, migration); err != nil {
+		return nil, err
+	}
+	return migration, nil
+}
+
+// ******************** JSON-RPC ********************
+
+// RPCBalanceChecker reads the balances from an Ethereum JSON-RPC node
+type RPCBalanceChecker struct {
+	url    string
+	client *http.Client
+}
+
+func NewRPCBalanceChecker(url string) *RPCBalanceChecker {
+	return &RPCBalanceChecker{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *RPCBalanceChecker) Balance(ctx context.Context, address string) (*big.Int, error) {
+	var result string
+	if err := c.call(ctx, "eth_getBalance", []interface{}{address, "latest"}, &result); err != nil {
+		return nil, err
+	}
+	return parseHexQuantity(result)
+}
+
+// balanceOfSelector is the selector of the ERC-20 balanceOf(address)
+var balanceOfSelector = crypto.Keccak256([]byte("balanceOf(address)"))[:4]
+
+func (c *RPCBalanceChecker) TokenBalance(ctx context.Context, token string, address string) (*big.Int, error) {
+	owner, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	if err != nil || len(owner) != 20 {
+		return nil, fmt.Errorf("invalid address %s", address)
+	}
+	data := append(append([]byte{}, balanceOfSelector...), make([]byte, 12)...)
+	data = append(data, owner...)
+
+	call := map[string]string{"to": token, "data": "0x" + hex.EncodeToString(data)}
+	var result string
+	if err := c.call(ctx, "eth_call", []interface{}{call, "latest"}, &result); err != nil {
+		return nil, err
+	}
+	return parseHexQuantity(result)
+}
+
+func (c *RPCBalanceChecker) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		return fmt.Errorf("error marshaling request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(respBody))
+	}
+
+	var rpcResponse struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResponse); err != nil {
+		return fmt.Errorf("error decoding %s response: %v", method, err)
+	}
+	if rpcResponse.Error != nil {
+		return fmt.Errorf("%s failed: %s", method, rpcResponse.Error.Message)
+	}
+	return json.Unmarshal(rpcResponse.Result, result)
+}
+
+func parseHexQuantity(value string) (*big.Int, error) {
+	digits := strings.TrimPrefix(value, "0x")
+	if digits == "" {
+		return new(big.Int), nil
+	}
+	quantity, ok := new(big.Int).SetString(digits, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid quantity %q", value)
+	}
+	return quantity, nil
+}
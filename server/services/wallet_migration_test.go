@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+const testMnemonic = "test test test test test test test test test test test junk"
+
+// memoryWalletMigrationStore keeps the migrations of the tests in memory
+type memoryWalletMigrationStore struct {
+	migrations map[uuid.UUID]*types.WalletMigration
+	addresses  map[uuid.UUID]string
+}
+
+func (m *memoryWalletMigrationStore) SaveWalletMigration(ctx context.Context, migration *types.WalletMigration) error {
+	m.migrations[migration.UserID] = migration
+	return nil
+}
+
+func (m *memoryWalletMigrationStore) UpdateUserWalletAddress(ctx context.Context, userID uuid.UUID, walletAddress string) error {
+	m.addresses[userID] = walletAddress
+	return nil
+}
+
+// fixedBalances answers the balances it was given, zero for everything else
+type fixedBalances map[string]*big.Int
+
+func (b fixedBalances) Balance(ctx context.Context, address string) (*big.Int, error) {
+	return b.TokenBalance(ctx, "", address)
+}
+
+func (b fixedBalances) TokenBalance(ctx context.Context, token string, address string) (*big.Int, error) {
+	if balance, ok := b[token+address]; ok {
+		return balance, nil
+	}
+	return new(big.Int), nil
+}
+
+func testWalletUser(t *testing.T, legacy bool) (*types.User, string, string) {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+
+	encrypted, err := types.EncryptString(testMnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standardKey, _ := types.DeriveAccountKey(testMnemonic, 0)
+	legacyKey, _ := types.LegacyPrivateKeyFromMnemonic(testMnemonic)
+	standard := crypto.PubkeyToAddress(standardKey.PublicKey).Hex()
+	legacyAddress := crypto.PubkeyToAddress(legacyKey.PublicKey).Hex()
+
+	user := &types.User{ID: uuid.New(), SeedPhrase: encrypted, WalletAddress: standard}
+	if legacy {
+		user.WalletAddress = legacyAddress
+	}
+	return user, legacyAddress, standard
+}
+
+func newTestWalletMigrator(balances fixedBalances, apply bool) (*WalletMigrator, *memoryWalletMigrationStore) {
+	store := &memoryWalletMigrationStore{
+		migrations: map[uuid.UUID]*types.WalletMigration{},
+		addresses:  map[uuid.UUID]string{},
+	}
+	return NewWalletMigrator(store, balances, []string{"0xtoken"}, apply), store
+}
+
+func TestMigrateLegacyWallet(t *testing.T) {
+	ctx := context.Background()
+	user, legacy, standard := testWalletUser(t, true)
+
+	// A dry run only records what it found
+	migrator, store := newTestWalletMigrator(fixedBalances{}, false)
+	migration, err := migrator.MigrateUser(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Status != types.WalletMigrationPending || migration.LegacyAddress != legacy || migration.StandardAddress != standard {
+		t.Errorf("unexpected migration: %+v", migration)
+	}
+	if _, ok := store.addresses[user.ID]; ok {
+		t.Error("expected the dry run to keep the wallet address")
+	}
+	if store.migrations[user.ID] == nil {
+		t.Error("expected the migration to be recorded")
+	}
+
+	// Applied, the user gets the standard address
+	migrator, store = newTestWalletMigrator(fixedBalances{}, true)
+	migration, err = migrator.MigrateUser(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Status != types.WalletMigrationMigrated || migration.MigratedAt == nil {
+		t.Errorf("expected the wallet to be migrated, got %+v", migration)
+	}
+	if store.addresses[user.ID] != standard {
+		t.Errorf("expected the wallet address to be %s, got %s", standard, store.addresses[user.ID])
+	}
+}
+
+func TestMigrateFundedLegacyWallet(t *testing.T) {
+	ctx := context.Background()
+	user, legacy, _ := testWalletUser(t, true)
+
+	migrator, store := newTestWalletMigrator(fixedBalances{"0xtoken" + legacy: big.NewInt(42)}, true)
+	migration, err := migrator.MigrateUser(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Status != types.WalletMigrationNeedsSweep || migration.TokenBalances["0xtoken"] != "42" {
+		t.Errorf("expected the wallet to need a sweep, got %+v", migration)
+	}
+	if _, ok := store.addresses[user.ID]; ok {
+		t.Error("expected the funded wallet to keep its address")
+	}
+}
+
+func TestMigrateOtherWallets(t *testing.T) {
+	ctx := context.Background()
+	user, _, _ := testWalletUser(t, false)
+	migrator, store := newTestWalletMigrator(fixedBalances{}, true)
+
+	if migration, err := migrator.MigrateUser(ctx, user); migration != nil || err != nil {
+		t.Errorf("expected a standard wallet to be left alone, got %+v and %v", migration, err)
+	}
+
+	user.WalletAddress = "0x0000000000000000000000000000000000000001"
+	if _, err := migrator.MigrateUser(ctx, user); !errors.Is(err, ErrUnknownWalletAddress) {
+		t.Errorf("expected ErrUnknownWalletAddress, got %v", err)
+	}
+	if len(store.migrations) != 0 {
+		t.Errorf("expected nothing recorded, got %d migrations", len(store.migrations))
+	}
+}
+
+func TestRPCBalanceChecker(t *testing.T) {
+	var requests []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(body))
+		if strings.Contains(string(body), "eth_call") {
+			fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":"0x000000000000000000000000000000000000000000000000000000000000002a"}`)
+			return
+		}
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":"0xde0b6b3a7640000"}`)
+	}))
+	defer node.Close()
+
+	checker := NewRPCBalanceChecker(node.URL)
+	address := "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+
+	balance, err := checker.Balance(context.Background(), address)
+	if err != nil || balance.String() != "1000000000000000000" {
+		t.Errorf("expected 1 ether, got %v and %v", balance, err)
+	}
+
+	balance, err = checker.TokenBalance(context.Background(), "0xtoken", address)
+	if err != nil || balance.Int64() != 42 {
+		t.Errorf("expected 42, got %v and %v", balance, err)
+	}
+	// balanceOf(address) with the padded owner
+	if want := "0x70a08231000000000000000000000000f39fd6e51aad88f6f4ce6ab8827279cfffb92266"; !strings.Contains(requests[1], want) {
+		t.Errorf("expected the call data %s in %s", want, requests[1])
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+	"github.com/google/uuid"
+)
+
+// ErrRawSessionNotFound is returned when there is no raw file stored for a writing session
+var ErrRawSessionNotFound = errors.New("raw writing session not found")
+
+// WritingSessionService keeps the raw keystroke files of the writing sessions on disk
+// and turns them into the values we store on the writing_sessions rows.
+type WritingSessionService struct {
+	dataDir string
+}
+
+func NewWritingSessionService() *WritingSessionService {
+	dataDir := os.Getenv("WRITING_SESSIONS_DIR")
+	if dataDir == "" {
+		dataDir = "data/writing_sessions"
+	}
+	return &WritingSessionService{dataDir: dataDir}
+}
+
+func (s *WritingSessionService) userDir(userID uuid.UUID) string {
+	return filepath.Join(s.dataDir, userID.String())
+}
+
+func (s *WritingSessionService) sessionFilePath(userID, sessionID uuid.UUID) string {
+	return filepath.Join(s.userDir(userID), sessionID.String()+".txt")
+}
+
+// SaveRawSession parses the raw writing string and stores it as the session's raw file,
+// registering the session in the user's all_writing_sessions.txt index.
+func (s *WritingSessionService) SaveRawSession(raw string) (*types.RawWritingSession, error) {
+	rawSession, err := types.ParseRawWritingSession(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	userDir := s.userDir(rawSession.UserID)
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory structure: %v", err)
+	}
+
+	sessionFilePath := s.sessionFilePath(rawSession.UserID, rawSession.SessionID)
+	_, statErr := os.Stat(sessionFilePath)
+	isNewSession := os.IsNotExist(statErr)
+
+	if err := os.WriteFile(sessionFilePath, []byte(raw), 0644); err != nil {
+		return nil, fmt.Errorf("error writing session file: %v", err)
+	}
+
+	if isNewSession {
+		if err := s.appendToSessionIndex(rawSession.UserID, rawSession.SessionID); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Stored raw writing session %s for user %s (%d keystrokes)", rawSession.SessionID, rawSession.UserID, len(rawSession.Keystrokes))
+	return rawSession, nil
+}
+
+func (s *WritingSessionService) appendToSessionIndex(userID, sessionID uuid.UUID) error {
+	allSessionsPath := filepath.Join(s.userDir(userID), "all_writing_sessions.txt")
+	f, err := os.OpenFile(allSessionsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening all_writing_sessions.txt: %v", err)
+	}
+	defer f.Close()
+
+	// Add newline before new session ID if file is not empty
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %v", err)
+	}
+	if fileInfo.Size() > 0 {
+		if _, err := f.WriteString("\n"); err != nil {
+			return fmt.Errorf("error writing newline: %v", err)
+		}
+	}
+
+	if _, err := f.WriteString(sessionID.String()); err != nil {
+		return fmt.Errorf("error writing session ID: %v", err)
+	}
+	return nil
+}
+
+// LoadRawSession reads and parses the raw file of a writing session
+func (s *WritingSessionService) LoadRawSession(userID, sessionID uuid.UUID) (*types.RawWritingSession, error) {
+	raw, err := s.RawSessionFile(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return types.ParseRawWritingSession(string(raw))
+}
+
+// RawSessionFile returns the raw file of a writing session as it is stored
+func (s *WritingSessionService) RawSessionFile(userID, sessionID uuid.UUID) ([]byte, error) {
+	raw, err := os.ReadFile(s.sessionFilePath(userID, sessionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrRawSessionNotFound
+		}
+		return nil, fmt.Errorf("error reading session file: %v", err)
+	}
+	return raw, nil
+}
+
+// StartRawSession creates the raw file of a live session with just its header. If the file
+// already exists (the client reconnected, or the server restarted mid-session) the keystrokes
+// stored so far are loaded and returned instead.
+func (s *WritingSessionService) StartRawSession(rawSession *types.RawWritingSession) (*types.RawWritingSession, error) {
+	if err := rawSession.ValidateHeader(); err != nil {
+		return nil, fmt.Errorf("invalid writing session: %v", err)
+	}
+
+	existing, err := s.LoadRawSession(rawSession.UserID, rawSession.SessionID)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, ErrRawSessionNotFound) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(s.userDir(rawSession.UserID), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory structure: %v", err)
+	}
+	if err := os.WriteFile(s.sessionFilePath(rawSession.UserID, rawSession.SessionID), []byte(rawSession.HeaderString()), 0644); err != nil {
+		return nil, fmt.Errorf("error writing session file: %v", err)
+	}
+	if err := s.appendToSessionIndex(rawSession.UserID, rawSession.SessionID); err != nil {
+		return nil, err
+	}
+	return rawSession, nil
+}
+
+// AppendKeystrokes adds keystrokes at the end of the raw file of a session
+func (s *WritingSessionService) AppendKeystrokes(userID, sessionID uuid.UUID, keystrokes []types.Keystroke) error {
+	// A keystroke that can't be parsed back would make the whole file unreadable
+	for i, keystroke := range keystrokes {
+		if err := keystroke.Validate(); err != nil {
+			return fmt.Errorf("invalid keystroke %d: %v", i, err)
+		}
+	}
+
+	f, err := os.OpenFile(s.sessionFilePath(userID, sessionID), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrRawSessionNotFound
+		}
+		return fmt.Errorf("error opening session file: %v", err)
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	for _, keystroke := range keystrokes {
+		b.WriteString("\n")
+		b.WriteString(keystroke.Line())
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("error appending keystrokes: %v", err)
+	}
+	return nil
+}
+
+// FindRawSession looks up the raw file of a writing session without knowing its user
+func (s *WritingSessionService) FindRawSession(sessionID uuid.UUID) (*types.RawWritingSession, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dataDir, "*", sessionID.String()+".txt"))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up session file: %v", err)
+	}
+	if len(matches) == 0 {
+		return nil, ErrRawSessionNotFound
+	}
+
+	raw, err := os.ReadFile(matches[0])
+	if err != nil {
+		return nil, fmt.Errorf("error reading session file: %v", err)
+	}
+	return types.ParseRawWritingSession(string(raw))
+}
+
+// ApplyRawSession overwrites the client-reported values of the writing session with the
+// ones computed from its keystrokes. Whatever was typed after the first 8-second pause is
+// dropped, and IsAnky, TimeSpent and Status are derived from the resulting verdict.
+func (s *WritingSessionService) ApplyRawSession(writingSession *types.WritingSession, rawSession *types.RawWritingSession) *types.AnkyVerdict {
+	effective := rawSession.Effective()
+	verdict := rawSession.Verdict()
+
+	writingSession.Writing = effective.Text()
+	writingSession.WordsWritten = effective.WordCount()
+	writingSession.Language = DetectLanguage(writingSession.Writing).Code
+	writingSession.ApplyVerdict(verdict)
+
+	return verdict
+}
+
+// ApplyLiveSession is ApplyRawSession for a session whose keystrokes were streamed live.
+// The delays come from the client, so the session can't have lasted longer than the time
+// the server saw go by while receiving them.
+func (s *WritingSessionService) ApplyLiveSession(writingSession *types.WritingSession, rawSession *types.RawWritingSession, observed time.Duration) *types.AnkyVerdict {
+	verdict := s.ApplyRawSession(writingSession, rawSession)
+	if maxMs := observed.Milliseconds(); verdict.TotalMs > maxMs {
+		log.Printf("Session %s reported %d ms of writing but only %d ms went by, capping it", rawSession.SessionID, verdict.TotalMs, maxMs)
+		verdict.TotalMs = maxMs
+		verdict.Valid = maxMs >= types.AnkyDurationSeconds*1000
+		writingSession.ApplyVerdict(verdict)
+	}
+	return verdict
+}
+
+// ApplyClientReport is the fallback for sessions without a raw file: the text comes from the
+// client, but the words are counted here and the time spent can't exceed the time elapsed
+// since the server registered the start of the session. Without keystrokes there is no way
+// to check the 8-second rule, so the session can't become an Anky.
+func (s *WritingSessionService) ApplyClientReport(writingSession *types.WritingSession, text string, reportedTimeSpent int) *types.AnkyVerdict {
+	timeSpent := reportedTimeSpent
+	if !writingSession.StartingTimestamp.IsZero() {
+		elapsed := int(time.Since(writingSession.StartingTimestamp).Seconds())
+		if timeSpent > elapsed {
+			timeSpent = elapsed
+		}
+	}
+	if timeSpent < 0 {
+		timeSpent = 0
+	}
+
+	verdict := &types.AnkyVerdict{
+		Valid:   false,
+		TotalMs: int64(timeSpent) * 1000,
+	}
+
+	writingSession.Writing = text
+	writingSession.WordsWritten = len(strings.Fields(text))
+	writingSession.Language = DetectLanguage(text).Code
+	writingSession.ApplyVerdict(verdict)
+
+	return verdict
+}
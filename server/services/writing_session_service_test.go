@@ -0,0 +1,41 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ankylat/anky/server/types"
+)
+
+func TestApplyLiveSessionCapsToObservedTime(t *testing.T) {
+	keystrokes := []types.Keystroke{{Key: "a", DelayMs: 0}}
+	for i := 0; i < 480; i++ {
+		keystrokes = append(keystrokes, types.Keystroke{Key: "a", DelayMs: 1000})
+	}
+	rawSession := &types.RawWritingSession{Keystrokes: keystrokes}
+
+	tests := []struct {
+		name        string
+		observed    time.Duration
+		wantValid   bool
+		wantTotalMs int64
+	}{
+		{"written in real time", 481 * time.Second, true, 480000},
+		{"sent all at once", 3 * time.Second, false, 3000},
+	}
+
+	service := NewWritingSessionService()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writingSession := &types.WritingSession{}
+			verdict := service.ApplyLiveSession(writingSession, rawSession, tt.observed)
+
+			if verdict.Valid != tt.wantValid || writingSession.IsAnky != tt.wantValid {
+				t.Errorf("expected valid %t, got verdict %t and IsAnky %t", tt.wantValid, verdict.Valid, writingSession.IsAnky)
+			}
+			if verdict.TotalMs != tt.wantTotalMs {
+				t.Errorf("expected total %d ms, got %d", tt.wantTotalMs, verdict.TotalMs)
+			}
+		})
+	}
+}
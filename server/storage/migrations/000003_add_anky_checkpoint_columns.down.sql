@@ -0,0 +1,2 @@
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_generation_id;
+ALTER TABLE ankys DROP COLUMN IF EXISTS fid;
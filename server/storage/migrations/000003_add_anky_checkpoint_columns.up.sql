@@ -0,0 +1,3 @@
+-- Columns needed to resume an Anky from its last completed step
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS fid INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_generation_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_anky_jobs_active_anky;
+DROP INDEX IF EXISTS idx_anky_jobs_status_run_after;
+DROP TABLE IF EXISTS anky_jobs;
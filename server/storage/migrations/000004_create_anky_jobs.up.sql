@@ -0,0 +1,19 @@
+-- Durable queue of Anky processing jobs
+CREATE TABLE anky_jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    anky_id UUID NOT NULL REFERENCES ankys(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued, running, succeeded, dead
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 5,
+    run_after TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_by VARCHAR(255),
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_anky_jobs_status_run_after ON anky_jobs(status, run_after);
+
+-- An Anky can only have one job waiting or running at a time
+CREATE UNIQUE INDEX idx_anky_jobs_active_anky ON anky_jobs(anky_id) WHERE status IN ('queued', 'running');
@@ -0,0 +1,12 @@
+-- Every status change of an Anky, to see where and why its generation stalled
+CREATE TABLE anky_status_history (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    anky_id UUID NOT NULL REFERENCES ankys(id) ON DELETE CASCADE,
+    from_status VARCHAR(50) NOT NULL,
+    to_status VARCHAR(50) NOT NULL,
+    error TEXT,
+    attempt INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_anky_status_history_anky_id ON anky_status_history(anky_id, created_at);
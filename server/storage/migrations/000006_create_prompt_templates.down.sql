@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_onboarding_responses_prompt_version;
+DROP INDEX IF EXISTS idx_onboarding_responses_user_id;
+DROP TABLE IF EXISTS onboarding_responses;
+ALTER TABLE ankys DROP COLUMN IF EXISTS prompt_version;
+DROP TABLE IF EXISTS prompt_templates;
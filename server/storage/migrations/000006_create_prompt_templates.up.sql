@@ -0,0 +1,29 @@
+-- Versions of the system prompts, on top of the ones shipped in the prompts directory.
+-- The active versions of a prompt share its users according to their weight.
+CREATE TABLE prompt_templates (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL,
+    version VARCHAR(100) NOT NULL,
+    template TEXT NOT NULL,
+    weight INTEGER NOT NULL DEFAULT 100,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (name, version)
+);
+
+-- The prompt version that produced each reflection, to compare how the versions do
+ALTER TABLE ankys ADD COLUMN prompt_version VARCHAR(200) NOT NULL DEFAULT '';
+
+CREATE TABLE onboarding_responses (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL,
+    replied_to_writing_session_id UUID,
+    reasoning TEXT NOT NULL DEFAULT '',
+    response_to_user TEXT NOT NULL,
+    ai_model_used VARCHAR(200) NOT NULL DEFAULT '',
+    prompt_version VARCHAR(200) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_onboarding_responses_user_id ON onboarding_responses(user_id);
+CREATE INDEX idx_onboarding_responses_prompt_version ON onboarding_responses(prompt_version);
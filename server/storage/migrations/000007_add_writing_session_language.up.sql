@@ -0,0 +1,2 @@
+-- Language detected from the writing (ISO 639-1), used to reply in the writer's language
+ALTER TABLE writing_sessions ADD COLUMN IF NOT EXISTS language VARCHAR(10) NOT NULL DEFAULT '';
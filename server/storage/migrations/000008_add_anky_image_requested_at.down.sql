@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_ankys_image_generation_id;
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_requested_at;
@@ -0,0 +1,4 @@
+-- When the image of an Anky was asked for, to give up on image jobs that take too long
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_requested_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_ankys_image_generation_id ON ankys(image_generation_id);
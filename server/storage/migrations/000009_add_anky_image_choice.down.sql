@@ -0,0 +1,5 @@
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_alternates;
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_chosen_by;
+ALTER TABLE ankys DROP COLUMN IF EXISTS chosen_image_url;
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_choose_by;
+ALTER TABLE ankys DROP COLUMN IF EXISTS image_candidates;
@@ -0,0 +1,6 @@
+-- Candidates of the image of an Anky, the one that was chosen and by whom, and the alternates
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_candidates TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_choose_by TIMESTAMP WITH TIME ZONE;
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS chosen_image_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_chosen_by VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS image_alternates TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,3 @@
+ALTER TABLE ankys ALTER COLUMN image_ipfs_hash DROP NOT NULL;
+ALTER TABLE ankys ALTER COLUMN image_ipfs_hash DROP DEFAULT;
+ALTER TABLE ankys DROP COLUMN IF EXISTS writing_ipfs_hash;
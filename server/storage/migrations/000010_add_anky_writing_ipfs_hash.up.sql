@@ -0,0 +1,7 @@
+-- CID of the raw file of the writing session, next to the CID of the image
+ALTER TABLE ankys ADD COLUMN IF NOT EXISTS writing_ipfs_hash TEXT NOT NULL DEFAULT '';
+
+-- The image hash was never set, so it can be made an empty string like the other hashes
+UPDATE ankys SET image_ipfs_hash = '' WHERE image_ipfs_hash IS NULL;
+ALTER TABLE ankys ALTER COLUMN image_ipfs_hash SET DEFAULT '';
+ALTER TABLE ankys ALTER COLUMN image_ipfs_hash SET NOT NULL;
@@ -0,0 +1,3 @@
+-- What a user is allowed to do: user for everyone, admin for the team (listing all the users
+-- and all the Ankys). Admins are promoted by hand in the database.
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
@@ -0,0 +1,15 @@
+-- The custodial wallets created before the BIP-44 derivation, with both of their addresses.
+-- Users with funds at the legacy address keep it as their wallet address until the funds are
+-- moved, the others are switched to the standard one.
+CREATE TABLE wallet_migrations (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    legacy_address VARCHAR(42) NOT NULL,
+    standard_address VARCHAR(42) NOT NULL,
+    legacy_balance_wei NUMERIC(78, 0) NOT NULL DEFAULT 0,
+    legacy_token_balances JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL, -- pending, migrated, needs_sweep
+    checked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    migrated_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_wallet_migrations_status ON wallet_migrations(status);
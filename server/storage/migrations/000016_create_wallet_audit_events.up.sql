@@ -0,0 +1,15 @@
+-- Every time a user is shown their mnemonic or replaces their custodial wallet, and the
+-- attempts that failed to re-authenticate. The last export also sets the export cooldown.
+CREATE TABLE wallet_audit_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    action VARCHAR(20) NOT NULL, -- export, import, reauth_failed
+    wallet_address VARCHAR(42) NOT NULL DEFAULT '',
+    previous_wallet_address VARCHAR(42) NOT NULL DEFAULT '',
+    session_id UUID,
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_wallet_audit_events_user_action ON wallet_audit_events(user_id, action, created_at DESC);
@@ -0,0 +1,9 @@
+-- A Privy user belongs to a single user. The links made before the Privy token was checked
+-- can't be trusted, so a Privy user linked to several users stays with the first of them only.
+UPDATE users SET privy_did = ''
+FROM users first
+WHERE first.privy_did = users.privy_did
+    AND users.privy_did <> ''
+    AND (first.created_at, first.id) < (users.created_at, users.id);
+
+CREATE UNIQUE INDEX idx_users_privy_did ON users(privy_did) WHERE privy_did <> '';
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -22,8 +23,11 @@ type Storage interface {
 	// User operations
 	GetUsers(ctx context.Context) ([]*types.User, error)
 	GetUserByID(ctx context.Context, userID uuid.UUID) (*types.User, error)
+	GetUserByPrivyDID(ctx context.Context, privyDID string) (*types.User, error)
 	CreateUser(ctx context.Context, user *types.User) error
 	UpdateUser(ctx context.Context, userID uuid.UUID, user *types.User) error
+	LinkUserPrivyDID(ctx context.Context, userID uuid.UUID, privyDID string) (bool, error)
+	RetireUserLegacyJWT(ctx context.Context, userID uuid.UUID, jwt string) (bool, error)
 	DeleteUser(ctx context.Context, userID uuid.UUID) error
 
 	// Privy user operations
@@ -39,11 +43,66 @@ type Storage interface {
 	GetAnkys(ctx context.Context, limit int, offset int) ([]*types.Anky, error)
 	CreateAnky(ctx context.Context, anky *types.Anky) error
 	UpdateAnky(ctx context.Context, anky *types.Anky) error
+	SetAnkyFID(ctx context.Context, ankyID uuid.UUID, fid int) error
 	GetAnkyByID(ctx context.Context, ankyID uuid.UUID) (*types.Anky, error)
 	GetAnkysByUserID(ctx context.Context, userID uuid.UUID, limit int, offset int) ([]*types.Anky, error)
+	GetUnfinishedAnkys(ctx context.Context) ([]*types.Anky, error)
+	GetAnkyByImageGenerationID(ctx context.Context, imageGenerationID string) (*types.Anky, error)
+	HasPublishedAnky(ctx context.Context, writingSessionID uuid.UUID) (bool, error)
+	ChooseAnkyImage(ctx context.Context, ankyID uuid.UUID, imageURL string, chosenBy string) (bool, error)
+
+	// Anky status history operations
+	TransitionAnky(ctx context.Context, anky *types.Anky, transition *types.AnkyStatusTransition) error
+	CreateAnkyStatusTransition(ctx context.Context, transition *types.AnkyStatusTransition) error
+	GetAnkyStatusHistory(ctx context.Context, ankyID uuid.UUID) ([]*types.AnkyStatusTransition, error)
+
+	// Prompt operations
+	GetPromptTemplates(ctx context.Context, name string) ([]*types.PromptTemplate, error)
+	CreateOnboardingResponse(ctx context.Context, response *types.AnkyOnboardingResponse) error
+
+	// Anky job operations
+	EnqueueAnkyJob(ctx context.Context, ankyID uuid.UUID, maxAttempts int) error
+	ClaimAnkyJob(ctx context.Context, workerID string, lease time.Duration) (*types.AnkyJob, error)
+	ExtendAnkyJobLease(ctx context.Context, jobID uuid.UUID, workerID string, lease time.Duration) (bool, error)
+	CompleteAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error
+	RetryAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time, lastError string) error
+	DeadLetterAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, lastError string) error
+	ReleaseAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error
+	SnoozeAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) error
+	WakeAnkyJob(ctx context.Context, ankyID uuid.UUID) error
 
 	// Badge operations
 	GetUserBadges(ctx context.Context, userID uuid.UUID) ([]*types.Badge, error)
+
+	// Upload operations
+	CreateUpload(ctx context.Context, upload *types.Upload) error
+	GetUploadByID(ctx context.Context, uploadID uuid.UUID) (*types.Upload, error)
+	DeleteUpload(ctx context.Context, uploadID uuid.UUID) error
+
+	// Session operations
+	CreateSession(ctx context.Context, session *types.Session) error
+	GetSessionByID(ctx context.Context, sessionID uuid.UUID) (*types.Session, error)
+	RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash string, newHash string, expiresAt time.Time) (bool, error)
+	EndSession(ctx context.Context, sessionID uuid.UUID, status string) error
+	EndUserSessions(ctx context.Context, userID uuid.UUID) error
+
+	// Usage operations
+	GetDailyUsage(ctx context.Context, userID uuid.UUID, day time.Time) (*types.DailyUsage, error)
+	AddDailyUsage(ctx context.Context, usage *types.DailyUsage) (*types.DailyUsage, error)
+
+	// Wallet migration operations
+	SaveWalletMigration(ctx context.Context, migration *types.WalletMigration) error
+	UpdateUserWalletAddress(ctx context.Context, userID uuid.UUID, walletAddress string) error
+
+	// Seed phrase operations
+	GetSeedPhrasesAfter(ctx context.Context, after uuid.UUID, limit int) ([]*types.EncryptedSeedPhrase, error)
+	ReplaceUserSeedPhrase(ctx context.Context, userID uuid.UUID, old string, replacement string) (bool, error)
+	ReplaceUserWallet(ctx context.Context, userID uuid.UUID, oldSeedPhrase string, seedPhrase string, walletAddress string) (bool, error)
+
+	// Wallet audit operations
+	CreateWalletAuditEvent(ctx context.Context, event *types.WalletAuditEvent) error
+	GetLastWalletAuditEvent(ctx context.Context, userID uuid.UUID, action string) (*types.WalletAuditEvent, error)
+	RecordWalletExport(ctx context.Context, event *types.WalletAuditEvent, since time.Time) (*types.WalletAuditEvent, error)
 }
 
 type PostgresStore struct {
@@ -92,7 +151,7 @@ func runMigrations(connStr string) error {
 
 func (s *PostgresStore) GetUsers(ctx context.Context, limit int, offset int) ([]*types.User, error) {
 	query := `
-        SELECT id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, created_at, updated_at 
+        SELECT id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, role, created_at, updated_at 
         FROM users 
         ORDER BY created_at DESC
         LIMIT $1 OFFSET $2
@@ -120,16 +179,33 @@ func (s *PostgresStore) GetUsers(ctx context.Context, limit int, offset int) ([]
 }
 
 func (s *PostgresStore) GetUserByID(ctx context.Context, userID uuid.UUID) (*types.User, error) {
-	query := `SELECT * FROM users WHERE id = $1`
+	query := `
+		SELECT id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, role, created_at, updated_at
+		FROM users WHERE id = $1
+	`
 	row := s.db.QueryRow(ctx, query, userID)
 	return scanIntoUser(row)
 }
 
+// GetUserByPrivyDID finds the user a Privy account is linked to
+func (s *PostgresStore) GetUserByPrivyDID(ctx context.Context, privyDID string) (*types.User, error) {
+	query := `
+		SELECT id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, role, created_at, updated_at
+		FROM users WHERE privy_did = $1
+	`
+	row := s.db.QueryRow(ctx, query, privyDID)
+	return scanIntoUser(row)
+}
+
 func (s *PostgresStore) CreateUser(ctx context.Context, user *types.User) error {
 	query := `
-		INSERT INTO users (id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO users (id, privy_did, fid, settings, seed_phrase, wallet_address, jwt, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
+	role := user.Role
+	if role == "" {
+		role = types.UserRoleUser
+	}
 	_, err := s.db.Exec(ctx, query,
 		user.ID,
 		user.PrivyDID,
@@ -138,6 +214,7 @@ func (s *PostgresStore) CreateUser(ctx context.Context, user *types.User) error
 		user.SeedPhrase,
 		user.WalletAddress,
 		user.JWT,
+		role,
 		user.CreatedAt,
 		user.UpdatedAt,
 	)
@@ -145,24 +222,47 @@ func (s *PostgresStore) CreateUser(ctx context.Context, user *types.User) error
 }
 
 func (s *PostgresStore) UpdateUser(ctx context.Context, userID uuid.UUID, user *types.User) error {
+	// The wallet and the legacy JWT only change through ReplaceUserWallet,
+	// ReplaceUserSeedPhrase and RetireUserLegacyJWT, which check what they replace
 	query := `
 		UPDATE users 
-		SET privy_did = $1, fid = $2, settings = $3, seed_phrase = $4, 
-			wallet_address = $5, jwt = $6, updated_at = CURRENT_TIMESTAMP 
-		WHERE id = $7
+		SET privy_did = $1, fid = $2, settings = $3, updated_at = CURRENT_TIMESTAMP 
+		WHERE id = $4
 	`
 	_, err := s.db.Exec(ctx, query,
 		user.PrivyDID,
 		user.FID,
 		user.Settings,
-		user.SeedPhrase,
-		user.WalletAddress,
-		user.JWT,
 		userID,
 	)
 	return err
 }
 
+// RetireUserLegacyJWT clears the JWT of the user if it is still jwt. It returns false when it
+// was already retired.
+func (s *PostgresStore) RetireUserLegacyJWT(ctx context.Context, userID uuid.UUID, jwt string) (bool, error) {
+	query := `UPDATE users SET jwt = '', updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND jwt = $2 AND jwt <> ''`
+	tag, err := s.db.Exec(ctx, query, userID, jwt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// LinkUserPrivyDID links a Privy user to the user. It returns false, and links nothing, when the
+// Privy user is already linked to someone else.
+func (s *PostgresStore) LinkUserPrivyDID(ctx context.Context, userID uuid.UUID, privyDID string) (bool, error) {
+	query := `
+		UPDATE users SET privy_did = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM users WHERE privy_did = $1 AND id <> $2)
+	`
+	tag, err := s.db.Exec(ctx, query, privyDID, userID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
 func (s *PostgresStore) DeleteUser(ctx context.Context, userID uuid.UUID) error {
 	query := `DELETE FROM users WHERE id = $1`
 	_, err := s.db.Exec(ctx, query, userID)
@@ -183,8 +283,8 @@ func (s *PostgresStore) CreateWritingSession(ctx context.Context, ws *types.Writ
         INSERT INTO writing_sessions (
             id, user_id, session_index_for_user, starting_timestamp,
             prompt, status, writing, words_written, newen_earned,
-            time_spent, is_anky, parent_anky_id, anky_response, is_onboarding
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+            time_spent, is_anky, parent_anky_id, anky_response, is_onboarding, language
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
     `
 
 	_, err := s.db.Exec(ctx, query,
@@ -202,6 +302,7 @@ func (s *PostgresStore) CreateWritingSession(ctx context.Context, ws *types.Writ
 		ws.ParentAnkyID, // Directly use the UUID pointer
 		ws.AnkyResponse,
 		ws.IsOnboarding,
+		ws.Language,
 	)
 	return err
 }
@@ -257,8 +358,9 @@ func (s *PostgresStore) UpdateWritingSession(ctx context.Context, ws *types.Writ
 			parent_anky_id = $8,
 			anky_response = $9,
 			is_onboarding = $10,
-			anky_id = $11
-		WHERE id = $12
+			anky_id = $11,
+			language = $12
+		WHERE id = $13
 	`
 	_, err := s.db.Exec(ctx, query,
 		ws.Status,
@@ -272,6 +374,7 @@ func (s *PostgresStore) UpdateWritingSession(ctx context.Context, ws *types.Writ
 		ws.AnkyResponse,
 		ws.IsOnboarding,
 		ws.AnkyID,
+		ws.Language,
 		ws.ID,
 	)
 	return err
@@ -279,8 +382,14 @@ func (s *PostgresStore) UpdateWritingSession(ctx context.Context, ws *types.Writ
 
 // ******************** Anky operations ********************
 
+// ankyColumns lists the columns in the order scanIntoAnky reads them
+const ankyColumns = `id, user_id, writing_session_id, chosen_prompt, anky_reflection, image_prompt,
+	follow_up_prompt, image_url, image_ipfs_hash, status, cast_hash, created_at, last_updated_at,
+	fid, image_generation_id, prompt_version, image_requested_at, image_candidates, image_choose_by,
+	chosen_image_url, image_chosen_by, image_alternates, writing_ipfs_hash`
+
 func (s *PostgresStore) GetAnkys(ctx context.Context, limit int, offset int) ([]*types.Anky, error) {
-	query := `SELECT * FROM ankys ORDER BY created_at DESC LIMIT $1 OFFSET $2`
+	query := `SELECT ` + ankyColumns + ` FROM ankys ORDER BY created_at DESC LIMIT $1 OFFSET $2`
 	rows, err := s.db.Query(ctx, query, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ankys: %w", err)
@@ -300,13 +409,13 @@ func (s *PostgresStore) GetAnkys(ctx context.Context, limit int, offset int) ([]
 }
 
 func (s *PostgresStore) GetAnkyByID(ctx context.Context, ankyID uuid.UUID) (*types.Anky, error) {
-	query := `SELECT * FROM ankys WHERE id = $1`
+	query := `SELECT ` + ankyColumns + ` FROM ankys WHERE id = $1`
 	row := s.db.QueryRow(ctx, query, ankyID)
 	return scanIntoAnky(row)
 }
 
 func (s *PostgresStore) GetAnkysByUserID(ctx context.Context, userID uuid.UUID, limit int, offset int) ([]*types.Anky, error) {
-	query := `SELECT * FROM ankys WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`
+	query := `SELECT ` + ankyColumns + ` FROM ankys WHERE user_id = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`
 	rows, err := s.db.Query(ctx, query, userID, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ankys by user ID: %w", err)
@@ -335,8 +444,11 @@ func (s *PostgresStore) CreateAnky(ctx context.Context, anky *types.Anky) error
             id, user_id, writing_session_id, chosen_prompt, 
             anky_reflection, image_prompt, follow_up_prompt, 
             image_url, image_ipfs_hash, status, cast_hash, 
-            created_at, last_updated_at
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+            created_at, last_updated_at, fid, image_generation_id, prompt_version,
+            image_requested_at, image_candidates, image_choose_by, chosen_image_url,
+            image_chosen_by, image_alternates, writing_ipfs_hash
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17,
+            $18, $19, $20, $21, $22, $23)
     `
 
 	// Initialize LastUpdatedAt if it's zero
@@ -345,19 +457,29 @@ func (s *PostgresStore) CreateAnky(ctx context.Context, anky *types.Anky) error
 	}
 
 	_, err := s.db.Exec(ctx, query,
-		anky.ID,               // $1
-		anky.UserID,           // $2
-		anky.WritingSessionID, // $3
-		anky.ChosenPrompt,     // $4
-		anky.AnkyReflection,   // $5
-		anky.ImagePrompt,      // $6
-		anky.FollowUpPrompt,   // $7
-		anky.ImageURL,         // $8
-		anky.ImageIPFSHash,    // $9
-		anky.Status,           // $10
-		anky.CastHash,         // $11
-		anky.CreatedAt,        // $12
-		anky.LastUpdatedAt,    // $13
+		anky.ID,                             // $1
+		anky.UserID,                         // $2
+		anky.WritingSessionID,               // $3
+		anky.ChosenPrompt,                   // $4
+		anky.AnkyReflection,                 // $5
+		anky.ImagePrompt,                    // $6
+		anky.FollowUpPrompt,                 // $7
+		anky.ImageURL,                       // $8
+		anky.ImageIPFSHash,                  // $9
+		string(anky.Status),                 // $10
+		anky.CastHash,                       // $11
+		anky.CreatedAt,                      // $12
+		anky.LastUpdatedAt,                  // $13
+		anky.FID,                            // $14
+		anky.ImageGenerationID,              // $15
+		anky.PromptVersion,                  // $16
+		anky.ImageRequestedAt,               // $17
+		nonNilStrings(anky.ImageCandidates), // $18
+		anky.ImageChooseBy,                  // $19
+		anky.ChosenImageURL,                 // $20
+		anky.ImageChosenBy,                  // $21
+		nonNilStrings(anky.ImageAlternates), // $22
+		anky.WritingIPFSHash,                // $23
 	)
 
 	if err != nil {
@@ -367,8 +489,8 @@ func (s *PostgresStore) CreateAnky(ctx context.Context, anky *types.Anky) error
 	return nil
 }
 
-func (s *PostgresStore) UpdateAnky(ctx context.Context, anky *types.Anky) error {
-	query := `
+// ankyUpdateQuery overwrites every column of an Anky, see ankyUpdateArgs
+const ankyUpdateQuery = `
 		UPDATE ankys SET 
 			user_id = $1,
 			writing_session_id = $2,
@@ -381,33 +503,391 @@ func (s *PostgresStore) UpdateAnky(ctx context.Context, anky *types.Anky) error
 			status = $9,
 			cast_hash = $10,
 			last_updated_at = $11,
-			fid = $12
-		WHERE id = $13`
-	_, err := s.db.Exec(ctx, query,
+			fid = $12,
+			image_generation_id = $13,
+			prompt_version = $14,
+			image_requested_at = $15,
+			image_candidates = $16,
+			image_choose_by = $17,
+			chosen_image_url = $18,
+			image_chosen_by = $19,
+			image_alternates = $20,
+			writing_ipfs_hash = $21
+		WHERE id = $22`
+
+func ankyUpdateArgs(anky *types.Anky) []interface{} {
+	return []interface{}{
 		anky.UserID,
 		anky.WritingSessionID,
 		anky.ChosenPrompt,
 		anky.AnkyReflection,
 		anky.ImagePrompt,
-
 		anky.FollowUpPrompt,
 		anky.ImageURL,
 		anky.ImageIPFSHash,
-		anky.Status,
+		string(anky.Status),
 		anky.CastHash,
 		anky.LastUpdatedAt,
-		anky.ID,
 		anky.FID,
-	)
+		anky.ImageGenerationID,
+		anky.PromptVersion,
+		anky.ImageRequestedAt,
+		nonNilStrings(anky.ImageCandidates),
+		anky.ImageChooseBy,
+		anky.ChosenImageURL,
+		anky.ImageChosenBy,
+		nonNilStrings(anky.ImageAlternates),
+		anky.WritingIPFSHash,
+		anky.ID,
+	}
+}
+
+// nonNilStrings keeps the array columns from being set to NULL
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func (s *PostgresStore) UpdateAnky(ctx context.Context, anky *types.Anky) error {
+	anky.LastUpdatedAt = time.Now().UTC()
+	_, err := s.db.Exec(ctx, ankyUpdateQuery, ankyUpdateArgs(anky)...)
 	return err
 }
 
+// SetAnkyFID only touches the fid column, so it can't undo what a worker processing the
+// same Anky saved in the meantime
+func (s *PostgresStore) SetAnkyFID(ctx context.Context, ankyID uuid.UUID, fid int) error {
+	query := `UPDATE ankys SET fid = $1, last_updated_at = NOW() WHERE id = $2`
+	_, err := s.db.Exec(ctx, query, fid, ankyID)
+	return err
+}
+
+// GetUnfinishedAnkys returns the Ankys whose processing stopped before reaching a final status
+func (s *PostgresStore) GetUnfinishedAnkys(ctx context.Context) ([]*types.Anky, error) {
+	finalStatuses := make([]string, 0, len(types.AnkyFinalStatuses))
+	for _, status := range types.AnkyFinalStatuses {
+		finalStatuses = append(finalStatuses, string(status))
+	}
+
+	query := `SELECT ` + ankyColumns + ` FROM ankys WHERE status <> ALL($1) ORDER BY created_at ASC`
+	rows, err := s.db.Query(ctx, query, finalStatuses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unfinished ankys: %w", err)
+	}
+	defer rows.Close()
+
+	ankys := make([]*types.Anky, 0)
+	for rows.Next() {
+		anky, err := scanIntoAnky(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan anky: %w", err)
+		}
+		ankys = append(ankys, anky)
+	}
+
+	return ankys, nil
+}
+
+// GetAnkyByImageGenerationID finds the Anky waiting for an image job of the image backend
+func (s *PostgresStore) GetAnkyByImageGenerationID(ctx context.Context, imageGenerationID string) (*types.Anky, error) {
+	query := `SELECT ` + ankyColumns + ` FROM ankys WHERE image_generation_id = $1 AND image_generation_id <> '' LIMIT 1`
+	row := s.db.QueryRow(ctx, query, imageGenerationID)
+	return scanIntoAnky(row)
+}
+
+// HasPublishedAnky tells if the Anky of a writing session was cast to Farcaster
+func (s *PostgresStore) HasPublishedAnky(ctx context.Context, writingSessionID uuid.UUID) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM ankys WHERE writing_session_id = $1 AND COALESCE(cast_hash, '') <> '')`
+	var published bool
+	err := s.db.QueryRow(ctx, query, writingSessionID).Scan(&published)
+	return published, err
+}
+
+// ChooseAnkyImage sets the chosen image of an Anky that is waiting for one. It only touches
+// those columns, and tells if the choice was taken: the first choice wins.
+func (s *PostgresStore) ChooseAnkyImage(ctx context.Context, ankyID uuid.UUID, imageURL string, chosenBy string) (bool, error) {
+	query := `
+		UPDATE ankys SET chosen_image_url = $2, image_chosen_by = $3, last_updated_at = NOW()
+		WHERE id = $1 AND status = $4 AND chosen_image_url = ''
+	`
+	tag, err := s.db.Exec(ctx, query, ankyID, imageURL, chosenBy, string(types.AnkyStatusChoosingImage))
+	if err != nil {
+		return false, fmt.Errorf("failed to choose anky image: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
 func (s *PostgresStore) GetLastAnkyByUserID(ctx context.Context, userID uuid.UUID) (*types.Anky, error) {
-	query := `SELECT * FROM ankys WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1`
+	query := `SELECT ` + ankyColumns + ` FROM ankys WHERE user_id = $1 ORDER BY created_at DESC LIMIT 1`
 	row := s.db.QueryRow(ctx, query, userID)
 	return scanIntoAnky(row)
 }
 
+// ******************** Anky status history operations ********************
+
+const ankyStatusTransitionColumns = `id, anky_id, from_status, to_status, error, attempt, created_at`
+
+// TransitionAnky saves the Anky and records the status transition that brought it there,
+// in the same transaction so the history never disagrees with the Anky.
+func (s *PostgresStore) TransitionAnky(ctx context.Context, anky *types.Anky, transition *types.AnkyStatusTransition) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	anky.LastUpdatedAt = time.Now().UTC()
+	if _, err := tx.Exec(ctx, ankyUpdateQuery, ankyUpdateArgs(anky)...); err != nil {
+		return fmt.Errorf("failed to update anky: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, insertAnkyStatusTransitionQuery, ankyStatusTransitionArgs(transition)...); err != nil {
+		return fmt.Errorf("failed to record anky status transition: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit anky transition: %w", err)
+	}
+	return nil
+}
+
+const insertAnkyStatusTransitionQuery = `
+		INSERT INTO anky_status_history (id, anky_id, from_status, to_status, error, attempt, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+func ankyStatusTransitionArgs(transition *types.AnkyStatusTransition) []interface{} {
+	return []interface{}{
+		transition.ID,
+		transition.AnkyID,
+		string(transition.FromStatus),
+		string(transition.ToStatus),
+		transition.Error,
+		transition.Attempt,
+		transition.CreatedAt,
+	}
+}
+
+// CreateAnkyStatusTransition records a history row on its own, like a failed attempt that
+// left the Anky in the status it was in
+func (s *PostgresStore) CreateAnkyStatusTransition(ctx context.Context, transition *types.AnkyStatusTransition) error {
+	if _, err := s.db.Exec(ctx, insertAnkyStatusTransitionQuery, ankyStatusTransitionArgs(transition)...); err != nil {
+		return fmt.Errorf("failed to record anky status transition: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetAnkyStatusHistory(ctx context.Context, ankyID uuid.UUID) ([]*types.AnkyStatusTransition, error) {
+	query := `SELECT ` + ankyStatusTransitionColumns + ` FROM anky_status_history WHERE anky_id = $1 ORDER BY created_at ASC`
+	rows, err := s.db.Query(ctx, query, ankyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get anky status history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make([]*types.AnkyStatusTransition, 0)
+	for rows.Next() {
+		transition, err := scanIntoAnkyStatusTransition(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, transition)
+	}
+
+	return history, nil
+}
+
+// ******************** Anky job operations ********************
+
+const ankyJobColumns = `id, anky_id, status, attempts, max_attempts, run_after, locked_by, locked_until, last_error, created_at, updated_at`
+
+// EnqueueAnkyJob queues the processing of an Anky. It does nothing if the Anky already has a
+// job waiting or running.
+func (s *PostgresStore) EnqueueAnkyJob(ctx context.Context, ankyID uuid.UUID, maxAttempts int) error {
+	query := `
+		INSERT INTO anky_jobs (anky_id, max_attempts)
+		VALUES ($1, $2)
+		ON CONFLICT (anky_id) WHERE status IN ('queued', 'running') DO NOTHING
+	`
+	_, err := s.db.Exec(ctx, query, ankyID, maxAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue anky job: %w", err)
+	}
+	return nil
+}
+
+// ClaimAnkyJob leases the next job that is due, including running jobs whose lease expired
+// because their worker died. It returns nil when there is nothing to do.
+func (s *PostgresStore) ClaimAnkyJob(ctx context.Context, workerID string, lease time.Duration) (*types.AnkyJob, error) {
+	query := `
+		UPDATE anky_jobs SET
+			status = 'running',
+			attempts = attempts + 1,
+			locked_by = $1,
+			locked_until = NOW() + ($2 * INTERVAL '1 second'),
+			updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM anky_jobs
+			WHERE (status = 'queued' AND run_after <= NOW())
+			   OR (status = 'running' AND locked_until < NOW())
+			ORDER BY run_after
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + ankyJobColumns
+	row := s.db.QueryRow(ctx, query, workerID, lease.Seconds())
+	job, err := scanIntoAnkyJob(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return job, err
+}
+
+// ExtendAnkyJobLease keeps a long-running job from being claimed by another worker. It returns
+// false when the worker doesn't hold the job anymore, its lease expired and another worker took it.
+func (s *PostgresStore) ExtendAnkyJobLease(ctx context.Context, jobID uuid.UUID, workerID string, lease time.Duration) (bool, error) {
+	query := `
+		UPDATE anky_jobs SET locked_until = NOW() + ($3 * INTERVAL '1 second'), updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'
+	`
+	tag, err := s.db.Exec(ctx, query, jobID, workerID, lease.Seconds())
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *PostgresStore) CompleteAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error {
+	query := `
+		UPDATE anky_jobs SET status = 'succeeded', locked_by = NULL, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2
+	`
+	_, err := s.db.Exec(ctx, query, jobID, workerID)
+	return err
+}
+
+// RetryAnkyJob puts a failed job back in the queue, to be run again after runAfter
+func (s *PostgresStore) RetryAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time, lastError string) error {
+	query := `
+		UPDATE anky_jobs SET status = 'queued', run_after = $3, last_error = $4,
+			locked_by = NULL, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2
+	`
+	_, err := s.db.Exec(ctx, query, jobID, workerID, runAfter, lastError)
+	return err
+}
+
+// DeadLetterAnkyJob gives up on a job that ran out of attempts
+func (s *PostgresStore) DeadLetterAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, lastError string) error {
+	query := `
+		UPDATE anky_jobs SET status = 'dead', last_error = $3, locked_by = NULL, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2
+	`
+	_, err := s.db.Exec(ctx, query, jobID, workerID, lastError)
+	return err
+}
+
+// ReleaseAnkyJob puts a job interrupted by a shutdown back in the queue, right away and
+// without counting the attempt it was on
+func (s *PostgresStore) ReleaseAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string) error {
+	query := `
+		UPDATE anky_jobs SET status = 'queued', attempts = GREATEST(attempts - 1, 0), run_after = NOW(),
+			locked_by = NULL, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'
+	`
+	_, err := s.db.Exec(ctx, query, jobID, workerID)
+	return err
+}
+
+// SnoozeAnkyJob puts a job that is waiting on something else back in the queue until runAfter,
+// without counting the attempt it was on. WakeAnkyJob runs it earlier.
+func (s *PostgresStore) SnoozeAnkyJob(ctx context.Context, jobID uuid.UUID, workerID string, runAfter time.Time) error {
+	query := `
+		UPDATE anky_jobs SET status = 'queued', attempts = GREATEST(attempts - 1, 0), run_after = $3,
+			locked_by = NULL, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1 AND locked_by = $2 AND status = 'running'
+	`
+	_, err := s.db.Exec(ctx, query, jobID, workerID, runAfter)
+	return err
+}
+
+// WakeAnkyJob makes the queued job of an Anky due right away, if it has one
+func (s *PostgresStore) WakeAnkyJob(ctx context.Context, ankyID uuid.UUID) error {
+	query := `
+		UPDATE anky_jobs SET run_after = NOW(), updated_at = NOW()
+		WHERE anky_id = $1 AND status = 'queued' AND run_after > NOW()
+	`
+	_, err := s.db.Exec(ctx, query, ankyID)
+	return err
+}
+
+// ******************** Prompt operations ********************
+
+// GetPromptTemplates returns every version of a prompt, the inactive ones included since
+// they switch off the versions of the same name shipped as files
+func (s *PostgresStore) GetPromptTemplates(ctx context.Context, name string) ([]*types.PromptTemplate, error) {
+	query := `
+		SELECT id, name, version, template, weight, active, created_at
+		FROM prompt_templates
+		WHERE name = $1
+		ORDER BY version ASC
+	`
+	rows, err := s.db.Query(ctx, query, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prompt templates: %w", err)
+	}
+	defer rows.Close()
+
+	templates := make([]*types.PromptTemplate, 0)
+	for rows.Next() {
+		template := new(types.PromptTemplate)
+		if err := rows.Scan(
+			&template.ID,
+			&template.Name,
+			&template.Version,
+			&template.Template,
+			&template.Weight,
+			&template.Active,
+			&template.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan prompt template: %w", err)
+		}
+		templates = append(templates, template)
+	}
+
+	return templates, nil
+}
+
+func (s *PostgresStore) CreateOnboardingResponse(ctx context.Context, response *types.AnkyOnboardingResponse) error {
+	query := `
+		INSERT INTO onboarding_responses (
+			id, user_id, replied_to_writing_session_id, reasoning, response_to_user,
+			ai_model_used, prompt_version, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	var repliedTo *uuid.UUID
+	if response.RepliedToWritingSessionID != uuid.Nil {
+		repliedTo = &response.RepliedToWritingSessionID
+	}
+
+	_, err := s.db.Exec(ctx, query,
+		response.ID,
+		response.UserID,
+		repliedTo,
+		response.Reasoning,
+		response.ResponseToUser,
+		response.AiModelUsed,
+		response.PromptVersion,
+		response.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create onboarding response: %w", err)
+	}
+	return nil
+}
+
 // ******************** Badge operations ********************
 
 func (s *PostgresStore) GetUserBadges(ctx context.Context, userID uuid.UUID) ([]*types.Badge, error) {
@@ -430,6 +910,335 @@ func (s *PostgresStore) GetUserBadges(ctx context.Context, userID uuid.UUID) ([]
 	return badges, nil
 }
 
+// ******************** Upload operations ********************
+
+const uploadColumns = `id, user_id, kind, anky_id, blob_key, thumbnail_key, url, thumbnail_url,
+	content_type, size_bytes, width, height, created_at`
+
+func (s *PostgresStore) CreateUpload(ctx context.Context, upload *types.Upload) error {
+	query := `INSERT INTO uploads (` + uploadColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	_, err := s.db.Exec(ctx, query,
+		upload.ID,
+		upload.UserID,
+		upload.Kind,
+		upload.AnkyID,
+		upload.BlobKey,
+		upload.ThumbnailKey,
+		upload.URL,
+		upload.ThumbnailURL,
+		upload.ContentType,
+		upload.SizeBytes,
+		upload.Width,
+		upload.Height,
+		upload.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetUploadByID(ctx context.Context, uploadID uuid.UUID) (*types.Upload, error) {
+	query := `SELECT ` + uploadColumns + ` FROM uploads WHERE id = $1`
+	return scanIntoUpload(s.db.QueryRow(ctx, query, uploadID))
+}
+
+func (s *PostgresStore) DeleteUpload(ctx context.Context, uploadID uuid.UUID) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM uploads WHERE id = $1`, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	return nil
+}
+
+// ******************** Session operations ********************
+
+const sessionColumns = `id, user_id, refresh_token_hash, previous_refresh_token_hash, start_time, end_time,
+	last_activity, expires_at, status, user_agent, created_at, updated_at`
+
+func (s *PostgresStore) CreateSession(ctx context.Context, session *types.Session) error {
+	query := `INSERT INTO sessions (` + sessionColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	_, err := s.db.Exec(ctx, query,
+		session.ID,
+		session.UserID,
+		session.RefreshTokenHash,
+		session.PreviousRefreshTokenHash,
+		session.StartTime,
+		session.EndTime,
+		session.LastActivity,
+		session.ExpiresAt,
+		session.Status,
+		session.UserAgent,
+		session.CreatedAt,
+		session.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetSessionByID(ctx context.Context, sessionID uuid.UUID) (*types.Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+	return scanIntoSession(s.db.QueryRow(ctx, query, sessionID))
+}
+
+// RotateSessionRefreshToken replaces the refresh token of an active session, as long as it is
+// still oldHash. It returns false when another request rotated it first, or the session ended.
+func (s *PostgresStore) RotateSessionRefreshToken(ctx context.Context, sessionID uuid.UUID, oldHash string, newHash string, expiresAt time.Time) (bool, error) {
+	query := `
+		UPDATE sessions
+		SET refresh_token_hash = $3, previous_refresh_token_hash = $2, expires_at = $4,
+			last_activity = NOW(), updated_at = NOW()
+		WHERE id = $1 AND refresh_token_hash = $2 AND status = 'active' AND expires_at > NOW()
+	`
+	tag, err := s.db.Exec(ctx, query, sessionID, oldHash, newHash, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate session refresh token: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s *PostgresStore) EndSession(ctx context.Context, sessionID uuid.UUID, status string) error {
+	query := `
+		UPDATE sessions SET status = $2, end_time = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = 'active'
+	`
+	if _, err := s.db.Exec(ctx, query, sessionID, status); err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	return nil
+}
+
+// EndUserSessions signs the user out everywhere
+func (s *PostgresStore) EndUserSessions(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE sessions SET status = 'ended', end_time = NOW(), updated_at = NOW()
+		WHERE user_id = $1 AND status = 'active'
+	`
+	if _, err := s.db.Exec(ctx, query, userID); err != nil {
+		return fmt.Errorf("failed to end user sessions: %w", err)
+	}
+	return nil
+}
+
+// ******************** Usage operations ********************
+
+const dailyUsageColumns = `user_id, day, llm_calls, prompt_tokens, response_tokens, image_generations`
+
+// GetDailyUsage returns what the user spent during the day, nothing when there is no row yet
+func (s *PostgresStore) GetDailyUsage(ctx context.Context, userID uuid.UUID, day time.Time) (*types.DailyUsage, error) {
+	query := `SELECT ` + dailyUsageColumns + ` FROM daily_usage WHERE user_id = $1 AND day = $2`
+	usage, err := scanIntoDailyUsage(s.db.QueryRow(ctx, query, userID, day))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &types.DailyUsage{UserID: userID, Day: day}, nil
+	}
+	return usage, err
+}
+
+// AddDailyUsage adds the counts of usage to the day of the user, in one statement so that
+// concurrent requests don't lose any, and returns the new totals. Negative counts give back
+// what was reserved.
+func (s *PostgresStore) AddDailyUsage(ctx context.Context, usage *types.DailyUsage) (*types.DailyUsage, error) {
+	query := `
+		INSERT INTO daily_usage (` + dailyUsageColumns + `)
+		VALUES ($1, $2, GREATEST($3, 0), GREATEST($4, 0), GREATEST($5, 0), GREATEST($6, 0))
+		ON CONFLICT (user_id, day) DO UPDATE SET
+			llm_calls = GREATEST(daily_usage.llm_calls + $3, 0),
+			prompt_tokens = GREATEST(daily_usage.prompt_tokens + $4, 0),
+			response_tokens = GREATEST(daily_usage.response_tokens + $5, 0),
+			image_generations = GREATEST(daily_usage.image_generations + $6, 0),
+			updated_at = NOW()
+		RETURNING ` + dailyUsageColumns
+	row := s.db.QueryRow(ctx, query,
+		usage.UserID,
+		usage.Day,
+		usage.LLMCalls,
+		usage.PromptTokens,
+		usage.ResponseTokens,
+		usage.ImageGenerations,
+	)
+	return scanIntoDailyUsage(row)
+}
+
+// ******************** Wallet migration operations ********************
+
+// SaveWalletMigration records what the migration tool found for a user, replacing what an
+// earlier run found
+func (s *PostgresStore) SaveWalletMigration(ctx context.Context, migration *types.WalletMigration) error {
+	balance := "0"
+	if migration.LegacyBalance != nil {
+		balance = migration.LegacyBalance.String()
+	}
+	query := `
+		INSERT INTO wallet_migrations (user_id, legacy_address, standard_address, legacy_balance_wei,
+			legacy_token_balances, status, checked_at, migrated_at)
+		VALUES ($1, $2, $3, $4::numeric, $5, $6, $7, $8)
+		ON CONFLICT (user_id) DO UPDATE SET
+			legacy_address = EXCLUDED.legacy_address,
+			standard_address = EXCLUDED.standard_address,
+			legacy_balance_wei = EXCLUDED.legacy_balance_wei,
+			legacy_token_balances = EXCLUDED.legacy_token_balances,
+			status = EXCLUDED.status,
+			checked_at = EXCLUDED.checked_at,
+			migrated_at = EXCLUDED.migrated_at
+	`
+	_, err := s.db.Exec(ctx, query,
+		migration.UserID,
+		migration.LegacyAddress,
+		migration.StandardAddress,
+		balance,
+		migration.TokenBalances,
+		migration.Status,
+		migration.CheckedAt,
+		migration.MigratedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save wallet migration: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) UpdateUserWalletAddress(ctx context.Context, userID uuid.UUID, walletAddress string) error {
+	query := `UPDATE users SET wallet_address = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	if _, err := s.db.Exec(ctx, query, userID, walletAddress); err != nil {
+		return fmt.Errorf("failed to update wallet address: %w", err)
+	}
+	return nil
+}
+
+// ******************** Seed phrase operations ********************
+
+// GetSeedPhrasesAfter pages through the stored seed phrases in the order of the user IDs,
+// starting after the given one (uuid.Nil for the first page)
+func (s *PostgresStore) GetSeedPhrasesAfter(ctx context.Context, after uuid.UUID, limit int) ([]*types.EncryptedSeedPhrase, error) {
+	query := `
+		SELECT id, seed_phrase FROM users
+		WHERE id > $1 AND seed_phrase IS NOT NULL AND seed_phrase <> ''
+		ORDER BY id
+		LIMIT $2`
+	rows, err := s.db.Query(ctx, query, after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get seed phrases: %w", err)
+	}
+	defer rows.Close()
+
+	seedPhrases := make([]*types.EncryptedSeedPhrase, 0, limit)
+	for rows.Next() {
+		seedPhrase := new(types.EncryptedSeedPhrase)
+		if err := rows.Scan(&seedPhrase.UserID, &seedPhrase.SeedPhrase); err != nil {
+			return nil, fmt.Errorf("failed to scan seed phrase: %w", err)
+		}
+		seedPhrases = append(seedPhrases, seedPhrase)
+	}
+	return seedPhrases, rows.Err()
+}
+
+// ReplaceUserSeedPhrase swaps the stored seed phrase of a user, only if it is still old. It
+// returns false when it changed in the meantime.
+func (s *PostgresStore) ReplaceUserSeedPhrase(ctx context.Context, userID uuid.UUID, old string, replacement string) (bool, error) {
+	query := `UPDATE users SET seed_phrase = $3, updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND seed_phrase = $2`
+	tag, err := s.db.Exec(ctx, query, userID, old, replacement)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace seed phrase: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ReplaceUserWallet gives the user another wallet, only if their seed phrase is still
+// oldSeedPhrase. It returns false when it changed in the meantime.
+func (s *PostgresStore) ReplaceUserWallet(ctx context.Context, userID uuid.UUID, oldSeedPhrase string, seedPhrase string, walletAddress string) (bool, error) {
+	query := `
+		UPDATE users SET seed_phrase = $3, wallet_address = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND COALESCE(seed_phrase, '') = $2`
+	tag, err := s.db.Exec(ctx, query, userID, oldSeedPhrase, seedPhrase, walletAddress)
+	if err != nil {
+		return false, fmt.Errorf("failed to replace wallet: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ******************** Wallet audit operations ********************
+
+const walletAuditEventColumns = `id, user_id, action, wallet_address, previous_wallet_address, session_id,
+	ip_address, user_agent, created_at`
+
+const insertWalletAuditEventQuery = `INSERT INTO wallet_audit_events (` + walletAuditEventColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+func walletAuditEventArgs(event *types.WalletAuditEvent) []interface{} {
+	return []interface{}{
+		event.ID,
+		event.UserID,
+		event.Action,
+		event.WalletAddress,
+		event.PreviousWalletAddress,
+		event.SessionID,
+		event.IPAddress,
+		event.UserAgent,
+		event.CreatedAt,
+	}
+}
+
+func (s *PostgresStore) CreateWalletAuditEvent(ctx context.Context, event *types.WalletAuditEvent) error {
+	if _, err := s.db.Exec(ctx, insertWalletAuditEventQuery, walletAuditEventArgs(event)...); err != nil {
+		return fmt.Errorf("failed to create wallet audit event: %w", err)
+	}
+	return nil
+}
+
+// RecordWalletExport writes an export to the audit log, unless the user already exported their
+// mnemonic after since. The user's row stays locked from the check to the insert, so of two
+// exports at the same time only one gets in. It returns the recent export that was found, nil
+// once the new one is recorded.
+func (s *PostgresStore) RecordWalletExport(ctx context.Context, event *types.WalletAuditEvent, since time.Time) (*types.WalletAuditEvent, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID uuid.UUID
+	if err := tx.QueryRow(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, event.UserID).Scan(&userID); err != nil {
+		return nil, fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	query := `SELECT ` + walletAuditEventColumns + ` FROM wallet_audit_events
+		WHERE user_id = $1 AND action = $2 AND created_at > $3
+		ORDER BY created_at DESC
+		LIMIT 1`
+	recent, err := scanIntoWalletAuditEvent(tx.QueryRow(ctx, query, event.UserID, types.WalletAuditExport, since))
+	if err == nil {
+		return recent, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, insertWalletAuditEventQuery, walletAuditEventArgs(event)...); err != nil {
+		return nil, fmt.Errorf("failed to create wallet audit event: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit wallet export: %w", err)
+	}
+	return nil, nil
+}
+
+// GetLastWalletAuditEvent returns the latest event of the action for the user, nil if there is none
+func (s *PostgresStore) GetLastWalletAuditEvent(ctx context.Context, userID uuid.UUID, action string) (*types.WalletAuditEvent, error) {
+	query := `SELECT ` + walletAuditEventColumns + ` FROM wallet_audit_events
+		WHERE user_id = $1 AND action = $2
+		ORDER BY created_at DESC
+		LIMIT 1`
+	event, err := scanIntoWalletAuditEvent(s.db.QueryRow(ctx, query, userID, action))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return event, err
+}
+
 // ******************** Scan functions ********************
 // Scan functions are essential utilities that map database query results into Go structs.
 // They handle the conversion of raw database rows into strongly-typed application objects,
@@ -445,6 +1254,7 @@ func scanIntoUser(row pgx.Row) (*types.User, error) {
 		&user.SeedPhrase,
 		&user.WalletAddress,
 		&user.JWT,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -478,6 +1288,7 @@ func scanIntoWritingSession(row pgx.Row) (*types.WritingSession, error) {
 		&ws.Status,
 		&ankyID,
 		&ws.IsOnboarding,
+		&ws.Language,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan writing session: %w", err)
@@ -498,6 +1309,7 @@ func scanIntoWritingSession(row pgx.Row) (*types.WritingSession, error) {
 
 func scanIntoAnky(row pgx.Row) (*types.Anky, error) {
 	anky := new(types.Anky)
+	var status string
 	err := row.Scan(
 		&anky.ID,
 		&anky.UserID,
@@ -508,17 +1320,69 @@ func scanIntoAnky(row pgx.Row) (*types.Anky, error) {
 		&anky.FollowUpPrompt,
 		&anky.ImageURL,
 		&anky.ImageIPFSHash,
-		&anky.Status,
+		&status,
 		&anky.CastHash,
 		&anky.CreatedAt,
 		&anky.LastUpdatedAt,
+		&anky.FID,
+		&anky.ImageGenerationID,
+		&anky.PromptVersion,
+		&anky.ImageRequestedAt,
+		&anky.ImageCandidates,
+		&anky.ImageChooseBy,
+		&anky.ChosenImageURL,
+		&anky.ImageChosenBy,
+		&anky.ImageAlternates,
+		&anky.WritingIPFSHash,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan anky: %w", err)
 	}
+	anky.Status = types.AnkyStatus(status)
 	return anky, nil
 }
 
+func scanIntoAnkyStatusTransition(row pgx.Row) (*types.AnkyStatusTransition, error) {
+	transition := new(types.AnkyStatusTransition)
+	var fromStatus, toStatus string
+	err := row.Scan(
+		&transition.ID,
+		&transition.AnkyID,
+		&fromStatus,
+		&toStatus,
+		&transition.Error,
+		&transition.Attempt,
+		&transition.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan anky status transition: %w", err)
+	}
+	transition.FromStatus = types.AnkyStatus(fromStatus)
+	transition.ToStatus = types.AnkyStatus(toStatus)
+	return transition, nil
+}
+
+func scanIntoAnkyJob(row pgx.Row) (*types.AnkyJob, error) {
+	job := new(types.AnkyJob)
+	err := row.Scan(
+		&job.ID,
+		&job.AnkyID,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAfter,
+		&job.LockedBy,
+		&job.LockedUntil,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan anky job: %w", err)
+	}
+	return job, nil
+}
+
 func scanIntoBadge(row pgx.Row) (*types.Badge, error) {
 	badge := new(types.Badge)
 	err := row.Scan(
@@ -532,3 +1396,83 @@ func scanIntoBadge(row pgx.Row) (*types.Badge, error) {
 	}
 	return badge, nil
 }
+
+func scanIntoUpload(row pgx.Row) (*types.Upload, error) {
+	upload := new(types.Upload)
+	err := row.Scan(
+		&upload.ID,
+		&upload.UserID,
+		&upload.Kind,
+		&upload.AnkyID,
+		&upload.BlobKey,
+		&upload.ThumbnailKey,
+		&upload.URL,
+		&upload.ThumbnailURL,
+		&upload.ContentType,
+		&upload.SizeBytes,
+		&upload.Width,
+		&upload.Height,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan upload: %w", err)
+	}
+	return upload, nil
+}
+
+func scanIntoSession(row pgx.Row) (*types.Session, error) {
+	session := new(types.Session)
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.RefreshTokenHash,
+		&session.PreviousRefreshTokenHash,
+		&session.StartTime,
+		&session.EndTime,
+		&session.LastActivity,
+		&session.ExpiresAt,
+		&session.Status,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan session: %w", err)
+	}
+	return session, nil
+}
+
+func scanIntoDailyUsage(row pgx.Row) (*types.DailyUsage, error) {
+	usage := new(types.DailyUsage)
+	err := row.Scan(
+		&usage.UserID,
+		&usage.Day,
+		&usage.LLMCalls,
+		&usage.PromptTokens,
+		&usage.ResponseTokens,
+		&usage.ImageGenerations,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan daily usage: %w", err)
+	}
+	return usage, nil
+}
+
+func scanIntoWalletAuditEvent(row pgx.Row) (*types.WalletAuditEvent, error) {
+	event := new(types.WalletAuditEvent)
+	err := row.Scan(
+		&event.ID,
+		&event.UserID,
+		&event.Action,
+		&event.WalletAddress,
+		&event.PreviousWalletAddress,
+		&event.SessionID,
+		&event.IPAddress,
+		&event.UserAgent,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan wallet audit event: %w", err)
+	}
+	return event, nil
+}
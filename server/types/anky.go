@@ -1,14 +1,9 @@
 package types
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/ecdsa"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -32,6 +27,8 @@ type CreatePrivyUserRequest struct {
 	UserID         uuid.UUID       `json:"user_id"`
 	PrivyUser      *PrivyUser      `json:"privy_user"`
 	LinkedAccounts []LinkedAccount `json:"linked_accounts"`
+	// The Privy user to link is the one of this token
+	PrivyAccessToken string `json:"privy_access_token"`
 }
 
 type CreateWritingSessionRequest struct {
@@ -74,11 +71,12 @@ type User struct {
 	FarcasterUser   *FarcasterUser   `json:"farcaster_user"`
 	FID             int              `json:"fid"`
 	Settings        *UserSettings    `json:"settings"`
-	SeedPhrase      string           `json:"seed_phrase"`
+	SeedPhrase      string           `json:"-"` // encrypted, see POST /users/{userId}/wallet/export
 	WalletAddress   string           `json:"wallet_address"`
+	Role            string           `json:"role"`
 	CreatedAt       time.Time        `json:"created_at"`
 	UpdatedAt       time.Time        `json:"updated_at"`
-	JWT             string           `json:"jwt"`
+	JWT             string           `json:"-"` // the token of the users from before sessions
 	WritingSessions []WritingSession `json:"writing_sessions"`
 	Ankys           []Anky           `json:"ankys"`
 	Badges          []Badge          `json:"badges"`
@@ -86,6 +84,18 @@ type User struct {
 	UserMetadata    *UserMetadata    `json:"user_metadata"`
 }
 
+// EncryptedSeedPhrase is the seed phrase of a user as it is stored, see EncryptString
+type EncryptedSeedPhrase struct {
+	UserID     uuid.UUID
+	SeedPhrase string
+}
+
+// Roles of the users, admins can see the lists of all the users and all the Ankys
+const (
+	UserRoleUser  = "user"
+	UserRoleAdmin = "admin"
+)
+
 type FarcasterUser struct {
 	FID            int    `json:"fid"`
 	Username       string `json:"username"`
@@ -113,16 +123,34 @@ type UserMetadata struct {
 	InstallationSource string    `json:"installation_source"`
 }
 
+// Session is a sign-in of a user. Its refresh token is exchanged for new access tokens until
+// the session expires or the user signs out, and it changes on every exchange: only its hash is
+// kept, with the hash of the one before to recognize a stolen token being used again.
 type Session struct {
-	ID           uuid.UUID `json:"id"`
-	UserID       uuid.UUID `json:"user_id"`
-	StartTime    time.Time `json:"start_time"`
-	EndTime      time.Time `json:"end_time"`
-	LastActivity time.Time `json:"last_activity"`
-	Status       string    `json:"status"` // active, expired, ended
-	JWT          string    `json:"jwt"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID                       uuid.UUID  `json:"id"`
+	UserID                   uuid.UUID  `json:"user_id"`
+	RefreshTokenHash         string     `json:"-"`
+	PreviousRefreshTokenHash string     `json:"-"`
+	StartTime                time.Time  `json:"start_time"`
+	EndTime                  *time.Time `json:"end_time"`
+	LastActivity             time.Time  `json:"last_activity"`
+	ExpiresAt                time.Time  `json:"expires_at"`
+	Status                   string     `json:"status"` // active, ended, revoked
+	UserAgent                string     `json:"user_agent"`
+	CreatedAt                time.Time  `json:"created_at"`
+	UpdatedAt                time.Time  `json:"updated_at"`
+}
+
+// Statuses of a session
+const (
+	SessionStatusActive  = "active"
+	SessionStatusEnded   = "ended"   // the user signed out
+	SessionStatusRevoked = "revoked" // an old refresh token was used again
+)
+
+// IsActive says if the session can still be used at the time
+func (s *Session) IsActive(now time.Time) bool {
+	return s.Status == SessionStatusActive && now.Before(s.ExpiresAt)
 }
 
 type Badge struct {
@@ -192,6 +220,12 @@ type WritingSession struct {
 	// Anky-related fields
 	AnkyID *uuid.UUID `json:"anky_id" bson:"anky_id"`
 	Anky   *Anky      `json:"anky" bson:"anky"`
+
+	// Verdict is computed when the session ends, it is not stored
+	Verdict *AnkyVerdict `json:"verdict,omitempty" bson:"-"`
+
+	// Language detected from the writing, as an ISO 639-1 code. Empty when it wasn't clear.
+	Language string `json:"language" bson:"language"`
 }
 
 type Anky struct {
@@ -204,12 +238,54 @@ type Anky struct {
 	FollowUpPrompt   string    `json:"follow_up_prompt" bson:"follow_up_prompt"`
 	ImageURL         string    `json:"image_url" bson:"image_url"`
 	ImageIPFSHash    string    `json:"image_ipfs_hash" bson:"image_ipfs_hash"`
-	Status           string    `json:"status" bson:"status"`
+	// CID of the raw file of the writing session
+	WritingIPFSHash string     `json:"writing_ipfs_hash" bson:"writing_ipfs_hash"`
+	Status          AnkyStatus `json:"status" bson:"status"`
 
 	CastHash      string    `json:"cast_hash" bson:"cast_hash"`
 	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
 	LastUpdatedAt time.Time `json:"last_updated_at" bson:"last_updated_at"`
 	FID           int       `json:"fid" bson:"fid"`
+
+	// ID of the image job on the image generation backend, kept so that a restarted
+	// processing job can pick up the same image instead of generating a new one
+	ImageGenerationID string `json:"image_generation_id" bson:"image_generation_id"`
+
+	// When the image was asked for, the time the image backend has to generate it starts there
+	ImageRequestedAt *time.Time `json:"image_requested_at" bson:"image_requested_at"`
+
+	// Images the backend generated, for the writer to choose from until ImageChooseBy
+	ImageCandidates []string   `json:"image_candidates" bson:"image_candidates"`
+	ImageChooseBy   *time.Time `json:"image_choose_by" bson:"image_choose_by"`
+	// The candidate that became the image of the Anky, chosen by the user or auto
+	ChosenImageURL string `json:"chosen_image_url" bson:"chosen_image_url"`
+	ImageChosenBy  string `json:"image_chosen_by" bson:"image_chosen_by"`
+	// Uploaded copies of the candidates that were not chosen
+	ImageAlternates []string `json:"image_alternates" bson:"image_alternates"`
+
+	// Version of the prompt that generated the reflection, like reflection/v1
+	PromptVersion string `json:"prompt_version" bson:"prompt_version"`
+}
+
+// Who chose the image of an Anky
+const (
+	ImageChosenByUser = "user"
+	ImageChosenByAuto = "auto"
+)
+
+// AnkyJob is a unit of work of the Anky processing queue
+type AnkyJob struct {
+	ID          uuid.UUID  `json:"id"`
+	AnkyID      uuid.UUID  `json:"anky_id"`
+	Status      string     `json:"status"` // queued, running, succeeded, dead
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	RunAfter    time.Time  `json:"run_after"`
+	LockedBy    *string    `json:"locked_by"`
+	LockedUntil *time.Time `json:"locked_until"`
+	LastError   *string    `json:"last_error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
 type AnkyOnProfile struct {
@@ -230,10 +306,33 @@ type AnkyOnboardingResponse struct {
 	ResponseToUser            string    `json:"response_to_user" bson:"response_to_user"`
 	RepliedToWritingSessionID uuid.UUID `json:"replied_to_writing_session_id" bson:"replied_to_writing_session_id"`
 	AiModelUsed               string    `json:"ai_model_used" bson:"ai_model_used"`
+	PromptVersion             string    `json:"prompt_version" bson:"prompt_version"`
+}
+
+// PromptTemplate is a version of a system prompt stored in the database
+type PromptTemplate struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Template  string    `json:"template"`
+	Weight    int       `json:"weight"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 func (ws *WritingSession) IsValidAnky() bool {
-	return ws.TimeSpent != nil && *ws.TimeSpent >= 480 // 8 minutes in seconds
+	if ws.Verdict != nil {
+		return ws.Verdict.Valid
+	}
+	return ws.TimeSpent != nil && *ws.TimeSpent >= AnkyDurationSeconds
+}
+
+// ApplyVerdict derives the time spent, IsAnky and the status of the session from the verdict
+func (ws *WritingSession) ApplyVerdict(verdict *AnkyVerdict) {
+	timeSpent := int(verdict.TotalMs / 1000)
+	ws.Verdict = verdict
+	ws.TimeSpent = &timeSpent
+	ws.SetAnkyStatus()
 }
 
 func (ws *WritingSession) SetAnkyStatus() {
@@ -269,6 +368,7 @@ func NewUser(id uuid.UUID, isAnonymous bool, createdAt time.Time, userMetadata *
 		ID:            id,
 		SeedPhrase:    string(encryptedMnemonic),
 		WalletAddress: address,
+		Role:          UserRoleUser,
 		IsAnonymous:   isAnonymous,
 		UserMetadata:  userMetadata,
 		CreatedAt:     createdAt,
@@ -296,7 +396,7 @@ func NewAnky(writingSessionID uuid.UUID, chosenPrompt string, userID uuid.UUID)
 	return &Anky{
 		ID:               uuid.New(),
 		UserID:           userID,
-		Status:           "created",
+		Status:           AnkyStatusCreated,
 		WritingSessionID: writingSessionID,
 		ChosenPrompt:     chosenPrompt,
 		CreatedAt:        time.Now().UTC(),
@@ -328,11 +428,8 @@ func (s *WalletService) CreateNewWallet() (string, string, error) {
 	}
 	log.Println("Successfully generated mnemonic")
 
-	// Create seed from mnemonic
-	seed := bip39.NewSeed(mnemonic, "")
-
-	// Generate private key from seed
-	privateKey, err := crypto.ToECDSA(seed[:32])
+	// The first account of the wallet, m/44'/60'/0'/0/0
+	privateKey, err := DeriveAccountKey(mnemonic, 0)
 	if err != nil {
 		log.Printf("Error generating private key: %v", err)
 		return "", "", fmt.Errorf("failed to generate private key: %v", err)
@@ -349,9 +446,15 @@ func (s *WalletService) GetAddressFromPrivateKey(privateKey *ecdsa.PrivateKey) c
 	return crypto.PubkeyToAddress(privateKey.PublicKey)
 }
 
+// GetPrivateKeyFromMnemonic returns the key of the first account of the wallet, the one whose
+// address the users see
 func (s *WalletService) GetPrivateKeyFromMnemonic(mnemonic string) (*ecdsa.PrivateKey, error) {
-	seed := bip39.NewSeed(mnemonic, "")
-	privateKey, err := crypto.ToECDSA(seed[:32])
+	return s.GetAccountKeyFromMnemonic(mnemonic, 0)
+}
+
+// GetAccountKeyFromMnemonic returns the key of the account at index, m/44'/60'/0'/0/index
+func (s *WalletService) GetAccountKeyFromMnemonic(mnemonic string, index uint32) (*ecdsa.PrivateKey, error) {
+	privateKey, err := DeriveAccountKey(mnemonic, index)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate private key from mnemonic: %v", err)
 	}
@@ -373,10 +476,10 @@ type ChatRequest struct {
 
 type LLMRequest struct {
 	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Messages []Message `json:"messages,omitempty"`
 	Stream   bool      `json:"stream"`
-	Format   string    `json:"format"`
-	Prompt   string    `json:"prompt"`
+	Format   string    `json:"format,omitempty"`
+	Prompt   string    `json:"prompt,omitempty"`
 }
 
 type StreamResponse struct {
@@ -494,93 +597,3 @@ type ChannelContext struct {
 	Role      string `json:"role"`
 	Following bool   `json:"following"`
 }
-
-func EncryptString(plaintext string) (string, error) {
-	// Get encryption key from environment
-	key, err := getEncryptionKey()
-	if err != nil {
-		return "", err
-	}
-
-	// Create cipher block
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	// Create GCM cipher mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	// Create nonce
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return "", err
-	}
-
-	// Encrypt and combine nonce + ciphertext
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-
-	// Encode as base64 for storage
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
-}
-
-func DecryptString(encryptedString string) (string, error) {
-	// Get encryption key from environment
-	key, err := getEncryptionKey()
-	if err != nil {
-		return "", err
-	}
-
-	// Decode from base64
-	ciphertext, err := base64.StdEncoding.DecodeString(encryptedString)
-	if err != nil {
-		return "", err
-	}
-
-	// Create cipher block
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	// Create GCM cipher mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	// Extract nonce from ciphertext
-	if len(ciphertext) < gcm.NonceSize() {
-		return "", fmt.Errorf("ciphertext too short")
-	}
-	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
-
-	// Decrypt
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
-
-	return string(plaintext), nil
-}
-
-func getEncryptionKey() ([]byte, error) {
-	encodedKey := os.Getenv("ENCRYPTION_KEY")
-	if encodedKey == "" {
-		return nil, fmt.Errorf("ENCRYPTION_KEY environment variable not set")
-	}
-
-	key, err := base64.StdEncoding.DecodeString(encodedKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode encryption key: %v", err)
-	}
-
-	if len(key) != 32 {
-		return nil, fmt.Errorf("decoded encryption key must be 32 bytes, got %d", len(key))
-	}
-
-	return key, nil
-}
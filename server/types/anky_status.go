@@ -0,0 +1,133 @@
+package types
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AnkyStatus is the step of its lifecycle an Anky is in
+type AnkyStatus string
+
+const (
+	AnkyStatusCreated              AnkyStatus = "created"
+	AnkyStatusStartingProcessing   AnkyStatus = "starting_processing"
+	AnkyStatusReflectionCompleted  AnkyStatus = "reflection_completed"
+	AnkyStatusGoingToGenerateImage AnkyStatus = "going_to_generate_image"
+	AnkyStatusGeneratingImage      AnkyStatus = "generating_image"
+	AnkyStatusImageGenerated       AnkyStatus = "image_generated"
+	AnkyStatusImageTimedOut        AnkyStatus = "image_timed_out"
+	AnkyStatusChoosingImage        AnkyStatus = "choosing_image"
+	AnkyStatusUploadingImage       AnkyStatus = "uploading_image"
+	AnkyStatusImageUploaded        AnkyStatus = "image_uploaded"
+	AnkyStatusCastingToFarcaster   AnkyStatus = "casting_to_farcaster"
+	AnkyStatusCompleted            AnkyStatus = "completed"
+	AnkyStatusFidLinked            AnkyStatus = "fid_linked"
+	AnkyStatusFailed               AnkyStatus = "failed"
+)
+
+// ankyStatusSteps are the statuses of the happy path, in order
+var ankyStatusSteps = []AnkyStatus{
+	AnkyStatusCreated,
+	AnkyStatusStartingProcessing,
+	AnkyStatusReflectionCompleted,
+	AnkyStatusGoingToGenerateImage,
+	AnkyStatusGeneratingImage,
+	AnkyStatusImageGenerated,
+	AnkyStatusChoosingImage,
+	AnkyStatusUploadingImage,
+	AnkyStatusImageUploaded,
+	AnkyStatusCastingToFarcaster,
+	AnkyStatusCompleted,
+	AnkyStatusFidLinked,
+}
+
+// ankyStatusTransitions lists the statuses each status can move to. Any status that is not
+// final can also move to failed, and every status can be entered again to retry its step.
+var ankyStatusTransitions = map[AnkyStatus][]AnkyStatus{
+	AnkyStatusCreated:              {AnkyStatusStartingProcessing},
+	AnkyStatusStartingProcessing:   {AnkyStatusReflectionCompleted},
+	AnkyStatusReflectionCompleted:  {AnkyStatusGoingToGenerateImage},
+	AnkyStatusGoingToGenerateImage: {AnkyStatusGeneratingImage},
+	AnkyStatusGeneratingImage:      {AnkyStatusImageGenerated, AnkyStatusGoingToGenerateImage, AnkyStatusImageTimedOut},
+	AnkyStatusImageTimedOut:        {AnkyStatusGoingToGenerateImage, AnkyStatusImageGenerated},
+	AnkyStatusImageGenerated:       {AnkyStatusChoosingImage},
+	AnkyStatusChoosingImage:        {AnkyStatusUploadingImage},
+	AnkyStatusUploadingImage:       {AnkyStatusImageUploaded},
+	AnkyStatusImageUploaded:        {AnkyStatusCastingToFarcaster},
+	AnkyStatusCastingToFarcaster:   {AnkyStatusCompleted},
+	AnkyStatusCompleted:            {AnkyStatusFidLinked},
+	AnkyStatusFidLinked:            {},
+	AnkyStatusFailed:               {},
+}
+
+// AnkyFinalStatuses are the statuses of Ankys that don't need any more processing
+var AnkyFinalStatuses = []AnkyStatus{AnkyStatusCompleted, AnkyStatusFidLinked, AnkyStatusFailed}
+
+// IsFinal tells if an Anky in this status doesn't need any more processing
+func (s AnkyStatus) IsFinal() bool {
+	return slices.Contains(AnkyFinalStatuses, s)
+}
+
+// Reached tells if an Anky in this status already went through the given step of the happy path.
+// An Anky whose image timed out is back to asking for one.
+func (s AnkyStatus) Reached(step AnkyStatus) bool {
+	if s == AnkyStatusImageTimedOut {
+		s = AnkyStatusGoingToGenerateImage
+	}
+	current := slices.Index(ankyStatusSteps, s)
+	return current >= 0 && current >= slices.Index(ankyStatusSteps, step)
+}
+
+// CanTransitionTo tells if an Anky can move from this status to next
+func (s AnkyStatus) CanTransitionTo(next AnkyStatus) bool {
+	allowed, known := ankyStatusTransitions[s]
+	if !known {
+		return false
+	}
+	if next == s && !s.IsFinal() {
+		return true
+	}
+	if next == AnkyStatusFailed && !s.IsFinal() {
+		return true
+	}
+	return slices.Contains(allowed, next)
+}
+
+// TransitionTo moves the Anky to the next status, failing if the move is not allowed
+func (a *Anky) TransitionTo(next AnkyStatus) error {
+	if !a.Status.CanTransitionTo(next) {
+		return fmt.Errorf("invalid anky status transition from %s to %s", a.Status, next)
+	}
+	a.Status = next
+	return nil
+}
+
+// AnkyStatusTransition is a row of an Anky's status history
+type AnkyStatusTransition struct {
+	ID         uuid.UUID  `json:"id"`
+	AnkyID     uuid.UUID  `json:"anky_id"`
+	FromStatus AnkyStatus `json:"from_status"`
+	ToStatus   AnkyStatus `json:"to_status"`
+	Error      *string    `json:"error"`
+	Attempt    int        `json:"attempt"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func NewAnkyStatusTransition(ankyID uuid.UUID, from AnkyStatus, to AnkyStatus, attempt int, cause error) *AnkyStatusTransition {
+	transition := &AnkyStatusTransition{
+		ID:         uuid.New(),
+		AnkyID:     ankyID,
+		FromStatus: from,
+		ToStatus:   to,
+		Attempt:    attempt,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if cause != nil {
+		message := cause.Error()
+		transition.Error = &message
+	}
+	return transition
+}
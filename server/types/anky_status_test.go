@@ -0,0 +1,50 @@
+package types
+
+import "testing"
+
+func TestAnkyStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from AnkyStatus
+		to   AnkyStatus
+		want bool
+	}{
+		{AnkyStatusGeneratingImage, AnkyStatusImageGenerated, true},
+		{AnkyStatusGeneratingImage, AnkyStatusImageTimedOut, true},
+		{AnkyStatusImageTimedOut, AnkyStatusGoingToGenerateImage, true},
+		{AnkyStatusImageTimedOut, AnkyStatusImageGenerated, true},
+		{AnkyStatusImageTimedOut, AnkyStatusFailed, true},
+		{AnkyStatusImageTimedOut, AnkyStatusUploadingImage, false},
+		{AnkyStatusReflectionCompleted, AnkyStatusImageTimedOut, false},
+		{AnkyStatusFailed, AnkyStatusGoingToGenerateImage, false},
+		{AnkyStatusImageGenerated, AnkyStatusChoosingImage, true},
+		{AnkyStatusImageGenerated, AnkyStatusUploadingImage, false},
+		{AnkyStatusChoosingImage, AnkyStatusUploadingImage, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s -> %s: expected %t, got %t", tt.from, tt.to, tt.want, got)
+		}
+	}
+}
+
+func TestAnkyStatusReached(t *testing.T) {
+	tests := []struct {
+		status AnkyStatus
+		step   AnkyStatus
+		want   bool
+	}{
+		{AnkyStatusImageGenerated, AnkyStatusGeneratingImage, true},
+		{AnkyStatusGeneratingImage, AnkyStatusImageGenerated, false},
+		// An Anky whose image timed out keeps its reflection but asks for a new image
+		{AnkyStatusImageTimedOut, AnkyStatusReflectionCompleted, true},
+		{AnkyStatusImageTimedOut, AnkyStatusGeneratingImage, false},
+		{AnkyStatusFailed, AnkyStatusCreated, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.status.Reached(tt.step); got != tt.want {
+			t.Errorf("%s reached %s: expected %t, got %t", tt.status, tt.step, tt.want, got)
+		}
+	}
+}
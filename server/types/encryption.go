@@ -0,0 +1,408 @@
+package types
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encryption
+//
+// Secrets like the seed phrases are stored with envelope encryption: every value is encrypted
+// with its own random data key (AES-256-GCM), and the data key is encrypted with a master key.
+// The master keys are versioned and the version is written in front of the stored value,
+// "v<version>:<base64>", so the master key can be rotated: new values use the newest key, the
+// older values stay readable as long as their key is configured, and the re-encryption job
+// (services.SeedPhraseRotator) moves them to the newest key.
+//
+// The master keys come from a KeyProvider, either
+//   - ENCRYPTION_KEYS="1:<base64 key>,2:<base64 key>" (EnvKeyProvider), or
+//   - ENCRYPTION_KEYS_FILE, a file with a "<version>:<base64 key>" line per key (FileKeyProvider),
+//     read again whenever it changes.
+//
+// The newest key is the one with the highest version. ENCRYPTION_KEY, the single key used before
+// the envelopes, is version 0 with both: it keeps decrypting the values it encrypted (plain
+// base64, no version) and is the master key until a newer one is configured.
+
+// masterKeySize is the size of the master keys and the data keys, AES-256
+const masterKeySize = 32
+
+// ErrUnknownKeyVersion is returned for a value encrypted with a master key that isn't configured
+var ErrUnknownKeyVersion = errors.New("unknown encryption key version")
+
+// MasterKey is a version of the key the data keys are encrypted with
+type MasterKey struct {
+	Version uint32
+	Key     []byte
+}
+
+// KeyProvider gives the master keys
+type KeyProvider interface {
+	// CurrentKey is the key new values are encrypted with
+	CurrentKey() (*MasterKey, error)
+	// Key returns the key of a version, or ErrUnknownKeyVersion
+	Key(version uint32) (*MasterKey, error)
+}
+
+// keyRing holds the configured master keys by version
+type keyRing map[uint32][]byte
+
+func (k keyRing) current() (*MasterKey, error) {
+	if len(k) == 0 {
+		return nil, errors.New("no encryption key configured, set ENCRYPTION_KEYS, ENCRYPTION_KEYS_FILE or ENCRYPTION_KEY")
+	}
+	current := &MasterKey{}
+	for version, key := range k {
+		if current.Key == nil || version > current.Version {
+			current = &MasterKey{Version: version, Key: key}
+		}
+	}
+	return current, nil
+}
+
+func (k keyRing) key(version uint32) (*MasterKey, error) {
+	key, ok := k[version]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownKeyVersion, version)
+	}
+	return &MasterKey{Version: version, Key: key}, nil
+}
+
+// parseKeyRing reads "<version>:<base64 key>" entries, blank ones are skipped. legacyKey, the
+// base64 ENCRYPTION_KEY, is version 0 if it is set.
+func parseKeyRing(entries []string, legacyKey string) (keyRing, error) {
+	keys := make(keyRing)
+	if legacyKey != "" {
+		key, err := decodeMasterKey(legacyKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_KEY: %v", err)
+		}
+		keys[0] = key
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		versionString, encodedKey, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("invalid encryption key, expected <version>:<base64 key>")
+		}
+		version, err := strconv.ParseUint(strings.TrimSpace(versionString), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key version %q: %v", versionString, err)
+		}
+		key, err := decodeMasterKey(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", version, err)
+		}
+		if _, exists := keys[uint32(version)]; exists {
+			return nil, fmt.Errorf("encryption key %d is configured twice", version)
+		}
+		keys[uint32(version)] = key
+	}
+	return keys, nil
+}
+
+func decodeMasterKey(encodedKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encryption key: %v", err)
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("decoded encryption key must be %d bytes, got %d", masterKeySize, len(key))
+	}
+	return key, nil
+}
+
+// EnvKeyProvider reads the master keys from ENCRYPTION_KEYS and ENCRYPTION_KEY
+type EnvKeyProvider struct{}
+
+func (EnvKeyProvider) keys() (keyRing, error) {
+	return parseKeyRing(strings.Split(os.Getenv("ENCRYPTION_KEYS"), ","), os.Getenv("ENCRYPTION_KEY"))
+}
+
+func (p EnvKeyProvider) CurrentKey() (*MasterKey, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.current()
+}
+
+func (p EnvKeyProvider) Key(version uint32) (*MasterKey, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.key(version)
+}
+
+// FileKeyProvider reads the master keys from a file, one "<version>:<base64 key>" line per key.
+// The file is read again when it changes, so a key can be added without restarting.
+type FileKeyProvider struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	ring    keyRing
+}
+
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path: path}
+}
+
+func (p *FileKeyProvider) keys() (keyRing, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption keys: %v", err)
+	}
+	if p.ring != nil && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.ring, nil
+	}
+
+	file, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading encryption keys: %v", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading encryption keys: %v", err)
+	}
+
+	ring, err := parseKeyRing(lines, os.Getenv("ENCRYPTION_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.path, err)
+	}
+	p.ring, p.modTime, p.size = ring, info.ModTime(), info.Size()
+	return ring, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (*MasterKey, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.current()
+}
+
+func (p *FileKeyProvider) Key(version uint32) (*MasterKey, error) {
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	return keys.key(version)
+}
+
+// NewKeyProviderFromEnv returns the file provider if ENCRYPTION_KEYS_FILE is set, the
+// environment one otherwise
+func NewKeyProviderFromEnv() KeyProvider {
+	if path := os.Getenv("ENCRYPTION_KEYS_FILE"); path != "" {
+		return NewFileKeyProvider(path)
+	}
+	return EnvKeyProvider{}
+}
+
+var (
+	defaultKeyProviderMu sync.Mutex
+	defaultKeyProvider   KeyProvider
+)
+
+// DefaultKeyProvider is the provider of EncryptString and DecryptString, configured from the
+// environment the first time it is needed
+func DefaultKeyProvider() KeyProvider {
+	defaultKeyProviderMu.Lock()
+	defer defaultKeyProviderMu.Unlock()
+	if defaultKeyProvider == nil {
+		defaultKeyProvider = NewKeyProviderFromEnv()
+	}
+	return defaultKeyProvider
+}
+
+// SetKeyProvider replaces the provider of EncryptString and DecryptString
+func SetKeyProvider(provider KeyProvider) {
+	defaultKeyProviderMu.Lock()
+	defer defaultKeyProviderMu.Unlock()
+	defaultKeyProvider = provider
+}
+
+func EncryptString(plaintext string) (string, error) {
+	return EncryptStringWith(DefaultKeyProvider(), plaintext)
+}
+
+func DecryptString(encryptedString string) (string, error) {
+	return DecryptStringWith(DefaultKeyProvider(), encryptedString)
+}
+
+// EncryptStringWith encrypts plaintext with a new data key, wrapped by the current master key
+func EncryptStringWith(provider KeyProvider, plaintext string) (string, error) {
+	master, err := provider.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	// The version is authenticated with the data key, it can't be swapped for another one
+	prefix := versionPrefix(master.Version)
+	wrappedKey, err := seal(master.Key, dataKey, []byte(prefix))
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + base64.StdEncoding.EncodeToString(append(wrappedKey, ciphertext...)), nil
+}
+
+// DecryptStringWith decrypts a value encrypted by EncryptStringWith, or by the single key used
+// before the envelopes
+func DecryptStringWith(provider KeyProvider, encryptedString string) (string, error) {
+	version, enveloped, err := EncryptionKeyVersion(encryptedString)
+	if err != nil {
+		return "", err
+	}
+	master, err := provider.Key(version)
+	if err != nil {
+		return "", err
+	}
+
+	if !enveloped {
+		ciphertext, err := base64.StdEncoding.DecodeString(encryptedString)
+		if err != nil {
+			return "", err
+		}
+		plaintext, err := open(master.Key, ciphertext, nil)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	}
+
+	prefix := versionPrefix(version)
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encryptedString, prefix))
+	if err != nil {
+		return "", err
+	}
+	wrappedKeySize := sealedSize(masterKeySize)
+	if len(blob) < wrappedKeySize {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	dataKey, err := open(master.Key, blob[:wrappedKeySize], []byte(prefix))
+	if err != nil {
+		return "", fmt.Errorf("error unwrapping the data key: %v", err)
+	}
+	plaintext, err := open(dataKey, blob[wrappedKeySize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptionKeyVersion is the version of the master key a value was encrypted with. The values
+// encrypted before the envelopes aren't enveloped, they use ENCRYPTION_KEY, version 0.
+func EncryptionKeyVersion(encryptedString string) (uint32, bool, error) {
+	// The legacy values are plain base64, which never contains a colon
+	prefix, _, enveloped := strings.Cut(encryptedString, ":")
+	if !enveloped {
+		return 0, false, nil
+	}
+	version, err := strconv.ParseUint(strings.TrimPrefix(prefix, "v"), 10, 32)
+	if err != nil || !strings.HasPrefix(prefix, "v") {
+		return 0, false, fmt.Errorf("invalid encryption key version %q", prefix)
+	}
+	return uint32(version), true, nil
+}
+
+// ReencryptString encrypts a value again with the current master key. It returns false, and
+// the value unchanged, when it already uses it.
+func ReencryptString(provider KeyProvider, encryptedString string) (string, bool, error) {
+	current, err := provider.CurrentKey()
+	if err != nil {
+		return "", false, err
+	}
+	version, enveloped, err := EncryptionKeyVersion(encryptedString)
+	if err != nil {
+		return "", false, err
+	}
+	if enveloped && version == current.Version {
+		return encryptedString, false, nil
+	}
+
+	plaintext, err := DecryptStringWith(provider, encryptedString)
+	if err != nil {
+		return "", false, err
+	}
+	reencrypted, err := EncryptStringWith(provider, plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return reencrypted, true, nil
+}
+
+func versionPrefix(version uint32) string {
+	return fmt.Sprintf("v%d:", version)
+}
+
+// seal encrypts with AES-GCM, the random nonce goes in front of the ciphertext
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// sealedSize is the size of what seal returns for a plaintext of size bytes
+func sealedSize(size int) int {
+	// 12 bytes of nonce, 16 of tag
+	return 12 + size + 16
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
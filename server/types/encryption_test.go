@@ -0,0 +1,158 @@
+package types
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, masterKeySize))
+}
+
+// legacyEncrypt is how the values were encrypted before the envelopes
+func legacyEncrypt(t *testing.T, encodedKey string, plaintext string) string {
+	t.Helper()
+	key, _ := base64.StdEncoding.DecodeString(encodedKey)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil))
+}
+
+func TestEnvelopeEncryption(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "")
+	t.Setenv("ENCRYPTION_KEYS", "1:"+testMasterKey(1)+", 2:"+testMasterKey(2))
+	provider := EnvKeyProvider{}
+
+	encrypted, err := EncryptStringWith(provider, "abandon about")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, "v2:") {
+		t.Errorf("expected the newest key version in front, got %s", encrypted)
+	}
+	if version, enveloped, err := EncryptionKeyVersion(encrypted); version != 2 || !enveloped || err != nil {
+		t.Errorf("expected version 2, got %d, %v, %v", version, enveloped, err)
+	}
+	if other, _ := EncryptStringWith(provider, "abandon about"); other == encrypted {
+		t.Error("expected every value to get its own data key and nonces")
+	}
+
+	decrypted, err := DecryptStringWith(provider, encrypted)
+	if err != nil || decrypted != "abandon about" {
+		t.Fatalf("expected the plaintext back, got %q and %v", decrypted, err)
+	}
+
+	// The version is authenticated
+	if _, err := DecryptStringWith(provider, "v1:"+strings.TrimPrefix(encrypted, "v2:")); err == nil {
+		t.Error("expected a swapped version to fail")
+	}
+
+	// Without its key, a value can't be read
+	t.Setenv("ENCRYPTION_KEYS", "1:"+testMasterKey(1))
+	if _, err := DecryptStringWith(provider, encrypted); !errors.Is(err, ErrUnknownKeyVersion) {
+		t.Errorf("expected ErrUnknownKeyVersion, got %v", err)
+	}
+}
+
+func TestLegacyValuesStayReadable(t *testing.T) {
+	legacyKey := testMasterKey(7)
+	t.Setenv("ENCRYPTION_KEY", legacyKey)
+	t.Setenv("ENCRYPTION_KEYS", "")
+	provider := EnvKeyProvider{}
+	legacy := legacyEncrypt(t, legacyKey, "test junk")
+
+	if version, enveloped, err := EncryptionKeyVersion(legacy); version != 0 || enveloped || err != nil {
+		t.Errorf("expected a legacy value, got %d, %v, %v", version, enveloped, err)
+	}
+	if decrypted, err := DecryptStringWith(provider, legacy); err != nil || decrypted != "test junk" {
+		t.Fatalf("expected the legacy value to decrypt, got %q and %v", decrypted, err)
+	}
+
+	// Until a newer key is configured, ENCRYPTION_KEY is the master key
+	encrypted, err := EncryptStringWith(provider, "test junk")
+	if err != nil || !strings.HasPrefix(encrypted, "v0:") {
+		t.Fatalf("expected a version 0 envelope, got %s and %v", encrypted, err)
+	}
+
+	// Then the re-encryption moves both to the new key
+	t.Setenv("ENCRYPTION_KEYS", "1:"+testMasterKey(1))
+	for _, value := range []string{legacy, encrypted} {
+		reencrypted, changed, err := ReencryptString(provider, value)
+		if err != nil || !changed || !strings.HasPrefix(reencrypted, "v1:") {
+			t.Fatalf("expected a version 1 envelope, got %s, %v and %v", reencrypted, changed, err)
+		}
+		if decrypted, _ := DecryptStringWith(provider, reencrypted); decrypted != "test junk" {
+			t.Errorf("expected the re-encrypted value to decrypt, got %q", decrypted)
+		}
+		if again, changed, _ := ReencryptString(provider, reencrypted); changed || again != reencrypted {
+			t.Error("expected a value on the current key to be left alone")
+		}
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		legacy  string
+		wantErr bool
+	}{
+		{"versions", []string{"1:" + testMasterKey(1), "# retired", "", "3:" + testMasterKey(3)}, "", false},
+		{"legacy and versions", []string{"1:" + testMasterKey(1)}, testMasterKey(0), false},
+		{"missing version", []string{testMasterKey(1)}, "", true},
+		{"short key", []string{"1:" + base64.StdEncoding.EncodeToString([]byte("short"))}, "", true},
+		{"duplicate", []string{"1:" + testMasterKey(1), "1:" + testMasterKey(2)}, "", true},
+		{"legacy twice", []string{"0:" + testMasterKey(1)}, testMasterKey(0), true},
+	}
+	for _, tt := range tests {
+		if _, err := parseKeyRing(tt.entries, tt.legacy); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	if _, err := (keyRing{}).current(); err == nil {
+		t.Error("expected an error without any key")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", "")
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("1:"+testMasterKey(1)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider := NewFileKeyProvider(path)
+
+	encrypted, err := EncryptStringWith(provider, "seed")
+	if err != nil || !strings.HasPrefix(encrypted, "v1:") {
+		t.Fatalf("expected a version 1 envelope, got %s and %v", encrypted, err)
+	}
+
+	// A key added to the file is picked up without restarting
+	if err := os.WriteFile(path, []byte("1:"+testMasterKey(1)+"\n2:"+testMasterKey(2)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := provider.CurrentKey(); err != nil || current.Version != 2 {
+		t.Fatalf("expected key 2 to be current, got %+v and %v", current, err)
+	}
+	if decrypted, err := DecryptStringWith(provider, encrypted); err != nil || decrypted != "seed" {
+		t.Errorf("expected the version 1 value to decrypt, got %q and %v", decrypted, err)
+	}
+}
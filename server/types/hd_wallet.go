@@ -0,0 +1,142 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// HD wallets
+//
+// The keys of the custodial wallets are derived from their mnemonic like every standard
+// Ethereum wallet does (MetaMask, Ledger, Rainbow...): BIP-39 seed, BIP-32 derivation along
+// the BIP-44 path m/44'/60'/0'/0/n, n being the index of the account. The same 12 words
+// imported anywhere else give the same addresses.
+//
+// The first wallets used the first 32 bytes of the seed as the private key instead. Their
+// address is only reachable through LegacyPrivateKeyFromMnemonic, see the wallet migration
+// tool in cmd/wallet-migration.
+
+const hardenedOffset = 0x80000000
+
+// ethereumAccountsPath is m/44'/60'/0'/0, the parent of the account keys
+var ethereumAccountsPath = []uint32{44 + hardenedOffset, 60 + hardenedOffset, 0 + hardenedOffset, 0}
+
+var errInvalidChildKey = errors.New("invalid child key")
+
+// DerivationPath is the BIP-44 path of the account at index
+func DerivationPath(index uint32) string {
+	return fmt.Sprintf("m/44'/60'/0'/0/%d", index)
+}
+
+// DeriveAccountKey returns the private key of the account at index of the mnemonic's wallet
+func DeriveAccountKey(mnemonic string, index uint32) (*ecdsa.PrivateKey, error) {
+	if index >= hardenedOffset {
+		return nil, fmt.Errorf("invalid account index %d", index)
+	}
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err)
+	}
+
+	key, err := deriveKey(seed, append(append([]uint32{}, ethereumAccountsPath...), index))
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive %s: %v", DerivationPath(index), err)
+	}
+	return key, nil
+}
+
+// LegacyPrivateKeyFromMnemonic is the key the first custodial wallets used, the first 32 bytes
+// of the seed. No other wallet derives it, it is only kept to find and move the funds left at
+// those addresses.
+func LegacyPrivateKeyFromMnemonic(mnemonic string) (*ecdsa.PrivateKey, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err)
+	}
+	return crypto.ToECDSA(seed[:32])
+}
+
+// deriveKey follows the BIP-32 path from the master key of seed
+func deriveKey(seed []byte, path []uint32) (*ecdsa.PrivateKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+
+	key, chainCode := new(big.Int).SetBytes(sum[:32]), sum[32:]
+	if key.Sign() == 0 || key.Cmp(crypto.S256().Params().N) >= 0 {
+		return nil, errors.New("invalid master key")
+	}
+
+	for _, index := range path {
+		var err error
+		key, chainCode, err = deriveChild(key, chainCode, index)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return crypto.ToECDSA(key.FillBytes(make([]byte, 32)))
+}
+
+// deriveChild is BIP-32's CKDpriv: the private key and chain code of the child at index
+func deriveChild(key *big.Int, chainCode []byte, index uint32) (*big.Int, []byte, error) {
+	data := make([]byte, 0, 37)
+	if index >= hardenedOffset {
+		data = append(data, 0)
+		data = append(data, key.FillBytes(make([]byte, 32))...)
+	} else {
+		parent, err := crypto.ToECDSA(key.FillBytes(make([]byte, 32)))
+		if err != nil {
+			return nil, nil, err
+		}
+		data = append(data, crypto.CompressPubkey(&parent.PublicKey)...)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	mac := hmac.New(sha512.New, chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	n := crypto.S256().Params().N
+	tweak := new(big.Int).SetBytes(sum[:32])
+	if tweak.Cmp(n) >= 0 {
+		return nil, nil, errInvalidChildKey
+	}
+	child := tweak.Add(tweak, key)
+	child.Mod(child, n)
+	if child.Sign() == 0 {
+		return nil, nil, errInvalidChildKey
+	}
+	return child, sum[32:], nil
+}
+
+// Statuses of a wallet migration
+const (
+	// Found by a dry run, nothing changed yet
+	WalletMigrationPending = "pending"
+	// The user's wallet address is now the standard one
+	WalletMigrationMigrated = "migrated"
+	// There are funds at the legacy address, it stays the user's address until they are moved
+	WalletMigrationNeedsSweep = "needs_sweep"
+)
+
+// WalletMigration is the record of a legacy wallet found by the migration tool
+type WalletMigration struct {
+	UserID          uuid.UUID         `json:"user_id"`
+	LegacyAddress   string            `json:"legacy_address"`
+	StandardAddress string            `json:"standard_address"`
+	LegacyBalance   *big.Int          `json:"legacy_balance_wei"`
+	TokenBalances   map[string]string `json:"legacy_token_balances"` // token contract => balance
+	Status          string            `json:"status"`
+	CheckedAt       time.Time         `json:"checked_at"`
+	MigratedAt      *time.Time        `json:"migrated_at"`
+}
@@ -0,0 +1,112 @@
+package types
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestDeriveAccountKey(t *testing.T) {
+	// The addresses MetaMask and Hardhat show for these mnemonics
+	tests := []struct {
+		mnemonic string
+		index    uint32
+		want     string
+	}{
+		{"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", 0, "0x9858EfFD232B4033E47d90003D41EC34EcaEda94"},
+		{"test test test test test test test test test test test junk", 0, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"},
+		{"test test test test test test test test test test test junk", 1, "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"},
+		{"test test test test test test test test test test test junk", 2, "0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC"},
+	}
+
+	for _, tt := range tests {
+		key, err := DeriveAccountKey(tt.mnemonic, tt.index)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", DerivationPath(tt.index), err)
+		}
+		if got := crypto.PubkeyToAddress(key.PublicKey).Hex(); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", DerivationPath(tt.index), tt.want, got)
+		}
+	}
+}
+
+func TestDeriveKeyVectors(t *testing.T) {
+	// BIP-32 test vector 1
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	tests := []struct {
+		path []uint32
+		want string
+	}{
+		{[]uint32{}, "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"},
+		{[]uint32{hardenedOffset}, "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{[]uint32{hardenedOffset, 1}, "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+	}
+
+	for _, tt := range tests {
+		key, err := deriveKey(seed, tt.path)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.path, err)
+		}
+		if got := hex.EncodeToString(crypto.FromECDSA(key)); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestCreateNewWalletIsStandard(t *testing.T) {
+	wallets := NewWalletService()
+	mnemonic, address, err := wallets.CreateNewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wallets.GetPrivateKeyFromMnemonic(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := wallets.GetAddressFromPrivateKey(key).Hex(); got != address {
+		t.Errorf("expected the key of %s, got %s", address, got)
+	}
+
+	legacy, err := LegacyPrivateKeyFromMnemonic(mnemonic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(legacy.PublicKey).Hex() == address {
+		t.Errorf("expected the new wallets not to use the legacy derivation")
+	}
+}
+
+func TestDeriveAccountKeyRefusesInvalidInput(t *testing.T) {
+	if _, err := DeriveAccountKey("not a valid mnemonic at all", 0); err == nil {
+		t.Errorf("expected an invalid mnemonic to be refused")
+	}
+	if _, err := DeriveAccountKey("test test test test test test test test test test test junk", hardenedOffset); err == nil {
+		t.Errorf("expected a hardened index to be refused")
+	}
+}
+
+func TestUserJSONHidesSecrets(t *testing.T) {
+	user := &User{SeedPhrase: "v1:encrypted", JWT: "legacy.jwt.token", WalletAddress: "0xabc"}
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"seed_phrase", "v1:encrypted", `"jwt"`, "legacy.jwt.token"} {
+		if strings.Contains(string(encoded), secret) {
+			t.Errorf("expected %s to stay out of the JSON: %s", secret, encoded)
+		}
+	}
+
+	// Nor can a request body set them
+	var decoded User
+	if err := json.Unmarshal([]byte(`{"seed_phrase": "mine", "jwt": "mine"}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SeedPhrase != "" || decoded.JWT != "" {
+		t.Errorf("expected the secrets to be ignored, got %+v", decoded)
+	}
+}
@@ -0,0 +1,315 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// The raw writing session format is what the clients send to /anky/raw-writing-session
+// and what we keep on disk under data/writing_sessions/<user>/<session>.txt:
+//
+//	<user id>
+//	<session id>
+//	<prompt>
+//	<starting timestamp, epoch milliseconds>
+//	<char> <milliseconds since the previous keystroke>
+//	<char> <milliseconds since the previous keystroke>
+//	...
+//
+// Special keys are written by name ("Backspace", "Enter"), and a typed space is a
+// line starting with a space ("  123").
+const (
+	KeyBackspace = "Backspace"
+	KeyEnter     = "Enter"
+)
+
+// MaxPauseMs is how long a writer can stay silent before the session ends
+const MaxPauseMs = 8000
+
+// AnkyDurationSeconds is how long a session has to last to become an Anky
+const AnkyDurationSeconds = 480
+
+// rawSessionHeaderLines is the number of metadata lines before the keystrokes start
+const rawSessionHeaderLines = 4
+
+// minEpochMillis rejects timestamps that are obviously seconds instead of milliseconds (anything before 2001)
+const minEpochMillis = 1_000_000_000_000
+
+// maxClockSkew is how far in the future a starting timestamp is allowed to be
+const maxClockSkew = 24 * time.Hour
+
+type Keystroke struct {
+	Key     string `json:"key"`
+	DelayMs int64  `json:"delay_ms"`
+}
+
+// AnkyVerdict is the server's judgement of a writing session, computed from its keystrokes
+type AnkyVerdict struct {
+	Valid bool `json:"valid"`
+	// EndedByPauseAt is the offset in ms (from the start) of the last keystroke before the
+	// first silence longer than MaxPauseMs, nil if the writer never stopped that long.
+	EndedByPauseAt *int64 `json:"ended_by_pause_at"`
+	// TotalMs is how long the writer wrote, from their first keystroke to the effective end.
+	// The time it took them to start writing doesn't count.
+	TotalMs int64 `json:"total_ms"`
+}
+
+type RawWritingSession struct {
+	UserID            uuid.UUID   `json:"user_id"`
+	SessionID         uuid.UUID   `json:"session_id"`
+	Prompt            string      `json:"prompt"`
+	StartingTimestamp time.Time   `json:"starting_timestamp"`
+	Keystrokes        []Keystroke `json:"keystrokes"`
+}
+
+// ParseRawWritingSession parses and validates a raw writing session string
+func ParseRawWritingSession(raw string) (*RawWritingSession, error) {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+	if len(lines) < rawSessionHeaderLines {
+		return nil, fmt.Errorf("invalid writing session format: insufficient lines (got %d, need at least %d)", len(lines), rawSessionHeaderLines)
+	}
+
+	userID, err := uuid.Parse(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID in header: %v", err)
+	}
+
+	sessionID, err := uuid.Parse(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid session ID in header: %v", err)
+	}
+
+	startingTimestamp, err := parseEpochMillis(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid starting timestamp in header: %v", err)
+	}
+
+	session := &RawWritingSession{
+		UserID:            userID,
+		SessionID:         sessionID,
+		Prompt:            strings.TrimSpace(lines[2]),
+		StartingTimestamp: startingTimestamp,
+		Keystrokes:        make([]Keystroke, 0, len(lines)-rawSessionHeaderLines),
+	}
+
+	for i, line := range lines[rawSessionHeaderLines:] {
+		// Blank lines separate the header from the keystrokes and carry no timing
+		if line == "" {
+			continue
+		}
+
+		keystroke, err := ParseKeystroke(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keystroke on line %d: %v", i+rawSessionHeaderLines+1, err)
+		}
+		session.Keystrokes = append(session.Keystrokes, keystroke)
+	}
+
+	return session, nil
+}
+
+// ParseKeystroke parses a single "<char> <ms-delta>" line
+func ParseKeystroke(line string) (Keystroke, error) {
+	// Split on the last space so that a typed space ("  123") keeps its key
+	separator := strings.LastIndex(line, " ")
+	if separator < 1 {
+		return Keystroke{}, fmt.Errorf("expected \"<char> <ms-delta>\", got %q", line)
+	}
+
+	delay, err := strconv.ParseInt(strings.TrimSpace(line[separator+1:]), 10, 64)
+	if err != nil {
+		return Keystroke{}, fmt.Errorf("invalid delay %q: %v", line[separator+1:], err)
+	}
+	if delay < 0 {
+		return Keystroke{}, fmt.Errorf("negative delay %d", delay)
+	}
+
+	return Keystroke{Key: line[:separator], DelayMs: delay}, nil
+}
+
+// storedKey is the key the way it is written in the raw session file
+func (k Keystroke) storedKey() string {
+	switch k.Key {
+	case "\n", "\r\n":
+		return KeyEnter
+	case "\b":
+		return KeyBackspace
+	}
+	return k.Key
+}
+
+// Validate checks that the keystroke can be stored and parsed back, with the same rules as ParseKeystroke
+func (k Keystroke) Validate() error {
+	key := k.storedKey()
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	if strings.ContainsAny(key, "\r\n") {
+		return fmt.Errorf("key %q contains a line break", key)
+	}
+	if k.DelayMs < 0 {
+		return fmt.Errorf("negative delay %d", k.DelayMs)
+	}
+	return nil
+}
+
+// Line formats the keystroke the way it is stored in the raw session file
+func (k Keystroke) Line() string {
+	return fmt.Sprintf("%s %d", k.storedKey(), k.DelayMs)
+}
+
+// ValidateHeader checks that the metadata of the session can be stored and parsed back
+func (s *RawWritingSession) ValidateHeader() error {
+	if s.UserID == uuid.Nil || s.SessionID == uuid.Nil {
+		return fmt.Errorf("missing user or session ID")
+	}
+	if strings.ContainsAny(s.Prompt, "\r\n") {
+		return fmt.Errorf("the prompt can't contain line breaks")
+	}
+	return ValidateStartingTimestamp(s.StartingTimestamp)
+}
+
+// HeaderString formats the four metadata lines of the raw session file
+func (s *RawWritingSession) HeaderString() string {
+	return fmt.Sprintf("%s\n%s\n%s\n%d",
+		s.UserID,
+		s.SessionID,
+		s.Prompt,
+		s.StartingTimestamp.UnixMilli(),
+	)
+}
+
+// String serializes the session back into the raw format
+func (s *RawWritingSession) String() string {
+	var b strings.Builder
+	b.WriteString(s.HeaderString())
+	for _, keystroke := range s.Keystrokes {
+		b.WriteString("\n")
+		b.WriteString(keystroke.Line())
+	}
+	return b.String()
+}
+
+// Text reconstructs the final text by replaying every keystroke
+func (s *RawWritingSession) Text() string {
+	return replayKeystrokes(s.Keystrokes)
+}
+
+// TotalDuration is the time between the start of the session and the last keystroke
+func (s *RawWritingSession) TotalDuration() time.Duration {
+	var total int64
+	for _, keystroke := range s.Keystrokes {
+		total += keystroke.DelayMs
+	}
+	return time.Duration(total) * time.Millisecond
+}
+
+// WritingDuration is the time between the first and the last keystroke. Unlike
+// TotalDuration, it leaves out how long the writer waited before starting.
+func (s *RawWritingSession) WritingDuration() time.Duration {
+	if len(s.Keystrokes) == 0 {
+		return 0
+	}
+	return s.TotalDuration() - time.Duration(s.Keystrokes[0].DelayMs)*time.Millisecond
+}
+
+// LongestPause is the longest gap between two consecutive keystrokes
+func (s *RawWritingSession) LongestPause() time.Duration {
+	var longest int64
+	for _, keystroke := range s.Keystrokes {
+		if keystroke.DelayMs > longest {
+			longest = keystroke.DelayMs
+		}
+	}
+	return time.Duration(longest) * time.Millisecond
+}
+
+// EffectiveKeystrokes returns the keystrokes written before the first pause longer than
+// MaxPauseMs. Everything typed after that pause happened once the session was over.
+func (s *RawWritingSession) EffectiveKeystrokes() []Keystroke {
+	for i, keystroke := range s.Keystrokes {
+		// The first keystroke's delay is the time it took to start writing, not a pause
+		if i > 0 && keystroke.DelayMs > MaxPauseMs {
+			return s.Keystrokes[:i]
+		}
+	}
+	return s.Keystrokes
+}
+
+// Effective returns a copy of the session cut at its effective end
+func (s *RawWritingSession) Effective() *RawWritingSession {
+	effective := *s
+	effective.Keystrokes = s.EffectiveKeystrokes()
+	return &effective
+}
+
+// Verdict decides whether the session is an Anky, enforcing the 8-second pause rule
+func (s *RawWritingSession) Verdict() *AnkyVerdict {
+	effective := s.Effective()
+	totalMs := effective.WritingDuration().Milliseconds()
+
+	verdict := &AnkyVerdict{
+		Valid:   totalMs >= AnkyDurationSeconds*1000,
+		TotalMs: totalMs,
+	}
+	if len(effective.Keystrokes) < len(s.Keystrokes) {
+		endedByPauseAt := effective.TotalDuration().Milliseconds()
+		verdict.EndedByPauseAt = &endedByPauseAt
+	}
+	return verdict
+}
+
+// WordCount counts the words of the reconstructed text
+func (s *RawWritingSession) WordCount() int {
+	return len(strings.Fields(s.Text()))
+}
+
+func replayKeystrokes(keystrokes []Keystroke) string {
+	text := make([]rune, 0, len(keystrokes))
+	for _, keystroke := range keystrokes {
+		switch keystroke.Key {
+		case KeyBackspace, "\b":
+			if len(text) > 0 {
+				text = text[:len(text)-1]
+			}
+		case KeyEnter, "\n", "\r\n":
+			text = append(text, '\n')
+		default:
+			// Other named keys (Shift, Tab, arrows...) don't change the text
+			if utf8.RuneCountInString(keystroke.Key) == 1 {
+				text = append(text, []rune(keystroke.Key)...)
+			}
+		}
+	}
+	return string(text)
+}
+
+func parseEpochMillis(value string) (time.Time, error) {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected epoch milliseconds, got %q", value)
+	}
+	timestamp := time.UnixMilli(millis).UTC()
+	if err := ValidateStartingTimestamp(timestamp); err != nil {
+		return time.Time{}, err
+	}
+	return timestamp, nil
+}
+
+// ValidateStartingTimestamp rejects timestamps that were obviously not sent in epoch
+// milliseconds, or that are too far in the future
+func ValidateStartingTimestamp(timestamp time.Time) error {
+	millis := timestamp.UnixMilli()
+	if millis < minEpochMillis {
+		return fmt.Errorf("timestamp %d is not in epoch milliseconds", millis)
+	}
+	if timestamp.After(time.Now().Add(maxClockSkew)) {
+		return fmt.Errorf("timestamp %d is in the future", millis)
+	}
+	return nil
+}
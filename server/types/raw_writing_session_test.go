@@ -0,0 +1,238 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	testUserID    = "7c3e1c3a-4b4e-4d0c-9d1a-2f0e3b8c9a11"
+	testSessionID = "0b9f6a52-6e0f-4a4f-8f1e-5d2c7b1e3f22"
+)
+
+func rawSession(lines ...string) string {
+	header := []string{testUserID, testSessionID, "what is alive in you?", "1730000000000"}
+	return strings.Join(append(header, lines...), "\n")
+}
+
+func TestParseRawWritingSession(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantErr    string
+		wantKeys   []string
+		wantText   string
+		wantPrompt string
+	}{
+		{
+			name:       "letters, space and special keys",
+			raw:        rawSession("h 0", "i 120", "  90", "x 80", "Backspace 150", "Enter 200", "y 60"),
+			wantKeys:   []string{"h", "i", " ", "x", "Backspace", "Enter", "y"},
+			wantText:   "hi \ny",
+			wantPrompt: "what is alive in you?",
+		},
+		{
+			name:       "windows line endings and blank lines",
+			raw:        strings.ReplaceAll(rawSession("", "a 10", "", "b 20"), "\n", "\r\n"),
+			wantKeys:   []string{"a", "b"},
+			wantText:   "ab",
+			wantPrompt: "what is alive in you?",
+		},
+		{
+			name:       "named keys that don't change the text",
+			raw:        rawSession("Shift 10", "A 5", "ArrowLeft 30"),
+			wantKeys:   []string{"Shift", "A", "ArrowLeft"},
+			wantText:   "A",
+			wantPrompt: "what is alive in you?",
+		},
+		{
+			name:    "missing header lines",
+			raw:     testUserID + "\n" + testSessionID,
+			wantErr: "insufficient lines",
+		},
+		{
+			name:    "invalid user ID",
+			raw:     strings.Replace(rawSession("a 1"), testUserID, "not-a-uuid", 1),
+			wantErr: "invalid user ID",
+		},
+		{
+			name:    "timestamp in seconds",
+			raw:     strings.Replace(rawSession("a 1"), "1730000000000", "1730000000", 1),
+			wantErr: "not in epoch milliseconds",
+		},
+		{
+			name:    "timestamp in the future",
+			raw:     strings.Replace(rawSession("a 1"), "1730000000000", "99999999999999", 1),
+			wantErr: "in the future",
+		},
+		{
+			name:    "keystroke without delay",
+			raw:     rawSession("a 1", "b"),
+			wantErr: "line 6",
+		},
+		{
+			name:    "negative delay",
+			raw:     rawSession("a -5"),
+			wantErr: "negative delay",
+		},
+		{
+			name:    "empty key",
+			raw:     rawSession(" 5"),
+			wantErr: "expected",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := ParseRawWritingSession(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(session.Keystrokes) != len(tt.wantKeys) {
+				t.Fatalf("expected %d keystrokes, got %d", len(tt.wantKeys), len(session.Keystrokes))
+			}
+			for i, key := range tt.wantKeys {
+				if session.Keystrokes[i].Key != key {
+					t.Errorf("keystroke %d: expected key %q, got %q", i, key, session.Keystrokes[i].Key)
+				}
+			}
+			if text := session.Text(); text != tt.wantText {
+				t.Errorf("expected text %q, got %q", tt.wantText, text)
+			}
+			if session.Prompt != tt.wantPrompt {
+				t.Errorf("expected prompt %q, got %q", tt.wantPrompt, session.Prompt)
+			}
+		})
+	}
+}
+
+func TestRawWritingSessionRoundTrip(t *testing.T) {
+	raw := rawSession("h 0", "  120", "Backspace 30", "Enter 40")
+	session, err := ParseRawWritingSession(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if session.String() != raw {
+		t.Errorf("expected the session to serialize back to\n%q\ngot\n%q", raw, session.String())
+	}
+}
+
+// keystrokes writes n keystrokes of the given delay, after a first one that took firstDelay
+func keystrokes(firstDelay int64, n int, delay int64) []Keystroke {
+	result := []Keystroke{{Key: "a", DelayMs: firstDelay}}
+	for i := 0; i < n; i++ {
+		result = append(result, Keystroke{Key: "a", DelayMs: delay})
+	}
+	return result
+}
+
+func TestVerdict(t *testing.T) {
+	tests := []struct {
+		name               string
+		keystrokes         []Keystroke
+		wantValid          bool
+		wantTotalMs        int64
+		wantEndedByPauseAt int64 // 0 when the session didn't end on a pause
+	}{
+		{
+			name:        "eight minutes without stopping",
+			keystrokes:  keystrokes(0, 480, 1000),
+			wantValid:   true,
+			wantTotalMs: 480000,
+		},
+		{
+			name:        "just under eight minutes",
+			keystrokes:  keystrokes(0, 479, 1000),
+			wantValid:   false,
+			wantTotalMs: 479000,
+		},
+		{
+			name:        "waiting before the first keystroke doesn't count",
+			keystrokes:  []Keystroke{{Key: "a", DelayMs: 480000}, {Key: "b", DelayMs: 100}},
+			wantValid:   false,
+			wantTotalMs: 100,
+		},
+		{
+			name:        "a slow start is not a pause",
+			keystrokes:  keystrokes(20000, 480, 1000),
+			wantValid:   true,
+			wantTotalMs: 480000,
+		},
+		{
+			name:        "a pause of exactly eight seconds is allowed",
+			keystrokes:  append(keystrokes(0, 240, 1000), keystrokes(MaxPauseMs, 240, 1000)...),
+			wantValid:   true,
+			wantTotalMs: 488000,
+		},
+		{
+			name:               "writing after a long pause is dropped",
+			keystrokes:         append(keystrokes(500, 300, 1000), keystrokes(MaxPauseMs+1, 300, 1000)...),
+			wantValid:          false,
+			wantTotalMs:        300000,
+			wantEndedByPauseAt: 300500,
+		},
+		{
+			name:        "no keystrokes",
+			keystrokes:  nil,
+			wantValid:   false,
+			wantTotalMs: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &RawWritingSession{Keystrokes: tt.keystrokes}
+			verdict := session.Verdict()
+
+			if verdict.Valid != tt.wantValid {
+				t.Errorf("expected valid %t, got %t", tt.wantValid, verdict.Valid)
+			}
+			if verdict.TotalMs != tt.wantTotalMs {
+				t.Errorf("expected total %d ms, got %d", tt.wantTotalMs, verdict.TotalMs)
+			}
+			switch {
+			case tt.wantEndedByPauseAt == 0 && verdict.EndedByPauseAt != nil:
+				t.Errorf("expected no pause, got one at %d ms", *verdict.EndedByPauseAt)
+			case tt.wantEndedByPauseAt != 0 && verdict.EndedByPauseAt == nil:
+				t.Errorf("expected a pause at %d ms, got none", tt.wantEndedByPauseAt)
+			case tt.wantEndedByPauseAt != 0 && *verdict.EndedByPauseAt != tt.wantEndedByPauseAt:
+				t.Errorf("expected a pause at %d ms, got %d", tt.wantEndedByPauseAt, *verdict.EndedByPauseAt)
+			}
+		})
+	}
+}
+
+func TestKeystrokeValidate(t *testing.T) {
+	tests := []struct {
+		keystroke Keystroke
+		wantErr   bool
+	}{
+		{Keystroke{Key: "a", DelayMs: 10}, false},
+		{Keystroke{Key: " ", DelayMs: 10}, false},
+		{Keystroke{Key: "\n", DelayMs: 10}, false},
+		{Keystroke{Key: "Backspace", DelayMs: 0}, false},
+		{Keystroke{Key: "", DelayMs: 10}, true},
+		{Keystroke{Key: "a\nb", DelayMs: 10}, true},
+		{Keystroke{Key: "\r", DelayMs: 10}, true},
+		{Keystroke{Key: "a", DelayMs: -1}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.keystroke.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: expected error %t, got %v", tt.keystroke, tt.wantErr, err)
+		}
+		if err == nil {
+			if _, err := ParseKeystroke(tt.keystroke.Line()); err != nil {
+				t.Errorf("%+v is valid but its line doesn't parse: %v", tt.keystroke, err)
+			}
+		}
+	}
+}
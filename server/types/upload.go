@@ -0,0 +1,38 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// What an uploaded image is for
+const (
+	UploadKindProfilePicture = "profile_picture"
+	UploadKindAnkyArt        = "anky_art"
+)
+
+// Upload is an image a user uploaded through /images. The file is kept without its
+// metadata, next to a thumbnail, in the blob store.
+type Upload struct {
+	ID     uuid.UUID `json:"id"`
+	UserID uuid.UUID `json:"user_id"`
+	Kind   string    `json:"kind"`
+	// The Anky the art was made for, only for anky_art uploads
+	AnkyID *uuid.UUID `json:"anky_id"`
+
+	BlobKey      string `json:"-"`
+	ThumbnailKey string `json:"-"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+
+	ContentType string    `json:"content_type"`
+	SizeBytes   int       `json:"size_bytes"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func ValidUploadKind(kind string) bool {
+	return kind == UploadKindProfilePicture || kind == UploadKindAnkyArt
+}
@@ -0,0 +1,44 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Quota tiers, the more a user is linked to, the more they can spend
+const (
+	QuotaTierAnonymous = "anonymous"
+	QuotaTierPrivy     = "privy"
+	QuotaTierFarcaster = "farcaster"
+)
+
+// QuotaTier is the tier of the user: Farcaster-linked, Privy-linked or anonymous
+func QuotaTier(user *User) string {
+	switch {
+	case user.FID != 0:
+		return QuotaTierFarcaster
+	case user.PrivyDID != "":
+		return QuotaTierPrivy
+	default:
+		return QuotaTierAnonymous
+	}
+}
+
+// DailyUsage is what a user spent on the models during a day (UTC). Tokens are counted for
+// the prompts the users send and the responses they get back.
+type DailyUsage struct {
+	UserID           uuid.UUID `json:"user_id"`
+	Day              time.Time `json:"day"`
+	LLMCalls         int       `json:"llm_calls"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	ResponseTokens   int       `json:"response_tokens"`
+	ImageGenerations int       `json:"image_generations"`
+}
+
+// QuotaLimits are the daily limits of a tier
+type QuotaLimits struct {
+	LLMCalls         int `json:"llm_calls"`
+	Tokens           int `json:"tokens"` // prompt and response tokens together
+	ImageGenerations int `json:"image_generations"`
+}
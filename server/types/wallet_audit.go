@@ -0,0 +1,30 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// What a wallet audit event records
+const (
+	// The user was shown their mnemonic
+	WalletAuditExport = "export"
+	// The user replaced their custodial wallet with their own mnemonic
+	WalletAuditImport = "import"
+	// Someone asked for the mnemonic or a new wallet without proving they are the user
+	WalletAuditReauthFailed = "reauth_failed"
+)
+
+// WalletAuditEvent is an entry of the audit log of the custodial wallets
+type WalletAuditEvent struct {
+	ID                    uuid.UUID  `json:"id"`
+	UserID                uuid.UUID  `json:"user_id"`
+	Action                string     `json:"action"`
+	WalletAddress         string     `json:"wallet_address"`
+	PreviousWalletAddress string     `json:"previous_wallet_address,omitempty"` // imports only
+	SessionID             *uuid.UUID `json:"session_id"`
+	IPAddress             string     `json:"ip_address"`
+	UserAgent             string     `json:"user_agent"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
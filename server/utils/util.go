@@ -1,13 +1,13 @@
 package utils
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"sort"
 	"time"
 
-	"github.com/ankylat/anky/server/types"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -23,32 +23,99 @@ func GetAnkyID(r *http.Request) (uuid.UUID, error) {
 	return uuid.Parse(vars["id"])
 }
 
-func CreateJWT(user *types.User) (string, error) {
-	claims := &jwt.MapClaims{
-		"expiresAt": time.Now().Add(400 * 24 * time.Hour).Unix(),
-		"userID":    user.ID,
+// Access tokens
+//
+// The API signs short-lived access tokens with JWT_SECRET (HS256). They carry the standard
+// claims, the user in sub, and the session they were issued for in sid so that signing out
+// revokes them. The server refuses to start without a secret.
+
+// AccessTokenIssuer is the iss of the access tokens
+const AccessTokenIssuer = "anky"
+
+var ErrMissingJWTSecret = errors.New("JWT_SECRET is not set")
+
+// AccessClaims are the claims of an access token
+type AccessClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// JWTSecret is the key the access tokens are signed with
+func JWTSecret() ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, ErrMissingJWTSecret
 	}
+	return []byte(secret), nil
+}
 
-	secretKey := os.Getenv("JWT_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// CreateAccessToken signs a token for the user of a session, valid for ttl
+func CreateAccessToken(userID, sessionID uuid.UUID, ttl time.Duration) (string, error) {
+	secret, err := JWTSecret()
+	if err != nil {
+		return "", err
+	}
 
-	return token.SignedString([]byte(secretKey))
+	now := time.Now()
+	claims := &AccessClaims{
+		SessionID: sessionID.String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    AccessTokenIssuer,
+			Subject:   userID.String(),
+			ID:        uuid.New().String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(secret)
 }
 
-func ValidateJWT(token string) (*jwt.MapClaims, error) {
-	secretKey := os.Getenv("JWT_SECRET")
-	parsedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
-	})
+// ValidateAccessToken checks the signature, the issuer and the expiry of an access token
+func ValidateAccessToken(token string) (*AccessClaims, error) {
+	secret, err := JWTSecret()
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := parsedToken.Claims.(jwt.MapClaims); ok && parsedToken.Valid {
-		return &claims, nil
+	claims := new(AccessClaims)
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(AccessTokenIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.SessionID == "" {
+		return nil, errors.New("the token has no user or no session")
+	}
+	return claims, nil
+}
+
+// ValidateLegacyJWT checks a token of the first versions of the API: HS256 with the user in
+// a userID claim and no expiry. They are only good to be exchanged for a session once.
+func ValidateLegacyJWT(token string) (uuid.UUID, error) {
+	secret, err := JWTSecret()
+	if err != nil {
+		return uuid.Nil, err
 	}
 
-	return nil, jwt.ErrSignatureInvalid
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	userID, ok := claims["userID"].(string)
+	if !ok {
+		return uuid.Nil, jwt.ErrTokenInvalidClaims
+	}
+	return uuid.Parse(userID)
 }
 
 func PrettyPrintMap(m map[string]interface{}) {